@@ -40,8 +40,9 @@ var (
 	// differentiated via a "service" label.
 	rpcDurations = prometheus.NewSummaryVec(
 		prometheus.SummaryOpts{
-			Name: "rpc_durations_microseconds",
-			Help: "RPC latency distributions.",
+			Name:       "rpc_durations_microseconds",
+			Help:       "RPC latency distributions.",
+			Objectives: prometheus.DefObjectives,
 		},
 		[]string{"service"},
 	)
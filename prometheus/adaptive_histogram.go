@@ -0,0 +1,229 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package prometheus
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+// DefWarmUpCapacity is the default value of AdaptiveHistogramOpts.WarmUpCapacity.
+const DefWarmUpCapacity = 10000
+
+// An AdaptiveHistogram is a Histogram that determines its bucket boundaries
+// from the observations made during a warm-up period. During the warm-up, it
+// counts observations into the FallbackBuckets and also keeps them in a ring
+// buffer. Afterwards, the bucket boundaries are computed from the ring buffer
+// by equal-frequency binning, i.e. each bucket receives about the same number
+// of the buffered observations, and locked in. From then on, the
+// AdaptiveHistogram behaves like a Histogram created by NewHistogram.
+//
+// The buffered observations are counted into the new buckets at lock-in.
+// Observations that have been overwritten in the ring buffer are lost at that
+// point, so the count and the sum decrease if more than WarmUpCapacity
+// observations were made during the warm-up. The Prometheus server treats that
+// like a counter reset. Note also that the bucket boundaries change once, at
+// lock-in, which the Prometheus server sees as new time series for the
+// buckets.
+//
+// To create AdaptiveHistogram instances, use NewAdaptiveHistogram.
+type AdaptiveHistogram interface {
+	Histogram
+
+	// LockedIn returns whether the warm-up is over and the bucket
+	// boundaries have been locked in.
+	LockedIn() bool
+}
+
+// AdaptiveHistogramOpts bundles the options for creating an AdaptiveHistogram.
+// The Namespace, Subsystem, Name, Help, and ConstLabels fields work as in
+// HistogramOpts.
+type AdaptiveHistogramOpts struct {
+	Namespace   string
+	Subsystem   string
+	Name        string
+	Help        string
+	ConstLabels Labels
+
+	// WarmUpPeriod is the time after creation at which the bucket
+	// boundaries are locked in. The lock-in happens with the first
+	// observation or collection after WarmUpPeriod has passed. Mandatory!
+	WarmUpPeriod time.Duration
+
+	// WarmUpCapacity is the size of the ring buffer holding the
+	// observations of the warm-up. Once it is full, each observation
+	// overwrites the oldest one. The default value is DefWarmUpCapacity.
+	WarmUpCapacity int
+
+	// TargetBuckets is the number of buckets computed at lock-in. Fewer
+	// buckets result if the buffered observations contain duplicate
+	// values. The default value is the number of DefBuckets.
+	TargetBuckets int
+
+	// FallbackBuckets are the buckets used during the warm-up, i.e. if the
+	// AdaptiveHistogram is collected before the lock-in. They are kept
+	// after the lock-in if the ring buffer has not been filled during the
+	// warm-up, as too few observations are available to compute
+	// meaningful bucket boundaries. The default value is DefBuckets.
+	FallbackBuckets []float64
+}
+
+// NewAdaptiveHistogram creates a new AdaptiveHistogram based on the provided
+// AdaptiveHistogramOpts. It panics if WarmUpPeriod is not positive, if
+// WarmUpCapacity or TargetBuckets is negative, or if the FallbackBuckets are
+// not in strictly increasing order.
+func NewAdaptiveHistogram(opts AdaptiveHistogramOpts) AdaptiveHistogram {
+	desc := NewDesc(
+		BuildFQName(opts.Namespace, opts.Subsystem, opts.Name),
+		opts.Help,
+		nil,
+		opts.ConstLabels,
+	)
+	if opts.WarmUpPeriod <= 0 {
+		panic(fmt.Errorf("adaptive histogram %s needs a positive warm-up period, got %v", desc, opts.WarmUpPeriod))
+	}
+	if opts.WarmUpCapacity < 0 || opts.TargetBuckets < 0 {
+		panic(fmt.Errorf("adaptive histogram %s has a negative warm-up capacity or number of target buckets", desc))
+	}
+	if opts.WarmUpCapacity == 0 {
+		opts.WarmUpCapacity = DefWarmUpCapacity
+	}
+	if opts.TargetBuckets == 0 {
+		opts.TargetBuckets = len(DefBuckets)
+	}
+	if len(opts.FallbackBuckets) == 0 {
+		opts.FallbackBuckets = DefBuckets
+	}
+
+	h := &adaptiveHistogram{
+		desc:          desc,
+		now:           time.Now,
+		targetBuckets: opts.TargetBuckets,
+		ring:          make([]float64, 0, opts.WarmUpCapacity),
+		current:       newHistogram(desc, HistogramOpts{Buckets: opts.FallbackBuckets}),
+	}
+	h.lockInAt = h.now().Add(opts.WarmUpPeriod)
+	h.Init(h) // Init self-collection.
+	return h
+}
+
+type adaptiveHistogram struct {
+	// lockedIn is 1 once the bucket boundaries are locked in. From then on,
+	// current is not changed anymore and can be used without locking mtx.
+	lockedIn uint32
+
+	SelfCollector
+
+	desc          *Desc
+	now           func() time.Time
+	lockInAt      time.Time
+	targetBuckets int
+
+	mtx     sync.Mutex // Protects the fields below until lock-in.
+	current Histogram
+	ring    []float64
+	next    int // Index in ring to overwrite next once ring is full.
+}
+
+func (h *adaptiveHistogram) Desc() *Desc {
+	return h.desc
+}
+
+func (h *adaptiveHistogram) LockedIn() bool {
+	return atomic.LoadUint32(&h.lockedIn) == 1
+}
+
+func (h *adaptiveHistogram) Observe(v float64) {
+	if h.LockedIn() {
+		h.current.Observe(v)
+		return
+	}
+
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+
+	if !h.maybeLockIn() {
+		if len(h.ring) < cap(h.ring) {
+			h.ring = append(h.ring, v)
+		} else {
+			h.ring[h.next] = v
+			h.next = (h.next + 1) % len(h.ring)
+		}
+	}
+	h.current.Observe(v)
+}
+
+func (h *adaptiveHistogram) Write(out *dto.Metric) error {
+	if h.LockedIn() {
+		return h.current.Write(out)
+	}
+
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+
+	h.maybeLockIn()
+	return h.current.Write(out)
+}
+
+// maybeLockIn locks in the bucket boundaries if the warm-up period is over. It
+// returns whether the boundaries are locked in. It needs mtx locked.
+func (h *adaptiveHistogram) maybeLockIn() bool {
+	if h.LockedIn() {
+		return true
+	}
+	if h.now().Before(h.lockInAt) {
+		return false
+	}
+	if len(h.ring) == cap(h.ring) {
+		if buckets := equalFrequencyBuckets(h.ring, h.targetBuckets); len(buckets) > 0 {
+			current := newHistogram(h.desc, HistogramOpts{Buckets: buckets})
+			for _, v := range h.ring {
+				current.Observe(v)
+			}
+			h.current = current
+		}
+	}
+	h.ring = nil
+	atomic.StoreUint32(&h.lockedIn, 1)
+	return true
+}
+
+// equalFrequencyBuckets returns up to n strictly increasing bucket boundaries
+// so that each bucket contains about the same number of the provided values.
+// The highest boundary is the maximum of the values. The values are not
+// modified.
+func equalFrequencyBuckets(values []float64, n int) []float64 {
+	if len(values) == 0 {
+		return nil
+	}
+	sorted := append(make([]float64, 0, len(values)), values...)
+	sort.Float64s(sorted)
+
+	buckets := make([]float64, 0, n)
+	for i := 1; i <= n; i++ {
+		// Index of the value at the i/n quantile, rounded up.
+		idx := (i*len(sorted)+n-1)/n - 1
+		b := sorted[idx]
+		if len(buckets) > 0 && b <= buckets[len(buckets)-1] {
+			continue
+		}
+		buckets = append(buckets, b)
+	}
+	return buckets
+}
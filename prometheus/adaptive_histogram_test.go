@@ -0,0 +1,141 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package prometheus
+
+import (
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+func upperBoundsOf(t *testing.T, h Histogram) ([]float64, uint64) {
+	m := &dto.Metric{}
+	if err := h.Write(m); err != nil {
+		t.Fatal(err)
+	}
+	var bounds []float64
+	for _, b := range m.GetHistogram().GetBucket() {
+		bounds = append(bounds, b.GetUpperBound())
+	}
+	return bounds, m.GetHistogram().GetSampleCount()
+}
+
+func TestAdaptiveHistogram(t *testing.T) {
+	start := time.Now()
+	clock := start
+	newAdaptive := func(capacity int) *adaptiveHistogram {
+		h := NewAdaptiveHistogram(AdaptiveHistogramOpts{
+			Name:            "test",
+			Help:            "helpless",
+			WarmUpPeriod:    time.Minute,
+			WarmUpCapacity:  capacity,
+			TargetBuckets:   4,
+			FallbackBuckets: []float64{1, 10},
+		}).(*adaptiveHistogram)
+		h.now = func() time.Time { return clock }
+		h.lockInAt = clock.Add(time.Minute)
+		return h
+	}
+
+	h := newAdaptive(8)
+	for i := 1; i <= 12; i++ {
+		h.Observe(float64(i))
+	}
+	bounds, count := upperBoundsOf(t, h)
+	if want := []float64{1, 10}; !reflect.DeepEqual(bounds, want) {
+		t.Errorf("got upper bounds %v during warm-up, want %v", bounds, want)
+	}
+	if got, want := count, uint64(12); got != want {
+		t.Errorf("got count %d during warm-up, want %d", got, want)
+	}
+	if h.LockedIn() {
+		t.Error("expected LockedIn to be false during warm-up")
+	}
+
+	// The ring buffer holds the observations 5 to 12 now.
+	clock = start.Add(time.Minute)
+	bounds, count = upperBoundsOf(t, h)
+	if want := []float64{6, 8, 10, 12}; !reflect.DeepEqual(bounds, want) {
+		t.Errorf("got upper bounds %v after lock-in, want %v", bounds, want)
+	}
+	if got, want := count, uint64(8); got != want {
+		t.Errorf("got count %d after lock-in, want %d", got, want)
+	}
+	if !h.LockedIn() {
+		t.Error("expected LockedIn to be true after the warm-up")
+	}
+	h.Observe(7)
+	if _, count = upperBoundsOf(t, h); count != 9 {
+		t.Errorf("got count %d after observing, want %d", count, 9)
+	}
+
+	// Too few observations to fill the ring buffer.
+	clock = start
+	h = newAdaptive(8)
+	h.Observe(3)
+	clock = start.Add(2 * time.Minute)
+	h.Observe(4)
+	bounds, count = upperBoundsOf(t, h)
+	if want := []float64{1, 10}; !reflect.DeepEqual(bounds, want) {
+		t.Errorf("got upper bounds %v, want fallback buckets %v", bounds, want)
+	}
+	if got, want := count, uint64(2); got != want {
+		t.Errorf("got count %d, want %d", got, want)
+	}
+}
+
+func TestAdaptiveHistogramConcurrency(t *testing.T) {
+	h := NewAdaptiveHistogram(AdaptiveHistogramOpts{
+		Name:           "test",
+		Help:           "helpless",
+		WarmUpPeriod:   time.Millisecond,
+		WarmUpCapacity: 100,
+	})
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				h.Observe(float64(i*1000 + j))
+				if j%100 == 0 {
+					h.Write(&dto.Metric{})
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
+func TestEqualFrequencyBuckets(t *testing.T) {
+	scenarios := []struct {
+		values []float64
+		n      int
+		want   []float64
+	}{
+		{nil, 3, nil},
+		{[]float64{4, 1, 3, 2}, 2, []float64{2, 4}},
+		{[]float64{4, 1, 3, 2}, 4, []float64{1, 2, 3, 4}},
+		{[]float64{1, 2, 3}, 5, []float64{1, 2, 3}},
+		{[]float64{1, 1, 1, 5}, 4, []float64{1, 5}},
+	}
+	for i, s := range scenarios {
+		if got := equalFrequencyBuckets(s.values, s.n); !reflect.DeepEqual(got, s.want) {
+			t.Errorf("%d. got %v, want %v", i, got, s.want)
+		}
+	}
+}
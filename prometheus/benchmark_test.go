@@ -14,6 +14,9 @@
 package prometheus
 
 import (
+	"math/rand"
+	"strconv"
+	"sync"
 	"testing"
 )
 
@@ -105,8 +108,9 @@ func BenchmarkGaugeNoLabels(b *testing.B) {
 func BenchmarkSummaryWithLabelValues(b *testing.B) {
 	m := NewSummaryVec(
 		SummaryOpts{
-			Name: "benchmark_summary",
-			Help: "A summary to benchmark it.",
+			Name:       "benchmark_summary",
+			Help:       "A summary to benchmark it.",
+			Objectives: DefObjectives,
 		},
 		[]string{"one", "two", "three"},
 	)
@@ -119,8 +123,9 @@ func BenchmarkSummaryWithLabelValues(b *testing.B) {
 
 func BenchmarkSummaryNoLabels(b *testing.B) {
 	m := NewSummary(SummaryOpts{
-		Name: "benchmark_summary",
-		Help: "A summary to benchmark it.",
+		Name:       "benchmark_summary",
+		Help:       "A summary to benchmark it.",
+		Objectives: DefObjectives,
 	},
 	)
 	b.ReportAllocs()
@@ -130,6 +135,38 @@ func BenchmarkSummaryNoLabels(b *testing.B) {
 	}
 }
 
+func benchmarkSummaryAlgorithm(b *testing.B, algo SummaryAlgorithm) {
+	m := NewSummary(SummaryOpts{
+		Name:       "benchmark_summary",
+		Help:       "A summary to benchmark it.",
+		Objectives: DefObjectives,
+		Algorithm:  algo,
+	},
+	)
+	r := rand.New(rand.NewSource(42))
+	vs := make([]float64, 1024)
+	for i := range vs {
+		vs[i] = r.Float64()
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		m.Observe(vs[i%len(vs)])
+	}
+}
+
+func BenchmarkSummaryAlgorithmCkms(b *testing.B) {
+	benchmarkSummaryAlgorithm(b, AlgoCkms)
+}
+
+func BenchmarkSummaryAlgorithmP2(b *testing.B) {
+	benchmarkSummaryAlgorithm(b, AlgoP2)
+}
+
+func BenchmarkSummaryAlgorithmGK(b *testing.B) {
+	benchmarkSummaryAlgorithm(b, AlgoGK)
+}
+
 func BenchmarkHistogramWithLabelValues(b *testing.B) {
 	m := NewHistogramVec(
 		HistogramOpts{
@@ -145,6 +182,35 @@ func BenchmarkHistogramWithLabelValues(b *testing.B) {
 	}
 }
 
+func benchmarkHistogramVecLayout(b *testing.B, shared bool) {
+	m := NewHistogramVec(
+		HistogramOpts{
+			Name:               "benchmark_histogram",
+			Help:               "A histogram to benchmark it.",
+			SharedBucketLayout: shared,
+		},
+		[]string{"one"},
+	)
+	// Observe sequentially into consecutively created children.
+	hs := make([]Histogram, 10000)
+	for i := range hs {
+		hs[i] = m.WithLabelValues(strconv.Itoa(i))
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		hs[i%len(hs)].Observe(3.1415)
+	}
+}
+
+func BenchmarkHistogramVecSeparateBucketLayout(b *testing.B) {
+	benchmarkHistogramVecLayout(b, false)
+}
+
+func BenchmarkHistogramVecSharedBucketLayout(b *testing.B) {
+	benchmarkHistogramVecLayout(b, true)
+}
+
 func BenchmarkHistogramNoLabels(b *testing.B) {
 	m := NewHistogram(HistogramOpts{
 		Name: "benchmark_histogram",
@@ -157,3 +223,82 @@ func BenchmarkHistogramNoLabels(b *testing.B) {
 		m.Observe(3.1415)
 	}
 }
+
+func benchmarkHistogramVecChildCreateDelete(b *testing.B, pool *sync.Pool) {
+	m := NewHistogramVec(
+		HistogramOpts{
+			Name: "benchmark_histogram",
+			Help: "A histogram to benchmark it.",
+		},
+		[]string{"request"},
+	)
+	if pool != nil {
+		m.WithPool(pool)
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		m.WithLabelValues("eins").Observe(3.1415)
+		m.DeleteLabelValues("eins")
+	}
+}
+
+func BenchmarkHistogramVecChildCreateDelete(b *testing.B) {
+	benchmarkHistogramVecChildCreateDelete(b, nil)
+}
+
+func BenchmarkHistogramVecChildCreateDeletePooled(b *testing.B) {
+	benchmarkHistogramVecChildCreateDelete(b, &sync.Pool{})
+}
+
+func benchmarkCounterVecConcurrent(b *testing.B, lockFree bool, coldPercent int) {
+	m := NewCounterVec(
+		CounterOpts{
+			Name:            "benchmark_counter",
+			Help:            "A counter to benchmark it.",
+			LockFreeHotPath: lockFree,
+		},
+		[]string{"one", "two"},
+	)
+	hot := []string{"a", "b", "c", "d", "e", "f", "g", "h"}
+	for _, v := range hot {
+		m.WithLabelValues(v, v)
+	}
+	cold := make([]string, 1000)
+	for i := range cold {
+		cold[i] = strconv.Itoa(i)
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			i++
+			if i%100 < coldPercent {
+				// Deleting keeps creating new children.
+				lv := cold[i%len(cold)]
+				m.WithLabelValues(lv, lv).Inc()
+				m.DeleteLabelValues(lv, lv)
+				continue
+			}
+			lv := hot[i%len(hot)]
+			m.WithLabelValues(lv, lv).Inc()
+		}
+	})
+}
+
+func BenchmarkCounterVecHotPath(b *testing.B) {
+	benchmarkCounterVecConcurrent(b, false, 0)
+}
+
+func BenchmarkCounterVecHotPathLockFree(b *testing.B) {
+	benchmarkCounterVecConcurrent(b, true, 0)
+}
+
+func BenchmarkCounterVecColdPath(b *testing.B) {
+	benchmarkCounterVecConcurrent(b, false, 10)
+}
+
+func BenchmarkCounterVecColdPathLockFree(b *testing.B) {
+	benchmarkCounterVecConcurrent(b, true, 10)
+}
@@ -0,0 +1,274 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package prometheus
+
+import (
+	"fmt"
+	"math"
+	"sort"
+)
+
+// SuggestionStrategy is the algorithm used by HistogramBucketSuggestor to
+// suggest buckets.
+type SuggestionStrategy int
+
+// Possible values for SuggestionStrategy.
+const (
+	// StrategyEquiFrequency places the upper bounds at evenly spaced
+	// percentiles of the data, so that each bucket receives about the same
+	// number of observations.
+	StrategyEquiFrequency SuggestionStrategy = iota
+	// StrategyEquiWidth divides the range from the minimum to the maximum
+	// of the data into buckets of the same width.
+	StrategyEquiWidth
+	// StrategyJenksBreaks places the upper bounds at the Jenks natural
+	// breaks of the data, i.e. it minimizes the variance within the
+	// buckets. This fits data that falls into distinct clusters, e.g.
+	// cache hits and misses. Large data sets are reduced to
+	// MaxJenksSamples evenly spaced order statistics first.
+	StrategyJenksBreaks
+	// StrategyLog divides the range from the smallest positive value to
+	// the maximum of the data into buckets whose upper bounds grow by a
+	// constant factor, as created by ExponentialBucketsRange. This fits
+	// long-tailed data like latencies.
+	StrategyLog
+)
+
+// MaxJenksSamples is the maximum number of values StrategyJenksBreaks works
+// on. Its cost grows quadratically with the number of values.
+const MaxJenksSamples = 1000
+
+// DiagnosedPercentiles are the percentiles reported by
+// HistogramBucketSuggestor.Diagnose.
+var DiagnosedPercentiles = []float64{50, 90, 95, 99, 99.9}
+
+// HistogramBucketSuggestor analyzes a sample of data to suggest buckets for a
+// Histogram or to diagnose existing ones. It is meant for use during
+// development, e.g. with the results of load tests or with latencies extracted
+// from logs, rather than at runtime. Create instances with
+// NewHistogramBucketSuggestor.
+type HistogramBucketSuggestor struct {
+	sorted []float64
+}
+
+// NewHistogramBucketSuggestor creates a HistogramBucketSuggestor for the
+// provided data. NaN and infinite values are ignored. The data is copied, so it
+// may be modified afterwards.
+func NewHistogramBucketSuggestor(data []float64) *HistogramBucketSuggestor {
+	sorted := make([]float64, 0, len(data))
+	for _, v := range data {
+		if !isInvalidObservation(v) {
+			sorted = append(sorted, v)
+		}
+	}
+	sort.Float64s(sorted)
+	return &HistogramBucketSuggestor{sorted: sorted}
+}
+
+// Suggest returns up to targetBuckets upper bounds in increasing order
+// according to the provided strategy, to be used for the Buckets field of
+// HistogramOpts. The highest upper bound is the maximum of the data. Fewer
+// upper bounds are returned if the data does not support more distinct ones,
+// and nil is returned if there is no data. Suggest panics if targetBuckets is
+// not positive or if the strategy is unknown.
+func (s *HistogramBucketSuggestor) Suggest(targetBuckets int, strategy SuggestionStrategy) []float64 {
+	if targetBuckets < 1 {
+		panic("Suggest needs a positive targetBuckets")
+	}
+	if len(s.sorted) == 0 {
+		return nil
+	}
+	switch strategy {
+	case StrategyEquiFrequency:
+		return percentileBuckets(append([]float64(nil), s.sorted...), targetBuckets)
+	case StrategyEquiWidth:
+		return s.equiWidth(targetBuckets)
+	case StrategyJenksBreaks:
+		return s.jenksBreaks(targetBuckets)
+	case StrategyLog:
+		return s.log(targetBuckets)
+	}
+	panic(fmt.Errorf("unknown suggestion strategy %d", strategy))
+}
+
+func (s *HistogramBucketSuggestor) equiWidth(n int) []float64 {
+	min, max := s.sorted[0], s.sorted[len(s.sorted)-1]
+	if min == max {
+		return []float64{max}
+	}
+	buckets := make([]float64, n)
+	for i := range buckets {
+		buckets[i] = min + (max-min)*float64(i+1)/float64(n)
+	}
+	// Avoid rounding errors at the upper end of the range.
+	buckets[n-1] = max
+	return buckets
+}
+
+func (s *HistogramBucketSuggestor) log(n int) []float64 {
+	max := s.sorted[len(s.sorted)-1]
+	i := sort.Search(len(s.sorted), func(i int) bool { return s.sorted[i] > 0 })
+	if i == len(s.sorted) || s.sorted[i] == max {
+		return []float64{max}
+	}
+	min := s.sorted[i]
+	buckets := make([]float64, n)
+	for i := range buckets {
+		buckets[i] = min * math.Pow(max/min, float64(i+1)/float64(n))
+	}
+	buckets[n-1] = max
+	return buckets
+}
+
+// jenksBreaks implements the Fisher-Jenks algorithm by dynamic programming.
+func (s *HistogramBucketSuggestor) jenksBreaks(n int) []float64 {
+	values := s.sorted
+	if len(values) > MaxJenksSamples {
+		values = make([]float64, MaxJenksSamples)
+		for i := range values {
+			values[i] = s.sorted[i*(len(s.sorted)-1)/(MaxJenksSamples-1)]
+		}
+	}
+	m := len(values)
+	if n > m {
+		n = m
+	}
+	// Prefix sums allow the variance of any range in constant time.
+	sums, sqSums := make([]float64, m+1), make([]float64, m+1)
+	for i, v := range values {
+		sums[i+1] = sums[i] + v
+		sqSums[i+1] = sqSums[i] + v*v
+	}
+	// cost returns the sum of squared deviations of values[i:j].
+	cost := func(i, j int) float64 {
+		sum, cnt := sums[j]-sums[i], float64(j-i)
+		return sqSums[j] - sqSums[i] - sum*sum/cnt
+	}
+	// best[k][j] is the minimal cost of splitting values[:j] into k+1
+	// classes, and last[k][j] the start of the last of those classes.
+	best, last := make([][]float64, n), make([][]int, n)
+	for k := range best {
+		best[k], last[k] = make([]float64, m+1), make([]int, m+1)
+	}
+	for j := 1; j <= m; j++ {
+		best[0][j] = cost(0, j)
+	}
+	for k := 1; k < n; k++ {
+		for j := k + 1; j <= m; j++ {
+			best[k][j] = math.Inf(+1)
+			for i := k; i < j; i++ {
+				if c := best[k-1][i] + cost(i, j); c < best[k][j] {
+					best[k][j], last[k][j] = c, i
+				}
+			}
+		}
+	}
+	buckets := make([]float64, n)
+	for k, j := n-1, m; k >= 0; k-- {
+		buckets[k] = values[j-1]
+		j = last[k][j]
+	}
+	// Equal values in different classes yield duplicate upper bounds.
+	deduped := buckets[:1]
+	for _, b := range buckets[1:] {
+		if b > deduped[len(deduped)-1] {
+			deduped = append(deduped, b)
+		}
+	}
+	return deduped
+}
+
+// BucketDiagnosis is the result of HistogramBucketSuggestor.Diagnose.
+type BucketDiagnosis struct {
+	// Percentiles contains the resolution for each of the
+	// DiagnosedPercentiles.
+	Percentiles []PercentileResolution
+	// EmptyBuckets is the number of buckets (not counting the +Inf bucket)
+	// that no value of the data falls into.
+	EmptyBuckets int
+	// OverflowRatio is the ratio of the data above the highest upper
+	// bound, i.e. in the +Inf bucket.
+	OverflowRatio float64
+}
+
+// PercentileResolution describes how precisely a percentile can be estimated
+// from the buckets of a Histogram.
+type PercentileResolution struct {
+	// Percentile is the percentile (0 <= Percentile <= 100), and Value its
+	// value in the data (by the nearest-rank method).
+	Percentile, Value float64
+	// LowerBound and UpperBound are the bounds of the bucket containing
+	// Value. As in the histogram_quantile function of the Prometheus
+	// query language, the lower bound of the lowest bucket is assumed to
+	// be 0 if its upper bound is positive. Otherwise, it is -Inf. The
+	// upper bound of the +Inf bucket is +Inf.
+	LowerBound, UpperBound float64
+	// RelativeResolution is the width of the bucket divided by the
+	// absolute Value, i.e. the relative error the estimate of the
+	// percentile might have. It is +Inf if the bucket is unbounded or if
+	// Value is 0 in a bucket of non-zero width.
+	RelativeResolution float64
+}
+
+// Diagnose reports how well the provided upper bounds, which must be in
+// increasing order, suit the data. It returns the zero BucketDiagnosis if there
+// is no data.
+func (s *HistogramBucketSuggestor) Diagnose(existingBuckets []float64) BucketDiagnosis {
+	if len(s.sorted) == 0 {
+		return BucketDiagnosis{}
+	}
+	var d BucketDiagnosis
+	for _, p := range DiagnosedPercentiles {
+		// Multiply before dividing to avoid rounding errors for
+		// percentiles like 99.9.
+		rank := int(math.Ceil(p * float64(len(s.sorted)) / 100))
+		if rank < 1 {
+			rank = 1
+		}
+		v := s.sorted[rank-1]
+		i := sort.SearchFloat64s(existingBuckets, v)
+		r := PercentileResolution{Percentile: p, Value: v, UpperBound: math.Inf(+1)}
+		if i < len(existingBuckets) {
+			r.UpperBound = existingBuckets[i]
+		}
+		switch {
+		case i > 0:
+			r.LowerBound = existingBuckets[i-1]
+		case r.UpperBound > 0:
+			r.LowerBound = 0
+		default:
+			r.LowerBound = math.Inf(-1)
+		}
+		width := r.UpperBound - r.LowerBound
+		switch {
+		case math.IsInf(width, +1):
+			r.RelativeResolution = math.Inf(+1)
+		case v == 0 && width > 0:
+			r.RelativeResolution = math.Inf(+1)
+		default:
+			r.RelativeResolution = width / math.Abs(v)
+		}
+		d.Percentiles = append(d.Percentiles, r)
+	}
+	lower := 0
+	for _, b := range existingBuckets {
+		upper := sort.Search(len(s.sorted), func(i int) bool { return s.sorted[i] > b })
+		if upper == lower {
+			d.EmptyBuckets++
+		}
+		lower = upper
+	}
+	d.OverflowRatio = float64(len(s.sorted)-lower) / float64(len(s.sorted))
+	return d
+}
@@ -0,0 +1,102 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package prometheus
+
+import (
+	"math"
+	"reflect"
+	"testing"
+)
+
+func TestHistogramBucketSuggestorSuggest(t *testing.T) {
+	// Two clusters, one around 1 and one around 100.
+	data := []float64{0.9, 1, 1, 1.1, 1.2, 99, 100, 100, 101, math.NaN()}
+	s := NewHistogramBucketSuggestor(data)
+	data[0] = 1000 // Must not affect s.
+
+	scenarios := []struct {
+		strategy SuggestionStrategy
+		target   int
+		want     []float64
+	}{
+		{StrategyEquiFrequency, 3, []float64{1, 99, 101}},
+		{StrategyEquiWidth, 4, []float64{25.925, 50.95, 75.975, 101}},
+		{StrategyJenksBreaks, 2, []float64{1.2, 101}},
+		{StrategyJenksBreaks, 20, []float64{0.9, 1, 1.1, 1.2, 99, 100, 101}},
+		{StrategyLog, 2, []float64{0.9 * math.Sqrt(101/0.9), 101}},
+	}
+	for i, s2 := range scenarios {
+		got := s.Suggest(s2.target, s2.strategy)
+		if len(got) != len(s2.want) {
+			t.Errorf("%d. got buckets %v, want %v", i, got, s2.want)
+			continue
+		}
+		for j := range got {
+			if math.Abs(got[j]-s2.want[j]) > 1e-9 {
+				t.Errorf("%d. got buckets %v, want %v", i, got, s2.want)
+				break
+			}
+		}
+	}
+
+	if got := NewHistogramBucketSuggestor(nil).Suggest(5, StrategyLog); got != nil {
+		t.Errorf("got buckets %v without data, want nil", got)
+	}
+	if got, want := NewHistogramBucketSuggestor([]float64{-1, 0}).Suggest(5, StrategyLog), []float64{0}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got buckets %v, want %v", got, want)
+	}
+	large := make([]float64, 10*MaxJenksSamples)
+	for i := range large {
+		large[i] = float64(i % 2 * 1000)
+	}
+	if got, want := NewHistogramBucketSuggestor(large).Suggest(3, StrategyJenksBreaks), []float64{0, 1000}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got buckets %v, want %v", got, want)
+	}
+}
+
+func TestHistogramBucketSuggestorDiagnose(t *testing.T) {
+	data := make([]float64, 1000)
+	for i := range data {
+		data[i] = float64(i + 1)
+	}
+	d := NewHistogramBucketSuggestor(data).Diagnose([]float64{100, 500, 900, 950, 2000})
+
+	want := []PercentileResolution{
+		{Percentile: 50, Value: 500, LowerBound: 100, UpperBound: 500, RelativeResolution: 0.8},
+		{Percentile: 90, Value: 900, LowerBound: 500, UpperBound: 900, RelativeResolution: 400. / 900},
+		{Percentile: 95, Value: 950, LowerBound: 900, UpperBound: 950, RelativeResolution: 50. / 950},
+		{Percentile: 99, Value: 990, LowerBound: 950, UpperBound: 2000, RelativeResolution: 1050. / 990},
+		{Percentile: 99.9, Value: 999, LowerBound: 950, UpperBound: 2000, RelativeResolution: 1050. / 999},
+	}
+	if !reflect.DeepEqual(d.Percentiles, want) {
+		t.Errorf("got percentiles %+v, want %+v", d.Percentiles, want)
+	}
+	if got, want := d.EmptyBuckets, 0; got != want {
+		t.Errorf("got %d empty buckets, want %d", got, want)
+	}
+	if got, want := d.OverflowRatio, 0.; got != want {
+		t.Errorf("got overflow ratio %f, want %f", got, want)
+	}
+
+	d = NewHistogramBucketSuggestor(data).Diagnose([]float64{0.5, 10})
+	if got, want := d.EmptyBuckets, 1; got != want {
+		t.Errorf("got %d empty buckets, want %d", got, want)
+	}
+	if got, want := d.OverflowRatio, 0.99; got != want {
+		t.Errorf("got overflow ratio %f, want %f", got, want)
+	}
+	if got := d.Percentiles[0].RelativeResolution; !math.IsInf(got, +1) {
+		t.Errorf("got relative resolution %f in +Inf bucket, want +Inf", got)
+	}
+}
@@ -13,6 +13,22 @@
 
 package prometheus
 
+import (
+	"fmt"
+	"log"
+	"math"
+	"runtime/debug"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/golang/protobuf/proto"
+
+	dto "github.com/prometheus/client_model/go"
+
+	"github.com/prometheus/client_golang/model"
+)
+
 // Collector is the interface implemented by anything that can be used by
 // Prometheus to collect metrics. A Collector has to be registered for
 // collection. See Register, MustRegister, RegisterOrGet, and MustRegisterOrGet.
@@ -53,8 +69,15 @@ type Collector interface {
 // SelfCollector implements Collector for a single Metric so that that the
 // Metric collects itself. Add it as an anonymous field to a struct that
 // implements Metric, and call Init with the Metric itself as an argument.
+//
+// Alternatively, SelfCollector can implement Collector for a type that wraps a
+// fixed set of other Collectors (typically stock metrics like Counters and
+// Gauges). Add it as an anonymous field to such a type, and call MustInit with
+// the wrapped Collectors as arguments. The embedding type then only has to
+// update the values of the wrapped metrics.
 type SelfCollector struct {
-	self Metric
+	self     Metric
+	children []Collector
 }
 
 // Init provides the SelfCollector with a reference to the metric it is supposed
@@ -64,12 +87,1091 @@ func (c *SelfCollector) Init(self Metric) {
 	c.self = self
 }
 
+// MustInit provides the SelfCollector with the Collectors it is supposed to
+// describe and collect, in the given order. It is usually called within the
+// factory function of the embedding type. MustInit panics if any of the
+// provided Collectors is nil.
+func (c *SelfCollector) MustInit(children ...Collector) {
+	for _, child := range children {
+		if child == nil {
+			panic("SelfCollector.MustInit called with a nil Collector")
+		}
+	}
+	c.children = children
+}
+
 // Describe implements Collector.
 func (c *SelfCollector) Describe(ch chan<- *Desc) {
-	ch <- c.self.Desc()
+	if c.self != nil {
+		ch <- c.self.Desc()
+	}
+	for _, child := range c.children {
+		child.Describe(ch)
+	}
 }
 
 // Collect implements Collector.
 func (c *SelfCollector) Collect(ch chan<- Metric) {
-	ch <- c.self
+	if c.self != nil {
+		ch <- c.self
+	}
+	for _, child := range c.children {
+		child.Collect(ch)
+	}
+}
+
+// CompositeCollector is a Collector that bundles other Collectors so that they
+// can be registered and unregistered as a unit. Create instances with
+// NewCompositeCollector.
+//
+// Collectors can be added to and removed from a CompositeCollector at any
+// time. However, the registry only knows about the descriptors that were
+// described while the CompositeCollector was registered. To keep registration
+// consistent, unregister the CompositeCollector before adding or removing
+// Collectors and register it again afterwards.
+type CompositeCollector interface {
+	Collector
+
+	// Add adds the provided Collector. An error is returned if the
+	// Collector describes an invalid descriptor or a descriptor that is
+	// already described by one of the Collectors added before.
+	Add(Collector) error
+	// MustAdd works like Add but panics where Add would have returned an
+	// error.
+	MustAdd(Collector)
+	// Remove removes the provided Collector and returns whether it had
+	// been added before.
+	Remove(Collector) bool
+}
+
+// NewCompositeCollector returns a CompositeCollector containing the provided
+// Collectors. It panics if their descriptors conflict (see the Add method of
+// CompositeCollector).
+func NewCompositeCollector(inner ...Collector) CompositeCollector {
+	c := &compositeCollector{descIDs: map[uint64]Collector{}}
+	for _, i := range inner {
+		c.MustAdd(i)
+	}
+	return c
+}
+
+type compositeCollector struct {
+	mtx     sync.RWMutex
+	inner   []Collector
+	descIDs map[uint64]Collector // Desc ID -> Collector describing it.
+}
+
+// Describe implements Collector.
+func (c *compositeCollector) Describe(ch chan<- *Desc) {
+	c.mtx.RLock()
+	defer c.mtx.RUnlock()
+
+	for _, i := range c.inner {
+		i.Describe(ch)
+	}
+}
+
+// Collect implements Collector.
+func (c *compositeCollector) Collect(ch chan<- Metric) {
+	c.mtx.RLock()
+	defer c.mtx.RUnlock()
+
+	for _, i := range c.inner {
+		i.Collect(ch)
+	}
+}
+
+func (c *compositeCollector) Add(collector Collector) error {
+	descs := describe(collector)
+
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	for _, desc := range descs {
+		if desc.err != nil {
+			return fmt.Errorf("descriptor %s is invalid: %s", desc, desc.err)
+		}
+		if _, exists := c.descIDs[desc.id]; exists {
+			return fmt.Errorf("descriptor %s already exists in composite collector", desc)
+		}
+	}
+	for _, desc := range descs {
+		c.descIDs[desc.id] = collector
+	}
+	c.inner = append(c.inner, collector)
+	return nil
+}
+
+func (c *compositeCollector) MustAdd(collector Collector) {
+	if err := c.Add(collector); err != nil {
+		panic(err)
+	}
+}
+
+func (c *compositeCollector) Remove(collector Collector) bool {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	for i, inner := range c.inner {
+		if inner != collector {
+			continue
+		}
+		c.inner = append(c.inner[:i], c.inner[i+1:]...)
+		for id, owner := range c.descIDs {
+			if owner == collector {
+				delete(c.descIDs, id)
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// AggregatingCollector is a Collector that merges the metrics of other
+// Collectors which contribute to the same metric families, e.g. two database
+// pools both collecting db_queries_total with disjoint values of a "pool"
+// label. Registered separately, the second Collector would be rejected, as it
+// describes already registered descriptors. Create instances with
+// NewAggregatingCollector.
+//
+// The member Collectors must agree on the help string and the label names of
+// descriptors of the same name, and on the type of the metrics of the same
+// name. The metrics of all members are collected into the same metric
+// families, so their label values must differ.
+//
+// As with a CompositeCollector, unregister the AggregatingCollector before
+// adding or removing Collectors and register it again afterwards.
+type AggregatingCollector interface {
+	Collector
+
+	// AddCollector adds the provided Collector. An error is returned if
+	// the Collector describes an invalid descriptor or a descriptor with
+	// a help string or label names that differ from those of the
+	// descriptor of the same name described by another member.
+	AddCollector(Collector) error
+	// RemoveCollector removes the provided Collector if it is a member.
+	RemoveCollector(Collector)
+}
+
+// NewAggregatingCollector returns an AggregatingCollector with the provided
+// Collectors as members. It returns an error if the descriptors of the
+// Collectors conflict, see AddCollector.
+//
+// The types of the metrics are not known before collection. A collected metric
+// whose type differs from the type of the first metric of the same name
+// collected in the same collection is replaced by an invalid metric, which
+// makes the collection fail.
+func NewAggregatingCollector(inner ...Collector) (AggregatingCollector, error) {
+	c := &aggregatingCollector{}
+	for _, i := range inner {
+		if err := c.AddCollector(i); err != nil {
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+type aggregatingCollector struct {
+	mtx     sync.RWMutex
+	members []aggregatedCollector
+}
+
+// aggregatedCollector is a member of an aggregatingCollector with the
+// descriptors it described when added.
+type aggregatedCollector struct {
+	collector Collector
+	descs     []*Desc
+}
+
+// Describe implements Collector. Descriptors described by several members are
+// described only once.
+func (c *aggregatingCollector) Describe(ch chan<- *Desc) {
+	c.mtx.RLock()
+	defer c.mtx.RUnlock()
+
+	described := map[uint64]struct{}{}
+	for _, m := range c.members {
+		for _, desc := range m.descs {
+			if _, exists := described[desc.id]; !exists {
+				described[desc.id] = struct{}{}
+				ch <- desc
+			}
+		}
+	}
+}
+
+// Collect implements Collector. Each metric is written once to check its type
+// and then forwarded as written.
+func (c *aggregatingCollector) Collect(ch chan<- Metric) {
+	c.mtx.RLock()
+	defer c.mtx.RUnlock()
+
+	types := map[string]dto.MetricType{}
+	for _, m := range c.members {
+		metricChan := make(chan Metric, capMetricChan)
+		go func(collector Collector) {
+			collector.Collect(metricChan)
+			close(metricChan)
+		}(m.collector)
+		for metric := range metricChan {
+			desc := metric.Desc()
+			pb := &dto.Metric{}
+			if err := metric.Write(pb); err != nil {
+				ch <- NewInvalidMetric(desc, err)
+				continue
+			}
+			typ, ok := writtenType(pb)
+			if !ok {
+				ch <- NewInvalidMetric(desc, fmt.Errorf("empty metric collected: %s", pb))
+				continue
+			}
+			if first, exists := types[desc.fqName]; !exists {
+				types[desc.fqName] = typ
+			} else if first != typ {
+				ch <- NewInvalidMetric(desc, fmt.Errorf(
+					"aggregated metric of type %s conflicts with previously collected metric of type %s and the same name %s",
+					typ, first, desc.fqName,
+				))
+				continue
+			}
+			ch <- &writtenMetric{desc: desc, pb: pb}
+		}
+	}
+}
+
+// writtenType returns the type of the written metric and false if no type is
+// set.
+func writtenType(pb *dto.Metric) (dto.MetricType, bool) {
+	switch {
+	case pb.Gauge != nil:
+		return dto.MetricType_GAUGE, true
+	case pb.Counter != nil:
+		return dto.MetricType_COUNTER, true
+	case pb.Summary != nil:
+		return dto.MetricType_SUMMARY, true
+	case pb.Untyped != nil:
+		return dto.MetricType_UNTYPED, true
+	case pb.Histogram != nil:
+		return dto.MetricType_HISTOGRAM, true
+	}
+	return 0, false
+}
+
+func (c *aggregatingCollector) AddCollector(collector Collector) error {
+	descs := describe(collector)
+
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	for _, desc := range descs {
+		if desc.err != nil {
+			return fmt.Errorf("descriptor %s is invalid: %s", desc, desc.err)
+		}
+		for _, m := range c.members {
+			for _, other := range m.descs {
+				if other.fqName == desc.fqName && other.dimHash != desc.dimHash {
+					return fmt.Errorf("descriptor %s has different label names or a different help string than %s of an aggregated collector", desc, other)
+				}
+			}
+		}
+	}
+	c.members = append(c.members, aggregatedCollector{collector: collector, descs: descs})
+	return nil
+}
+
+func (c *aggregatingCollector) RemoveCollector(collector Collector) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	for i, m := range c.members {
+		if m.collector == collector {
+			c.members = append(c.members[:i], c.members[i+1:]...)
+			return
+		}
+	}
+}
+
+// describe returns all descriptors described by the provided Collector.
+func describe(c Collector) []*Desc {
+	descChan := make(chan *Desc, capDescChan)
+	go func() {
+		c.Describe(descChan)
+		close(descChan)
+	}()
+	var descs []*Desc
+	for desc := range descChan {
+		descs = append(descs, desc)
+	}
+	return descs
+}
+
+// NewSyncedCollector wraps the provided Collector so that its metrics are
+// collected while holding the provided lock. This is useful for Collectors that
+// read from a data structure protected by an external lock, e.g. a cache or a
+// connection pool, but do not acquire that lock themselves. The lock is held
+// while the Collect method of the wrapped Collector runs and while the
+// collected metrics are written, so that all of them are read from the same
+// consistent state. The metrics are passed on only after the lock has been
+// released, so a slow consumer never holds up users of the lock.
+func NewSyncedCollector(inner Collector, lock sync.Locker) Collector {
+	return &syncedCollector{Collector: inner, lock: lock}
+}
+
+type syncedCollector struct {
+	Collector
+	lock sync.Locker
+}
+
+// Collect implements Collector.
+func (c *syncedCollector) Collect(ch chan<- Metric) {
+	var metrics []Metric
+	c.lock.Lock()
+	metricChan := make(chan Metric, capMetricChan)
+	go func() {
+		c.Collector.Collect(metricChan)
+		close(metricChan)
+	}()
+	for metric := range metricChan {
+		pb := &dto.Metric{}
+		if err := metric.Write(pb); err != nil {
+			metrics = append(metrics, NewInvalidMetric(metric.Desc(), err))
+			continue
+		}
+		metrics = append(metrics, &writtenMetric{desc: metric.Desc(), pb: pb})
+	}
+	c.lock.Unlock()
+
+	for _, metric := range metrics {
+		ch <- metric
+	}
+}
+
+// writtenMetric is a Metric that has been written before, so that its Write
+// method only needs to copy the result.
+type writtenMetric struct {
+	desc *Desc
+	pb   *dto.Metric
+}
+
+func (m *writtenMetric) Desc() *Desc {
+	return m.desc
+}
+
+func (m *writtenMetric) Write(out *dto.Metric) error {
+	*out = *m.pb
+	return nil
+}
+
+// DeprecatedCollector wraps the provided Collector so that all descriptors it
+// describes and all metrics it collects are marked as deprecated since the
+// given version (see the DeprecatedVersion method of Desc). Apart from that,
+// the returned Collector behaves exactly like the wrapped one. It is meant for
+// Collectors that are not created from Opts, like the ExpvarCollector or custom
+// Collectors, to which a DeprecatedVersion cannot be passed directly.
+func DeprecatedCollector(c Collector, version string) Collector {
+	return &deprecatedCollector{
+		Collector: c,
+		version:   version,
+		descs:     map[*Desc]*Desc{},
+	}
+}
+
+type deprecatedCollector struct {
+	Collector
+	version string
+
+	mtx   sync.Mutex
+	descs map[*Desc]*Desc // Original Desc -> deprecated copy.
+}
+
+// Describe implements Collector.
+func (c *deprecatedCollector) Describe(ch chan<- *Desc) {
+	descChan := make(chan *Desc, capDescChan)
+	go func() {
+		c.Collector.Describe(descChan)
+		close(descChan)
+	}()
+	for desc := range descChan {
+		ch <- c.deprecatedDesc(desc)
+	}
+}
+
+// Collect implements Collector.
+func (c *deprecatedCollector) Collect(ch chan<- Metric) {
+	metricChan := make(chan Metric, capMetricChan)
+	go func() {
+		c.Collector.Collect(metricChan)
+		close(metricChan)
+	}()
+	for metric := range metricChan {
+		ch <- &deprecatedMetric{
+			Metric: metric,
+			desc:   c.deprecatedDesc(metric.Desc()),
+		}
+	}
+}
+
+// deprecatedDesc returns a copy of the provided Desc with deprecatedVersion
+// set. Copies are cached so that the same Desc always results in the same copy.
+func (c *deprecatedCollector) deprecatedDesc(desc *Desc) *Desc {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	if d, ok := c.descs[desc]; ok {
+		return d
+	}
+	d := *desc
+	d.deprecatedVersion = c.version
+	c.descs[desc] = &d
+	return &d
+}
+
+type deprecatedMetric struct {
+	Metric
+	desc *Desc
+}
+
+func (m *deprecatedMetric) Desc() *Desc {
+	return m.desc
+}
+
+// RecoverCollector wraps the provided Collector so that a panic in its Collect
+// or Describe method does not propagate. The panic and its stack trace are
+// logged instead. A panicking Collect additionally sends a gauge with value 1
+// named "<namespace>_collector_panic_total", where <namespace> is the part of
+// the fully-qualified name of the first descriptor of c up to the first
+// underscore. (If there is no such descriptor, the gauge is named
+// "collector_panic_total".) Metrics sent before the panic are passed on. A
+// panicking Describe results in no descriptors at all, so that registering the
+// returned Collector fails with an error rather than crashing the process.
+//
+// The panic gauge is described along with the descriptors of c, so that it
+// passes the checks enabled by EnableCollectChecks. It has the label
+// "collector" set to the fully-qualified name of the first descriptor of c, so
+// that several wrapped Collectors with the same namespace can be registered.
+func RecoverCollector(c Collector) Collector {
+	r := &recoverCollector{Collector: c}
+	name := "collector_panic_total"
+	var constLabels Labels
+	if descs := r.describe(); len(descs) > 0 {
+		if i := strings.Index(descs[0].fqName, "_"); i > 0 {
+			name = descs[0].fqName[:i] + "_" + name
+		}
+		constLabels = Labels{"collector": descs[0].fqName}
+	}
+	r.panicDesc = NewDesc(name, "Set to 1 if the collector panicked during collection.", nil, constLabels)
+	return r
+}
+
+type recoverCollector struct {
+	Collector
+	panicDesc *Desc
+}
+
+// Describe implements Collector. The panic gauge is only described if the
+// wrapped Collector describes anything, so that a panicking Describe still
+// results in no descriptors at all.
+func (c *recoverCollector) Describe(ch chan<- *Desc) {
+	descs := c.describe()
+	for _, desc := range descs {
+		ch <- desc
+	}
+	if len(descs) > 0 {
+		ch <- c.panicDesc
+	}
+}
+
+// describe returns the descriptors of the wrapped Collector, or nil if its
+// Describe method panicked.
+func (c *recoverCollector) describe() []*Desc {
+	descChan := make(chan *Desc, capDescChan)
+	panicked := make(chan bool, 1)
+	go func() {
+		defer close(descChan)
+		defer func() {
+			if e := recover(); e != nil {
+				log.Printf("recovered from panic in Describe: %v\n%s", e, debug.Stack())
+				panicked <- true
+			}
+		}()
+		c.Collector.Describe(descChan)
+	}()
+	var descs []*Desc
+	for desc := range descChan {
+		descs = append(descs, desc)
+	}
+	select {
+	case <-panicked:
+		return nil
+	default:
+		return descs
+	}
+}
+
+// Collect implements Collector.
+func (c *recoverCollector) Collect(ch chan<- Metric) {
+	defer func() {
+		if e := recover(); e != nil {
+			log.Printf("recovered from panic in Collect: %v\n%s", e, debug.Stack())
+			ch <- MustNewConstMetric(c.panicDesc, GaugeValue, 1)
+		}
+	}()
+	c.Collector.Collect(ch)
+}
+
+// WrapCollectorWithLabels wraps the provided Collector so that all descriptors
+// it describes and all metrics it collects have the provided Labels as
+// additional const labels. This allows to attach labels to Collectors that
+// are not created from Opts, e.g. to tell apart the metrics of several
+// instances of a proxied component. WrapCollectorWithLabels returns an error if
+// any of the provided label names is already used by a descriptor of the
+// Collector, either as const or as variable label.
+func WrapCollectorWithLabels(c Collector, l Labels) (Collector, error) {
+	for _, desc := range describe(c) {
+		if desc.err != nil {
+			continue
+		}
+		for _, lp := range desc.constLabelPairs {
+			if _, ok := l[lp.GetName()]; ok {
+				return nil, fmt.Errorf("label %q is already a const label of %s", lp.GetName(), desc)
+			}
+		}
+		for _, name := range desc.variableLabels {
+			if _, ok := l[name]; ok {
+				return nil, fmt.Errorf("label %q is already a variable label of %s", name, desc)
+			}
+		}
+	}
+	labels := make(Labels, len(l))
+	labelPairs := make([]*dto.LabelPair, 0, len(l))
+	for name, value := range l {
+		labels[name] = value
+		labelPairs = append(labelPairs, &dto.LabelPair{
+			Name:  proto.String(name),
+			Value: proto.String(value),
+		})
+	}
+	return &labeledCollector{
+		Collector:  c,
+		labels:     labels,
+		labelPairs: labelPairs,
+		descs:      map[*Desc]*Desc{},
+	}, nil
+}
+
+type labeledCollector struct {
+	Collector
+	labels     Labels
+	labelPairs []*dto.LabelPair
+
+	mtx   sync.Mutex
+	descs map[*Desc]*Desc // Original Desc -> labeled copy.
+}
+
+// Describe implements Collector.
+func (c *labeledCollector) Describe(ch chan<- *Desc) {
+	for _, desc := range describe(c.Collector) {
+		ch <- c.labeledDesc(desc)
+	}
+}
+
+// Collect implements Collector.
+func (c *labeledCollector) Collect(ch chan<- Metric) {
+	metricChan := make(chan Metric, capMetricChan)
+	go func() {
+		c.Collector.Collect(metricChan)
+		close(metricChan)
+	}()
+	for metric := range metricChan {
+		ch <- &labeledMetric{
+			Metric:     metric,
+			desc:       c.labeledDesc(metric.Desc()),
+			labelPairs: c.labelPairs,
+		}
+	}
+}
+
+// labeledDesc returns a copy of the provided Desc with the additional const
+// labels. Copies are cached so that the same Desc always results in the same
+// copy. Invalid Descs are returned as is.
+func (c *labeledCollector) labeledDesc(desc *Desc) *Desc {
+	if desc.err != nil {
+		return desc
+	}
+
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	if d, ok := c.descs[desc]; ok {
+		return d
+	}
+	constLabels := make(Labels, len(desc.constLabelPairs)+len(c.labels))
+	for _, lp := range desc.constLabelPairs {
+		constLabels[lp.GetName()] = lp.GetValue()
+	}
+	for name, value := range c.labels {
+		constLabels[name] = value
+	}
+	d := NewDesc(desc.fqName, desc.help, desc.variableLabels, constLabels)
+	d.deprecatedVersion = desc.deprecatedVersion
+	c.descs[desc] = d
+	return d
+}
+
+type labeledMetric struct {
+	Metric
+	desc       *Desc
+	labelPairs []*dto.LabelPair
+}
+
+func (m *labeledMetric) Desc() *Desc {
+	return m.desc
+}
+
+func (m *labeledMetric) Write(out *dto.Metric) error {
+	if err := m.Metric.Write(out); err != nil {
+		return err
+	}
+	// The written label pairs may be shared with the wrapped Metric, so
+	// they must not be modified in place.
+	labels := make([]*dto.LabelPair, 0, len(out.Label)+len(m.labelPairs))
+	labels = append(labels, out.Label...)
+	labels = append(labels, m.labelPairs...)
+	sort.Sort(LabelPairSorter(labels))
+	out.Label = labels
+	return nil
+}
+
+// prefixedCollector is a Collector whose descriptors and metrics have a prefix
+// prepended to their names, see WrapRegistererWithPrefix.
+type prefixedCollector struct {
+	Collector
+	prefix string
+
+	mtx   sync.Mutex
+	descs map[*Desc]*Desc // Original Desc -> prefixed copy.
+}
+
+// Describe implements Collector.
+func (c *prefixedCollector) Describe(ch chan<- *Desc) {
+	for _, desc := range describe(c.Collector) {
+		ch <- c.prefixedDesc(desc)
+	}
+}
+
+// Collect implements Collector.
+func (c *prefixedCollector) Collect(ch chan<- Metric) {
+	metricChan := make(chan Metric, capMetricChan)
+	go func() {
+		c.Collector.Collect(metricChan)
+		close(metricChan)
+	}()
+	for metric := range metricChan {
+		ch <- &prefixedMetric{
+			Metric: metric,
+			desc:   c.prefixedDesc(metric.Desc()),
+		}
+	}
+}
+
+// prefixedDesc returns a copy of the provided Desc with the prefix prepended
+// to its name. Copies are cached like in labeledDesc. Invalid Descs are
+// returned as is.
+func (c *prefixedCollector) prefixedDesc(desc *Desc) *Desc {
+	if desc.err != nil {
+		return desc
+	}
+
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	if d, ok := c.descs[desc]; ok {
+		return d
+	}
+	constLabels := make(Labels, len(desc.constLabelPairs))
+	for _, lp := range desc.constLabelPairs {
+		constLabels[lp.GetName()] = lp.GetValue()
+	}
+	d := NewDesc(c.prefix+desc.fqName, desc.help, desc.variableLabels, constLabels)
+	d.deprecatedVersion = desc.deprecatedVersion
+	c.descs[desc] = d
+	return d
+}
+
+type prefixedMetric struct {
+	Metric
+	desc *Desc
+}
+
+func (m *prefixedMetric) Desc() *Desc {
+	return m.desc
+}
+
+// Gatherer is the interface implemented by anything that provides metrics as
+// ready-made MetricFamilies, e.g. a parsed exposition of another process. See
+// NewCollectorFromGatherer.
+type Gatherer interface {
+	// Gather returns the MetricFamilies. It must not modify them
+	// afterwards, as they are passed on without copying.
+	Gather() ([]*dto.MetricFamily, error)
+}
+
+// GathererFunc is a function that implements Gatherer.
+type GathererFunc func() ([]*dto.MetricFamily, error)
+
+// Gather implements Gatherer.
+func (f GathererFunc) Gather() ([]*dto.MetricFamily, error) {
+	return f()
+}
+
+// MultiError is a slice of errors implementing the error interface. It is
+// returned by the Gatherer created by MultiGatherer to report all errors that
+// occurred while gathering, rather than just the first one.
+type MultiError []error
+
+func (errs MultiError) Error() string {
+	if len(errs) == 0 {
+		return ""
+	}
+	msgs := make([]string, len(errs))
+	for i, err := range errs {
+		msgs[i] = err.Error()
+	}
+	return fmt.Sprintf("%d error(s) occurred:\n* %s", len(errs), strings.Join(msgs, "\n* "))
+}
+
+// MultiGatherer returns a Gatherer that calls the provided Gatherers one after
+// another and returns the union of their MetricFamilies, sorted by name, e.g.
+// to expose a Registry and a third-party Gatherer on the same endpoint.
+// MetricFamilies of the same name are merged into one by appending their
+// Metrics. The Metrics themselves are not deduplicated, so the Gatherers should
+// not provide the same Metric twice. A MetricFamily that has the same name but
+// a different type than a previously gathered one is skipped.
+//
+// Failing Gatherers do not suppress the MetricFamilies of the others. Gather
+// returns the MetricFamilies of all Gatherers together with a MultiError
+// containing all errors, including those for skipped MetricFamilies, or with a
+// nil error if there were none.
+func MultiGatherer(gatherers ...Gatherer) Gatherer {
+	return GathererFunc(func() ([]*dto.MetricFamily, error) {
+		var (
+			errs   MultiError
+			byName = map[string]*dto.MetricFamily{}
+			merged = map[string]bool{} // Families that are copies.
+		)
+		for _, g := range gatherers {
+			mfs, err := g.Gather()
+			if err != nil {
+				errs = append(errs, err)
+			}
+			for _, mf := range mfs {
+				name := mf.GetName()
+				existing, ok := byName[name]
+				if !ok {
+					byName[name] = mf
+					continue
+				}
+				if existing.GetType() != mf.GetType() {
+					errs = append(errs, fmt.Errorf(
+						"gathered metric family %s has type %s but should have type %s",
+						name, mf.GetType(), existing.GetType(),
+					))
+					continue
+				}
+				if !merged[name] {
+					// Do not modify the gathered MetricFamilies.
+					existing = &dto.MetricFamily{
+						Name:   existing.Name,
+						Help:   existing.Help,
+						Type:   existing.Type,
+						Metric: append([]*dto.Metric(nil), existing.Metric...),
+					}
+					byName[name] = existing
+					merged[name] = true
+				}
+				existing.Metric = append(existing.Metric, mf.Metric...)
+			}
+		}
+
+		names := make([]string, 0, len(byName))
+		for name := range byName {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		result := make([]*dto.MetricFamily, len(names))
+		for i, name := range names {
+			result[i] = byName[name]
+		}
+		if len(errs) > 0 {
+			return result, errs
+		}
+		return result, nil
+	})
+}
+
+// NewCollectorFromGatherer returns a Collector that collects the metrics
+// provided by g. It calls g.Gather once to discover the Descs, which are
+// described from then on: one Desc per metric family and set of label names,
+// with all labels as variable labels, and a generic help string if the family
+// has none. Each collection calls g.Gather again and
+// passes the metrics on unchanged. Metrics that do not match any of the
+// initially discovered Descs, and errors returned by g.Gather, are collected
+// as invalid metrics, which makes the collection fail with the respective
+// error. NewCollectorFromGatherer returns an error if the initial call of
+// g.Gather fails.
+func NewCollectorFromGatherer(g Gatherer) (Collector, error) {
+	mfs, err := g.Gather()
+	if err != nil {
+		return nil, err
+	}
+	c := &gathererCollector{gatherer: g, descs: map[string]*Desc{}}
+	for _, mf := range mfs {
+		for _, m := range mf.Metric {
+			key, labelNames := gatheredDescKey(mf, m)
+			if _, ok := c.descs[key]; ok {
+				continue
+			}
+			help := mf.GetHelp()
+			if help == "" {
+				// Descs require a help string.
+				help = "Gathered metric family " + mf.GetName() + "."
+			}
+			desc := NewDesc(mf.GetName(), help, labelNames, nil)
+			if desc.err != nil {
+				return nil, desc.err
+			}
+			c.descs[key] = desc
+			c.order = append(c.order, desc)
+		}
+	}
+	return c, nil
+}
+
+type gathererCollector struct {
+	gatherer Gatherer
+	descs    map[string]*Desc // By gatheredDescKey.
+	order    []*Desc          // In order of discovery.
+}
+
+// gatheredDescKey returns the key of the Desc for the provided metric of the
+// provided metric family and the label names of the metric.
+func gatheredDescKey(mf *dto.MetricFamily, m *dto.Metric) (string, []string) {
+	labelNames := make([]string, len(m.Label))
+	for i, lp := range m.Label {
+		labelNames[i] = lp.GetName()
+	}
+	sort.Strings(labelNames)
+	return mf.GetName() + string(model.SeparatorByte) +
+		strings.Join(labelNames, string(model.SeparatorByte)), labelNames
+}
+
+// Describe implements Collector.
+func (c *gathererCollector) Describe(ch chan<- *Desc) {
+	for _, desc := range c.order {
+		ch <- desc
+	}
+}
+
+// Collect implements Collector.
+func (c *gathererCollector) Collect(ch chan<- Metric) {
+	mfs, err := c.gatherer.Gather()
+	if err != nil {
+		ch <- NewInvalidMetric(NewInvalidDesc(err), err)
+		return
+	}
+	for _, mf := range mfs {
+		for _, m := range mf.Metric {
+			key, labelNames := gatheredDescKey(mf, m)
+			desc, ok := c.descs[key]
+			if !ok {
+				err := fmt.Errorf(
+					"gathered metric family %s with label names %v was not described",
+					mf.GetName(), labelNames,
+				)
+				ch <- NewInvalidMetric(NewInvalidDesc(err), err)
+				continue
+			}
+			ch <- &writtenMetric{desc: desc, pb: m}
+		}
+	}
+}
+
+// NewZeroValueCollector returns a Collector that collects the provided
+// Collectors and, in addition, a zero-valued sample for each of the provided
+// label sets the Collectors have not collected a metric for yet. A label set
+// applies to each described metric whose variable labels are exactly the
+// labels of the set. (Metrics without variable labels are always collected
+// anyway.) Once a Collector has collected a metric for a label set, no zero
+// value is injected for it anymore, not even if the metric disappears
+// again. Thereby, rate and increase in PromQL have a baseline from the start
+// of the process on, even for label combinations that are not pre-created
+// with WarmUp.
+//
+// A zero value has the type of the last metric collected with the same
+// Desc. Histograms get the same buckets, all empty. Before a metric of a Desc
+// has been collected, the type is taken from a metric created (but not kept)
+// by the vector the Desc belongs to, if it is one of the vectors of this
+// package. Otherwise, the zero value is injected as untyped.
+func NewZeroValueCollector(labelSets []Labels, collectors ...Collector) Collector {
+	c := &zeroValueCollector{
+		collectors: collectors,
+		templates:  map[uint64]*dto.Metric{},
+		pending:    map[string]zeroValue{},
+	}
+	for _, collector := range collectors {
+		for _, desc := range describe(collector) {
+			if len(desc.variableLabels) == 0 {
+				continue
+			}
+			for _, labels := range labelSets {
+				lvs, ok := labelValuesOf(desc, labels)
+				if !ok {
+					continue
+				}
+				c.pending[zeroValueKey(desc, lvs)] = zeroValue{desc: desc, labelValues: lvs}
+				if t, ok := collector.(templater); ok && c.templates[desc.id] == nil {
+					if d, pb, err := t.template(lvs); err == nil && d.id == desc.id {
+						c.templates[desc.id] = pb
+					}
+				}
+			}
+		}
+	}
+	return c
+}
+
+// templater is implemented by the vectors built on MetricVec.
+type templater interface {
+	template(labelValues []string) (*Desc, *dto.Metric, error)
+}
+
+type zeroValueCollector struct {
+	collectors []Collector
+
+	mtx sync.Mutex // Serializes Collect and protects the fields below.
+	// templates maps Desc IDs to the last metric collected with the Desc.
+	templates map[uint64]*dto.Metric
+	// pending contains the label combinations that still get zero values.
+	pending map[string]zeroValue
+}
+
+type zeroValue struct {
+	desc        *Desc
+	labelValues []string
+}
+
+// labelValuesOf returns the values of the variable labels of desc in the
+// provided labels and whether the labels are exactly the variable labels.
+func labelValuesOf(desc *Desc, labels Labels) ([]string, bool) {
+	if len(labels) != len(desc.variableLabels) {
+		return nil, false
+	}
+	lvs := make([]string, len(desc.variableLabels))
+	for i, name := range desc.variableLabels {
+		v, ok := labels[name]
+		if !ok {
+			return nil, false
+		}
+		lvs[i] = v
+	}
+	return lvs, true
+}
+
+func zeroValueKey(desc *Desc, labelValues []string) string {
+	return fmt.Sprint(desc.id) + string(model.SeparatorByte) +
+		strings.Join(labelValues, string(model.SeparatorByte))
+}
+
+// Describe implements Collector.
+func (c *zeroValueCollector) Describe(ch chan<- *Desc) {
+	for _, collector := range c.collectors {
+		collector.Describe(ch)
+	}
+}
+
+// Collect implements Collector.
+func (c *zeroValueCollector) Collect(ch chan<- Metric) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	for _, collector := range c.collectors {
+		metricChan := make(chan Metric, capMetricChan)
+		go func(collector Collector) {
+			collector.Collect(metricChan)
+			close(metricChan)
+		}(collector)
+		for metric := range metricChan {
+			desc := metric.Desc()
+			pb := &dto.Metric{}
+			if err := metric.Write(pb); err != nil {
+				ch <- NewInvalidMetric(desc, err)
+				continue
+			}
+			if len(desc.variableLabels) > 0 {
+				labels := Labels{}
+				for _, lp := range pb.Label {
+					labels[lp.GetName()] = lp.GetValue()
+				}
+				for _, lp := range desc.constLabelPairs {
+					delete(labels, lp.GetName())
+				}
+				if lvs, ok := labelValuesOf(desc, labels); ok {
+					delete(c.pending, zeroValueKey(desc, lvs))
+				}
+				c.templates[desc.id] = pb
+			}
+			ch <- &writtenMetric{desc: desc, pb: pb}
+		}
+	}
+	for _, zv := range c.pending {
+		pb := zeroMetric(c.templates[zv.desc.id])
+		pb.Label = makeLabelPairs(zv.desc, zv.labelValues)
+		ch <- &writtenMetric{desc: zv.desc, pb: pb}
+	}
+}
+
+// zeroMetric returns a metric of the same type as the provided one (or an
+// untyped one if it is nil) with all values set to zero. Buckets and quantiles
+// are retained, the former with a count of zero, the latter with a value of
+// NaN.
+func zeroMetric(template *dto.Metric) *dto.Metric {
+	pb := &dto.Metric{}
+	typ := dto.MetricType_UNTYPED
+	if template != nil {
+		if t, ok := writtenType(template); ok {
+			typ = t
+		}
+	}
+	switch typ {
+	case dto.MetricType_COUNTER:
+		pb.Counter = &dto.Counter{Value: proto.Float64(0)}
+	case dto.MetricType_GAUGE:
+		pb.Gauge = &dto.Gauge{Value: proto.Float64(0)}
+	case dto.MetricType_HISTOGRAM:
+		h := &dto.Histogram{SampleCount: proto.Uint64(0), SampleSum: proto.Float64(0)}
+		if template.Histogram.Bucket != nil {
+			// Keep a histogram with an empty Bucket field from
+			// turning into a NoBuckets one, see HistogramOpts.
+			h.Bucket = make([]*dto.Bucket, 0, len(template.Histogram.Bucket))
+		}
+		for _, b := range template.Histogram.Bucket {
+			h.Bucket = append(h.Bucket, &dto.Bucket{
+				UpperBound:      proto.Float64(b.GetUpperBound()),
+				CumulativeCount: proto.Uint64(0),
+			})
+		}
+		pb.Histogram = h
+	case dto.MetricType_SUMMARY:
+		s := &dto.Summary{SampleCount: proto.Uint64(0), SampleSum: proto.Float64(0)}
+		for _, q := range template.Summary.Quantile {
+			s.Quantile = append(s.Quantile, &dto.Quantile{
+				Quantile: proto.Float64(q.GetQuantile()),
+				Value:    proto.Float64(math.NaN()),
+			})
+		}
+		pb.Summary = s
+	default:
+		pb.Untyped = &dto.Untyped{Value: proto.Float64(0)}
+	}
+	return pb
 }
@@ -0,0 +1,534 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package prometheus
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	dto "github.com/prometheus/client_model/go"
+
+	"github.com/prometheus/client_golang/text"
+)
+
+type poolMetrics struct {
+	SelfCollector
+
+	size     Gauge
+	acquired Counter
+}
+
+func newPoolMetrics() *poolMetrics {
+	result := &poolMetrics{
+		size:     NewGauge(GaugeOpts{Name: "pool_size", Help: "Size of the pool."}),
+		acquired: NewCounter(CounterOpts{Name: "pool_acquired_total", Help: "Acquired items."}),
+	}
+	result.MustInit(result.size, result.acquired)
+	return result
+}
+
+func TestSelfCollectorMustInit(t *testing.T) {
+	pm := newPoolMetrics()
+
+	descCh := make(chan *Desc, 10)
+	pm.Describe(descCh)
+	close(descCh)
+	var descs []*Desc
+	for d := range descCh {
+		descs = append(descs, d)
+	}
+	if got, want := len(descs), 2; got != want {
+		t.Fatalf("got %d descs, want %d", got, want)
+	}
+	if descs[0] != pm.size.Desc() || descs[1] != pm.acquired.Desc() {
+		t.Errorf("got descs %v, want descs of children in order", descs)
+	}
+
+	metricCh := make(chan Metric, 10)
+	pm.Collect(metricCh)
+	close(metricCh)
+	var metrics []Metric
+	for m := range metricCh {
+		metrics = append(metrics, m)
+	}
+	if got, want := len(metrics), 2; got != want {
+		t.Fatalf("got %d metrics, want %d", got, want)
+	}
+	if metrics[0] != pm.size || metrics[1] != pm.acquired {
+		t.Errorf("got metrics %v, want children in order", metrics)
+	}
+
+	registry := newRegistry()
+	if _, err := registry.Register(pm); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestSelfCollectorMustInitPanicsOnNil(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Error("expected panic for nil Collector")
+		}
+	}()
+	var c SelfCollector
+	c.MustInit(nil)
+}
+
+func TestCompositeCollector(t *testing.T) {
+	var (
+		g1 = NewGauge(GaugeOpts{Name: "g1", Help: "help"})
+		g2 = NewGauge(GaugeOpts{Name: "g2", Help: "help"})
+		g3 = NewGauge(GaugeOpts{Name: "g3", Help: "help"})
+	)
+	cc := NewCompositeCollector(g1, g2)
+
+	if err := cc.Add(NewGauge(GaugeOpts{Name: "g1", Help: "help"})); err == nil {
+		t.Error("expected error for duplicate descriptor")
+	}
+	if err := cc.Add(g3); err != nil {
+		t.Error(err)
+	}
+	if got, want := cc.Remove(g2), true; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := cc.Remove(g2), false; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	ch := make(chan Metric, 10)
+	cc.Collect(ch)
+	close(ch)
+	var metrics []Metric
+	for m := range ch {
+		metrics = append(metrics, m)
+	}
+	if len(metrics) != 2 || metrics[0] != g1 || metrics[1] != g3 {
+		t.Errorf("got metrics %v, want g1 and g3", metrics)
+	}
+
+	registry := newRegistry()
+	if _, err := registry.Register(cc); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := registry.Register(g1); err == nil {
+		t.Error("expected error registering g1 separately")
+	}
+	if !registry.Unregister(cc) {
+		t.Error("expected composite collector to be unregistered")
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Error("expected panic for duplicate descriptor")
+		}
+	}()
+	cc.MustAdd(g1)
+}
+
+func TestSyncedCollector(t *testing.T) {
+	var mtx sync.Mutex
+	pool := newPoolMetrics()
+	synced := NewSyncedCollector(pool, &mtx)
+
+	mtx.Lock()
+	ch := make(chan Metric, 2)
+	done := make(chan struct{})
+	go func() {
+		synced.Collect(ch)
+		close(done)
+	}()
+	// Simulate a consistent update under the external lock.
+	pool.size.Set(10)
+	pool.acquired.Add(3)
+	mtx.Unlock()
+	<-done
+	close(ch)
+
+	// Changes after the collection must not be visible.
+	pool.size.Set(20)
+	var got []float64
+	for metric := range ch {
+		m := &dto.Metric{}
+		if err := metric.Write(m); err != nil {
+			t.Fatal(err)
+		}
+		if m.Gauge != nil {
+			got = append(got, m.GetGauge().GetValue())
+		} else {
+			got = append(got, m.GetCounter().GetValue())
+		}
+	}
+	for i, want := range []float64{10, 3} {
+		if got[i] != want {
+			t.Errorf("%d. got %f, want %f", i, got[i], want)
+		}
+	}
+
+	if _, err := newRegistry().Register(synced); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestWrapCollectorWithLabels(t *testing.T) {
+	vec := NewCounterVec(CounterOpts{
+		Name:        "test_counter",
+		Help:        "helpless",
+		ConstLabels: Labels{"b": "const"},
+	}, []string{"d"})
+	vec.WithLabelValues("var").Inc()
+
+	wrapped, err := WrapCollectorWithLabels(vec, Labels{"a": "1", "c": "2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	descs := describe(wrapped)
+	if got, want := len(descs), 1; got != want {
+		t.Fatalf("got %d descs, want %d", got, want)
+	}
+	if got, want := descs[0].String(), `Desc{fqName: "test_counter", help: "helpless", constLabels: {a="1",b="const",c="2"}, variableLabels: [d]}`; got != want {
+		t.Errorf("got desc %s, want %s", got, want)
+	}
+
+	ch := make(chan Metric, 1)
+	wrapped.Collect(ch)
+	metric := <-ch
+	if metric.Desc() != descs[0] {
+		t.Error("expected the collected metric to have the described desc")
+	}
+	m := &dto.Metric{}
+	metric.Write(m)
+	var got []string
+	for _, lp := range m.GetLabel() {
+		got = append(got, lp.GetName()+"="+lp.GetValue())
+	}
+	if want := []string{"a=1", "b=const", "c=2", "d=var"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got labels %v, want %v", got, want)
+	}
+	// The labels of the wrapped metric are unchanged.
+	m.Reset()
+	vec.WithLabelValues("var").Write(m)
+	if got, want := len(m.GetLabel()), 2; got != want {
+		t.Errorf("got %d labels of the wrapped metric, want %d", got, want)
+	}
+
+	if _, err := newRegistry().Register(wrapped); err != nil {
+		t.Error(err)
+	}
+	if _, err := WrapCollectorWithLabels(vec, Labels{"b": "x"}); err == nil {
+		t.Error("expected error for conflicting const label")
+	}
+	if _, err := WrapCollectorWithLabels(vec, Labels{"d": "x"}); err == nil {
+		t.Error("expected error for conflicting variable label")
+	}
+}
+
+func TestCollectorFromGatherer(t *testing.T) {
+	exposition := `# HELP requests_total Total requests.
+# TYPE requests_total counter
+requests_total{code="200",method="get"} 3
+requests_total{code="500",method="get"} 1
+# TYPE temperature gauge
+temperature 21.5
+`
+	var gatherErr error
+	g := GathererFunc(func() ([]*dto.MetricFamily, error) {
+		if gatherErr != nil {
+			return nil, gatherErr
+		}
+		families, err := (&text.Parser{}).TextToMetricFamilies(strings.NewReader(exposition))
+		if err != nil {
+			return nil, err
+		}
+		var mfs []*dto.MetricFamily
+		for _, mf := range families {
+			mfs = append(mfs, mf)
+		}
+		return mfs, nil
+	})
+
+	c, err := NewCollectorFromGatherer(g)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(describe(c)), 2; got != want {
+		t.Errorf("got %d descs, want %d", got, want)
+	}
+	registry := newRegistry()
+	if _, err := registry.Register(c); err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if _, err := registry.writePB(&buf, text.MetricFamilyToText, nil); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := buf.String(), `# HELP requests_total Total requests.
+# TYPE requests_total counter
+requests_total{code="200",method="get"} 3
+requests_total{code="500",method="get"} 1
+# HELP temperature Gathered metric family temperature.
+# TYPE temperature gauge
+temperature 21.5
+`; got != want {
+		t.Errorf("got\n%s\nwant\n%s", got, want)
+	}
+
+	// Metrics with other label names have not been described.
+	exposition += "temperature{room=\"kitchen\"} 23\n"
+	if _, err := registry.writePB(&buf, text.MetricFamilyToText, nil); err == nil || !strings.Contains(err.Error(), "not described") {
+		t.Errorf("got error %v for undescribed metric", err)
+	}
+
+	gatherErr = errors.New("gathering failed")
+	if _, err := registry.writePB(&buf, text.MetricFamilyToText, nil); err == nil || !strings.Contains(err.Error(), gatherErr.Error()) {
+		t.Errorf("got error %v, want %v", err, gatherErr)
+	}
+	if _, err := NewCollectorFromGatherer(g); err != gatherErr {
+		t.Errorf("got error %v, want %v", err, gatherErr)
+	}
+}
+
+func TestMultiGatherer(t *testing.T) {
+	parsed := func(exposition string) Gatherer {
+		return GathererFunc(func() ([]*dto.MetricFamily, error) {
+			families, err := (&text.Parser{}).TextToMetricFamilies(strings.NewReader(exposition))
+			if err != nil {
+				return nil, err
+			}
+			var mfs []*dto.MetricFamily
+			for _, mf := range families {
+				mfs = append(mfs, mf)
+			}
+			return mfs, nil
+		})
+	}
+	first := parsed(`# TYPE requests_total counter
+requests_total{code="200"} 3
+# TYPE temperature gauge
+temperature 21.5
+`)
+	second := parsed(`# TYPE requests_total counter
+requests_total{code="500"} 1
+# TYPE temperature counter
+temperature 7
+# TYPE humidity gauge
+humidity 0.4
+`)
+	gatherErr := errors.New("gathering failed")
+	failing := GathererFunc(func() ([]*dto.MetricFamily, error) { return nil, gatherErr })
+
+	mfs, err := MultiGatherer(first, failing, second).Gather()
+	errs, ok := err.(MultiError)
+	if !ok || len(errs) != 2 || errs[0] != gatherErr || !strings.Contains(errs[1].Error(), "temperature") {
+		t.Errorf("got error %v, want the gathering error and a type conflict for temperature", err)
+	}
+	var buf bytes.Buffer
+	for _, mf := range mfs {
+		text.MetricFamilyToText(&buf, mf)
+	}
+	if got, want := buf.String(), `# TYPE humidity gauge
+humidity 0.4
+# TYPE requests_total counter
+requests_total{code="200"} 3
+requests_total{code="500"} 1
+# TYPE temperature gauge
+temperature 21.5
+`; got != want {
+		t.Errorf("got\n%s\nwant\n%s", got, want)
+	}
+
+	// The gathered metric families are not modified.
+	mfs, err = first.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fixed := GathererFunc(func() ([]*dto.MetricFamily, error) { return mfs, nil })
+	if _, err := MultiGatherer(fixed, fixed).Gather(); err != nil {
+		t.Fatal(err)
+	}
+	for _, mf := range mfs {
+		if got, want := len(mf.Metric), 1; got != want {
+			t.Errorf("got %d metrics in %s, want %d", got, mf.GetName(), want)
+		}
+	}
+}
+
+func TestAggregatingCollector(t *testing.T) {
+	pool1 := NewCounterVec(CounterOpts{Name: "db_queries_total", Help: "help"}, []string{"pool"})
+	pool2 := NewCounterVec(CounterOpts{Name: "db_queries_total", Help: "help"}, []string{"pool"})
+	pool1.WithLabelValues("a").Add(2)
+	pool2.WithLabelValues("b").Add(3)
+
+	c, err := NewAggregatingCollector(pool1, pool2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewAggregatingCollector(
+		pool1,
+		NewCounterVec(CounterOpts{Name: "db_queries_total", Help: "other help"}, []string{"pool"}),
+	); err == nil {
+		t.Error("expected error for conflicting help")
+	}
+
+	registry := newRegistry()
+	if _, err := registry.Register(c); err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if _, err := registry.writePB(&buf, text.MetricFamilyToText, nil); err != nil {
+		t.Fatal(err)
+	}
+	want := `# HELP db_queries_total help
+# TYPE db_queries_total counter
+db_queries_total{pool="a"} 2
+db_queries_total{pool="b"} 3
+`
+	if got := buf.String(); got != want {
+		t.Errorf("got\n%s\nwant\n%s", got, want)
+	}
+
+	registry.Unregister(c)
+	c.RemoveCollector(pool1)
+	gauges := NewGaugeVec(GaugeOpts{Name: "db_queries_total", Help: "help"}, []string{"pool"})
+	gauges.WithLabelValues("c").Set(1)
+	if err := c.AddCollector(gauges); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := registry.Register(c); err != nil {
+		t.Fatal(err)
+	}
+	buf.Reset()
+	if _, err := registry.writePB(&buf, text.MetricFamilyToText, nil); err == nil {
+		t.Error("expected error for conflicting types")
+	}
+}
+
+func TestZeroValueCollector(t *testing.T) {
+	counters := NewCounterVec(CounterOpts{
+		Name: "test_counter",
+		Help: "helpless",
+	}, []string{"code"})
+	histograms := NewHistogramVec(HistogramOpts{
+		Name:    "test_histogram",
+		Help:    "helpless",
+		Buckets: []float64{1},
+	}, []string{"code"})
+	c := NewZeroValueCollector(
+		[]Labels{{"code": "200"}, {"code": "500"}, {"method": "GET"}},
+		counters, histograms,
+	)
+	registry := newRegistry()
+	if _, err := registry.Register(c); err != nil {
+		t.Fatal(err)
+	}
+
+	gather := func() string {
+		var buf bytes.Buffer
+		if _, err := registry.writePB(&buf, text.MetricFamilyToText, nil); err != nil {
+			t.Fatal(err)
+		}
+		return buf.String()
+	}
+	out := gather()
+	for _, want := range []string{
+		`test_counter{code="200"} 0`,
+		`test_counter{code="500"} 0`,
+		"# TYPE test_counter counter",
+		`test_histogram_bucket{code="200",le="1"} 0`,
+		"# TYPE test_histogram histogram",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("want %q in output:\n%s", want, out)
+		}
+	}
+
+	counters.WithLabelValues("200").Add(3)
+	histograms.WithLabelValues("404").Observe(0.5)
+	out = gather()
+	for _, want := range []string{
+		`test_counter{code="200"} 3`,
+		`test_counter{code="500"} 0`,
+		"# TYPE test_counter counter",
+		`test_histogram_bucket{code="200",le="1"} 0`,
+		`test_histogram_count{code="500"} 0`,
+		`test_histogram_bucket{code="404",le="1"} 1`,
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("want %q in output:\n%s", want, out)
+		}
+	}
+
+	counters.Delete(Labels{"code": "200"})
+	if out := gather(); strings.Contains(out, `test_counter{code="200"}`) {
+		t.Errorf("got zero value for label set collected before:\n%s", out)
+	}
+}
+
+type panickingCollector struct {
+	gauge                       Gauge
+	panicDescribe, panicCollect bool
+}
+
+func (c panickingCollector) Describe(ch chan<- *Desc) {
+	c.gauge.Describe(ch)
+	if c.panicDescribe {
+		panic("describe failed")
+	}
+}
+
+func (c panickingCollector) Collect(ch chan<- Metric) {
+	c.gauge.Collect(ch)
+	if c.panicCollect {
+		panic("collect failed")
+	}
+}
+
+func TestRecoverCollector(t *testing.T) {
+	gauge := NewGauge(GaugeOpts{Namespace: "unreliable", Name: "value", Help: "helpless"})
+	gauge.Set(42)
+
+	other := NewGauge(GaugeOpts{Namespace: "unreliable", Name: "other", Help: "helpless"})
+
+	registry := newRegistry()
+	registry.collectChecksEnabled = true
+	for _, g := range []Gauge{gauge, other} {
+		if _, err := registry.Register(RecoverCollector(panickingCollector{gauge: g, panicCollect: true})); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var buf bytes.Buffer
+	if _, err := registry.writePB(&buf, text.MetricFamilyToText, nil); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"unreliable_value 42\n",
+		`unreliable_collector_panic_total{collector="unreliable_value"} 1` + "\n",
+		`unreliable_collector_panic_total{collector="unreliable_other"} 1` + "\n",
+	} {
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("got %q, want it to contain %q", buf.String(), want)
+		}
+	}
+
+	r := RecoverCollector(panickingCollector{gauge: gauge, panicDescribe: true})
+	if got := describe(r); len(got) != 0 {
+		t.Errorf("got descriptors %v, want none", got)
+	}
+	if _, err := newRegistry().Register(r); err == nil {
+		t.Error("expected error registering a collector with a panicking Describe")
+	}
+}
@@ -15,7 +15,17 @@ package prometheus
 
 import (
 	"errors"
+	"fmt"
 	"hash/fnv"
+	"log"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
 )
 
 // Counter is a Metric that represents a single numerical value that only ever
@@ -55,11 +65,25 @@ func NewCounter(opts CounterOpts) Counter {
 		nil,
 		opts.ConstLabels,
 	)
+	desc.deprecatedVersion = opts.DeprecatedVersion
 	result := &counter{value: value{desc: desc, valType: CounterValue, labelPairs: desc.constLabelPairs}}
 	result.Init(result) // Init self-collection.
 	return result
 }
 
+// NewCounterWithInitialValue works like NewCounter, but the created Counter
+// starts with the given initial value instead of 0. This is useful to carry
+// over the total of a counter from another system, e.g. when migrating to
+// Prometheus. It panics if the initial value is negative.
+func NewCounterWithInitialValue(opts CounterOpts, initial float64) Counter {
+	if initial < 0 {
+		panic(errors.New("counter cannot start with a negative value"))
+	}
+	result := NewCounter(opts).(*counter)
+	result.value.Set(initial)
+	return result
+}
+
 type counter struct {
 	value
 }
@@ -81,6 +105,14 @@ func (c *counter) Add(v float64) {
 // detailed documentation.
 type CounterVec struct {
 	MetricVec
+	// invalid is returned by WithLabelValues and With for label value
+	// combinations that are not valid (see
+	// NewCounterVecWithValidCombinations) and for dropped label values
+	// (see Opts.LabelAllowlist).
+	invalid Counter
+	// now is used to timestamp the samples of Counters tracking their
+	// rate (see Opts.TrackRate).
+	now func() time.Time
 }
 
 // NewCounterVec creates a new CounterVec based on the provided CounterOpts and
@@ -93,22 +125,203 @@ func NewCounterVec(opts CounterOpts, labelNames []string) *CounterVec {
 		labelNames,
 		opts.ConstLabels,
 	)
-	return &CounterVec{
-		MetricVec: MetricVec{
-			children: map[uint64]Metric{},
-			desc:     desc,
-			hash:     fnv.New64a(),
-			newMetric: func(lvs ...string) Metric {
-				result := &counter{value: value{
-					desc:       desc,
-					valType:    CounterValue,
-					labelPairs: makeLabelPairs(desc, lvs),
-				}}
-				result.Init(result) // Init self-collection.
-				return result
-			},
+	desc.deprecatedVersion = opts.DeprecatedVersion
+	if opts.TrackRate && opts.RateSamples == 0 {
+		opts.RateSamples = DefRateSamples
+	}
+	if opts.TrackRate && opts.RateSamples < 2 {
+		panic(fmt.Errorf("counter vector %s needs at least 2 RateSamples", desc))
+	}
+	m := &CounterVec{now: time.Now}
+	m.MetricVec = MetricVec{
+		children: map[uint64]Metric{},
+		desc:     desc,
+		hash:     fnv.New64a(),
+		seed:     hashSeed(opts.HashSeed),
+		newMetric: func(lvs ...string) Metric {
+			result := &counter{value: value{
+				desc:       desc,
+				valType:    CounterValue,
+				labelPairs: makeLabelPairs(desc, lvs),
+			}}
+			result.Init(result) // Init self-collection.
+			var c Counter = result
+			if opts.TrackRate {
+				c = &rateCounter{
+					Counter: result,
+					now:     m.now,
+					samples: make([]rateSample, 0, opts.RateSamples),
+				}
+			}
+			if opts.TrackLastObserved {
+				return &trackedCounter{observedAt: newObservedAt(), Counter: c}
+			}
+			return c
 		},
+		allowlist: newLabelAllowlist(desc, opts.LabelAllowlist, opts.FallbackBehavior, opts.FallbackValue),
+		lockFree:  opts.LockFreeHotPath,
+	}
+	if m.allowlist != nil && m.allowlist.drop {
+		m.invalid = m.newMetric(make([]string, len(labelNames))...).(Counter)
+	}
+	return m
+}
+
+// trackedCounter is a Counter that records the time of its last update.
+type trackedCounter struct {
+	observedAt
+	Counter
+}
+
+func (c *trackedCounter) Set(v float64) { c.touch(); c.Counter.Set(v) }
+func (c *trackedCounter) Inc()          { c.touch(); c.Counter.Inc() }
+func (c *trackedCounter) Add(v float64) { c.touch(); c.Counter.Add(v) }
+
+// DefRateSamples is the default number of updates recorded per child of a
+// CounterVec with TrackRate set (see Opts).
+const DefRateSamples = 60
+
+// rateSample is the value of a Counter after an update and the time of that
+// update.
+type rateSample struct {
+	t     time.Time
+	value float64
+}
+
+// rateCounter is a Counter that records its most recent updates in a ring
+// buffer to estimate its rate.
+type rateCounter struct {
+	Counter
+	now func() time.Time
+
+	mtx     sync.Mutex // Protects the fields below.
+	total   float64
+	samples []rateSample // The ring buffer, full once len equals cap.
+	next    int          // Index of the oldest sample in a full buffer.
+}
+
+func (c *rateCounter) Set(v float64) {
+	c.Counter.Set(v)
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.total = v
+	c.record()
+}
+
+func (c *rateCounter) Inc() { c.Add(1) }
+
+func (c *rateCounter) Add(v float64) {
+	c.Counter.Add(v) // Panics for negative values.
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.total += v
+	c.record()
+}
+
+// record adds the current total to the samples. It needs mtx locked.
+func (c *rateCounter) record() {
+	s := rateSample{t: c.now(), value: c.total}
+	if len(c.samples) < cap(c.samples) {
+		c.samples = append(c.samples, s)
+		return
+	}
+	c.samples[c.next] = s
+	c.next = (c.next + 1) % len(c.samples)
+}
+
+// rate returns the slope between the oldest and the newest sample within the
+// window ending now, or NaN if there are less than two samples in the window.
+func (c *rateCounter) rate(window time.Duration) float64 {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if len(c.samples) < 2 {
+		return math.NaN()
+	}
+	cutoff := c.now().Add(-window)
+	newest := c.samples[(c.next+len(c.samples)-1)%len(c.samples)]
+	// Walk from the oldest sample to the first one within the window.
+	for i := 0; i < len(c.samples)-1; i++ {
+		oldest := c.samples[(c.next+i)%len(c.samples)]
+		if oldest.t.Before(cutoff) {
+			continue
+		}
+		elapsed := newest.t.Sub(oldest.t).Seconds()
+		if elapsed <= 0 {
+			return math.NaN()
+		}
+		return (newest.value - oldest.value) / elapsed
+	}
+	return math.NaN()
+}
+
+// Rate returns an estimate of the per-second rate of the Counter with the
+// provided label values over the provided window, ending now. It is the slope
+// between the oldest and the newest of the recorded updates within the
+// window. Updates are only recorded if the CounterVec was created with the
+// TrackRate option (see Opts), and only the most recent RateSamples updates are
+// kept. A Counter set to a lower value is treated like any other update, so
+// the estimate is negative across such a reset.
+//
+// Rate is meant for in-process decisions like rate limiting and does not
+// affect what is exposed. It returns NaN if the rate cannot be estimated,
+// i.e. if rates are not tracked, there is no Counter with the provided label
+// values, or fewer than two updates are within the window. Rate does not
+// create a Counter.
+func (m *CounterVec) Rate(window time.Duration, labelValues ...string) float64 {
+	m.mtx.Lock()
+	h, err := m.hashLabelValues(labelValues)
+	metric, ok := m.children[h]
+	m.mtx.Unlock()
+	if err != nil || !ok {
+		return math.NaN()
+	}
+	if r, ok := metric.(*rollupCounter); ok {
+		metric = r.Counter
+	}
+	if p, ok := metric.(*persistentCounter); ok {
+		metric = p.Counter
+	}
+	if t, ok := metric.(*trackedCounter); ok {
+		metric = t.Counter
+	}
+	rc, ok := metric.(*rateCounter)
+	if !ok {
+		return math.NaN()
 	}
+	return rc.rate(window)
+}
+
+// NewCounterVecWithValidCombinations creates a new CounterVec based on the
+// provided CounterOpts that only accepts the provided combinations of label
+// values. The variable labels are the label names of the provided Labels,
+// which must all have the same label names. For any other combination of label
+// values, GetMetricWithLabelValues and GetMetricWith return an error, while
+// WithLabelValues and With return a Counter that is not part of the CounterVec
+// and thus never exposed. This protects against an explosion of the number of
+// metrics caused by invalid input, e.g. label values taken from requests.
+// NewCounterVecWithValidCombinations returns an error if no combinations are
+// provided or if they have different label names.
+func NewCounterVecWithValidCombinations(opts CounterOpts, valid []Labels) (*CounterVec, error) {
+	if len(valid) == 0 {
+		return nil, errors.New("no valid label combinations provided")
+	}
+	labelNames := make([]string, 0, len(valid[0]))
+	for name := range valid[0] {
+		labelNames = append(labelNames, name)
+	}
+	sort.Strings(labelNames)
+
+	m := NewCounterVec(opts, labelNames)
+	m.valid = make(map[uint64]struct{}, len(valid))
+	for _, labels := range valid {
+		h, err := m.hashLabels(labels)
+		if err != nil {
+			return nil, fmt.Errorf("label combination %v: %s", labels, err)
+		}
+		m.valid[h] = struct{}{}
+	}
+	m.invalid = m.newMetric(make([]string, len(labelNames))...).(Counter)
+	return m, nil
 }
 
 // GetMetricWithLabelValues replaces the method of the same name in
@@ -137,15 +350,150 @@ func (m *CounterVec) GetMetricWith(labels Labels) (Counter, error) {
 // GetMetricWithLabelValues would have returned an error. By not returning an
 // error, WithLabelValues allows shortcuts like
 //     myVec.WithLabelValues("404", "GET").Add(42)
+// Label values that are not among the valid combinations of a CounterVec
+// created with NewCounterVecWithValidCombinations, or that are dropped because
+// they are not in the LabelAllowlist, do not cause a panic but result in a
+// Counter that is never exposed.
 func (m *CounterVec) WithLabelValues(lvs ...string) Counter {
-	return m.MetricVec.WithLabelValues(lvs...).(Counter)
+	c, err := m.GetMetricWithLabelValues(lvs...)
+	if err == errInvalidLabelCombination || err == errLabelValueNotAllowed {
+		return m.invalid
+	}
+	if err != nil {
+		panic(err)
+	}
+	return c
 }
 
 // With works as GetMetricWith, but panics where GetMetricWithLabels would have
 // returned an error. By not returning an error, With allows shortcuts like
 //     myVec.With(Labels{"code": "404", "method": "GET"}).Add(42)
+// Invalid label combinations are handled as in WithLabelValues.
 func (m *CounterVec) With(labels Labels) Counter {
-	return m.MetricVec.With(labels).(Counter)
+	c, err := m.GetMetricWith(labels)
+	if err == errInvalidLabelCombination || err == errLabelValueNotAllowed {
+		return m.invalid
+	}
+	if err != nil {
+		panic(err)
+	}
+	return c
+}
+
+// AddN is a shortcut for
+//     myVec.WithLabelValues(lvs...).Add(float64(n))
+// for batch processing, where n is the number of processed items. It panics if
+// n is negative and under the same conditions as WithLabelValues.
+func (m *CounterVec) AddN(n int, labelValues ...string) {
+	m.WithLabelValues(labelValues...).Add(float64(n))
+}
+
+// AddIf adds v to the Counter with the provided label values if condition is
+// true and returns condition. It allows to count and branch in one statement:
+//     if myVec.AddIf(err != nil, 1, "db") {
+//         return err
+//     }
+// If condition is false, the Counter is not even created. Otherwise, AddIf
+// panics under the same conditions as Add and WithLabelValues.
+func (m *CounterVec) AddIf(condition bool, v float64, labelValues ...string) bool {
+	if condition {
+		m.WithLabelValues(labelValues...).Add(v)
+	}
+	return condition
+}
+
+// IncIf works like AddIf but increments the Counter by 1.
+func (m *CounterVec) IncIf(condition bool, labelValues ...string) bool {
+	return m.AddIf(condition, 1, labelValues...)
+}
+
+// SortedForEach calls fn with the variable labels and the current value of
+// each Counter in the CounterVec, in the same order as GaugeVec.SortedForEach.
+func (m *CounterVec) SortedForEach(fn func(labels Labels, value float64)) {
+	for _, child := range m.sortedChildren() {
+		fn(child.labels, child.metric.GetCounter().GetValue())
+	}
+}
+
+// WithPartialLabels replaces the method of the same name in MetricVec. The
+// difference is that this method returns a PartialCounterVec and not a
+// PartialMetricVec so that no type conversion is required.
+func (m *CounterVec) WithPartialLabels(labels Labels) *PartialCounterVec {
+	return &PartialCounterVec{*m.MetricVec.WithPartialLabels(labels)}
+}
+
+// CurryWith replaces the method of the same name in MetricVec. The difference
+// is that this method returns a PartialCounterVec and not a PartialMetricVec so
+// that no type conversion is required.
+func (m *CounterVec) CurryWith(labels Labels) (*PartialCounterVec, error) {
+	p, err := m.MetricVec.CurryWith(labels)
+	if err != nil {
+		return nil, err
+	}
+	return &PartialCounterVec{*p}, nil
+}
+
+// MustCurryWith works as CurryWith, but panics where CurryWith would have
+// returned an error.
+func (m *CounterVec) MustCurryWith(labels Labels) *PartialCounterVec {
+	return &PartialCounterVec{*m.MetricVec.MustCurryWith(labels)}
+}
+
+// PartialCounterVec is a CounterVec with some of its variable labels already bound
+// to values. Create instances with the WithPartialLabels method of CounterVec.
+type PartialCounterVec struct {
+	PartialMetricVec
+}
+
+// GetMetricWithLabelValues replaces the method of the same name in
+// PartialMetricVec. The difference is that this method returns a Counter and
+// not a Metric so that no type conversion is required.
+func (p *PartialCounterVec) GetMetricWithLabelValues(lvs ...string) (Counter, error) {
+	metric, err := p.PartialMetricVec.GetMetricWithLabelValues(lvs...)
+	if metric != nil {
+		return metric.(Counter), err
+	}
+	return nil, err
+}
+
+// WithLabelValues works as GetMetricWithLabelValues, but panics where
+// GetMetricWithLabelValues would have returned an error.
+func (p *PartialCounterVec) WithLabelValues(lvs ...string) Counter {
+	return p.PartialMetricVec.WithLabelValues(lvs...).(Counter)
+}
+
+// GetMetricWith replaces the method of the same name in PartialMetricVec. The
+// difference is that this method returns a Counter and not a Metric so that no
+// type conversion is required.
+func (p *PartialCounterVec) GetMetricWith(labels Labels) (Counter, error) {
+	metric, err := p.PartialMetricVec.GetMetricWith(labels)
+	if metric != nil {
+		return metric.(Counter), err
+	}
+	return nil, err
+}
+
+// With works as GetMetricWith, but panics where GetMetricWith would have
+// returned an error.
+func (p *PartialCounterVec) With(labels Labels) Counter {
+	return p.PartialMetricVec.With(labels).(Counter)
+}
+
+// CurryWith replaces the method of the same name in PartialMetricVec. The
+// difference is that this method returns a PartialCounterVec and not a
+// PartialMetricVec so that no type conversion is required.
+func (p *PartialCounterVec) CurryWith(labels Labels) (*PartialCounterVec, error) {
+	curried, err := p.PartialMetricVec.CurryWith(labels)
+	if err != nil {
+		return nil, err
+	}
+	return &PartialCounterVec{*curried}, nil
+}
+
+// MustCurryWith works as CurryWith, but panics where CurryWith would have
+// returned an error.
+func (p *PartialCounterVec) MustCurryWith(labels Labels) *PartialCounterVec {
+	return &PartialCounterVec{*p.PartialMetricVec.MustCurryWith(labels)}
 }
 
 // CounterFunc is a Counter whose value is determined at collect time by calling a
@@ -163,13 +511,646 @@ type CounterFunc interface {
 // happen concurrently. If that results in concurrent calls to Write, like in
 // the case where a CounterFunc is directly registered with Prometheus, the
 // provided function must be concurrency-safe. The function should also honor
-// the contract for a Counter (values only go up, not down), but compliance will
-// not be checked.
+// the contract for a Counter (values only go up, not down). This is only
+// checked loosely: If the function returns a smaller value than on the
+// previous call, a warning is logged with the standard logger, as the Counter
+// appears to have been reset. This fits function-backed counters delegating
+// to counters maintained elsewhere, e.g. by the operating system or the
+// runtime, which may legitimately reset.
 func NewCounterFunc(opts CounterOpts, function func() float64) CounterFunc {
-	return newValueFunc(NewDesc(
+	desc := NewDesc(
+		BuildFQName(opts.Namespace, opts.Subsystem, opts.Name),
+		opts.Help,
+		nil,
+		opts.ConstLabels,
+	)
+	desc.deprecatedVersion = opts.DeprecatedVersion
+	var (
+		mtx  sync.Mutex
+		last = math.Inf(-1)
+	)
+	return newValueFunc(desc, CounterValue, func() float64 {
+		v := function()
+		mtx.Lock()
+		defer mtx.Unlock()
+		if v < last {
+			log.Printf("counter %s decreased from %v to %v, assuming a counter reset", desc.fqName, last, v)
+		}
+		last = v
+		return v
+	})
+}
+
+// NewDerivedCounter works like NewDerivedGauge, but it exposes the transformed
+// value of the provided Counter as a counter. The transform function must be
+// monotonically non-decreasing to keep the derived counter monotonic, e.g. a
+// multiplication by a positive factor.
+func NewDerivedCounter(desc *Desc, base Counter, transform func(float64) float64) Collector {
+	return &derivedMetric{
+		desc:      desc,
+		base:      base,
+		transform: transform,
+		valueType: CounterValue,
+	}
+}
+
+// RollingCounter is a Metric that is fed with the absolute values of a
+// monotonic counter from another source (like a kernel counter) but exposes
+// only the increase since it was collected the previous time. As that value is
+// not cumulative, it is exposed as a gauge. Prefer a Counter (possibly a
+// CounterFunc) if possible, as the Prometheus server can compute the increase
+// of a counter over arbitrary time ranges.
+//
+// To create RollingCounter instances, use NewRollingCounter.
+type RollingCounter interface {
+	Metric
+	Collector
+
+	// Set sets the current absolute value of the source counter. Between
+	// two collections, only the highest value set counts. A value lower
+	// than the one at the previous collection is taken as a reset of the
+	// source counter, so that the increase up to the reset is kept and
+	// the value itself is counted as the increase since the reset. The
+	// first value set is the baseline the increase is computed from.
+	Set(uint64)
+}
+
+// NewRollingCounter creates a new RollingCounter based on the provided
+// CounterOpts. Note that each collection of a RollingCounter starts a new
+// interval, so it must not be collected by more than one consumer.
+func NewRollingCounter(opts CounterOpts) RollingCounter {
+	desc := NewDesc(
 		BuildFQName(opts.Namespace, opts.Subsystem, opts.Name),
 		opts.Help,
 		nil,
 		opts.ConstLabels,
-	), CounterValue, function)
+	)
+	desc.deprecatedVersion = opts.DeprecatedVersion
+	result := &rollingCounter{desc: desc, labelPairs: desc.constLabelPairs}
+	result.Init(result) // Init self-collection.
+	return result
+}
+
+type rollingCounter struct {
+	SelfCollector
+
+	mtx sync.Mutex // Protects the fields below.
+	// collected is the highest absolute value at the time of the previous
+	// collection (or 0 after a reset of the source counter), max the
+	// highest absolute value set since. pending is the increase up to
+	// resets of the source counter since the previous collection.
+	collected, max, pending uint64
+	isSet                   bool
+
+	desc       *Desc
+	labelPairs []*dto.LabelPair
+}
+
+func (c *rollingCounter) Desc() *Desc {
+	return c.desc
+}
+
+func (c *rollingCounter) Set(v uint64) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	if !c.isSet {
+		c.collected, c.max, c.isSet = v, v, true
+		return
+	}
+	if v < c.collected {
+		c.pending += c.max - c.collected
+		c.collected, c.max = 0, v
+		return
+	}
+	if v > c.max {
+		c.max = v
+	}
+}
+
+func (c *rollingCounter) Write(out *dto.Metric) error {
+	c.mtx.Lock()
+	delta := c.pending + c.max - c.collected
+	c.collected, c.pending = c.max, 0
+	c.mtx.Unlock()
+
+	return populateMetric(GaugeValue, float64(delta), c.labelPairs, out)
+}
+
+// EventCounter is a Collector that counts events and tracks the distribution of
+// the time between them. It collects a counter with the suffix "_total" and a
+// histogram with the suffix "_inter_arrival_seconds". The latter is useful to
+// analyze the arrival process of events like queued messages, webhook
+// deliveries, or scheduled job runs.
+//
+// To create EventCounter instances, use NewEventCounter.
+type EventCounter interface {
+	Collector
+
+	// Record records an event. It increments the counter and observes the
+	// time since the previous call of Record in the histogram. The first
+	// call of Record does not observe anything, as there is no previous
+	// event.
+	Record()
+}
+
+// EventCounterOpts bundles the options for creating an EventCounter. The Name
+// in the embedded CounterOpts is the common prefix of both collected metrics.
+type EventCounterOpts struct {
+	CounterOpts
+
+	// InterArrivalBuckets defines the buckets of the inter-arrival
+	// histogram in seconds. If nil, DefBuckets is used, see
+	// HistogramOpts.
+	InterArrivalBuckets []float64
+}
+
+// NewEventCounter creates a new EventCounter based on the provided
+// EventCounterOpts. It panics if the InterArrivalBuckets are invalid, see
+// NewHistogram.
+func NewEventCounter(opts EventCounterOpts) EventCounter {
+	counter := NewCounter(CounterOpts{
+		Namespace:         opts.Namespace,
+		Subsystem:         opts.Subsystem,
+		Name:              opts.Name + "_total",
+		Help:              opts.Help,
+		ConstLabels:       opts.ConstLabels,
+		DeprecatedVersion: opts.DeprecatedVersion,
+	})
+	interArrival := NewHistogram(HistogramOpts{
+		Namespace:         opts.Namespace,
+		Subsystem:         opts.Subsystem,
+		Name:              opts.Name + "_inter_arrival_seconds",
+		Help:              "Time between events counted by " + counter.Desc().fqName + ".",
+		ConstLabels:       opts.ConstLabels,
+		Buckets:           opts.InterArrivalBuckets,
+		DeprecatedVersion: opts.DeprecatedVersion,
+	})
+	result := &eventCounter{
+		counter:      counter,
+		interArrival: interArrival,
+		now:          time.Now,
+	}
+	result.MustInit(counter, interArrival)
+	return result
+}
+
+type eventCounter struct {
+	SelfCollector
+
+	counter      Counter
+	interArrival Histogram
+	now          func() time.Time
+
+	mtx  sync.Mutex // Protects last.
+	last time.Time
+}
+
+func (c *eventCounter) Record() {
+	// Read the clock while holding the lock so that concurrent calls
+	// cannot store their times out of order, which would result in a
+	// negative inter-arrival time.
+	c.mtx.Lock()
+	now := c.now()
+	last := c.last
+	c.last = now
+	c.mtx.Unlock()
+
+	c.counter.Inc()
+	if !last.IsZero() {
+		c.interArrival.Observe(now.Sub(last).Seconds())
+	}
+}
+
+// DefThroughputRateInterval is the default RateInterval of a ThroughputCounter.
+const DefThroughputRateInterval = 10 * time.Second
+
+// ThroughputCounter is a Collector that counts events and additionally exposes
+// their rate as a gauge. It collects a counter with the suffix "_total" and a
+// gauge with the suffix "_per_second". The gauge is updated from a background
+// goroutine once per RateInterval with the increase of the counter during the
+// interval divided by the interval in seconds. This provides a pre-computed
+// rate for consumers of the metrics that cannot calculate rates themselves.
+// Where PromQL is available, the rate function applied to the counter is more
+// flexible and should be preferred.
+//
+// Register and unregister a ThroughputCounter as a whole, which covers both
+// metrics. To create ThroughputCounter instances, use NewThroughputCounter.
+type ThroughputCounter interface {
+	Collector
+
+	// Inc increments the counter by 1.
+	Inc()
+	// Add adds the given value to the counter. It panics if the value is <
+	// 0.
+	Add(float64)
+	// Close stops the background goroutine. The gauge keeps its last
+	// value. It is safe to call Close more than once.
+	Close()
+}
+
+// ThroughputCounterOpts bundles the options for creating a ThroughputCounter.
+// The Name in the embedded CounterOpts is the common prefix of both collected
+// metrics.
+type ThroughputCounterOpts struct {
+	CounterOpts
+
+	// RateInterval is the interval at which the rate gauge is updated. If
+	// 0, DefThroughputRateInterval is used.
+	RateInterval time.Duration
+}
+
+// NewThroughputCounter creates a new ThroughputCounter based on the provided
+// ThroughputCounterOpts and starts its background goroutine. Call Close if the
+// ThroughputCounter is not needed anymore. NewThroughputCounter panics if
+// RateInterval is negative.
+func NewThroughputCounter(opts ThroughputCounterOpts) ThroughputCounter {
+	if opts.RateInterval < 0 {
+		panic(fmt.Errorf("throughput counter %s has a negative RateInterval", opts.Name))
+	}
+	if opts.RateInterval == 0 {
+		opts.RateInterval = DefThroughputRateInterval
+	}
+	counter := NewCounter(CounterOpts{
+		Namespace:         opts.Namespace,
+		Subsystem:         opts.Subsystem,
+		Name:              opts.Name + "_total",
+		Help:              opts.Help,
+		ConstLabels:       opts.ConstLabels,
+		DeprecatedVersion: opts.DeprecatedVersion,
+	})
+	perSecond := NewGauge(GaugeOpts{
+		Namespace:         opts.Namespace,
+		Subsystem:         opts.Subsystem,
+		Name:              opts.Name + "_per_second",
+		Help:              "Per-second rate of " + counter.Desc().fqName + " over the last " + opts.RateInterval.String() + ".",
+		ConstLabels:       opts.ConstLabels,
+		DeprecatedVersion: opts.DeprecatedVersion,
+	})
+	result := &throughputCounter{
+		counter:   counter,
+		perSecond: perSecond,
+		interval:  opts.RateInterval,
+		done:      make(chan struct{}),
+	}
+	result.MustInit(counter, perSecond)
+	go result.run()
+	return result
+}
+
+type throughputCounter struct {
+	SelfCollector
+
+	counter   Counter
+	perSecond Gauge
+	interval  time.Duration
+	done      chan struct{}
+	closeOnce sync.Once
+
+	previous float64 // Only accessed by update.
+}
+
+func (c *throughputCounter) Inc()          { c.counter.Inc() }
+func (c *throughputCounter) Add(v float64) { c.counter.Add(v) }
+
+func (c *throughputCounter) run() {
+	ticker := time.NewTicker(c.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			c.update()
+		case <-c.done:
+			return
+		}
+	}
+}
+
+// update sets the rate gauge to the increase of the counter since the previous
+// update divided by the interval.
+func (c *throughputCounter) update() {
+	m := &dto.Metric{}
+	c.counter.Write(m)
+	current := m.GetCounter().GetValue()
+	c.perSecond.Set((current - c.previous) / c.interval.Seconds())
+	c.previous = current
+}
+
+// Close implements ThroughputCounter.
+func (c *throughputCounter) Close() {
+	c.closeOnce.Do(func() { close(c.done) })
+}
+
+// Uint64Counter is a Counter that is backed by a uint64 rather than a
+// float64. A float64 stops representing every integer exactly above 2^53, which
+// is a problem for counters of bytes, packets, or items that grow very
+// large. A Uint64Counter keeps the exact count. Note that the value is still
+// exposed to Prometheus as a float64 sample; the exact value is available via
+// the Value method.
+//
+// To create Uint64Counter instances, use NewUint64Counter.
+type Uint64Counter interface {
+	Metric
+	Collector
+
+	// Inc increments the counter by 1.
+	Inc()
+	// Add adds the given value to the counter.
+	Add(uint64)
+	// Value returns the current count.
+	Value() uint64
+}
+
+// NewUint64Counter creates a new Uint64Counter based on the provided
+// CounterOpts.
+func NewUint64Counter(opts CounterOpts) Uint64Counter {
+	desc := NewDesc(
+		BuildFQName(opts.Namespace, opts.Subsystem, opts.Name),
+		opts.Help,
+		nil,
+		opts.ConstLabels,
+	)
+	desc.deprecatedVersion = opts.DeprecatedVersion
+	return newUint64Counter(desc)
+}
+
+// uint64Counter implements Uint64Counter.
+type uint64Counter struct {
+	// val has to go first in the struct to guarantee alignment for atomic
+	// operations.  http://golang.org/pkg/sync/atomic/#pkg-note-BUG
+	val uint64
+
+	SelfCollector
+
+	desc       *Desc
+	labelPairs []*dto.LabelPair
+}
+
+func newUint64Counter(desc *Desc, labelValues ...string) *uint64Counter {
+	if len(labelValues) != len(desc.variableLabels) {
+		panic(errInconsistentCardinality)
+	}
+	result := &uint64Counter{
+		desc:       desc,
+		labelPairs: makeLabelPairs(desc, labelValues),
+	}
+	result.Init(result) // Init self-collection.
+	return result
+}
+
+func (c *uint64Counter) Desc() *Desc {
+	return c.desc
+}
+
+func (c *uint64Counter) Inc() {
+	atomic.AddUint64(&c.val, 1)
+}
+
+func (c *uint64Counter) Add(v uint64) {
+	atomic.AddUint64(&c.val, v)
+}
+
+func (c *uint64Counter) Value() uint64 {
+	return atomic.LoadUint64(&c.val)
+}
+
+func (c *uint64Counter) Write(out *dto.Metric) error {
+	return populateMetric(CounterValue, float64(c.Value()), c.labelPairs, out)
+}
+
+// Uint64CounterVec is a Collector that bundles a set of Uint64Counters that
+// all share the same Desc, but have different values for their variable
+// labels. Create instances with NewUint64CounterVec.
+//
+// Uint64CounterVec embeds MetricVec. See there for a full list of methods
+// with detailed documentation.
+type Uint64CounterVec struct {
+	MetricVec
+	// invalid is returned by WithLabelValues and With for dropped label
+	// values (see Opts.LabelAllowlist).
+	invalid Uint64Counter
+}
+
+// NewUint64CounterVec creates a new Uint64CounterVec based on the provided
+// CounterOpts and partitioned by the given label names. At least one label name
+// must be provided.
+func NewUint64CounterVec(opts CounterOpts, labelNames []string) *Uint64CounterVec {
+	desc := NewDesc(
+		BuildFQName(opts.Namespace, opts.Subsystem, opts.Name),
+		opts.Help,
+		labelNames,
+		opts.ConstLabels,
+	)
+	desc.deprecatedVersion = opts.DeprecatedVersion
+	m := &Uint64CounterVec{
+		MetricVec: MetricVec{
+			children: map[uint64]Metric{},
+			desc:     desc,
+			hash:     fnv.New64a(),
+			newMetric: func(lvs ...string) Metric {
+				if opts.TrackLastObserved {
+					return &trackedUint64Counter{
+						observedAt:    newObservedAt(),
+						Uint64Counter: newUint64Counter(desc, lvs...),
+					}
+				}
+				return newUint64Counter(desc, lvs...)
+			},
+			allowlist: newLabelAllowlist(desc, opts.LabelAllowlist, opts.FallbackBehavior, opts.FallbackValue),
+			lockFree:  opts.LockFreeHotPath,
+		},
+	}
+	if m.allowlist != nil && m.allowlist.drop {
+		m.invalid = newUint64Counter(desc, make([]string, len(labelNames))...)
+	}
+	return m
+}
+
+// trackedUint64Counter is a Uint64Counter that records the time of its last
+// update.
+type trackedUint64Counter struct {
+	observedAt
+	Uint64Counter
+}
+
+func (c *trackedUint64Counter) Inc()         { c.touch(); c.Uint64Counter.Inc() }
+func (c *trackedUint64Counter) Add(v uint64) { c.touch(); c.Uint64Counter.Add(v) }
+
+// GetMetricWithLabelValues replaces the method of the same name in
+// MetricVec. The difference is that this method returns a Uint64Counter and
+// not a Metric so that no type conversion is required.
+func (m *Uint64CounterVec) GetMetricWithLabelValues(lvs ...string) (Uint64Counter, error) {
+	metric, err := m.MetricVec.GetMetricWithLabelValues(lvs...)
+	if metric != nil {
+		return metric.(Uint64Counter), err
+	}
+	return nil, err
+}
+
+// GetMetricWith replaces the method of the same name in MetricVec. The
+// difference is that this method returns a Uint64Counter and not a Metric so
+// that no type conversion is required.
+func (m *Uint64CounterVec) GetMetricWith(labels Labels) (Uint64Counter, error) {
+	metric, err := m.MetricVec.GetMetricWith(labels)
+	if metric != nil {
+		return metric.(Uint64Counter), err
+	}
+	return nil, err
+}
+
+// WithLabelValues works as GetMetricWithLabelValues, but panics where
+// GetMetricWithLabelValues would have returned an error. By not returning an
+// error, WithLabelValues allows shortcuts like
+//     myVec.WithLabelValues("eth0", "rx").Add(1500)
+// Label values that are dropped because they are not in the LabelAllowlist do
+// not cause a panic but result in a Uint64Counter that is never exposed.
+func (m *Uint64CounterVec) WithLabelValues(lvs ...string) Uint64Counter {
+	metric, err := m.GetMetricWithLabelValues(lvs...)
+	if err == errLabelValueNotAllowed {
+		return m.invalid
+	}
+	if err != nil {
+		panic(err)
+	}
+	return metric
+}
+
+// With works as GetMetricWith, but panics where GetMetricWithLabels would have
+// returned an error. By not returning an error, With allows shortcuts like
+//     myVec.With(Labels{"device": "eth0", "direction": "rx"}).Add(1500)
+// Dropped label values are handled as in WithLabelValues.
+func (m *Uint64CounterVec) With(labels Labels) Uint64Counter {
+	metric, err := m.GetMetricWith(labels)
+	if err == errLabelValueNotAllowed {
+		return m.invalid
+	}
+	if err != nil {
+		panic(err)
+	}
+	return metric
+}
+
+// RollupCounterVec is a CounterVec that additionally maintains aggregations of
+// its Counters over some of their labels, e.g. requests_total by region and
+// endpoint in addition to requests_total by region, zone, host, and endpoint.
+// Each update of a Counter of the RollupCounterVec is also applied to the
+// Counters of the aggregation levels it contributes to. This keeps queries of
+// the aggregates cheap, while the full detail remains available. Create
+// instances with NewRollupCounterVec.
+//
+// Each aggregation level is collected as a separate metric family, named after
+// the RollupCounterVec with the suffix "_by_" followed by the label names of
+// the level joined by "_", e.g. requests_total_by_region_endpoint. Deleting a
+// Counter from the RollupCounterVec does not change the aggregates.
+type RollupCounterVec struct {
+	*CounterVec
+	levels []*CounterVec
+}
+
+// NewRollupCounterVec creates a new RollupCounterVec based on the provided
+// CounterOpts. The first element of labelHierarchy are the label names of the
+// RollupCounterVec itself, and each further element are the label names of an
+// aggregation level, which must be a non-empty subset of the former. Any
+// LabelAllowlist applies to the RollupCounterVec itself only. The function
+// panics if labelHierarchy is empty or a level is invalid.
+func NewRollupCounterVec(opts CounterOpts, labelHierarchy [][]string) *RollupCounterVec {
+	if len(labelHierarchy) == 0 {
+		panic(errors.New("NewRollupCounterVec needs at least one label group"))
+	}
+	labelNames := labelHierarchy[0]
+	v := NewCounterVec(opts, labelNames)
+	r := &RollupCounterVec{CounterVec: v}
+
+	levelOpts := opts
+	levelOpts.LabelAllowlist = nil
+	indexes := make([][]int, 0, len(labelHierarchy)-1)
+	for _, level := range labelHierarchy[1:] {
+		if len(level) == 0 {
+			panic(fmt.Errorf("empty aggregation level for %s", v.desc))
+		}
+		levelIndexes := make([]int, len(level))
+		for i, name := range level {
+			levelIndexes[i] = labelIndex(v.desc, name)
+		}
+		levelOpts.Name = opts.Name + "_by_" + strings.Join(level, "_")
+		levelOpts.Help = opts.Help + " Aggregated by " + strings.Join(level, ", ") + "."
+		r.levels = append(r.levels, NewCounterVec(levelOpts, level))
+		indexes = append(indexes, levelIndexes)
+	}
+
+	newMetric := v.newMetric
+	v.newMetric = func(lvs ...string) Metric {
+		c := &rollupCounter{
+			Counter: newMetric(lvs...).(Counter),
+			parents: make([]Counter, len(r.levels)),
+		}
+		for i, level := range r.levels {
+			levelLVs := make([]string, len(indexes[i]))
+			for j, idx := range indexes[i] {
+				levelLVs[j] = lvs[idx]
+			}
+			c.parents[i] = level.WithLabelValues(levelLVs...)
+		}
+		return c
+	}
+	return r
+}
+
+// Describe implements Collector. It describes all aggregation levels, too.
+func (r *RollupCounterVec) Describe(ch chan<- *Desc) {
+	r.CounterVec.Describe(ch)
+	for _, level := range r.levels {
+		level.Describe(ch)
+	}
+}
+
+// Collect implements Collector. It collects all aggregation levels, too.
+func (r *RollupCounterVec) Collect(ch chan<- Metric) {
+	r.CounterVec.Collect(ch)
+	for _, level := range r.levels {
+		level.Collect(ch)
+	}
+}
+
+// rollupCounter is a Counter of a RollupCounterVec that applies each update to
+// the Counters of the aggregation levels, too.
+type rollupCounter struct {
+	Counter
+	parents []Counter
+
+	setMtx sync.Mutex // Serializes Set.
+}
+
+func (c *rollupCounter) Inc() {
+	c.Counter.Inc()
+	for _, p := range c.parents {
+		p.Inc()
+	}
+}
+
+func (c *rollupCounter) Add(v float64) {
+	c.Counter.Add(v)
+	for _, p := range c.parents {
+		p.Add(v)
+	}
+}
+
+// Set adds the increase over the previous value to the aggregates. A decrease
+// is not applied, as the aggregates would have to go down. Concurrent calls of
+// Inc or Add might be attributed to the increase, too, so do not mix Set with
+// other updates.
+func (c *rollupCounter) Set(v float64) {
+	c.setMtx.Lock()
+	defer c.setMtx.Unlock()
+
+	m := &dto.Metric{}
+	c.Counter.Write(m)
+	delta := v - m.GetCounter().GetValue()
+	c.Counter.Set(v)
+	if delta <= 0 {
+		return
+	}
+	for _, p := range c.parents {
+		p.Add(delta)
+	}
 }
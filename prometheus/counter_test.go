@@ -14,10 +14,17 @@
 package prometheus
 
 import (
+	"bytes"
+	"log"
 	"math"
+	"os"
+	"strings"
 	"testing"
+	"time"
 
 	dto "github.com/prometheus/client_model/go"
+
+	"github.com/prometheus/client_golang/text"
 )
 
 func TestCounterAdd(t *testing.T) {
@@ -47,6 +54,17 @@ func TestCounterAdd(t *testing.T) {
 	}
 }
 
+func TestCounterWithInitialValue(t *testing.T) {
+	counter := NewCounterWithInitialValue(CounterOpts{
+		Name: "test",
+		Help: "test help",
+	}, 1000).(*counter)
+	counter.Add(42)
+	if expected, got := 1042., math.Float64frombits(counter.valBits); expected != got {
+		t.Errorf("Expected %f, got %f.", expected, got)
+	}
+}
+
 func decreaseCounter(c *counter) (err error) {
 	defer func() {
 		if e := recover(); e != nil {
@@ -56,3 +74,343 @@ func decreaseCounter(c *counter) (err error) {
 	c.Add(-1)
 	return nil
 }
+
+func TestUint64Counter(t *testing.T) {
+	vec := NewUint64CounterVec(CounterOpts{
+		Name: "test",
+		Help: "test help",
+	}, []string{"device"})
+	counter := vec.WithLabelValues("eth0")
+
+	// 2^53 + 1 cannot be represented exactly as a float64.
+	counter.Add(1 << 53)
+	counter.Inc()
+	if expected, got := uint64(1<<53+1), counter.Value(); expected != got {
+		t.Errorf("Expected %d, got %d.", expected, got)
+	}
+
+	m := &dto.Metric{}
+	vec.WithLabelValues("eth1").Add(42)
+	vec.WithLabelValues("eth1").Write(m)
+
+	if expected, got := `label:<name:"device" value:"eth1" > counter:<value:42 > `, m.String(); expected != got {
+		t.Errorf("expected %q, got %q", expected, got)
+	}
+}
+
+func TestRollingCounter(t *testing.T) {
+	rc := NewRollingCounter(CounterOpts{
+		Name: "test",
+		Help: "test help",
+	})
+
+	collect := func() float64 {
+		m := &dto.Metric{}
+		rc.Write(m)
+		return m.GetGauge().GetValue()
+	}
+
+	rc.Set(1000) // Baseline.
+	rc.Set(1010)
+	if expected, got := 10., collect(); expected != got {
+		t.Errorf("Expected %f, got %f.", expected, got)
+	}
+	if expected, got := 0., collect(); expected != got {
+		t.Errorf("Expected %f, got %f.", expected, got)
+	}
+	rc.Set(1030)
+	rc.Set(5) // Source counter reset.
+	if expected, got := 25., collect(); expected != got {
+		t.Errorf("Expected %f, got %f.", expected, got)
+	}
+
+	rc.Set(100)
+	collect()
+	rc.Set(5) // Source counter reset.
+	rc.Set(10)
+	if expected, got := 10., collect(); expected != got {
+		t.Errorf("Expected %f, got %f.", expected, got)
+	}
+}
+
+func TestEventCounter(t *testing.T) {
+	ec := NewEventCounter(EventCounterOpts{
+		CounterOpts: CounterOpts{
+			Name: "webhook_deliveries",
+			Help: "test help",
+		},
+		InterArrivalBuckets: []float64{1, 10},
+	})
+	now := time.Unix(1000, 0)
+	ec.(*eventCounter).now = func() time.Time { return now }
+
+	ec.Record()
+	now = now.Add(5 * time.Second)
+	ec.Record()
+	now = now.Add(500 * time.Millisecond)
+	ec.Record()
+
+	ch := make(chan Metric, 2)
+	ec.Collect(ch)
+	close(ch)
+	m := &dto.Metric{}
+	(<-ch).Write(m)
+	if expected, got := 3., m.GetCounter().GetValue(); expected != got {
+		t.Errorf("expected %f, got %f", expected, got)
+	}
+	hm := <-ch
+	if expected, got := "webhook_deliveries_inter_arrival_seconds", hm.Desc().fqName; expected != got {
+		t.Errorf("expected %q, got %q", expected, got)
+	}
+	m.Reset()
+	hm.Write(m)
+	if expected, got := uint64(2), m.GetHistogram().GetSampleCount(); expected != got {
+		t.Errorf("expected %d, got %d", expected, got)
+	}
+	if expected, got := 5.5, m.GetHistogram().GetSampleSum(); expected != got {
+		t.Errorf("expected %f, got %f", expected, got)
+	}
+	if expected, got := uint64(1), m.GetHistogram().GetBucket()[0].GetCumulativeCount(); expected != got {
+		t.Errorf("expected %d, got %d", expected, got)
+	}
+
+	if _, err := newRegistry().Register(ec); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestThroughputCounter(t *testing.T) {
+	tc := NewThroughputCounter(ThroughputCounterOpts{
+		CounterOpts: CounterOpts{
+			Name: "bytes_sent",
+			Help: "test help",
+		},
+		RateInterval: time.Hour, // Long enough not to tick during the test.
+	})
+	defer tc.Close()
+
+	tc.Add(7200)
+	tc.(*throughputCounter).update()
+	tc.Inc()
+	tc.Add(3599)
+	tc.(*throughputCounter).update()
+
+	ch := make(chan Metric, 2)
+	tc.Collect(ch)
+	close(ch)
+	m := &dto.Metric{}
+	cm := <-ch
+	if expected, got := "bytes_sent_total", cm.Desc().fqName; expected != got {
+		t.Errorf("expected %q, got %q", expected, got)
+	}
+	cm.Write(m)
+	if expected, got := 10800., m.GetCounter().GetValue(); expected != got {
+		t.Errorf("expected %f, got %f", expected, got)
+	}
+	gm := <-ch
+	if expected, got := "bytes_sent_per_second", gm.Desc().fqName; expected != got {
+		t.Errorf("expected %q, got %q", expected, got)
+	}
+	m.Reset()
+	gm.Write(m)
+	if expected, got := 1., m.GetGauge().GetValue(); expected != got {
+		t.Errorf("expected %f, got %f", expected, got)
+	}
+
+	registry := newRegistry()
+	if _, err := registry.Register(tc); err != nil {
+		t.Error(err)
+	}
+	if !registry.Unregister(tc) {
+		t.Error("expected throughput counter to be unregistered")
+	}
+}
+
+func TestCounterVecWithValidCombinations(t *testing.T) {
+	vec, err := NewCounterVecWithValidCombinations(
+		CounterOpts{Name: "test", Help: "helpless"},
+		[]Labels{
+			{"code": "200", "method": "GET"},
+			{"code": "404", "method": "GET"},
+		},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	vec.WithLabelValues("200", "GET").Inc()
+	vec.With(Labels{"code": "404", "method": "GET"}).Inc()
+	vec.WithLabelValues("500", "POST").Inc() // Must not panic.
+	vec.With(Labels{"code": "200", "method": "POST"}).Inc()
+
+	if _, err := vec.GetMetricWithLabelValues("500", "POST"); err != errInvalidLabelCombination {
+		t.Errorf("expected %v, got %v", errInvalidLabelCombination, err)
+	}
+	if _, err := vec.GetMetricWith(Labels{"code": "200", "method": "POST"}); err != errInvalidLabelCombination {
+		t.Errorf("expected %v, got %v", errInvalidLabelCombination, err)
+	}
+	if expected, got := 2, len(vec.children); expected != got {
+		t.Errorf("expected %d children, got %d", expected, got)
+	}
+
+	if _, err := NewCounterVecWithValidCombinations(CounterOpts{Name: "test", Help: "helpless"}, nil); err == nil {
+		t.Error("expected error for missing combinations")
+	}
+	if _, err := NewCounterVecWithValidCombinations(
+		CounterOpts{Name: "test", Help: "helpless"},
+		[]Labels{{"code": "200"}, {"method": "GET"}},
+	); err == nil {
+		t.Error("expected error for inconsistent label names")
+	}
+}
+
+func TestCounterFuncReset(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+
+	values := []float64{1, 5, 5, 2}
+	cf := NewCounterFunc(CounterOpts{Name: "test", Help: "helpless"}, func() float64 {
+		v := values[0]
+		values = values[1:]
+		return v
+	})
+	m := &dto.Metric{}
+	for i := 0; i < 3; i++ {
+		cf.Write(m)
+	}
+	if buf.Len() != 0 {
+		t.Errorf("unexpected log output %q", buf.String())
+	}
+	cf.Write(m)
+	if expected, got := 2., m.GetCounter().GetValue(); expected != got {
+		t.Errorf("expected %f, got %f", expected, got)
+	}
+	if !strings.Contains(buf.String(), "counter test decreased from 5 to 2") {
+		t.Errorf("expected reset warning, got %q", buf.String())
+	}
+}
+
+func TestCounterVecAddN(t *testing.T) {
+	vec := NewCounterVec(CounterOpts{
+		Name: "test",
+		Help: "test help",
+	}, []string{"a"})
+	vec.AddN(3, "x")
+	vec.AddN(4, "x")
+	m := &dto.Metric{}
+	vec.WithLabelValues("x").Write(m)
+	if expected, got := 7., m.GetCounter().GetValue(); expected != got {
+		t.Errorf("expected %f, got %f", expected, got)
+	}
+}
+
+func TestCounterVecAddIf(t *testing.T) {
+	vec := NewCounterVec(CounterOpts{
+		Name: "test",
+		Help: "test help",
+	}, []string{"a"})
+	if !vec.AddIf(true, 3, "x") || !vec.IncIf(true, "x") {
+		t.Error("expected true for true condition")
+	}
+	if vec.AddIf(false, 3, "x") || vec.IncIf(false, "y") {
+		t.Error("expected false for false condition")
+	}
+	m := &dto.Metric{}
+	vec.WithLabelValues("x").Write(m)
+	if expected, got := 4., m.GetCounter().GetValue(); expected != got {
+		t.Errorf("expected %f, got %f", expected, got)
+	}
+	if expected, got := 1, len(vec.children); expected != got {
+		t.Errorf("expected %d counters, got %d", expected, got)
+	}
+}
+
+func TestCounterVecRate(t *testing.T) {
+	vec := NewCounterVec(CounterOpts{
+		Name:        "test",
+		Help:        "test help",
+		TrackRate:   true,
+		RateSamples: 5,
+	}, []string{"a"})
+	now := time.Unix(1000, 0)
+	vec.now = func() time.Time { return now }
+
+	if got := vec.Rate(time.Minute, "1"); !math.IsNaN(got) {
+		t.Errorf("expected NaN for missing counter, got %f", got)
+	}
+	c := vec.WithLabelValues("1")
+	c.Add(10)
+	if got := vec.Rate(time.Minute, "1"); !math.IsNaN(got) {
+		t.Errorf("expected NaN for a single sample, got %f", got)
+	}
+
+	// 6 more updates, 10s apart, adding 20 each. Only the last 5 are kept.
+	for i := 0; i < 6; i++ {
+		now = now.Add(10 * time.Second)
+		c.Add(20)
+	}
+	if expected, got := 2., vec.Rate(time.Minute, "1"); expected != got {
+		t.Errorf("expected rate %f, got %f", expected, got)
+	}
+	// Only the last two updates are in a window of 15s.
+	if expected, got := 2., vec.Rate(15*time.Second, "1"); expected != got {
+		t.Errorf("expected rate %f, got %f", expected, got)
+	}
+	c.Inc()
+	now = now.Add(5 * time.Second)
+	c.Add(14)
+	if expected, got := 3., vec.Rate(10*time.Second, "1"); expected != got {
+		t.Errorf("expected rate %f, got %f", expected, got)
+	}
+	now = now.Add(time.Hour)
+	if got := vec.Rate(time.Minute, "1"); !math.IsNaN(got) {
+		t.Errorf("expected NaN for no samples in window, got %f", got)
+	}
+
+	untracked := NewCounterVec(CounterOpts{Name: "test", Help: "test help"}, []string{"a"})
+	untracked.WithLabelValues("1").Inc()
+	if got := untracked.Rate(time.Minute, "1"); !math.IsNaN(got) {
+		t.Errorf("expected NaN without rate tracking, got %f", got)
+	}
+}
+
+func TestRollupCounterVec(t *testing.T) {
+	vec := NewRollupCounterVec(
+		CounterOpts{Name: "requests_total", Help: "Total requests."},
+		[][]string{{"region", "zone", "endpoint"}, {"region", "endpoint"}, {"endpoint"}},
+	)
+	vec.WithLabelValues("eu", "eu-1", "/a").Inc()
+	vec.WithLabelValues("eu", "eu-2", "/a").Add(2)
+	vec.With(Labels{"region": "us", "zone": "us-1", "endpoint": "/a"}).Add(4)
+	vec.WithLabelValues("us", "us-1", "/b").Set(8)
+	vec.WithLabelValues("us", "us-1", "/b").Set(5)
+
+	registry := newRegistry()
+	if _, err := registry.Register(vec); err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if _, err := registry.writePB(&buf, text.MetricFamilyToText, nil); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		`requests_total{endpoint="/a",region="eu",zone="eu-2"} 2`,
+		`requests_total{endpoint="/b",region="us",zone="us-1"} 5`,
+		"# HELP requests_total_by_region_endpoint Total requests. Aggregated by region, endpoint.",
+		`requests_total_by_region_endpoint{endpoint="/a",region="eu"} 3`,
+		`requests_total_by_region_endpoint{endpoint="/b",region="us"} 8`,
+		`requests_total_by_endpoint{endpoint="/a"} 7`,
+	} {
+		if !strings.Contains(buf.String(), want+"\n") {
+			t.Errorf("missing %q in:\n%s", want, buf.String())
+		}
+	}
+
+	defer func() {
+		if r := recover(); r == nil {
+			t.Error("expected panic for unknown label")
+		}
+	}()
+	NewRollupCounterVec(CounterOpts{Name: "c", Help: "help"}, [][]string{{"a"}, {"b"}})
+}
@@ -64,6 +64,9 @@ type Desc struct {
 	// Help string. Each Desc with the same fqName must have the same
 	// dimHash.
 	dimHash uint64
+	// deprecatedVersion is the version since which the described metric
+	// is deprecated. Empty if the metric is not deprecated.
+	deprecatedVersion string
 	// err is an error that occured during construction. It is reported on
 	// registration time.
 	err error
@@ -175,6 +178,15 @@ func NewInvalidDesc(err error) *Desc {
 	}
 }
 
+// DeprecatedVersion returns the version since which the metric described by
+// the Desc is deprecated, or an empty string if it is not deprecated. The
+// metric implementations in this package take the value from the
+// DeprecatedVersion field of their Opts. For other Collectors, use
+// DeprecatedCollector.
+func (d *Desc) DeprecatedVersion() string {
+	return d.deprecatedVersion
+}
+
 func (d *Desc) String() string {
 	lpStrings := make([]string, 0, len(d.constLabelPairs))
 	for _, lp := range d.constLabelPairs {
@@ -342,8 +342,9 @@ func ExampleRegister() {
 
 func ExampleSummary() {
 	temps := prometheus.NewSummary(prometheus.SummaryOpts{
-		Name: "pond_temperature_celsius",
-		Help: "The temperature of the frog pond.", // Sorry, we can't measure how badly it smells.
+		Name:       "pond_temperature_celsius",
+		Help:       "The temperature of the frog pond.", // Sorry, we can't measure how badly it smells.
+		Objectives: map[float64]float64{0.5: 0.05, 0.9: 0.01, 0.99: 0.001},
 	})
 
 	// Simulate some observations.
@@ -380,8 +381,9 @@ func ExampleSummary() {
 func ExampleSummaryVec() {
 	temps := prometheus.NewSummaryVec(
 		prometheus.SummaryOpts{
-			Name: "pond_temperature_celsius",
-			Help: "The temperature of the frog pond.", // Sorry, we can't measure how badly it smells.
+			Name:       "pond_temperature_celsius",
+			Help:       "The temperature of the frog pond.", // Sorry, we can't measure how badly it smells.
+			Objectives: map[float64]float64{0.5: 0.05, 0.9: 0.01, 0.99: 0.001},
 		},
 		[]string{"species"},
 	)
@@ -574,6 +576,29 @@ func ExampleHistogram() {
 	// >
 }
 
+func ExampleTimer() {
+	requestDuration := prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "example_request_duration_seconds",
+		Help:    "Histogram for the runtime of a simple example function.",
+		Buckets: prometheus.LinearBuckets(0.01, 0.01, 10),
+	})
+
+	func() {
+		// The duration of the function is observed when it returns.
+		defer prometheus.NewTimer(requestDuration).ObserveDuration()
+
+		// Do something here that takes time.
+		time.Sleep(10 * time.Millisecond)
+	}()
+
+	metric := &dto.Metric{}
+	requestDuration.Write(metric)
+	fmt.Println(metric.GetHistogram().GetSampleCount())
+
+	// Output:
+	// 1
+}
+
 func ExampleConstHistogram() {
 	desc := prometheus.NewDesc(
 		"http_request_duration_seconds",
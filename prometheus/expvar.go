@@ -16,6 +16,8 @@ package prometheus
 import (
 	"encoding/json"
 	"expvar"
+	"log"
+	"sync"
 )
 
 // ExpvarCollector collects metrics from the expvar interface. It provides a
@@ -29,6 +31,9 @@ import (
 // Use NewExpvarCollector to create new instances.
 type ExpvarCollector struct {
 	exports map[string]*Desc
+
+	mtx     sync.Mutex // Protects skipped.
+	skipped map[string]bool
 }
 
 // NewExpvarCollector returns a newly allocated ExpvarCollector that still has
@@ -58,11 +63,27 @@ type ExpvarCollector struct {
 // leaves of that structure must be numbers or bools as above to serve as the
 // sample values.
 //
-// Anything that does not fit into the scheme above is silently ignored.
+// Anything that does not fit into the scheme above is skipped, as are expvar
+// keys that do not exist (yet) and expvar values that are not valid JSON, so
+// that the collection never fails. Each skipped expvar key is logged with the
+// standard logger the first time it is skipped.
 func NewExpvarCollector(exports map[string]*Desc) *ExpvarCollector {
 	return &ExpvarCollector{
 		exports: exports,
+		skipped: map[string]bool{},
+	}
+}
+
+// skip logs that the expvar with the given name is skipped for the given
+// reason unless it has been logged before.
+func (e *ExpvarCollector) skip(name, reason string) {
+	e.mtx.Lock()
+	defer e.mtx.Unlock()
+	if e.skipped[name] {
+		return
 	}
+	e.skipped[name] = true
+	log.Printf("skipping expvar %q: %s, further occurrences are not logged", name, reason)
 }
 
 // Describe implements Collector.
@@ -78,12 +99,13 @@ func (e *ExpvarCollector) Collect(ch chan<- Metric) {
 		var m Metric
 		expVar := expvar.Get(name)
 		if expVar == nil {
+			e.skip(name, "no such expvar")
 			continue
 		}
 		var v interface{}
 		labels := make([]string, len(desc.variableLabels))
 		if err := json.Unmarshal([]byte(expVar.String()), &v); err != nil {
-			ch <- NewInvalidMetric(desc, err)
+			e.skip(name, err.Error())
 			continue
 		}
 		var processValue func(v interface{}, i int)
@@ -100,6 +122,7 @@ func (e *ExpvarCollector) Collect(ch chan<- Metric) {
 						m = MustNewConstMetric(desc, UntypedValue, 0, copiedLabels...)
 					}
 				default:
+					e.skip(name, "value is neither a number nor a bool")
 					return
 				}
 				ch <- m
@@ -107,6 +130,7 @@ func (e *ExpvarCollector) Collect(ch chan<- Metric) {
 			}
 			vm, ok := v.(map[string]interface{})
 			if !ok {
+				e.skip(name, "value is not a map as required by the labels")
 				return
 			}
 			for lv, val := range vm {
@@ -14,10 +14,14 @@
 package prometheus_test
 
 import (
+	"bytes"
 	"expvar"
 	"fmt"
+	"log"
+	"os"
 	"sort"
 	"strings"
+	"testing"
 
 	dto "github.com/prometheus/client_model/go"
 
@@ -95,3 +99,42 @@ func ExampleExpvarCollector() {
 	// label:<name:"code" value:"404" > label:<name:"method" value:"POST" > untyped:<value:3 >
 	// untyped:<value:42 >
 }
+
+func TestExpvarCollectorSkips(t *testing.T) {
+	var logged bytes.Buffer
+	log.SetOutput(&logged)
+	defer log.SetOutput(os.Stderr)
+
+	expvar.NewString("test-expvar-string").Set("not a number")
+	expvar.NewInt("test-expvar-int").Set(7)
+	c := prometheus.NewExpvarCollector(map[string]*prometheus.Desc{
+		"test-expvar-missing": prometheus.NewDesc("expvar_missing", "help", nil, nil),
+		"test-expvar-string":  prometheus.NewDesc("expvar_string", "help", nil, nil),
+		"test-expvar-int":     prometheus.NewDesc("expvar_int", "help", nil, nil),
+		"test-expvar-invalid": prometheus.NewDesc("expvar_invalid", "help", nil, nil),
+	})
+	expvar.Publish("test-expvar-invalid", expvar.Func(func() interface{} { return func() {} }))
+
+	for i := 0; i < 2; i++ {
+		ch := make(chan prometheus.Metric, 10)
+		c.Collect(ch)
+		close(ch)
+		var got []string
+		for m := range ch {
+			pb := &dto.Metric{}
+			if err := m.Write(pb); err != nil {
+				t.Fatal(err)
+			}
+			got = append(got, fmt.Sprint(m.Desc(), pb.GetUntyped().GetValue()))
+		}
+		if len(got) != 1 || !strings.Contains(got[0], "expvar_int") || !strings.HasSuffix(got[0], " 7") {
+			t.Errorf("%d. got metrics %v, want only expvar_int with value 7", i, got)
+		}
+	}
+
+	for _, name := range []string{"test-expvar-missing", "test-expvar-string", "test-expvar-invalid"} {
+		if got, want := strings.Count(logged.String(), `"`+name+`"`), 1; got != want {
+			t.Errorf("got %d log lines for %s, want %d:\n%s", got, name, want, logged.String())
+		}
+	}
+}
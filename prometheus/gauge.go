@@ -13,7 +13,22 @@
 
 package prometheus
 
-import "hash/fnv"
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/model"
+	dto "github.com/prometheus/client_model/go"
+)
 
 // Gauge is a Metric that represents a single numerical value that can
 // arbitrarily go up and down.
@@ -39,6 +54,14 @@ type Gauge interface {
 	// Sub subtracts the given value from the Gauge. (The value can be
 	// negative, resulting in an increase of the Gauge.)
 	Sub(float64)
+	// SetIfHigher sets the Gauge to the given value if it is greater than
+	// the current value. It returns whether the Gauge was updated. The
+	// comparison and the update happen atomically, so SetIfHigher can be
+	// used to track a high-watermark from concurrent goroutines.
+	SetIfHigher(float64) bool
+	// SetIfLower works like SetIfHigher, but sets the Gauge to the given
+	// value if it is less than the current value.
+	SetIfLower(float64) bool
 }
 
 // GaugeOpts is an alias for Opts. See there for doc comments.
@@ -46,12 +69,233 @@ type GaugeOpts Opts
 
 // NewGauge creates a new Gauge based on the provided GaugeOpts.
 func NewGauge(opts GaugeOpts) Gauge {
-	return newValue(NewDesc(
+	desc := NewDesc(
+		BuildFQName(opts.Namespace, opts.Subsystem, opts.Name),
+		opts.Help,
+		nil,
+		opts.ConstLabels,
+	)
+	desc.deprecatedVersion = opts.DeprecatedVersion
+	return newValue(desc, GaugeValue, 0)
+}
+
+// ThresholdDirection is the direction in which the value of a ThresholdGauge
+// has to cross a threshold to trigger a callback.
+type ThresholdDirection int
+
+// Possible values for ThresholdDirection.
+const (
+	// CrossedAbove triggers if the value changes from at most the
+	// threshold to greater than it.
+	CrossedAbove ThresholdDirection = iota
+	// CrossedBelow triggers if the value changes from at least the
+	// threshold to less than it.
+	CrossedBelow
+)
+
+// ThresholdGauge is a Gauge that calls registered callbacks when its value
+// crosses a threshold. This allows to react to conditions like an overflowing
+// queue in-process without polling the Gauge.
+//
+// To create ThresholdGauge instances, use NewThresholdGauge.
+type ThresholdGauge interface {
+	Gauge
+
+	// OnThresholdCrossing registers fn to be called with the new value
+	// of the Gauge the first time it crosses threshold in the given
+	// direction. fn is called in a new goroutine, so that it does not
+	// block the update of the Gauge. Further crossings do not call fn
+	// again until ResetThresholds is called. Any number of callbacks can
+	// be registered.
+	OnThresholdCrossing(threshold float64, direction ThresholdDirection, fn func(current float64))
+	// ResetThresholds re-arms all registered callbacks, so that each of
+	// them is called again on the next crossing of its threshold.
+	ResetThresholds()
+}
+
+// NewThresholdGauge creates a new ThresholdGauge based on the provided
+// GaugeOpts. Its value is updated with the same atomic operations as the value
+// of a regular Gauge, but each update additionally checks the registered
+// thresholds.
+func NewThresholdGauge(opts GaugeOpts) ThresholdGauge {
+	return &thresholdGauge{value: NewGauge(opts).(*value)}
+}
+
+type thresholdGauge struct {
+	*value
+
+	mtx      sync.RWMutex // Protects triggers.
+	triggers []*thresholdTrigger
+}
+
+type thresholdTrigger struct {
+	// fired is 1 if fn has been called since the trigger was last armed.
+	// It is accessed atomically.
+	fired     int32
+	threshold float64
+	direction ThresholdDirection
+	fn        func(float64)
+}
+
+func (g *thresholdGauge) OnThresholdCrossing(threshold float64, direction ThresholdDirection, fn func(current float64)) {
+	g.mtx.Lock()
+	defer g.mtx.Unlock()
+	g.triggers = append(g.triggers, &thresholdTrigger{
+		threshold: threshold,
+		direction: direction,
+		fn:        fn,
+	})
+}
+
+func (g *thresholdGauge) ResetThresholds() {
+	g.mtx.RLock()
+	defer g.mtx.RUnlock()
+	for _, t := range g.triggers {
+		atomic.StoreInt32(&t.fired, 0)
+	}
+}
+
+func (g *thresholdGauge) Set(val float64) {
+	g.update(func(float64) (float64, bool) { return val, true })
+}
+
+func (g *thresholdGauge) Inc() {
+	g.Add(1)
+}
+
+func (g *thresholdGauge) Dec() {
+	g.Add(-1)
+}
+
+func (g *thresholdGauge) Add(val float64) {
+	g.update(func(old float64) (float64, bool) { return old + val, true })
+}
+
+func (g *thresholdGauge) Sub(val float64) {
+	g.Add(val * -1)
+}
+
+func (g *thresholdGauge) SetIfHigher(val float64) bool {
+	return g.update(func(old float64) (float64, bool) { return val, val > old })
+}
+
+func (g *thresholdGauge) SetIfLower(val float64) bool {
+	return g.update(func(old float64) (float64, bool) { return val, val < old })
+}
+
+// update atomically sets the value to the result of f for the old value,
+// unless f returns false, and then calls the triggers of all crossed
+// thresholds. It returns whether the value was set.
+func (g *thresholdGauge) update(f func(old float64) (float64, bool)) bool {
+	for {
+		oldBits := atomic.LoadUint64(&g.valBits)
+		old := math.Float64frombits(oldBits)
+		val, ok := f(old)
+		if !ok {
+			return false
+		}
+		if atomic.CompareAndSwapUint64(&g.valBits, oldBits, math.Float64bits(val)) {
+			g.checkThresholds(old, val)
+			return true
+		}
+	}
+}
+
+func (g *thresholdGauge) checkThresholds(old, val float64) {
+	g.mtx.RLock()
+	defer g.mtx.RUnlock()
+	for _, t := range g.triggers {
+		var crossed bool
+		switch t.direction {
+		case CrossedAbove:
+			crossed = old <= t.threshold && val > t.threshold
+		case CrossedBelow:
+			crossed = old >= t.threshold && val < t.threshold
+		}
+		if crossed && atomic.CompareAndSwapInt32(&t.fired, 0, 1) {
+			go t.fn(val)
+		}
+	}
+}
+
+// NewSharedGauge creates a new Gauge based on the provided GaugeOpts that keeps
+// its value in the uint64 the provided pointer points to, as the bits of a
+// float64 (see math.Float64bits). The caller may read the value directly with
+// atomic.LoadUint64, which avoids the call through the Gauge interface in hot
+// loops. Any write to the uint64 other than through the Gauge must happen
+// atomically, too. Note that the uint64 must be 64-bit aligned (see the bugs
+// section of the sync/atomic documentation).
+func NewSharedGauge(opts GaugeOpts, bits *uint64) Gauge {
+	desc := NewDesc(
 		BuildFQName(opts.Namespace, opts.Subsystem, opts.Name),
 		opts.Help,
 		nil,
 		opts.ConstLabels,
-	), GaugeValue, 0)
+	)
+	desc.deprecatedVersion = opts.DeprecatedVersion
+	return newSharedGauge(desc, bits)
+}
+
+func newSharedGauge(desc *Desc, bits *uint64, labelValues ...string) *sharedGauge {
+	if len(labelValues) != len(desc.variableLabels) {
+		panic(errInconsistentCardinality)
+	}
+	if bits == nil {
+		panic(fmt.Errorf("shared gauge %q needs a non-nil pointer", desc.fqName))
+	}
+	result := &sharedGauge{
+		bits:       bits,
+		desc:       desc,
+		labelPairs: makeLabelPairs(desc, labelValues),
+	}
+	result.Init(result) // Init self-collection.
+	return result
+}
+
+type sharedGauge struct {
+	bits *uint64
+
+	SelfCollector
+
+	desc       *Desc
+	labelPairs []*dto.LabelPair
+}
+
+func (g *sharedGauge) Desc() *Desc {
+	return g.desc
+}
+
+func (g *sharedGauge) Set(val float64) {
+	atomic.StoreUint64(g.bits, math.Float64bits(val))
+}
+
+func (g *sharedGauge) Inc() {
+	addFloat64Bits(g.bits, 1)
+}
+
+func (g *sharedGauge) Dec() {
+	addFloat64Bits(g.bits, -1)
+}
+
+func (g *sharedGauge) Add(val float64) {
+	addFloat64Bits(g.bits, val)
+}
+
+func (g *sharedGauge) Sub(val float64) {
+	addFloat64Bits(g.bits, -val)
+}
+
+func (g *sharedGauge) SetIfHigher(val float64) bool {
+	return setFloat64BitsIf(g.bits, val, func(val, old float64) bool { return val > old })
+}
+
+func (g *sharedGauge) SetIfLower(val float64) bool {
+	return setFloat64BitsIf(g.bits, val, func(val, old float64) bool { return val < old })
+}
+
+func (g *sharedGauge) Write(out *dto.Metric) error {
+	val := math.Float64frombits(atomic.LoadUint64(g.bits))
+	return populateMetric(GaugeValue, val, g.labelPairs, out)
 }
 
 // GaugeVec is a Collector that bundles a set of Gauges that all share the same
@@ -61,6 +305,9 @@ func NewGauge(opts GaugeOpts) Gauge {
 // type). Create instances with NewGaugeVec.
 type GaugeVec struct {
 	MetricVec
+	// invalid is returned by WithLabelValues and With for dropped label
+	// values (see Opts.LabelAllowlist).
+	invalid Gauge
 }
 
 // NewGaugeVec creates a new GaugeVec based on the provided GaugeOpts and
@@ -73,16 +320,90 @@ func NewGaugeVec(opts GaugeOpts, labelNames []string) *GaugeVec {
 		labelNames,
 		opts.ConstLabels,
 	)
-	return &GaugeVec{
+	desc.deprecatedVersion = opts.DeprecatedVersion
+	m := &GaugeVec{
 		MetricVec: MetricVec{
 			children: map[uint64]Metric{},
 			desc:     desc,
 			hash:     fnv.New64a(),
+			seed:     hashSeed(opts.HashSeed),
 			newMetric: func(lvs ...string) Metric {
+				if opts.TrackLastObserved {
+					return &trackedGauge{
+						observedAt: newObservedAt(),
+						Gauge:      newValue(desc, GaugeValue, 0, lvs...),
+					}
+				}
 				return newValue(desc, GaugeValue, 0, lvs...)
 			},
+			allowlist: newLabelAllowlist(desc, opts.LabelAllowlist, opts.FallbackBehavior, opts.FallbackValue),
+			lockFree:  opts.LockFreeHotPath,
+		},
+	}
+	if m.allowlist != nil && m.allowlist.drop {
+		m.invalid = newValue(desc, GaugeValue, 0, make([]string, len(labelNames))...)
+	}
+	return m
+}
+
+// NewSharedGaugeVec creates a new GaugeVec based on the provided GaugeOpts and
+// partitioned by the given label names. Its Gauges work like those created by
+// NewSharedGauge. Whenever a Gauge for new label values is created, the
+// provided function is called with these label values and returns the pointer
+// to the uint64 the Gauge keeps its value in. The function is called while the
+// GaugeVec is locked, so it must not use the GaugeVec.
+func NewSharedGaugeVec(opts GaugeOpts, labelNames []string, bitsFor func(labelValues ...string) *uint64) *GaugeVec {
+	desc := NewDesc(
+		BuildFQName(opts.Namespace, opts.Subsystem, opts.Name),
+		opts.Help,
+		labelNames,
+		opts.ConstLabels,
+	)
+	desc.deprecatedVersion = opts.DeprecatedVersion
+	m := &GaugeVec{
+		MetricVec: MetricVec{
+			children: map[uint64]Metric{},
+			desc:     desc,
+			hash:     fnv.New64a(),
+			newMetric: func(lvs ...string) Metric {
+				if opts.TrackLastObserved {
+					return &trackedGauge{
+						observedAt: newObservedAt(),
+						Gauge:      newSharedGauge(desc, bitsFor(lvs...), lvs...),
+					}
+				}
+				return newSharedGauge(desc, bitsFor(lvs...), lvs...)
+			},
+			allowlist: newLabelAllowlist(desc, opts.LabelAllowlist, opts.FallbackBehavior, opts.FallbackValue),
+			lockFree:  opts.LockFreeHotPath,
 		},
 	}
+	if m.allowlist != nil && m.allowlist.drop {
+		m.invalid = newValue(desc, GaugeValue, 0, make([]string, len(labelNames))...)
+	}
+	return m
+}
+
+// trackedGauge is a Gauge that records the time of its last update.
+type trackedGauge struct {
+	observedAt
+	Gauge
+}
+
+func (g *trackedGauge) Set(v float64) { g.touch(); g.Gauge.Set(v) }
+func (g *trackedGauge) Inc()          { g.touch(); g.Gauge.Inc() }
+func (g *trackedGauge) Dec()          { g.touch(); g.Gauge.Dec() }
+func (g *trackedGauge) Add(v float64) { g.touch(); g.Gauge.Add(v) }
+func (g *trackedGauge) Sub(v float64) { g.touch(); g.Gauge.Sub(v) }
+
+func (g *trackedGauge) SetIfHigher(v float64) bool {
+	g.touch()
+	return g.Gauge.SetIfHigher(v)
+}
+
+func (g *trackedGauge) SetIfLower(v float64) bool {
+	g.touch()
+	return g.Gauge.SetIfLower(v)
 }
 
 // GetMetricWithLabelValues replaces the method of the same name in
@@ -111,15 +432,229 @@ func (m *GaugeVec) GetMetricWith(labels Labels) (Gauge, error) {
 // GetMetricWithLabelValues would have returned an error. By not returning an
 // error, WithLabelValues allows shortcuts like
 //     myVec.WithLabelValues("404", "GET").Add(42)
+// Label values that are dropped because they are not in the LabelAllowlist do
+// not cause a panic but result in a Gauge that is never exposed.
 func (m *GaugeVec) WithLabelValues(lvs ...string) Gauge {
-	return m.MetricVec.WithLabelValues(lvs...).(Gauge)
+	g, err := m.GetMetricWithLabelValues(lvs...)
+	if err == errLabelValueNotAllowed {
+		return m.invalid
+	}
+	if err != nil {
+		panic(err)
+	}
+	return g
 }
 
 // With works as GetMetricWith, but panics where GetMetricWithLabels would have
 // returned an error. By not returning an error, With allows shortcuts like
 //     myVec.With(Labels{"code": "404", "method": "GET"}).Add(42)
+// Dropped label values are handled as in WithLabelValues.
 func (m *GaugeVec) With(labels Labels) Gauge {
-	return m.MetricVec.With(labels).(Gauge)
+	g, err := m.GetMetricWith(labels)
+	if err == errLabelValueNotAllowed {
+		return m.invalid
+	}
+	if err != nil {
+		panic(err)
+	}
+	return g
+}
+
+// WithPartialLabels replaces the method of the same name in MetricVec. The
+// difference is that this method returns a PartialGaugeVec and not a
+// PartialMetricVec so that no type conversion is required.
+func (m *GaugeVec) WithPartialLabels(labels Labels) *PartialGaugeVec {
+	return &PartialGaugeVec{*m.MetricVec.WithPartialLabels(labels)}
+}
+
+// CurryWith replaces the method of the same name in MetricVec. The difference
+// is that this method returns a PartialGaugeVec and not a PartialMetricVec so
+// that no type conversion is required.
+func (m *GaugeVec) CurryWith(labels Labels) (*PartialGaugeVec, error) {
+	p, err := m.MetricVec.CurryWith(labels)
+	if err != nil {
+		return nil, err
+	}
+	return &PartialGaugeVec{*p}, nil
+}
+
+// MustCurryWith works as CurryWith, but panics where CurryWith would have
+// returned an error.
+func (m *GaugeVec) MustCurryWith(labels Labels) *PartialGaugeVec {
+	return &PartialGaugeVec{*m.MetricVec.MustCurryWith(labels)}
+}
+
+// PartialGaugeVec is a GaugeVec with some of its variable labels already bound
+// to values. Create instances with the WithPartialLabels method of GaugeVec.
+type PartialGaugeVec struct {
+	PartialMetricVec
+}
+
+// GetMetricWithLabelValues replaces the method of the same name in
+// PartialMetricVec. The difference is that this method returns a Gauge and
+// not a Metric so that no type conversion is required.
+func (p *PartialGaugeVec) GetMetricWithLabelValues(lvs ...string) (Gauge, error) {
+	metric, err := p.PartialMetricVec.GetMetricWithLabelValues(lvs...)
+	if metric != nil {
+		return metric.(Gauge), err
+	}
+	return nil, err
+}
+
+// WithLabelValues works as GetMetricWithLabelValues, but panics where
+// GetMetricWithLabelValues would have returned an error.
+func (p *PartialGaugeVec) WithLabelValues(lvs ...string) Gauge {
+	return p.PartialMetricVec.WithLabelValues(lvs...).(Gauge)
+}
+
+// GetMetricWith replaces the method of the same name in PartialMetricVec. The
+// difference is that this method returns a Gauge and not a Metric so that no
+// type conversion is required.
+func (p *PartialGaugeVec) GetMetricWith(labels Labels) (Gauge, error) {
+	metric, err := p.PartialMetricVec.GetMetricWith(labels)
+	if metric != nil {
+		return metric.(Gauge), err
+	}
+	return nil, err
+}
+
+// With works as GetMetricWith, but panics where GetMetricWith would have
+// returned an error.
+func (p *PartialGaugeVec) With(labels Labels) Gauge {
+	return p.PartialMetricVec.With(labels).(Gauge)
+}
+
+// CurryWith replaces the method of the same name in PartialMetricVec. The
+// difference is that this method returns a PartialGaugeVec and not a
+// PartialMetricVec so that no type conversion is required.
+func (p *PartialGaugeVec) CurryWith(labels Labels) (*PartialGaugeVec, error) {
+	curried, err := p.PartialMetricVec.CurryWith(labels)
+	if err != nil {
+		return nil, err
+	}
+	return &PartialGaugeVec{*curried}, nil
+}
+
+// MustCurryWith works as CurryWith, but panics where CurryWith would have
+// returned an error.
+func (p *PartialGaugeVec) MustCurryWith(labels Labels) *PartialGaugeVec {
+	return &PartialGaugeVec{*p.PartialMetricVec.MustCurryWith(labels)}
+}
+
+// SetIfHigherWithLabelValues is a shortcut for
+//     myVec.WithLabelValues(lvs...).SetIfHigher(v)
+// It panics under the same conditions as WithLabelValues.
+func (m *GaugeVec) SetIfHigherWithLabelValues(v float64, lvs ...string) bool {
+	return m.MetricVec.WithLabelValues(lvs...).(Gauge).SetIfHigher(v)
+}
+
+// SetIfLowerWithLabelValues is a shortcut for
+//     myVec.WithLabelValues(lvs...).SetIfLower(v)
+// It panics under the same conditions as WithLabelValues.
+func (m *GaugeVec) SetIfLowerWithLabelValues(v float64, lvs ...string) bool {
+	return m.MetricVec.WithLabelValues(lvs...).(Gauge).SetIfLower(v)
+}
+
+// AddN is a shortcut for
+//     myVec.WithLabelValues(lvs...).Add(n)
+// for batch processing, matching CounterVec.AddN and HistogramVec.ObserveN. It
+// panics under the same conditions as WithLabelValues.
+func (m *GaugeVec) AddN(n float64, labelValues ...string) {
+	m.MetricVec.WithLabelValues(labelValues...).(Gauge).Add(n)
+}
+
+// AddIf adds v to the Gauge with the provided label values if condition is true
+// and returns condition, matching CounterVec.AddIf.
+func (m *GaugeVec) AddIf(condition bool, v float64, labelValues ...string) bool {
+	if condition {
+		m.MetricVec.WithLabelValues(labelValues...).(Gauge).Add(v)
+	}
+	return condition
+}
+
+// SortedForEach calls fn with the variable labels and the current value of
+// each Gauge in the GaugeVec, in the order of their label values, which are
+// compared in the order of the label names the GaugeVec was created with. The
+// values are read before the first call of fn, and no lock is held during the
+// calls, so fn may use the GaugeVec. Like Stats, SortedForEach is meant for
+// logging, reporting, and debugging and does not affect what is exposed.
+func (m *GaugeVec) SortedForEach(fn func(labels Labels, value float64)) {
+	for _, child := range m.sortedChildren() {
+		fn(child.labels, child.metric.GetGauge().GetValue())
+	}
+}
+
+// GaugeVecStats are statistics of the current values of all Gauges in a
+// GaugeVec, see the Stats method of GaugeVec. All fields except Count are NaN
+// if the GaugeVec has no Gauges.
+type GaugeVecStats struct {
+	Min, Max, Mean, P50, P95, P99, Count float64
+}
+
+// Percentile returns the p-th percentile (0 <= p <= 100) of the current values
+// of all Gauges in the GaugeVec, interpolating linearly between the closest
+// values. It returns NaN if the GaugeVec has no Gauges or p is out of range.
+// Like Stats, Percentile is meant for in-process decisions like admission
+// control and does not affect what is exposed.
+func (m *GaugeVec) Percentile(p float64) float64 {
+	return percentile(m.sortedValues(), p)
+}
+
+// Stats returns statistics of the current values of all Gauges in the
+// GaugeVec. The values are read once, so the statistics are consistent with
+// each other.
+func (m *GaugeVec) Stats() GaugeVecStats {
+	values := m.sortedValues()
+	stats := GaugeVecStats{
+		Min:   math.NaN(),
+		Max:   math.NaN(),
+		Mean:  math.NaN(),
+		P50:   percentile(values, 50),
+		P95:   percentile(values, 95),
+		P99:   percentile(values, 99),
+		Count: float64(len(values)),
+	}
+	if len(values) > 0 {
+		stats.Min, stats.Max = values[0], values[len(values)-1]
+		var sum float64
+		for _, v := range values {
+			sum += v
+		}
+		stats.Mean = sum / float64(len(values))
+	}
+	return stats
+}
+
+// sortedValues returns the current values of all Gauges in the GaugeVec in
+// increasing order. Gauges that cannot be read are skipped.
+func (m *GaugeVec) sortedValues() []float64 {
+	m.mtx.RLock()
+	values := make([]float64, 0, len(m.children))
+	for _, metric := range m.children {
+		var pb dto.Metric
+		if err := metric.Write(&pb); err != nil {
+			continue
+		}
+		values = append(values, pb.GetGauge().GetValue())
+	}
+	m.mtx.RUnlock()
+	sort.Float64s(values)
+	return values
+}
+
+// percentile returns the p-th percentile of the provided sorted values with
+// linear interpolation, or NaN if there are no values or p is out of range.
+func percentile(sorted []float64, p float64) float64 {
+	if len(sorted) == 0 || !(p >= 0 && p <= 100) {
+		return math.NaN()
+	}
+	rank := p / 100 * float64(len(sorted)-1)
+	lower := int(math.Floor(rank))
+	if lower == len(sorted)-1 {
+		return sorted[lower]
+	}
+	frac := rank - float64(lower)
+	return sorted[lower] + frac*(sorted[lower+1]-sorted[lower])
 }
 
 // GaugeFunc is a Gauge whose value is determined at collect time by calling a
@@ -138,10 +673,1577 @@ type GaugeFunc interface {
 // where a GaugeFunc is directly registered with Prometheus, the provided
 // function must be concurrency-safe.
 func NewGaugeFunc(opts GaugeOpts, function func() float64) GaugeFunc {
-	return newValueFunc(NewDesc(
+	desc := NewDesc(
 		BuildFQName(opts.Namespace, opts.Subsystem, opts.Name),
 		opts.Help,
 		nil,
 		opts.ConstLabels,
-	), GaugeValue, function)
+	)
+	desc.deprecatedVersion = opts.DeprecatedVersion
+	return newValueFunc(desc, GaugeValue, function)
+}
+
+// NewGaugeFn works like NewGaugeFunc but returns a Gauge, so that a value
+// maintained elsewhere, e.g. the size of a cache, can be exposed where a Gauge
+// is expected without updating it. The Gauge is read-only: Set, Inc, Dec, Add,
+// Sub, SetIfHigher, and SetIfLower panic. fn is called from the Write method,
+// i.e. on the goroutine performing the collection, so it must not acquire a
+// lock that might be held while the collection is triggered.
+func NewGaugeFn(opts GaugeOpts, fn func() float64) Gauge {
+	return gaugeFn{NewGaugeFunc(opts, fn).(*valueFunc)}
+}
+
+var errGaugeFnReadOnly = errors.New("cannot change the value of a Gauge created by NewGaugeFn")
+
+// gaugeFn implements the Gauge returned by NewGaugeFn.
+type gaugeFn struct {
+	*valueFunc
+}
+
+func (gaugeFn) Set(float64)              { panic(errGaugeFnReadOnly) }
+func (gaugeFn) Inc()                     { panic(errGaugeFnReadOnly) }
+func (gaugeFn) Dec()                     { panic(errGaugeFnReadOnly) }
+func (gaugeFn) Add(float64)              { panic(errGaugeFnReadOnly) }
+func (gaugeFn) Sub(float64)              { panic(errGaugeFnReadOnly) }
+func (gaugeFn) SetIfHigher(float64) bool { panic(errGaugeFnReadOnly) }
+func (gaugeFn) SetIfLower(float64) bool  { panic(errGaugeFnReadOnly) }
+
+// NewLabeledGaugeFunc creates a Collector that exposes one gauge per entry of
+// the provided map, all sharing the provided Desc. The Desc must have exactly
+// one variable label. The keys of the map are the values of that label, and the
+// functions return the values of the corresponding gauges. They are called
+// from within the Collect method and must be concurrency-safe. The map is
+// copied, so later changes to it have no effect. NewLabeledGaugeFunc panics if
+// the Desc does not have exactly one variable label.
+//
+// This is useful to expose a fixed set of related values, e.g. the number of
+// goroutines per state, without creating a GaugeFunc for each of them.
+func NewLabeledGaugeFunc(desc *Desc, fns map[string]func() float64) Collector {
+	if desc.err == nil && len(desc.variableLabels) != 1 {
+		panic(fmt.Errorf(
+			"labeled gauge func %q needs exactly one variable label, got %d",
+			desc.fqName, len(desc.variableLabels),
+		))
+	}
+	g := &labeledGaugeFunc{
+		desc:        desc,
+		labelValues: make([]string, 0, len(fns)),
+		fns:         make([]func() float64, 0, len(fns)),
+	}
+	for lv := range fns {
+		g.labelValues = append(g.labelValues, lv)
+	}
+	sort.Strings(g.labelValues)
+	for _, lv := range g.labelValues {
+		g.fns = append(g.fns, fns[lv])
+	}
+	return g
+}
+
+type labeledGaugeFunc struct {
+	desc        *Desc
+	labelValues []string // Sorted.
+	fns         []func() float64
+}
+
+// Describe implements Collector.
+func (g *labeledGaugeFunc) Describe(ch chan<- *Desc) {
+	ch <- g.desc
+}
+
+// Collect implements Collector.
+func (g *labeledGaugeFunc) Collect(ch chan<- Metric) {
+	for i, lv := range g.labelValues {
+		ch <- MustNewConstMetric(g.desc, GaugeValue, g.fns[i](), lv)
+	}
+}
+
+// SyscallGaugeDef defines a gauge exposed by a Collector created with
+// NewConstGaugesFromSyscall. Index is the position of its value in the slice
+// returned by the syscall function.
+type SyscallGaugeDef struct {
+	Desc  *Desc
+	Index int
+}
+
+// NewConstGaugesFromSyscall returns a Collector that exposes several gauges
+// whose values are all obtained by a single call of sysFn, like the fields of a
+// struct filled in by one syscall. sysFn is called once per collection, and
+// each gauge gets the value at its Index in the returned slice. If sysFn returns
+// an error, no metrics are collected at all. The Descs must not have variable
+// labels. A gauge whose Index is out of range of the returned slice is
+// collected as an invalid metric. NewConstGaugesFromSyscall panics if an Index
+// is negative.
+func NewConstGaugesFromSyscall(defs []SyscallGaugeDef, sysFn func() ([]uint64, error)) Collector {
+	for _, def := range defs {
+		if def.Index < 0 {
+			panic(fmt.Errorf("negative index %d for syscall gauge %s", def.Index, def.Desc))
+		}
+	}
+	return &syscallGauges{
+		defs:  append([]SyscallGaugeDef(nil), defs...),
+		sysFn: sysFn,
+	}
+}
+
+type syscallGauges struct {
+	defs  []SyscallGaugeDef
+	sysFn func() ([]uint64, error)
+}
+
+// Describe implements Collector.
+func (g *syscallGauges) Describe(ch chan<- *Desc) {
+	for _, def := range g.defs {
+		ch <- def.Desc
+	}
+}
+
+// Collect implements Collector.
+func (g *syscallGauges) Collect(ch chan<- Metric) {
+	values, err := g.sysFn()
+	if err != nil {
+		return
+	}
+	for _, def := range g.defs {
+		if def.Index >= len(values) {
+			ch <- NewInvalidMetric(def.Desc, fmt.Errorf(
+				"index %d out of range of %d syscall values", def.Index, len(values),
+			))
+			continue
+		}
+		m, err := NewConstMetric(def.Desc, GaugeValue, float64(values[def.Index]))
+		if err != nil {
+			m = NewInvalidMetric(def.Desc, err)
+		}
+		ch <- m
+	}
+}
+
+// GaugeGroupSetter sets the values of the gauges of a GaugeGroup from within
+// the mapper function of the GaugeGroup.
+type GaugeGroupSetter interface {
+	// Set sets the gauge with the given fully-qualified name to the given
+	// value. It panics if the GaugeGroup has no gauge of that name.
+	Set(name string, value float64)
+}
+
+// GaugeGroup is a Collector for a group of related gauges that are always
+// updated together, e.g. values read with a single system call. All gauges of
+// a GaugeGroup are updated atomically by Update, and they are collected
+// atomically, so that a collection never sees a partial update.
+//
+// To create GaugeGroup instances, use NewGaugeGroup.
+type GaugeGroup struct {
+	descs  []*Desc
+	index  map[string]int // Maps fqName to index in descs and values.
+	mapper func(interface{}, GaugeGroupSetter)
+
+	mtx    sync.RWMutex // Protects values.
+	values []float64
+}
+
+// NewGaugeGroup creates a new GaugeGroup with one gauge for each of the
+// provided Descs. The mapper function is called by Update and sets the values
+// of the gauges (identified by the fully-qualified names of their Descs) from
+// the data passed to Update. Gauges not set by the mapper keep their previous
+// value, initially 0. NewGaugeGroup panics if any of the Descs has variable
+// labels or if two Descs have the same fully-qualified name.
+func NewGaugeGroup(descs []*Desc, mapper func(data interface{}, s GaugeGroupSetter)) *GaugeGroup {
+	g := &GaugeGroup{
+		descs:  descs,
+		index:  make(map[string]int, len(descs)),
+		mapper: mapper,
+		values: make([]float64, len(descs)),
+	}
+	for i, desc := range descs {
+		if len(desc.variableLabels) > 0 {
+			panic(fmt.Errorf("gauge %q in gauge group has variable labels", desc.fqName))
+		}
+		if _, exists := g.index[desc.fqName]; exists {
+			panic(fmt.Errorf("duplicate gauge %q in gauge group", desc.fqName))
+		}
+		g.index[desc.fqName] = i
+	}
+	return g
+}
+
+// Update calls the mapper function of the GaugeGroup with the provided data
+// and applies all values set by it in one step.
+func (g *GaugeGroup) Update(data interface{}) {
+	g.mtx.Lock()
+	defer g.mtx.Unlock()
+	g.mapper(data, gaugeGroupSetter{g})
+}
+
+type gaugeGroupSetter struct {
+	g *GaugeGroup
+}
+
+// Set implements GaugeGroupSetter. It must only be called with the mtx of the
+// GaugeGroup locked.
+func (s gaugeGroupSetter) Set(name string, value float64) {
+	i, ok := s.g.index[name]
+	if !ok {
+		panic(fmt.Errorf("gauge group has no gauge %q", name))
+	}
+	s.g.values[i] = value
+}
+
+// Describe implements Collector.
+func (g *GaugeGroup) Describe(ch chan<- *Desc) {
+	for _, desc := range g.descs {
+		ch <- desc
+	}
+}
+
+// Collect implements Collector.
+func (g *GaugeGroup) Collect(ch chan<- Metric) {
+	g.mtx.RLock()
+	values := make([]float64, len(g.values))
+	copy(values, g.values)
+	g.mtx.RUnlock()
+
+	for i, desc := range g.descs {
+		ch <- MustNewConstMetric(desc, GaugeValue, values[i])
+	}
+}
+
+// MutuallyExclusiveGaugeSet is a Collector for a set of gauges of which exactly
+// one is 1 at any time, while all others are 0. This is the common way to
+// expose the current state of a state machine, e.g. whether a node is leader,
+// follower, or candidate.
+//
+// To create MutuallyExclusiveGaugeSet instances, use
+// NewMutuallyExclusiveGaugeSet.
+type MutuallyExclusiveGaugeSet interface {
+	Collector
+
+	// SetState sets the gauge with the given index (in the order of the
+	// GaugeOpts the set was created with) to 1 and all others to 0 in
+	// one step. It panics if the index is out of range.
+	SetState(index int)
+	// SetStateByName works like SetState, but identifies the gauge by its
+	// fully-qualified name. It returns an error if the set has no gauge of
+	// that name.
+	SetStateByName(name string) error
+	// CurrentState returns the index of the gauge currently set to 1.
+	CurrentState() int
+}
+
+// NewMutuallyExclusiveGaugeSet creates a new MutuallyExclusiveGaugeSet with one
+// gauge per provided GaugeOpts. Initially, the first gauge is set to 1. It
+// panics if no GaugeOpts are provided or if two of them result in the same
+// fully-qualified name.
+func NewMutuallyExclusiveGaugeSet(opts []GaugeOpts) MutuallyExclusiveGaugeSet {
+	if len(opts) == 0 {
+		panic(errors.New("mutually exclusive gauge set needs at least one gauge"))
+	}
+	s := &mutuallyExclusiveGaugeSet{
+		descs:   make([]*Desc, len(opts)),
+		indices: make(map[string]int, len(opts)),
+	}
+	for i, o := range opts {
+		desc := NewDesc(
+			BuildFQName(o.Namespace, o.Subsystem, o.Name),
+			o.Help,
+			nil,
+			o.ConstLabels,
+		)
+		desc.deprecatedVersion = o.DeprecatedVersion
+		if _, exists := s.indices[desc.fqName]; exists {
+			panic(fmt.Errorf("duplicate gauge %q in mutually exclusive gauge set", desc.fqName))
+		}
+		s.descs[i] = desc
+		s.indices[desc.fqName] = i
+	}
+	return s
+}
+
+type mutuallyExclusiveGaugeSet struct {
+	current int32 // Accessed atomically.
+	descs   []*Desc
+	indices map[string]int // Maps fqName to index in descs.
+}
+
+func (s *mutuallyExclusiveGaugeSet) SetState(index int) {
+	if index < 0 || index >= len(s.descs) {
+		panic(fmt.Errorf("state index %d out of range [0, %d)", index, len(s.descs)))
+	}
+	atomic.StoreInt32(&s.current, int32(index))
+}
+
+func (s *mutuallyExclusiveGaugeSet) SetStateByName(name string) error {
+	i, ok := s.indices[name]
+	if !ok {
+		return fmt.Errorf("mutually exclusive gauge set has no gauge %q", name)
+	}
+	s.SetState(i)
+	return nil
+}
+
+func (s *mutuallyExclusiveGaugeSet) CurrentState() int {
+	return int(atomic.LoadInt32(&s.current))
+}
+
+// Describe implements Collector.
+func (s *mutuallyExclusiveGaugeSet) Describe(ch chan<- *Desc) {
+	for _, desc := range s.descs {
+		ch <- desc
+	}
+}
+
+// Collect implements Collector.
+func (s *mutuallyExclusiveGaugeSet) Collect(ch chan<- Metric) {
+	current := s.CurrentState()
+	for i, desc := range s.descs {
+		v := 0.
+		if i == current {
+			v = 1
+		}
+		ch <- MustNewConstMetric(desc, GaugeValue, v)
+	}
+}
+
+// TrackedGaugeFunc is a GaugeFunc that also reports when its value was last
+// updated. It collects two metrics, the gauge itself and a gauge with the
+// suffix "_last_updated_seconds" that contains the Unix time of the last update
+// in seconds. The latter allows to alert on stale values.
+//
+// To create TrackedGaugeFunc instances, use NewTrackedGaugeFunc.
+type TrackedGaugeFunc interface {
+	Collector
+}
+
+// NewTrackedGaugeFunc creates a new TrackedGaugeFunc based on the provided
+// GaugeOpts. The given function is called from within the Collect method and
+// returns the value of the gauge together with the time that value was
+// computed. If the returned time is the zero time, the "_last_updated_seconds"
+// metric is not collected. Like for NewGaugeFunc, the provided function must be
+// concurrency-safe.
+func NewTrackedGaugeFunc(opts GaugeOpts, function func() (float64, time.Time)) TrackedGaugeFunc {
+	fqName := BuildFQName(opts.Namespace, opts.Subsystem, opts.Name)
+	desc := NewDesc(fqName, opts.Help, nil, opts.ConstLabels)
+	desc.deprecatedVersion = opts.DeprecatedVersion
+	lastUpdatedDesc := NewDesc(
+		fqName+"_last_updated_seconds",
+		"Unix time in seconds when "+fqName+" was last updated.",
+		nil,
+		opts.ConstLabels,
+	)
+	lastUpdatedDesc.deprecatedVersion = opts.DeprecatedVersion
+	return &trackedGaugeFunc{
+		desc:            desc,
+		lastUpdatedDesc: lastUpdatedDesc,
+		function:        function,
+	}
+}
+
+type trackedGaugeFunc struct {
+	desc, lastUpdatedDesc *Desc
+	function              func() (float64, time.Time)
+}
+
+// Describe implements Collector.
+func (g *trackedGaugeFunc) Describe(ch chan<- *Desc) {
+	ch <- g.desc
+	ch <- g.lastUpdatedDesc
+}
+
+// Collect implements Collector.
+func (g *trackedGaugeFunc) Collect(ch chan<- Metric) {
+	v, updated := g.function()
+	ch <- MustNewConstMetric(g.desc, GaugeValue, v)
+	if !updated.IsZero() {
+		ch <- MustNewConstMetric(
+			g.lastUpdatedDesc, GaugeValue,
+			float64(updated.UnixNano())/float64(time.Second),
+		)
+	}
+}
+
+// NewRatioGauge creates a Collector based on the provided GaugeOpts that
+// exposes the ratio of the two provided Counters as a gauge. It also exposes
+// the current values of the Counters as counters with the suffixes
+// "_numerator" and "_denominator". If the denominator is 0, the ratio is
+// NaN. The values are read from within the Collect method, so the Counters
+// may be registered elsewhere (or not at all).
+//
+// Note that in most cases, a ratio is better computed by the Prometheus server
+// from the rates of the two counters. Use NewRatioGauge only if that is not an
+// option.
+func NewRatioGauge(numerator, denominator Counter, opts GaugeOpts) Collector {
+	fqName := BuildFQName(opts.Namespace, opts.Subsystem, opts.Name)
+	newDesc := func(name, help string) *Desc {
+		desc := NewDesc(name, help, nil, opts.ConstLabels)
+		desc.deprecatedVersion = opts.DeprecatedVersion
+		return desc
+	}
+	return &ratioGauge{
+		numerator:   numerator,
+		denominator: denominator,
+		desc:        newDesc(fqName, opts.Help),
+		numDesc:     newDesc(fqName+"_numerator", "Numerator of "+fqName+"."),
+		denDesc:     newDesc(fqName+"_denominator", "Denominator of "+fqName+"."),
+	}
+}
+
+type ratioGauge struct {
+	numerator, denominator Counter
+	desc, numDesc, denDesc *Desc
+}
+
+// Describe implements Collector.
+func (g *ratioGauge) Describe(ch chan<- *Desc) {
+	ch <- g.desc
+	ch <- g.numDesc
+	ch <- g.denDesc
+}
+
+// Collect implements Collector.
+func (g *ratioGauge) Collect(ch chan<- Metric) {
+	var num, den dto.Metric
+	if err := g.numerator.Write(&num); err != nil {
+		ch <- NewInvalidMetric(g.desc, err)
+		return
+	}
+	if err := g.denominator.Write(&den); err != nil {
+		ch <- NewInvalidMetric(g.desc, err)
+		return
+	}
+	n, d := num.GetCounter().GetValue(), den.GetCounter().GetValue()
+	ratio := math.NaN()
+	if d != 0 {
+		ratio = n / d
+	}
+	ch <- MustNewConstMetric(g.desc, GaugeValue, ratio)
+	ch <- MustNewConstMetric(g.numDesc, CounterValue, n)
+	ch <- MustNewConstMetric(g.denDesc, CounterValue, d)
+}
+
+// NewDerivedGauge creates a Collector that exposes the value of the provided
+// Gauge, transformed by the provided function, as a gauge with the provided
+// Desc. This is useful to expose the same value in different units, e.g. bytes
+// and megabytes, for compatibility with existing dashboards. The value is read
+// and transformed from within the Collect method. The base Gauge is read only
+// and may be registered elsewhere (or not at all). The Desc must not have any
+// variable labels. See NewDerivedCounter for the counter equivalent.
+func NewDerivedGauge(desc *Desc, base Gauge, transform func(float64) float64) Collector {
+	return &derivedMetric{
+		desc:      desc,
+		base:      base,
+		transform: transform,
+		valueType: GaugeValue,
+	}
+}
+
+// derivedMetric is the implementation of NewDerivedGauge and
+// NewDerivedCounter.
+type derivedMetric struct {
+	desc      *Desc
+	base      Metric
+	transform func(float64) float64
+	valueType ValueType
+}
+
+// Describe implements Collector.
+func (d *derivedMetric) Describe(ch chan<- *Desc) {
+	ch <- d.desc
+}
+
+// Collect implements Collector.
+func (d *derivedMetric) Collect(ch chan<- Metric) {
+	var m dto.Metric
+	if err := d.base.Write(&m); err != nil {
+		ch <- NewInvalidMetric(d.desc, err)
+		return
+	}
+	var v float64
+	switch {
+	case m.Gauge != nil:
+		v = m.GetGauge().GetValue()
+	case m.Counter != nil:
+		v = m.GetCounter().GetValue()
+	case m.Untyped != nil:
+		v = m.GetUntyped().GetValue()
+	}
+	cm, err := NewConstMetric(d.desc, d.valueType, d.transform(v))
+	if err != nil {
+		cm = NewInvalidMetric(d.desc, err)
+	}
+	ch <- cm
+}
+
+// HysteresisGauge is a read-only Gauge-like metric that represents a boolean
+// state derived from another Gauge with hysteresis. Its value is 1 if the
+// state is on and 0 otherwise. Create instances with NewHysteresisGauge.
+type HysteresisGauge interface {
+	Metric
+	Collector
+
+	// CurrentState reads the source Gauge, updates the state accordingly,
+	// and returns it.
+	CurrentState() bool
+}
+
+// NewHysteresisGauge creates a new HysteresisGauge based on the provided
+// GaugeOpts. Whenever its state is read (on each collection and call of
+// CurrentState), the value of the source Gauge is read as well. The state is
+// switched on if the value is greater than riseThreshold and switched off if
+// the value is less than fallThreshold. Otherwise, it is left unchanged, so
+// that a value oscillating around a single threshold does not make the state
+// oscillate, too. The initial state is off. The source Gauge may be registered
+// elsewhere (or not at all). NewHysteresisGauge panics if fallThreshold is
+// greater than riseThreshold.
+func NewHysteresisGauge(opts GaugeOpts, source Gauge, riseThreshold, fallThreshold float64) HysteresisGauge {
+	if fallThreshold > riseThreshold {
+		panic(fmt.Errorf(
+			"fall threshold %f of hysteresis gauge %s is greater than rise threshold %f",
+			fallThreshold, opts.Name, riseThreshold,
+		))
+	}
+	desc := NewDesc(
+		BuildFQName(opts.Namespace, opts.Subsystem, opts.Name),
+		opts.Help,
+		nil,
+		opts.ConstLabels,
+	)
+	desc.deprecatedVersion = opts.DeprecatedVersion
+	g := &hysteresisGauge{
+		desc:   desc,
+		source: source,
+		rise:   riseThreshold,
+		fall:   fallThreshold,
+	}
+	g.Init(g) // Init self-collection.
+	return g
+}
+
+type hysteresisGauge struct {
+	SelfCollector
+
+	desc       *Desc
+	source     Gauge
+	rise, fall float64
+
+	mtx sync.Mutex
+	on  bool
+}
+
+func (g *hysteresisGauge) Desc() *Desc {
+	return g.desc
+}
+
+func (g *hysteresisGauge) CurrentState() bool {
+	on, _ := g.update()
+	return on
+}
+
+// update reads the source Gauge and updates and returns the state.
+func (g *hysteresisGauge) update() (bool, error) {
+	var m dto.Metric
+	if err := g.source.Write(&m); err != nil {
+		return false, err
+	}
+	v := m.GetGauge().GetValue()
+
+	g.mtx.Lock()
+	defer g.mtx.Unlock()
+	switch {
+	case v > g.rise:
+		g.on = true
+	case v < g.fall:
+		g.on = false
+	}
+	return g.on, nil
+}
+
+func (g *hysteresisGauge) Write(out *dto.Metric) error {
+	on, err := g.update()
+	if err != nil {
+		return err
+	}
+	var v float64
+	if on {
+		v = 1
+	}
+	return populateMetric(GaugeValue, v, g.desc.constLabelPairs, out)
+}
+
+// Aggregation determines how a HierarchicalGaugeVec combines the values of the
+// gauges one level below into the gauge of a parent level.
+type Aggregation int
+
+// Possible values for Aggregation.
+const (
+	AggregateSum Aggregation = iota
+	AggregateAvg
+	AggregateMax
+	AggregateMin
+)
+
+// HierarchicalGaugeVec is a Collector for gauges with hierarchical labels
+// (e.g. datacenter, region, zone, and host). Values are set at the leaf level,
+// i.e. for all label values, and each parent level is exposed as an aggregate
+// of the level below, so that it can be queried without aggregating in the
+// query. The labels of the levels below a parent are exposed with an empty
+// value, which the Prometheus server treats like a missing label. Therefore,
+// leaf label values must not be empty. Create instances with
+// NewHierarchicalGaugeVec.
+type HierarchicalGaugeVec struct {
+	desc         *Desc
+	levelSizes   []int // Number of label values up to and including each level.
+	aggregations []Aggregation
+
+	mtx    sync.RWMutex
+	leaves map[string]hierarchicalValue
+}
+
+type hierarchicalValue struct {
+	labelValues []string
+	value       float64
+}
+
+// NewHierarchicalGaugeVec creates a new HierarchicalGaugeVec based on the
+// provided GaugeOpts. The hierarchy is an ordered list of label groups, from
+// the top level to the leaf level. For example,
+//     [][]string{{"datacenter"}, {"region"}, {"zone", "host"}}
+// results in gauges with all four labels at the leaf level and aggregates by
+// datacenter and by datacenter and region. All levels are aggregated with
+// AggregateSum by default (see WithAggregation). NewHierarchicalGaugeVec panics
+// if the hierarchy or one of its groups is empty, or if opts has a
+// LabelAllowlist or LockFreeHotPath set, which HierarchicalGaugeVec does not
+// support.
+func NewHierarchicalGaugeVec(opts GaugeOpts, hierarchy [][]string) *HierarchicalGaugeVec {
+	if len(hierarchy) == 0 {
+		panic("hierarchical gauge vector needs at least one label group")
+	}
+	if len(opts.LabelAllowlist) > 0 || opts.LockFreeHotPath {
+		panic(fmt.Errorf("hierarchical gauge vector %s does not support LabelAllowlist and LockFreeHotPath", opts.Name))
+	}
+	var labelNames []string
+	levelSizes := make([]int, len(hierarchy))
+	for i, group := range hierarchy {
+		if len(group) == 0 {
+			panic(fmt.Errorf("label group %d of hierarchical gauge vector %s is empty", i, opts.Name))
+		}
+		labelNames = append(labelNames, group...)
+		levelSizes[i] = len(labelNames)
+	}
+	desc := NewDesc(
+		BuildFQName(opts.Namespace, opts.Subsystem, opts.Name),
+		opts.Help,
+		labelNames,
+		opts.ConstLabels,
+	)
+	desc.deprecatedVersion = opts.DeprecatedVersion
+	return &HierarchicalGaugeVec{
+		desc:         desc,
+		levelSizes:   levelSizes,
+		aggregations: make([]Aggregation, len(hierarchy)-1),
+		leaves:       map[string]hierarchicalValue{},
+	}
+}
+
+// WithAggregation sets the Aggregation of the provided parent level, where 0
+// is the top level. The leaf level cannot be aggregated. Call WithAggregation
+// before the HierarchicalGaugeVec is used for the first time. It returns the
+// HierarchicalGaugeVec for convenience and panics if the level is not a parent
+// level.
+func (v *HierarchicalGaugeVec) WithAggregation(level int, a Aggregation) *HierarchicalGaugeVec {
+	if level < 0 || level >= len(v.aggregations) {
+		panic(fmt.Errorf("%d is not a parent level of hierarchical gauge vector %s", level, v.desc))
+	}
+	v.aggregations[level] = a
+	return v
+}
+
+// Set sets the value of the leaf gauge with the provided label values (same
+// order as in the hierarchy). It panics if the number of label values does not
+// match the number of labels, or if a label value is empty.
+func (v *HierarchicalGaugeVec) Set(value float64, levels ...string) {
+	if len(levels) != len(v.desc.variableLabels) {
+		panic(errInconsistentCardinality)
+	}
+	for i, l := range levels {
+		if l == "" {
+			panic(fmt.Errorf("empty value for label %q of hierarchical gauge vector %s", v.desc.variableLabels[i], v.desc))
+		}
+	}
+	key := strings.Join(levels, string(model.SeparatorByte))
+
+	v.mtx.Lock()
+	defer v.mtx.Unlock()
+	if leaf, ok := v.leaves[key]; ok {
+		leaf.value = value
+		v.leaves[key] = leaf
+		return
+	}
+	v.leaves[key] = hierarchicalValue{
+		labelValues: append([]string(nil), levels...),
+		value:       value,
+	}
+}
+
+// Delete deletes the leaf gauge with the provided label values. It returns
+// true if a gauge was deleted. Parent levels without any leaves left are not
+// exposed anymore.
+func (v *HierarchicalGaugeVec) Delete(levels ...string) bool {
+	key := strings.Join(levels, string(model.SeparatorByte))
+
+	v.mtx.Lock()
+	defer v.mtx.Unlock()
+	if _, ok := v.leaves[key]; !ok {
+		return false
+	}
+	delete(v.leaves, key)
+	return true
+}
+
+// Describe implements Collector.
+func (v *HierarchicalGaugeVec) Describe(ch chan<- *Desc) {
+	ch <- v.desc
+}
+
+// Collect implements Collector. It collects the gauges of all levels.
+func (v *HierarchicalGaugeVec) Collect(ch chan<- Metric) {
+	v.mtx.RLock()
+	current := make([]hierarchicalValue, 0, len(v.leaves))
+	for _, leaf := range v.leaves {
+		current = append(current, leaf)
+	}
+	v.mtx.RUnlock()
+
+	for level := len(v.levelSizes) - 1; ; level-- {
+		for _, hv := range current {
+			ch <- MustNewConstMetric(v.desc, GaugeValue, hv.value, hv.labelValues...)
+		}
+		if level == 0 {
+			return
+		}
+		current = v.aggregate(current, level-1)
+	}
+}
+
+// aggregate combines the provided values of the level below the provided
+// parent level into the values of the parent level.
+func (v *HierarchicalGaugeVec) aggregate(children []hierarchicalValue, level int) []hierarchicalValue {
+	var (
+		size    = v.levelSizes[level]
+		a       = v.aggregations[level]
+		parents = map[string]*hierarchicalValue{}
+		counts  = map[string]int{}
+		order   []string
+	)
+	for _, child := range children {
+		key := strings.Join(child.labelValues[:size], string(model.SeparatorByte))
+		parent, ok := parents[key]
+		if !ok {
+			lvs := make([]string, len(child.labelValues))
+			copy(lvs, child.labelValues[:size])
+			parents[key] = &hierarchicalValue{labelValues: lvs, value: child.value}
+			counts[key] = 1
+			order = append(order, key)
+			continue
+		}
+		counts[key]++
+		switch a {
+		case AggregateSum, AggregateAvg:
+			parent.value += child.value
+		case AggregateMax:
+			parent.value = math.Max(parent.value, child.value)
+		case AggregateMin:
+			parent.value = math.Min(parent.value, child.value)
+		}
+	}
+	result := make([]hierarchicalValue, 0, len(order))
+	for _, key := range order {
+		parent := parents[key]
+		if a == AggregateAvg {
+			parent.value /= float64(counts[key])
+		}
+		result = append(result, *parent)
+	}
+	return result
+}
+
+// QueueDepthGauge is a Gauge that tracks the number of items in a queue, or
+// of any other operations in progress. Each enqueue returns the function that
+// undoes it, so that the decrement cannot be forgotten:
+//     defer queueDepth.Enqueue()()
+//
+// To create QueueDepthGauge instances, use NewQueueDepthGauge.
+type QueueDepthGauge interface {
+	Gauge
+
+	// Enqueue increments the Gauge by 1 and returns a function that
+	// decrements it again.
+	Enqueue() func()
+	// EnqueueN increments the Gauge by n and returns a function that
+	// decrements it by n again.
+	EnqueueN(n int) func()
+}
+
+// NewQueueDepthGauge creates a new QueueDepthGauge based on the provided
+// GaugeOpts.
+func NewQueueDepthGauge(opts GaugeOpts) QueueDepthGauge {
+	return &queueDepthGauge{Gauge: NewGauge(opts)}
+}
+
+type queueDepthGauge struct {
+	Gauge
+}
+
+func (g *queueDepthGauge) Enqueue() func() {
+	return enqueue(g.Gauge, 1)
+}
+
+func (g *queueDepthGauge) EnqueueN(n int) func() {
+	return enqueue(g.Gauge, n)
+}
+
+// enqueue adds n to g and returns a function that subtracts n from g. Only the
+// first call of the returned function has an effect, so that calling it twice
+// does not corrupt the depth.
+func enqueue(g Gauge, n int) func() {
+	g.Add(float64(n))
+	var done int32
+	return func() {
+		if atomic.CompareAndSwapInt32(&done, 0, 1) {
+			g.Sub(float64(n))
+		}
+	}
+}
+
+// QueueDepthGaugeVec is a GaugeVec whose Gauges track queue depths like a
+// QueueDepthGauge. Create instances with NewQueueDepthGaugeVec.
+type QueueDepthGaugeVec struct {
+	*GaugeVec
+}
+
+// NewQueueDepthGaugeVec creates a new QueueDepthGaugeVec based on the provided
+// GaugeOpts and partitioned by the given label names. See NewGaugeVec.
+func NewQueueDepthGaugeVec(opts GaugeOpts, labelNames []string) *QueueDepthGaugeVec {
+	return &QueueDepthGaugeVec{GaugeVec: NewGaugeVec(opts, labelNames)}
+}
+
+// EnqueueWithLabels increments the Gauge with the provided label values by 1
+// and returns a function that decrements it again. Like WithLabelValues, it
+// panics if the number of label values is not correct.
+func (m *QueueDepthGaugeVec) EnqueueWithLabels(lvs ...string) func() {
+	return enqueue(m.WithLabelValues(lvs...), 1)
+}
+
+// TrailingAverageGauge is a Gauge that also keeps an exponential trailing
+// average of its value. This smoothes a fluctuating value for human reading
+// without the need to average it on the server side. It is collected as two
+// metric families, the Gauge itself and a gauge with the "_trailing_avg"
+// suffix. As both are described by the same Collector, they are registered
+// (and unregistered) together.
+//
+// To create TrailingAverageGauge instances, use WithTrailingAverage.
+type TrailingAverageGauge interface {
+	Gauge
+
+	// AverageValue returns the current trailing average. Before the first
+	// update (and the first update after Reset), it is the current value
+	// of the Gauge.
+	AverageValue() float64
+	// Reset clears the trailing average. It does not change the value of
+	// the Gauge.
+	Reset()
+}
+
+// WithTrailingAverage attaches an exponential trailing average over the
+// provided window to the provided Gauge. Each update through the returned
+// TrailingAverageGauge moves the average towards the new value of the Gauge,
+// weighted by the time passed since the previous update, so that the weight
+// of a value decays by a factor of e per window. Updates of the Gauge
+// that bypass the TrailingAverageGauge are not taken into account. Register
+// the TrailingAverageGauge instead of the Gauge. WithTrailingAverage panics
+// if window is not positive.
+func WithTrailingAverage(g Gauge, window time.Duration) TrailingAverageGauge {
+	if window <= 0 {
+		panic(fmt.Errorf("trailing average window of gauge %s must be positive", g.Desc()))
+	}
+	// The average has the same labels as the Gauge, including the variable
+	// labels if the Gauge is the child of a GaugeVec.
+	var m dto.Metric
+	if err := g.Write(&m); err != nil {
+		panic(err)
+	}
+	labels := make(Labels, len(m.Label))
+	for _, lp := range m.Label {
+		labels[lp.GetName()] = lp.GetValue()
+	}
+	name := g.Desc().fqName
+	return &trailingAverageGauge{
+		Gauge: g,
+		avgDesc: NewDesc(
+			name+"_trailing_avg",
+			fmt.Sprintf("Exponential trailing average of %s over %s.", name, window),
+			nil,
+			labels,
+		),
+		window: window,
+		now:    time.Now,
+	}
+}
+
+type trailingAverageGauge struct {
+	Gauge
+	avgDesc *Desc
+	window  time.Duration
+	now     func() time.Time
+
+	mtx         sync.Mutex // Protects the fields below.
+	avg         float64
+	lastUpdate  time.Time
+	initialized bool
+}
+
+func (g *trailingAverageGauge) Set(v float64) {
+	g.update(func() { g.Gauge.Set(v) })
+}
+
+func (g *trailingAverageGauge) Inc() {
+	g.update(g.Gauge.Inc)
+}
+
+func (g *trailingAverageGauge) Dec() {
+	g.update(g.Gauge.Dec)
+}
+
+func (g *trailingAverageGauge) Add(v float64) {
+	g.update(func() { g.Gauge.Add(v) })
+}
+
+func (g *trailingAverageGauge) Sub(v float64) {
+	g.update(func() { g.Gauge.Sub(v) })
+}
+
+func (g *trailingAverageGauge) SetIfHigher(v float64) (updated bool) {
+	g.update(func() { updated = g.Gauge.SetIfHigher(v) })
+	return updated
+}
+
+func (g *trailingAverageGauge) SetIfLower(v float64) (updated bool) {
+	g.update(func() { updated = g.Gauge.SetIfLower(v) })
+	return updated
+}
+
+// update applies the provided update to the Gauge and moves the average
+// towards the new value. Both happen under the lock, so that concurrent
+// updates are averaged in the order they are applied.
+func (g *trailingAverageGauge) update(apply func()) {
+	g.mtx.Lock()
+	defer g.mtx.Unlock()
+
+	apply()
+	v := g.value()
+	now := g.now()
+	if !g.initialized {
+		g.avg, g.lastUpdate, g.initialized = v, now, true
+		return
+	}
+	alpha := 1 - math.Exp(-float64(now.Sub(g.lastUpdate))/float64(g.window))
+	g.avg += alpha * (v - g.avg)
+	g.lastUpdate = now
+}
+
+// value returns the current value of the Gauge.
+func (g *trailingAverageGauge) value() float64 {
+	var m dto.Metric
+	if err := g.Gauge.Write(&m); err != nil {
+		return math.NaN()
+	}
+	return m.GetGauge().GetValue()
+}
+
+func (g *trailingAverageGauge) AverageValue() float64 {
+	g.mtx.Lock()
+	defer g.mtx.Unlock()
+
+	if !g.initialized {
+		return g.value()
+	}
+	return g.avg
+}
+
+func (g *trailingAverageGauge) Reset() {
+	g.mtx.Lock()
+	defer g.mtx.Unlock()
+
+	g.initialized = false
+}
+
+func (g *trailingAverageGauge) Describe(ch chan<- *Desc) {
+	ch <- g.Gauge.Desc()
+	ch <- g.avgDesc
+}
+
+func (g *trailingAverageGauge) Collect(ch chan<- Metric) {
+	ch <- g.Gauge
+	ch <- MustNewConstMetric(g.avgDesc, GaugeValue, g.AverageValue())
+}
+
+// DefEventGaugeWindowSize is the default number of events in the window of an
+// EventGauge.
+const DefEventGaugeWindowSize = 100
+
+// EventGauge is a Collector that tracks the outcome of the most recent events,
+// e.g. whether the last 100 requests succeeded. It collects the fraction of
+// successful events in the window as a gauge with the suffix "_success_rate",
+// the number of events in the window as a gauge with the suffix
+// "_window_total", and the number of events recorded overall as a counter with
+// the suffix "_events_recorded_total". This allows to track client-side SLOs
+// in-process.
+//
+// To create EventGauge instances, use NewEventGauge.
+type EventGauge interface {
+	Metric
+	Collector
+
+	// Record records the outcome of an event. Once the window is full,
+	// the outcome of the oldest event in the window is forgotten.
+	Record(success bool)
+	// SuccessRate returns the fraction of successful events in the
+	// window. It returns NaN if no event has been recorded yet.
+	SuccessRate() float64
+}
+
+// EventGaugeOpts bundles the options for creating an EventGauge. The Name in
+// the embedded GaugeOpts is the common prefix of all collected metrics.
+type EventGaugeOpts struct {
+	GaugeOpts
+
+	// WindowSize is the number of most recent events the success rate is
+	// calculated from. The default value is DefEventGaugeWindowSize.
+	WindowSize int
+}
+
+// NewEventGauge creates a new EventGauge based on the provided EventGaugeOpts.
+// It panics if WindowSize is negative.
+func NewEventGauge(opts EventGaugeOpts) EventGauge {
+	return newEventGaugeDescs(opts, nil).newEventGauge()
+}
+
+// eventGaugeDescs are the Descs of the metrics collected by an EventGauge.
+type eventGaugeDescs struct {
+	successRate, window, recorded *Desc
+	windowSize                    int
+}
+
+func newEventGaugeDescs(opts EventGaugeOpts, labelNames []string) *eventGaugeDescs {
+	if opts.WindowSize < 0 {
+		panic(fmt.Errorf("event gauge %s has a negative WindowSize", opts.Name))
+	}
+	if opts.WindowSize == 0 {
+		opts.WindowSize = DefEventGaugeWindowSize
+	}
+	name := BuildFQName(opts.Namespace, opts.Subsystem, opts.Name)
+	d := &eventGaugeDescs{
+		successRate: NewDesc(name+"_success_rate", opts.Help, labelNames, opts.ConstLabels),
+		window: NewDesc(
+			name+"_window_total",
+			"Number of events the success rate of "+name+" is calculated from.",
+			labelNames, opts.ConstLabels,
+		),
+		recorded: NewDesc(
+			name+"_events_recorded_total",
+			"Total number of events recorded by "+name+".",
+			labelNames, opts.ConstLabels,
+		),
+		windowSize: opts.WindowSize,
+	}
+	for _, desc := range []*Desc{d.successRate, d.window, d.recorded} {
+		desc.deprecatedVersion = opts.DeprecatedVersion
+	}
+	return d
+}
+
+func (d *eventGaugeDescs) newEventGauge(lvs ...string) *eventGauge {
+	return &eventGauge{
+		descs:       d,
+		labelValues: lvs,
+		labelPairs:  makeLabelPairs(d.successRate, lvs),
+		outcomes:    make([]bool, d.windowSize),
+	}
+}
+
+type eventGauge struct {
+	descs       *eventGaugeDescs
+	labelValues []string
+	labelPairs  []*dto.LabelPair
+
+	mtx       sync.Mutex // Protects the fields below.
+	outcomes  []bool     // Ring buffer of the window.
+	next      int        // Index of the next outcome in outcomes.
+	inWindow  int        // Number of events in the window.
+	successes int        // Number of successful events in the window.
+	recorded  uint64
+}
+
+func (g *eventGauge) Desc() *Desc {
+	return g.descs.successRate
+}
+
+func (g *eventGauge) Record(success bool) {
+	g.mtx.Lock()
+	defer g.mtx.Unlock()
+
+	if g.inWindow == len(g.outcomes) {
+		if g.outcomes[g.next] {
+			g.successes--
+		}
+	} else {
+		g.inWindow++
+	}
+	g.outcomes[g.next] = success
+	if success {
+		g.successes++
+	}
+	g.next = (g.next + 1) % len(g.outcomes)
+	g.recorded++
+}
+
+func (g *eventGauge) SuccessRate() float64 {
+	rate, _, _ := g.snapshot()
+	return rate
+}
+
+// snapshot returns the success rate, the number of events in the window, and
+// the number of recorded events.
+func (g *eventGauge) snapshot() (float64, int, uint64) {
+	g.mtx.Lock()
+	defer g.mtx.Unlock()
+
+	if g.inWindow == 0 {
+		return math.NaN(), 0, g.recorded
+	}
+	return float64(g.successes) / float64(g.inWindow), g.inWindow, g.recorded
+}
+
+// Write writes the success rate.
+func (g *eventGauge) Write(out *dto.Metric) error {
+	return populateMetric(GaugeValue, g.SuccessRate(), g.labelPairs, out)
+}
+
+// Describe implements Collector.
+func (g *eventGauge) Describe(ch chan<- *Desc) {
+	ch <- g.descs.successRate
+	ch <- g.descs.window
+	ch <- g.descs.recorded
+}
+
+// Collect implements Collector.
+func (g *eventGauge) Collect(ch chan<- Metric) {
+	rate, inWindow, recorded := g.snapshot()
+	ch <- MustNewConstMetric(g.descs.successRate, GaugeValue, rate, g.labelValues...)
+	ch <- MustNewConstMetric(g.descs.window, GaugeValue, float64(inWindow), g.labelValues...)
+	ch <- MustNewConstMetric(g.descs.recorded, CounterValue, float64(recorded), g.labelValues...)
+}
+
+// EventGaugeVec is a Collector that bundles a set of EventGauges that all share
+// the same Descs, but have different values for their variable labels. Create
+// instances with NewEventGaugeVec.
+type EventGaugeVec struct {
+	MetricVec
+	descs *eventGaugeDescs
+}
+
+// NewEventGaugeVec creates a new EventGaugeVec based on the provided
+// EventGaugeOpts and partitioned by the given label names. At least one label
+// name must be provided. It panics if WindowSize is negative.
+func NewEventGaugeVec(opts EventGaugeOpts, labelNames []string) *EventGaugeVec {
+	descs := newEventGaugeDescs(opts, labelNames)
+	return &EventGaugeVec{
+		MetricVec: MetricVec{
+			children: map[uint64]Metric{},
+			desc:     descs.successRate,
+			hash:     fnv.New64a(),
+			newMetric: func(lvs ...string) Metric {
+				return descs.newEventGauge(lvs...)
+			},
+		},
+		descs: descs,
+	}
+}
+
+// Describe implements Collector.
+func (m *EventGaugeVec) Describe(ch chan<- *Desc) {
+	ch <- m.descs.successRate
+	ch <- m.descs.window
+	ch <- m.descs.recorded
+}
+
+// Collect implements Collector.
+func (m *EventGaugeVec) Collect(ch chan<- Metric) {
+	m.mtx.RLock()
+	defer m.mtx.RUnlock()
+	for _, metric := range m.children {
+		metric.(*eventGauge).Collect(ch)
+	}
+}
+
+// GetMetricWithLabelValues replaces the method of the same name in
+// MetricVec. The difference is that this method returns an EventGauge and not
+// a Metric so that no type conversion is required.
+func (m *EventGaugeVec) GetMetricWithLabelValues(lvs ...string) (EventGauge, error) {
+	metric, err := m.MetricVec.GetMetricWithLabelValues(lvs...)
+	if metric != nil {
+		return metric.(EventGauge), err
+	}
+	return nil, err
+}
+
+// GetMetricWith replaces the method of the same name in MetricVec. The
+// difference is that this method returns an EventGauge and not a Metric so
+// that no type conversion is required.
+func (m *EventGaugeVec) GetMetricWith(labels Labels) (EventGauge, error) {
+	metric, err := m.MetricVec.GetMetricWith(labels)
+	if metric != nil {
+		return metric.(EventGauge), err
+	}
+	return nil, err
+}
+
+// WithLabelValues works as GetMetricWithLabelValues, but panics where
+// GetMetricWithLabelValues would have returned an error.
+func (m *EventGaugeVec) WithLabelValues(lvs ...string) EventGauge {
+	return m.MetricVec.WithLabelValues(lvs...).(EventGauge)
+}
+
+// With works as GetMetricWith, but panics where GetMetricWithLabels would have
+// returned an error.
+func (m *EventGaugeVec) With(labels Labels) EventGauge {
+	return m.MetricVec.With(labels).(EventGauge)
+}
+
+// SnapshotGauge returns a function that reads the current value of g into
+// *into when called. Creating the function does not access g at all, and the
+// read is atomic but happens only once the function is called. This allows to
+// prepare a read of a Gauge within a critical section and to perform it after
+// leaving that section, e.g. with defer. Each call of the returned function
+// reads the value again. If the value of g cannot be read, *into is set to
+// NaN.
+func SnapshotGauge(g Gauge, into *float64) func() {
+	if v, ok := g.(*value); ok {
+		return func() {
+			*into = math.Float64frombits(atomic.LoadUint64(&v.valBits))
+		}
+	}
+	return func() {
+		var m dto.Metric
+		if err := g.Write(&m); err != nil {
+			*into = math.NaN()
+			return
+		}
+		*into = m.GetGauge().GetValue()
+	}
+}
+
+// ErrEnvVarNotSet is returned by SetFromEnv if the environment variable is not
+// set or empty.
+var ErrEnvVarNotSet = errors.New("environment variable not set")
+
+// SetFromEnv sets g to the value of the environment variable envVar, parsed as
+// a float64, e.g. to expose a configured threshold. If the variable is not set
+// or empty, it returns ErrEnvVarNotSet, and if the value cannot be parsed, it
+// returns the *strconv.NumError from strconv.ParseFloat. In both cases, g is
+// left unchanged.
+func SetFromEnv(g Gauge, envVar string) error {
+	s := os.Getenv(envVar)
+	if s == "" {
+		return ErrEnvVarNotSet
+	}
+	v, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return err
+	}
+	g.Set(v)
+	return nil
+}
+
+// MustSetFromEnv works like SetFromEnv but panics where SetFromEnv would have
+// returned an error.
+func MustSetFromEnv(g Gauge, envVar string) {
+	if err := SetFromEnv(g, envVar); err != nil {
+		panic(fmt.Errorf("setting gauge %s from %s: %s", g.Desc(), envVar, err))
+	}
+}
+
+// SetFromEnvOr works like SetFromEnv but sets g to defaultVal if the
+// environment variable is not set or empty. It only returns an error if the
+// value cannot be parsed, in which case g is left unchanged.
+func SetFromEnvOr(g Gauge, envVar string, defaultVal float64) error {
+	err := SetFromEnv(g, envVar)
+	if err == ErrEnvVarNotSet {
+		g.Set(defaultVal)
+		return nil
+	}
+	return err
+}
+
+// EventualConsistencyGauge is a Collector for a gauge whose value is fetched
+// from a slow or eventually consistent data source, e.g. a distributed
+// configuration system. The value is fetched in the background, and Collect
+// serves the last fetched value without blocking. Along with the gauge, it
+// collects a gauge with the suffix "_staleness_seconds", which contains the
+// age of the served value, and a gauge with the suffix "_staleness_critical",
+// which is 1 if the value is older than the tolerated staleness and 0
+// otherwise.
+//
+// To create EventualConsistencyGauge instances, use
+// NewEventualConsistencyGauge.
+type EventualConsistencyGauge interface {
+	Collector
+
+	// Close stops fetching in the background. The last fetched value is
+	// still collected.
+	Close()
+}
+
+// NewEventualConsistencyGauge creates a new EventualConsistencyGauge based on
+// the provided GaugeOpts and starts its background goroutine, which calls fetch
+// right away and then every maxStaleness/2. If fetch returns an error, the
+// previously fetched value is kept. Before the first successful fetch, the
+// gauge is NaN, and its age is counted from the creation of the
+// EventualConsistencyGauge. Call Close if the EventualConsistencyGauge is not
+// needed anymore. NewEventualConsistencyGauge panics if maxStaleness is not
+// positive.
+func NewEventualConsistencyGauge(opts GaugeOpts, fetch func() (float64, error), maxStaleness time.Duration) EventualConsistencyGauge {
+	fqName := BuildFQName(opts.Namespace, opts.Subsystem, opts.Name)
+	if maxStaleness <= 0 {
+		panic(fmt.Errorf("eventual consistency gauge %s has a non-positive maxStaleness", fqName))
+	}
+	newDesc := func(name, help string) *Desc {
+		desc := NewDesc(name, help, nil, opts.ConstLabels)
+		desc.deprecatedVersion = opts.DeprecatedVersion
+		return desc
+	}
+	g := &eventualConsistencyGauge{
+		desc: newDesc(fqName, opts.Help),
+		stalenessDesc: newDesc(
+			fqName+"_staleness_seconds",
+			"Age in seconds of the value of "+fqName+".",
+		),
+		criticalDesc: newDesc(
+			fqName+"_staleness_critical",
+			"Whether the value of "+fqName+" is older than "+maxStaleness.String()+" (1) or not (0).",
+		),
+		fetch:        fetch,
+		maxStaleness: maxStaleness,
+		now:          time.Now,
+		done:         make(chan struct{}),
+		value:        math.NaN(),
+	}
+	g.fetchedAt = g.now()
+	go g.run()
+	return g
+}
+
+type eventualConsistencyGauge struct {
+	desc, stalenessDesc, criticalDesc *Desc
+	fetch                             func() (float64, error)
+	maxStaleness                      time.Duration
+	now                               func() time.Time
+	done                              chan struct{}
+	closeOnce                         sync.Once
+
+	mtx       sync.RWMutex // Protects value and fetchedAt.
+	value     float64
+	fetchedAt time.Time
+}
+
+func (g *eventualConsistencyGauge) run() {
+	g.refresh()
+	ticker := time.NewTicker(g.maxStaleness / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			g.refresh()
+		case <-g.done:
+			return
+		}
+	}
+}
+
+// refresh calls fetch and stores the value if fetch succeeds.
+func (g *eventualConsistencyGauge) refresh() {
+	v, err := g.fetch()
+	if err != nil {
+		return
+	}
+	g.mtx.Lock()
+	defer g.mtx.Unlock()
+	g.value, g.fetchedAt = v, g.now()
+}
+
+// Describe implements Collector.
+func (g *eventualConsistencyGauge) Describe(ch chan<- *Desc) {
+	ch <- g.desc
+	ch <- g.stalenessDesc
+	ch <- g.criticalDesc
+}
+
+// Collect implements Collector.
+func (g *eventualConsistencyGauge) Collect(ch chan<- Metric) {
+	g.mtx.RLock()
+	v, fetchedAt := g.value, g.fetchedAt
+	g.mtx.RUnlock()
+
+	staleness := g.now().Sub(fetchedAt)
+	var critical float64
+	if staleness > g.maxStaleness {
+		critical = 1
+	}
+	ch <- MustNewConstMetric(g.desc, GaugeValue, v)
+	ch <- MustNewConstMetric(g.stalenessDesc, GaugeValue, staleness.Seconds())
+	ch <- MustNewConstMetric(g.criticalDesc, GaugeValue, critical)
+}
+
+// Close implements EventualConsistencyGauge.
+func (g *eventualConsistencyGauge) Close() {
+	g.closeOnce.Do(func() { close(g.done) })
+}
+
+// GaugePair is a Gauge that also tracks the highest and lowest values it has
+// been set to, e.g. the peak usage of a connection pool next to its current
+// usage. Depending on GaugePairOpts, it collects a gauge with the suffix
+// "_max_value" and a gauge with the suffix "_min_value" along with the Gauge
+// itself. All updates go through the GaugePair, so the extremes cannot miss an
+// update in between scrapes.
+//
+// To create GaugePair instances, use NewGaugePair.
+type GaugePair interface {
+	Gauge
+
+	// ResetMax sets the tracked maximum to the current value.
+	ResetMax()
+	// ResetMin sets the tracked minimum to the current value.
+	ResetMin()
+}
+
+// GaugePairOpts bundles the options for creating a GaugePair. The Name in the
+// embedded GaugeOpts is the name of the Gauge itself and the prefix of the
+// extremes.
+type GaugePairOpts struct {
+	GaugeOpts
+
+	// TrackMax and TrackMin determine whether the maximum and the minimum
+	// are tracked and collected.
+	TrackMax, TrackMin bool
+}
+
+// NewGaugePair creates a new GaugePair based on the provided GaugePairOpts. Like
+// the Gauge, the extremes start at 0.
+func NewGaugePair(opts GaugePairOpts) GaugePair {
+	fqName := BuildFQName(opts.Namespace, opts.Subsystem, opts.Name)
+	newGauge := func(name, help string) *value {
+		desc := NewDesc(name, help, nil, opts.ConstLabels)
+		desc.deprecatedVersion = opts.DeprecatedVersion
+		return newValue(desc, GaugeValue, 0)
+	}
+	g := &gaugePair{value: newGauge(fqName, opts.Help)}
+	if opts.TrackMax {
+		g.max = newGauge(fqName+"_max_value", "Maximum value of "+fqName+" since creation or the last reset of the maximum.")
+	}
+	if opts.TrackMin {
+		g.min = newGauge(fqName+"_min_value", "Minimum value of "+fqName+" since creation or the last reset of the minimum.")
+	}
+	return g
+}
+
+type gaugePair struct {
+	*value
+	max, min *value // Nil if not tracked.
+}
+
+func (g *gaugePair) Set(v float64) {
+	g.value.Set(v)
+	g.track(v)
+}
+
+func (g *gaugePair) Inc() {
+	g.Add(1)
+}
+
+func (g *gaugePair) Dec() {
+	g.Add(-1)
+}
+
+func (g *gaugePair) Add(v float64) {
+	for {
+		oldBits := atomic.LoadUint64(&g.valBits)
+		newVal := math.Float64frombits(oldBits) + v
+		if atomic.CompareAndSwapUint64(&g.valBits, oldBits, math.Float64bits(newVal)) {
+			g.track(newVal)
+			return
+		}
+	}
+}
+
+func (g *gaugePair) Sub(v float64) {
+	g.Add(v * -1)
+}
+
+func (g *gaugePair) SetIfHigher(v float64) bool {
+	if !g.value.SetIfHigher(v) {
+		return false
+	}
+	g.track(v)
+	return true
+}
+
+func (g *gaugePair) SetIfLower(v float64) bool {
+	if !g.value.SetIfLower(v) {
+		return false
+	}
+	g.track(v)
+	return true
+}
+
+// track updates the extremes with the provided new value.
+func (g *gaugePair) track(v float64) {
+	if g.max != nil {
+		g.max.SetIfHigher(v)
+	}
+	if g.min != nil {
+		g.min.SetIfLower(v)
+	}
+}
+
+func (g *gaugePair) ResetMax() {
+	if g.max != nil {
+		g.max.Set(math.Float64frombits(atomic.LoadUint64(&g.valBits)))
+	}
+}
+
+func (g *gaugePair) ResetMin() {
+	if g.min != nil {
+		g.min.Set(math.Float64frombits(atomic.LoadUint64(&g.valBits)))
+	}
+}
+
+// Describe implements Collector.
+func (g *gaugePair) Describe(ch chan<- *Desc) {
+	ch <- g.desc
+	if g.max != nil {
+		ch <- g.max.desc
+	}
+	if g.min != nil {
+		ch <- g.min.desc
+	}
+}
+
+// Collect implements Collector.
+func (g *gaugePair) Collect(ch chan<- Metric) {
+	ch <- g.value
+	if g.max != nil {
+		ch <- g.max
+	}
+	if g.min != nil {
+		ch <- g.min
+	}
 }
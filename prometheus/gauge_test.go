@@ -14,11 +14,19 @@
 package prometheus
 
 import (
+	"errors"
+	"fmt"
 	"math"
 	"math/rand"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"testing/quick"
+	"time"
 
 	dto "github.com/prometheus/client_model/go"
 )
@@ -159,6 +167,75 @@ func TestGaugeVecConcurrency(t *testing.T) {
 	}
 }
 
+func TestGaugeVecDeleteConcurrency(t *testing.T) {
+	it := func(n uint32) bool {
+		mutations := int(n%1000 + 1)
+		concLevel := int(n%15 + 1)
+
+		gge := NewGaugeVec(
+			GaugeOpts{
+				Name: "test_gauge",
+				Help: "no help can be found here",
+			},
+			[]string{"label"},
+		)
+
+		var start, end sync.WaitGroup
+		start.Add(1)
+		end.Add(concLevel)
+		failed := make(chan string, concLevel)
+
+		// Each goroutine creates and deletes the child for its own label
+		// value while the others modify the same vector concurrently.
+		for i := 0; i < concLevel; i++ {
+			go func(label string) {
+				defer end.Done()
+				start.Wait()
+				for j := 0; j < mutations; j++ {
+					g := gge.WithLabelValues(label)
+					if got := math.Float64frombits(g.(*value).valBits); got != 0 {
+						failed <- fmt.Sprintf("expected a new child for %q, got value %f", label, got)
+						return
+					}
+					g.Inc()
+					var deleted bool
+					if j%2 == 0 {
+						deleted = gge.DeleteLabelValues(label)
+					} else {
+						deleted = gge.Delete(Labels{"label": label})
+					}
+					if !deleted {
+						failed <- fmt.Sprintf("expected deletion of child for %q", label)
+						return
+					}
+					if gge.DeleteLabelValues(label) {
+						failed <- fmt.Sprintf("expected no second deletion of child for %q", label)
+						return
+					}
+				}
+			}(string(rune('A' + i)))
+		}
+		start.Done()
+		end.Wait()
+
+		select {
+		case msg := <-failed:
+			t.Fatal(msg)
+			return false
+		default:
+		}
+		if got := len(gge.children); got != 0 {
+			t.Fatalf("expected no children left, got %d", got)
+			return false
+		}
+		return true
+	}
+
+	if err := quick.Check(it, nil); err != nil {
+		t.Fatal(err)
+	}
+}
+
 func TestGaugeFunc(t *testing.T) {
 	gf := NewGaugeFunc(
 		GaugeOpts{
@@ -180,3 +257,947 @@ func TestGaugeFunc(t *testing.T) {
 		t.Errorf("expected %q, got %q", expected, got)
 	}
 }
+
+func TestGaugeFn(t *testing.T) {
+	size := 3.
+	g := NewGaugeFn(GaugeOpts{Name: "test_name", Help: "test help"}, func() float64 { return size })
+
+	m := &dto.Metric{}
+	g.Write(m)
+	if expected, got := 3., m.GetGauge().GetValue(); expected != got {
+		t.Errorf("Expected %f, got %f.", expected, got)
+	}
+	size = 4
+	m.Reset()
+	g.Write(m)
+	if expected, got := 4., m.GetGauge().GetValue(); expected != got {
+		t.Errorf("Expected %f, got %f.", expected, got)
+	}
+
+	defer func() {
+		if r := recover(); r != errGaugeFnReadOnly {
+			t.Errorf("Expected panic %v, got %v.", errGaugeFnReadOnly, r)
+		}
+	}()
+	g.Set(1)
+}
+
+func TestGaugeSetIfHigherLower(t *testing.T) {
+	vec := NewGaugeVec(GaugeOpts{Name: "test", Help: "test help"}, []string{"pool"})
+	g := vec.WithLabelValues("a")
+
+	if !g.SetIfHigher(5) {
+		t.Error("expected SetIfHigher(5) to update the gauge")
+	}
+	if g.SetIfHigher(3) {
+		t.Error("expected SetIfHigher(3) not to update the gauge")
+	}
+	if g.SetIfLower(7) {
+		t.Error("expected SetIfLower(7) not to update the gauge")
+	}
+	if !vec.SetIfLowerWithLabelValues(2, "a") {
+		t.Error("expected SetIfLowerWithLabelValues(2) to update the gauge")
+	}
+	if vec.SetIfHigherWithLabelValues(2, "a") {
+		t.Error("expected SetIfHigherWithLabelValues(2) not to update the gauge")
+	}
+
+	m := &dto.Metric{}
+	g.Write(m)
+	if expected, got := 2., m.GetGauge().GetValue(); expected != got {
+		t.Errorf("expected %f, got %f", expected, got)
+	}
+
+	var wg sync.WaitGroup
+	max := NewGauge(GaugeOpts{Name: "test_max", Help: "test help"})
+	for i := 1; i <= 100; i++ {
+		wg.Add(1)
+		go func(v float64) {
+			max.SetIfHigher(v)
+			wg.Done()
+		}(float64(i))
+	}
+	wg.Wait()
+	max.Write(m)
+	if expected, got := 100., m.GetGauge().GetValue(); expected != got {
+		t.Errorf("expected %f, got %f", expected, got)
+	}
+}
+
+func TestTrackedGaugeFunc(t *testing.T) {
+	var updated time.Time
+	tgf := NewTrackedGaugeFunc(
+		GaugeOpts{
+			Namespace: "cache",
+			Name:      "entries",
+			Help:      "test help",
+		},
+		func() (float64, time.Time) { return 42, updated },
+	)
+
+	collect := func() []*dto.Metric {
+		ch := make(chan Metric, 2)
+		tgf.Collect(ch)
+		close(ch)
+		var result []*dto.Metric
+		for m := range ch {
+			out := &dto.Metric{}
+			m.Write(out)
+			result = append(result, out)
+		}
+		return result
+	}
+
+	if got := collect(); len(got) != 1 {
+		t.Errorf("expected 1 metric for zero update time, got %d", len(got))
+	}
+
+	updated = time.Unix(1500, 5e8)
+	got := collect()
+	if len(got) != 2 {
+		t.Fatalf("expected 2 metrics, got %d", len(got))
+	}
+	if expected, got := 42., got[0].GetGauge().GetValue(); expected != got {
+		t.Errorf("expected %f, got %f", expected, got)
+	}
+	if expected, got := 1500.5, got[1].GetGauge().GetValue(); expected != got {
+		t.Errorf("expected %f, got %f", expected, got)
+	}
+
+	registry := newRegistry()
+	if _, err := registry.Register(tgf); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRatioGauge(t *testing.T) {
+	var (
+		hits    = NewCounter(CounterOpts{Name: "hits_total", Help: "test help"})
+		lookups = NewCounter(CounterOpts{Name: "lookups_total", Help: "test help"})
+		rg      = NewRatioGauge(hits, lookups, GaugeOpts{Name: "hit_ratio", Help: "test help"})
+	)
+
+	collect := func() []float64 {
+		ch := make(chan Metric, 3)
+		rg.Collect(ch)
+		close(ch)
+		var result []float64
+		for m := range ch {
+			out := &dto.Metric{}
+			m.Write(out)
+			if out.Gauge != nil {
+				result = append(result, out.GetGauge().GetValue())
+			} else {
+				result = append(result, out.GetCounter().GetValue())
+			}
+		}
+		return result
+	}
+
+	if got := collect(); !math.IsNaN(got[0]) {
+		t.Errorf("expected NaN for zero denominator, got %f", got[0])
+	}
+
+	hits.Add(3)
+	lookups.Add(4)
+	got := collect()
+	for i, expected := range []float64{0.75, 3, 4} {
+		if expected != got[i] {
+			t.Errorf("%d. expected %f, got %f", i, expected, got[i])
+		}
+	}
+
+	if _, err := newRegistry().Register(rg); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestLabeledGaugeFunc(t *testing.T) {
+	desc := NewDesc("goroutines", "test help", []string{"state"}, Labels{"a": "1"})
+	lgf := NewLabeledGaugeFunc(desc, map[string]func() float64{
+		"waiting": func() float64 { return 3 },
+		"running": func() float64 { return 1 },
+	})
+
+	ch := make(chan Metric, 2)
+	lgf.Collect(ch)
+	close(ch)
+	var got []string
+	for m := range ch {
+		out := &dto.Metric{}
+		m.Write(out)
+		got = append(got, out.String())
+	}
+	expected := []string{
+		`label:<name:"a" value:"1" > label:<name:"state" value:"running" > gauge:<value:1 > `,
+		`label:<name:"a" value:"1" > label:<name:"state" value:"waiting" > gauge:<value:3 > `,
+	}
+	if len(got) != len(expected) {
+		t.Fatalf("expected %d metrics, got %d", len(expected), len(got))
+	}
+	for i := range expected {
+		if expected[i] != got[i] {
+			t.Errorf("%d. expected %q, got %q", i, expected[i], got[i])
+		}
+	}
+
+	if _, err := newRegistry().Register(lgf); err != nil {
+		t.Error(err)
+	}
+
+	defer func() {
+		if r := recover(); r == nil {
+			t.Error("expected panic for desc without variable label")
+		}
+	}()
+	NewLabeledGaugeFunc(NewDesc("invalid", "test help", nil, nil), nil)
+}
+
+func TestGaugeGroup(t *testing.T) {
+	type cpuStats struct{ user, system float64 }
+	var (
+		userDesc   = NewDesc("cpu_user_seconds", "test help", nil, nil)
+		systemDesc = NewDesc("cpu_system_seconds", "test help", nil, nil)
+	)
+	gg := NewGaugeGroup(
+		[]*Desc{userDesc, systemDesc},
+		func(data interface{}, s GaugeGroupSetter) {
+			stats := data.(cpuStats)
+			s.Set("cpu_user_seconds", stats.user)
+			s.Set("cpu_system_seconds", stats.system)
+		},
+	)
+
+	collect := func() []float64 {
+		ch := make(chan Metric, 2)
+		gg.Collect(ch)
+		close(ch)
+		var result []float64
+		for m := range ch {
+			out := &dto.Metric{}
+			m.Write(out)
+			result = append(result, out.GetGauge().GetValue())
+		}
+		return result
+	}
+
+	gg.Update(cpuStats{user: 1.5, system: 0.5})
+	got := collect()
+	for i, expected := range []float64{1.5, 0.5} {
+		if expected != got[i] {
+			t.Errorf("%d. expected %f, got %f", i, expected, got[i])
+		}
+	}
+
+	if _, err := newRegistry().Register(gg); err != nil {
+		t.Error(err)
+	}
+
+	defer func() {
+		if r := recover(); r == nil {
+			t.Error("expected panic for unknown gauge name")
+		}
+	}()
+	gg.Update(cpuStats{})
+	NewGaugeGroup([]*Desc{userDesc}, func(_ interface{}, s GaugeGroupSetter) {
+		s.Set("unknown", 1)
+	}).Update(nil)
+}
+
+func TestDerivedGaugeAndCounter(t *testing.T) {
+	var (
+		bytes   = NewGauge(GaugeOpts{Name: "memory_bytes", Help: "test help"})
+		nanos   = NewCounter(CounterOpts{Name: "cpu_nanoseconds_total", Help: "test help"})
+		mbytes  = NewDerivedGauge(NewDesc("memory_megabytes", "test help", nil, nil), bytes, func(v float64) float64 { return v / 1e6 })
+		seconds = NewDerivedCounter(NewDesc("cpu_seconds_total", "test help", nil, nil), nanos, func(v float64) float64 { return v / 1e9 })
+	)
+	bytes.Set(3e6)
+	nanos.Add(1.5e9)
+
+	collect := func(c Collector) *dto.Metric {
+		ch := make(chan Metric, 1)
+		c.Collect(ch)
+		out := &dto.Metric{}
+		(<-ch).Write(out)
+		return out
+	}
+
+	if expected, got := `gauge:<value:3 > `, collect(mbytes).String(); expected != got {
+		t.Errorf("expected %q, got %q", expected, got)
+	}
+	if expected, got := `counter:<value:1.5 > `, collect(seconds).String(); expected != got {
+		t.Errorf("expected %q, got %q", expected, got)
+	}
+
+	registry := newRegistry()
+	for _, c := range []Collector{bytes, mbytes, seconds} {
+		if _, err := registry.Register(c); err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func TestSharedGauge(t *testing.T) {
+	var depth uint64
+	g := NewSharedGauge(GaugeOpts{Name: "queue_depth", Help: "test help"}, &depth)
+	g.Set(3)
+	g.Inc()
+	g.Sub(0.5)
+	if !g.SetIfHigher(42) {
+		t.Error("expected SetIfHigher(42) to update the gauge")
+	}
+	g.Dec()
+	if expected, got := 41., math.Float64frombits(atomic.LoadUint64(&depth)); expected != got {
+		t.Errorf("expected %f, got %f", expected, got)
+	}
+
+	atomic.StoreUint64(&depth, math.Float64bits(7))
+	m := &dto.Metric{}
+	g.Write(m)
+	if expected, got := 7., m.GetGauge().GetValue(); expected != got {
+		t.Errorf("expected %f, got %f", expected, got)
+	}
+
+	depths := map[string]*uint64{"a": new(uint64), "b": new(uint64)}
+	vec := NewSharedGaugeVec(
+		GaugeOpts{Name: "queue_depths", Help: "test help"},
+		[]string{"queue"},
+		func(lvs ...string) *uint64 { return depths[lvs[0]] },
+	)
+	vec.WithLabelValues("b").Add(2)
+	if expected, got := 2., math.Float64frombits(atomic.LoadUint64(depths["b"])); expected != got {
+		t.Errorf("expected %f, got %f", expected, got)
+	}
+	if expected, got := 0., math.Float64frombits(atomic.LoadUint64(depths["a"])); expected != got {
+		t.Errorf("expected %f, got %f", expected, got)
+	}
+}
+
+func TestMutuallyExclusiveGaugeSet(t *testing.T) {
+	set := NewMutuallyExclusiveGaugeSet([]GaugeOpts{
+		{Namespace: "raft", Name: "leader", Help: "test help"},
+		{Namespace: "raft", Name: "follower", Help: "test help"},
+		{Namespace: "raft", Name: "candidate", Help: "test help"},
+	})
+
+	collect := func() []float64 {
+		ch := make(chan Metric, 3)
+		set.Collect(ch)
+		close(ch)
+		var result []float64
+		for m := range ch {
+			out := &dto.Metric{}
+			m.Write(out)
+			result = append(result, out.GetGauge().GetValue())
+		}
+		return result
+	}
+
+	if expected, got := []float64{1, 0, 0}, collect(); !reflect.DeepEqual(expected, got) {
+		t.Errorf("expected %v, got %v", expected, got)
+	}
+	set.SetState(2)
+	if expected, got := 2, set.CurrentState(); expected != got {
+		t.Errorf("expected %d, got %d", expected, got)
+	}
+	if err := set.SetStateByName("raft_follower"); err != nil {
+		t.Error(err)
+	}
+	if expected, got := []float64{0, 1, 0}, collect(); !reflect.DeepEqual(expected, got) {
+		t.Errorf("expected %v, got %v", expected, got)
+	}
+	if err := set.SetStateByName("raft_observer"); err == nil {
+		t.Error("expected error for unknown state")
+	}
+
+	if _, err := newRegistry().Register(set); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestThresholdGauge(t *testing.T) {
+	g := NewThresholdGauge(GaugeOpts{Name: "queue_depth", Help: "helpless"})
+	above := make(chan float64, 10)
+	below := make(chan float64, 10)
+	g.OnThresholdCrossing(1000, CrossedAbove, func(v float64) { above <- v })
+	g.OnThresholdCrossing(10, CrossedBelow, func(v float64) { below <- v })
+
+	g.Set(1000) // Not above yet.
+	g.Add(5)
+	g.Set(2000) // Debounced.
+	g.Set(500)
+	g.Set(1500) // Debounced.
+	if expected, got := 1005., <-above; expected != got {
+		t.Errorf("expected %f, got %f", expected, got)
+	}
+
+	g.Sub(1490) // Exactly at the threshold is not below yet.
+	g.Dec()
+	if expected, got := 9., <-below; expected != got {
+		t.Errorf("expected %f, got %f", expected, got)
+	}
+
+	g.ResetThresholds()
+	g.SetIfLower(5) // Already below, thus no crossing.
+	if !g.SetIfHigher(1001) {
+		t.Error("expected SetIfHigher to update the gauge")
+	}
+	if expected, got := 1001., <-above; expected != got {
+		t.Errorf("expected %f, got %f", expected, got)
+	}
+
+	// Give stray callbacks a chance to show up.
+	time.Sleep(10 * time.Millisecond)
+	if len(above) != 0 || len(below) != 0 {
+		t.Errorf("unexpected callbacks: %d above, %d below", len(above), len(below))
+	}
+
+	m := &dto.Metric{}
+	g.Write(m)
+	if expected, got := 1001., m.GetGauge().GetValue(); expected != got {
+		t.Errorf("expected %f, got %f", expected, got)
+	}
+}
+
+func TestHysteresisGauge(t *testing.T) {
+	budget := NewGauge(GaugeOpts{Name: "error_budget_burn_ratio", Help: "test help"})
+	alert := NewHysteresisGauge(GaugeOpts{Name: "error_budget_alert", Help: "test help"}, budget, 0.9, 0.5)
+
+	for i, s := range []struct {
+		value    float64
+		expected bool
+	}{
+		{0.7, false},
+		{0.95, true},
+		{0.7, true},
+		{0.5, true},
+		{0.4, false},
+		{0.9, false},
+	} {
+		budget.Set(s.value)
+		if got := alert.CurrentState(); got != s.expected {
+			t.Errorf("%d. expected state %t for value %f, got %t", i, s.expected, s.value, got)
+		}
+	}
+
+	budget.Set(1)
+	ch := make(chan Metric, 1)
+	alert.Collect(ch)
+	m := &dto.Metric{}
+	(<-ch).Write(m)
+	if expected, got := `gauge:<value:1 > `, m.String(); expected != got {
+		t.Errorf("expected %q, got %q", expected, got)
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Error("expected panic for fall threshold greater than rise threshold")
+		}
+	}()
+	NewHysteresisGauge(GaugeOpts{Name: "test", Help: "test help"}, budget, 0.5, 0.9)
+}
+
+func TestHierarchicalGaugeVec(t *testing.T) {
+	vec := NewHierarchicalGaugeVec(
+		GaugeOpts{Name: "connections", Help: "test help"},
+		[][]string{{"datacenter"}, {"zone", "host"}},
+	).WithAggregation(0, AggregateMax)
+	vec.Set(3, "dc1", "a", "h1")
+	vec.Set(5, "dc1", "a", "h2")
+	vec.Set(2, "dc1", "b", "h3")
+	vec.Set(4, "dc2", "a", "h4")
+	vec.Set(1, "dc2", "a", "h4") // Overwrites.
+
+	registry := newRegistry()
+	if _, err := registry.Register(vec); err != nil {
+		t.Fatal(err)
+	}
+	ch := make(chan Metric, 10)
+	vec.Collect(ch)
+	close(ch)
+	got := map[string]float64{}
+	for metric := range ch {
+		m := &dto.Metric{}
+		if err := metric.Write(m); err != nil {
+			t.Fatal(err)
+		}
+		var lvs []string
+		for _, lp := range m.Label {
+			lvs = append(lvs, lp.GetName()+"="+lp.GetValue())
+		}
+		got[strings.Join(lvs, ",")] = m.GetGauge().GetValue()
+	}
+	expected := map[string]float64{
+		"datacenter=dc1,host=h1,zone=a": 3,
+		"datacenter=dc1,host=h2,zone=a": 5,
+		"datacenter=dc1,host=h3,zone=b": 2,
+		"datacenter=dc2,host=h4,zone=a": 1,
+		"datacenter=dc1,host=,zone=":    5,
+		"datacenter=dc2,host=,zone=":    1,
+	}
+	if !reflect.DeepEqual(expected, got) {
+		t.Errorf("expected %v, got %v", expected, got)
+	}
+
+	if !vec.Delete("dc2", "a", "h4") {
+		t.Error("expected leaf to be deleted")
+	}
+	ch = make(chan Metric, 10)
+	vec.Collect(ch)
+	close(ch)
+	if expected, got := 4, len(ch); expected != got {
+		t.Errorf("expected %d metrics after delete, got %d", expected, got)
+	}
+}
+
+func TestHierarchicalGaugeVecAggregations(t *testing.T) {
+	for a, expected := range map[Aggregation]float64{
+		AggregateSum: 6,
+		AggregateAvg: 2,
+		AggregateMax: 3,
+		AggregateMin: 1,
+	} {
+		vec := NewHierarchicalGaugeVec(
+			GaugeOpts{Name: "test", Help: "test help"},
+			[][]string{{"region"}, {"host"}},
+		).WithAggregation(0, a)
+		for i, host := range []string{"a", "b", "c"} {
+			vec.Set(float64(i+1), "eu", host)
+		}
+		ch := make(chan Metric, 4)
+		vec.Collect(ch)
+		for i := 0; i < 3; i++ {
+			<-ch
+		}
+		m := &dto.Metric{}
+		(<-ch).Write(m)
+		if got := m.GetGauge().GetValue(); expected != got {
+			t.Errorf("aggregation %d: expected %f, got %f", a, expected, got)
+		}
+	}
+}
+
+func TestQueueDepthGauge(t *testing.T) {
+	g := NewQueueDepthGauge(GaugeOpts{Name: "test_queue_depth", Help: "helpless"})
+	depth := func() float64 {
+		m := &dto.Metric{}
+		if err := g.Write(m); err != nil {
+			t.Fatal(err)
+		}
+		return m.GetGauge().GetValue()
+	}
+
+	dequeue := g.Enqueue()
+	dequeueBatch := g.EnqueueN(5)
+	if expected, got := 6., depth(); expected != got {
+		t.Errorf("Expected %f, got %f.", expected, got)
+	}
+	dequeueBatch()
+	dequeueBatch()
+	if expected, got := 1., depth(); expected != got {
+		t.Errorf("Expected %f after dequeuing batch twice, got %f.", expected, got)
+	}
+	func() {
+		defer g.Enqueue()()
+		if expected, got := 2., depth(); expected != got {
+			t.Errorf("Expected %f, got %f.", expected, got)
+		}
+	}()
+	dequeue()
+	if expected, got := 0., depth(); expected != got {
+		t.Errorf("Expected %f, got %f.", expected, got)
+	}
+
+	vec := NewQueueDepthGaugeVec(GaugeOpts{Name: "test_queue_depth", Help: "helpless"}, []string{"queue"})
+	dequeue = vec.EnqueueWithLabels("jobs")
+	m := &dto.Metric{}
+	vec.WithLabelValues("jobs").Write(m)
+	if expected, got := 1., m.GetGauge().GetValue(); expected != got {
+		t.Errorf("Expected %f, got %f.", expected, got)
+	}
+	dequeue()
+	vec.WithLabelValues("jobs").Write(m)
+	if expected, got := 0., m.GetGauge().GetValue(); expected != got {
+		t.Errorf("Expected %f, got %f.", expected, got)
+	}
+}
+
+func TestTrailingAverageGauge(t *testing.T) {
+	g := WithTrailingAverage(NewGauge(GaugeOpts{
+		Name:        "test_gauge",
+		Help:        "helpless",
+		ConstLabels: Labels{"a": "1"},
+	}), time.Second)
+	now := time.Unix(0, 0)
+	g.(*trailingAverageGauge).now = func() time.Time { return now }
+
+	g.Set(10)
+	if expected, got := 10., g.AverageValue(); expected != got {
+		t.Errorf("Expected %f, got %f.", expected, got)
+	}
+	now = now.Add(time.Second)
+	g.Set(20)
+	if expected, got := 20-10/math.E, g.AverageValue(); math.Abs(expected-got) > 1e-9 {
+		t.Errorf("Expected %f, got %f.", expected, got)
+	}
+	now = now.Add(time.Hour)
+	g.Add(10)
+	if expected, got := 30., g.AverageValue(); math.Abs(expected-got) > 1e-9 {
+		t.Errorf("Expected %f, got %f.", expected, got)
+	}
+
+	g.Reset()
+	g.Sub(20)
+	if expected, got := 10., g.AverageValue(); expected != got {
+		t.Errorf("Expected %f after reset, got %f.", expected, got)
+	}
+
+	ch := make(chan Metric, 2)
+	g.Collect(ch)
+	close(ch)
+	var got []string
+	for m := range ch {
+		out := &dto.Metric{}
+		m.Write(out)
+		got = append(got, m.Desc().fqName+" "+out.String())
+	}
+	expected := []string{
+		`test_gauge label:<name:"a" value:"1" > gauge:<value:10 > `,
+		`test_gauge_trailing_avg label:<name:"a" value:"1" > gauge:<value:10 > `,
+	}
+	if !reflect.DeepEqual(expected, got) {
+		t.Errorf("Expected %q, got %q.", expected, got)
+	}
+
+	if _, err := newRegistry().Register(g); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestConstGaugesFromSyscall(t *testing.T) {
+	fds := NewDesc("open_fds", "test help", nil, nil)
+	faults := NewDesc("page_faults", "test help", nil, nil)
+	missing := NewDesc("missing", "test help", nil, nil)
+	calls := 0
+	var sysErr error
+	c := NewConstGaugesFromSyscall([]SyscallGaugeDef{
+		{Desc: fds, Index: 0},
+		{Desc: faults, Index: 2},
+		{Desc: missing, Index: 3},
+	}, func() ([]uint64, error) {
+		calls++
+		return []uint64{7, 8, 9}, sysErr
+	})
+
+	ch := make(chan Metric, 3)
+	c.Collect(ch)
+	close(ch)
+	if expected, got := 1, calls; expected != got {
+		t.Errorf("Expected %d syscalls, got %d.", expected, got)
+	}
+	var got []float64
+	for m := range ch {
+		out := &dto.Metric{}
+		if err := m.Write(out); err != nil {
+			if m.Desc() != missing {
+				t.Errorf("unexpected error for %s: %s", m.Desc(), err)
+			}
+			continue
+		}
+		got = append(got, out.GetGauge().GetValue())
+	}
+	if expected := []float64{7, 9}; !reflect.DeepEqual(expected, got) {
+		t.Errorf("Expected %v, got %v.", expected, got)
+	}
+
+	sysErr = errors.New("syscall failed")
+	ch = make(chan Metric, 3)
+	c.Collect(ch)
+	if expected, got := 0, len(ch); expected != got {
+		t.Errorf("Expected %d metrics on error, got %d.", expected, got)
+	}
+}
+
+func TestEventGauge(t *testing.T) {
+	g := NewEventGauge(EventGaugeOpts{
+		GaugeOpts:  GaugeOpts{Name: "test_requests", Help: "helpless"},
+		WindowSize: 4,
+	})
+	if got := g.SuccessRate(); !math.IsNaN(got) {
+		t.Errorf("Expected NaN without events, got %f.", got)
+	}
+	for _, success := range []bool{false, true, true, false, true, true} {
+		g.Record(success)
+	}
+	// The first two events have left the window.
+	if expected, got := .75, g.SuccessRate(); expected != got {
+		t.Errorf("Expected %f, got %f.", expected, got)
+	}
+
+	ch := make(chan Metric, 3)
+	g.Collect(ch)
+	close(ch)
+	var got []string
+	for m := range ch {
+		out := &dto.Metric{}
+		m.Write(out)
+		got = append(got, m.Desc().fqName+" "+out.String())
+	}
+	expected := []string{
+		`test_requests_success_rate gauge:<value:0.75 > `,
+		`test_requests_window_total gauge:<value:4 > `,
+		`test_requests_events_recorded_total counter:<value:6 > `,
+	}
+	if !reflect.DeepEqual(expected, got) {
+		t.Errorf("Expected %q, got %q.", expected, got)
+	}
+
+	vec := NewEventGaugeVec(EventGaugeOpts{
+		GaugeOpts: GaugeOpts{Name: "test_requests", Help: "helpless"},
+	}, []string{"backend"})
+	vec.WithLabelValues("a").Record(true)
+	vec.With(Labels{"backend": "b"}).Record(false)
+	if expected, got := 0., vec.WithLabelValues("b").SuccessRate(); expected != got {
+		t.Errorf("Expected %f, got %f.", expected, got)
+	}
+	ch = make(chan Metric, 6)
+	vec.Collect(ch)
+	if expected, got := 6, len(ch); expected != got {
+		t.Errorf("Expected %d metrics, got %d.", expected, got)
+	}
+	if _, err := newRegistry().Register(vec); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestSnapshotGauge(t *testing.T) {
+	for _, g := range []Gauge{
+		NewGauge(GaugeOpts{Name: "test", Help: "helpless"}),
+		NewThresholdGauge(GaugeOpts{Name: "test", Help: "helpless"}),
+	} {
+		var got float64
+		g.Set(1)
+		read := SnapshotGauge(g, &got)
+		g.Set(2)
+		if expected := 0.; expected != got {
+			t.Errorf("Expected %f before the read, got %f.", expected, got)
+		}
+		read()
+		if expected := 2.; expected != got {
+			t.Errorf("Expected %f, got %f.", expected, got)
+		}
+		g.Add(1)
+		read()
+		if expected := 3.; expected != got {
+			t.Errorf("Expected %f after the second read, got %f.", expected, got)
+		}
+	}
+}
+
+func TestGaugeVecAddN(t *testing.T) {
+	vec := NewGaugeVec(GaugeOpts{
+		Name: "test",
+		Help: "test help",
+	}, []string{"a"})
+	vec.AddN(3, "x")
+	vec.AddN(-1.5, "x")
+	m := &dto.Metric{}
+	vec.WithLabelValues("x").Write(m)
+	if expected, got := 1.5, m.GetGauge().GetValue(); expected != got {
+		t.Errorf("Expected %f, got %f.", expected, got)
+	}
+}
+
+func TestGaugeVecAddIf(t *testing.T) {
+	vec := NewGaugeVec(GaugeOpts{
+		Name: "test",
+		Help: "test help",
+	}, []string{"a"})
+	if !vec.AddIf(true, -2, "x") || vec.AddIf(false, 5, "x") {
+		t.Error("Expected the condition to be returned.")
+	}
+	m := &dto.Metric{}
+	vec.WithLabelValues("x").Write(m)
+	if expected, got := -2., m.GetGauge().GetValue(); expected != got {
+		t.Errorf("Expected %f, got %f.", expected, got)
+	}
+}
+
+func TestGaugeVecStats(t *testing.T) {
+	vec := NewGaugeVec(GaugeOpts{Name: "test_latency", Help: "helpless"}, []string{"service"})
+	if got := vec.Percentile(50); !math.IsNaN(got) {
+		t.Errorf("Expected NaN for empty vector, got %f.", got)
+	}
+	if stats := vec.Stats(); stats.Count != 0 || !math.IsNaN(stats.Mean) {
+		t.Errorf("Expected no stats for empty vector, got %+v.", stats)
+	}
+
+	for i, v := range []float64{4, 1, 3, 2, 5} {
+		vec.WithLabelValues(fmt.Sprint(i)).Set(v)
+	}
+	for _, s := range []struct{ p, expected float64 }{
+		{0, 1}, {25, 2}, {50, 3}, {90, 4.6}, {100, 5},
+	} {
+		if got := vec.Percentile(s.p); math.Abs(s.expected-got) > 1e-9 {
+			t.Errorf("Expected percentile %f to be %f, got %f.", s.p, s.expected, got)
+		}
+	}
+	if got := vec.Percentile(101); !math.IsNaN(got) {
+		t.Errorf("Expected NaN for percentile out of range, got %f.", got)
+	}
+	stats := vec.Stats()
+	if stats.Min != 1 || stats.Max != 5 || stats.Mean != 3 || stats.P50 != 3 || stats.Count != 5 {
+		t.Errorf("Unexpected stats %+v.", stats)
+	}
+	if expected := 4.96; math.Abs(stats.P99-expected) > 1e-9 {
+		t.Errorf("Expected P99 %f, got %f.", expected, stats.P99)
+	}
+}
+
+func TestSetFromEnv(t *testing.T) {
+	const envVar = "PROMETHEUS_TEST_SET_FROM_ENV"
+	defer os.Unsetenv(envVar)
+	g := NewGauge(GaugeOpts{Name: "test_threshold", Help: "helpless"})
+	value := func() float64 {
+		m := &dto.Metric{}
+		g.Write(m)
+		return m.GetGauge().GetValue()
+	}
+
+	os.Unsetenv(envVar)
+	g.Set(1)
+	if err := SetFromEnv(g, envVar); err != ErrEnvVarNotSet {
+		t.Errorf("Expected ErrEnvVarNotSet, got %v.", err)
+	}
+	if expected, got := 1., value(); expected != got {
+		t.Errorf("Expected %f, got %f.", expected, got)
+	}
+	if err := SetFromEnvOr(g, envVar, 42); err != nil {
+		t.Error(err)
+	}
+	if expected, got := 42., value(); expected != got {
+		t.Errorf("Expected %f, got %f.", expected, got)
+	}
+
+	os.Setenv(envVar, "0.995")
+	if err := SetFromEnvOr(g, envVar, 42); err != nil {
+		t.Error(err)
+	}
+	if expected, got := 0.995, value(); expected != got {
+		t.Errorf("Expected %f, got %f.", expected, got)
+	}
+
+	os.Setenv(envVar, "high")
+	if _, ok := SetFromEnv(g, envVar).(*strconv.NumError); !ok {
+		t.Error("Expected *strconv.NumError for unparsable value.")
+	}
+	if expected, got := 0.995, value(); expected != got {
+		t.Errorf("Expected %f, got %f.", expected, got)
+	}
+	defer func() {
+		if r := recover(); r == nil {
+			t.Error("Expected panic for unparsable value.")
+		}
+	}()
+	MustSetFromEnv(g, envVar)
+}
+
+func TestEventualConsistencyGauge(t *testing.T) {
+	collect := func(g EventualConsistencyGauge) []float64 {
+		ch := make(chan Metric, 3)
+		g.Collect(ch)
+		close(ch)
+		var values []float64
+		for m := range ch {
+			pb := &dto.Metric{}
+			m.Write(pb)
+			values = append(values, pb.GetGauge().GetValue())
+		}
+		return values
+	}
+
+	fetched := make(chan struct{}, 1)
+	g := NewEventualConsistencyGauge(GaugeOpts{
+		Name: "test_gauge",
+		Help: "helpless",
+	}, func() (float64, error) {
+		defer func() { fetched <- struct{}{} }()
+		return 42, nil
+	}, time.Hour)
+	defer g.Close()
+	<-fetched
+	values := collect(g)
+	if expected, got := 42., values[0]; expected != got {
+		t.Errorf("Expected %f, got %f.", expected, got)
+	}
+	if got := values[1]; got < 0 || got > 60 {
+		t.Errorf("Expected staleness close to 0, got %f.", got)
+	}
+	if expected, got := 0., values[2]; expected != got {
+		t.Errorf("Expected %f, got %f.", expected, got)
+	}
+
+	failing := NewEventualConsistencyGauge(GaugeOpts{
+		Name: "test_gauge",
+		Help: "helpless",
+	}, func() (float64, error) {
+		return 0, errors.New("unavailable")
+	}, 10*time.Millisecond)
+	defer failing.Close()
+	time.Sleep(20 * time.Millisecond)
+	values = collect(failing)
+	if got := values[0]; !math.IsNaN(got) {
+		t.Errorf("Expected NaN before the first successful fetch, got %f.", got)
+	}
+	if expected, got := 1., values[2]; expected != got {
+		t.Errorf("Expected %f, got %f.", expected, got)
+	}
+}
+
+func TestGaugePair(t *testing.T) {
+	g := NewGaugePair(GaugePairOpts{
+		GaugeOpts: GaugeOpts{Name: "test_pool_in_use", Help: "helpless"},
+		TrackMax:  true,
+		TrackMin:  true,
+	})
+	g.Set(5)
+	g.Add(3)
+	g.Sub(10)
+	g.Inc()
+
+	values := map[string]float64{}
+	ch := make(chan Metric, 3)
+	g.Collect(ch)
+	close(ch)
+	for m := range ch {
+		pb := &dto.Metric{}
+		m.Write(pb)
+		values[m.Desc().fqName] = pb.GetGauge().GetValue()
+	}
+	for name, expected := range map[string]float64{
+		"test_pool_in_use":           -1,
+		"test_pool_in_use_max_value": 8,
+		"test_pool_in_use_min_value": -2,
+	} {
+		if got := values[name]; expected != got {
+			t.Errorf("Expected %f for %s, got %f.", expected, name, got)
+		}
+	}
+
+	g.ResetMax()
+	g.ResetMin()
+	max, min := g.(*gaugePair).max, g.(*gaugePair).min
+	if expected, got := -1., math.Float64frombits(max.valBits); expected != got {
+		t.Errorf("Expected %f, got %f.", expected, got)
+	}
+	if expected, got := -1., math.Float64frombits(min.valBits); expected != got {
+		t.Errorf("Expected %f, got %f.", expected, got)
+	}
+
+	untracked := NewGaugePair(GaugePairOpts{
+		GaugeOpts: GaugeOpts{Name: "test_gauge", Help: "helpless"},
+	})
+	if expected, got := 1, len(describe(untracked)); expected != got {
+		t.Errorf("Expected %d descs, got %d.", expected, got)
+	}
+}
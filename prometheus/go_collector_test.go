@@ -117,3 +117,64 @@ func TestGCCollector(t *testing.T) {
 		}
 	}
 }
+
+func TestGoCollectorMemStats(t *testing.T) {
+	registry := newRegistry()
+	if _, err := registry.Register(NewGoCollector()); err != nil {
+		t.Fatal(err)
+	}
+	mfs, err := registry.gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := map[string]*dto.MetricFamily{}
+	for _, mf := range mfs {
+		got[mf.GetName()] = mf
+	}
+
+	for name, typ := range map[string]dto.MetricType{
+		"go_goroutines":                 dto.MetricType_GAUGE,
+		"go_gc_duration_seconds":        dto.MetricType_SUMMARY,
+		"go_memstats_alloc_bytes":       dto.MetricType_GAUGE,
+		"go_memstats_alloc_bytes_total": dto.MetricType_COUNTER,
+		"go_memstats_heap_alloc_bytes":  dto.MetricType_GAUGE,
+		"go_memstats_mallocs_total":     dto.MetricType_COUNTER,
+	} {
+		mf, ok := got[name]
+		if !ok {
+			t.Errorf("metric family %s not collected", name)
+			continue
+		}
+		if mf.GetType() != typ {
+			t.Errorf("metric family %s has type %s, want %s", name, mf.GetType(), typ)
+		}
+	}
+	if v := got["go_memstats_heap_alloc_bytes"].GetMetric()[0].GetGauge().GetValue(); v <= 0 {
+		t.Errorf("want positive heap allocation, got %f", v)
+	}
+}
+
+func TestMustRegisterGoCollector(t *testing.T) {
+	registry := newDefaultRegistry()
+	if err := registry.registerGoCollector(); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(registry.collectorsByID), 2; got != want {
+		t.Errorf("got %d collectors, want %d", got, want)
+	}
+	if registry.registeredSinceDefaults {
+		t.Error("registering the default Go collector again counted as registration")
+	}
+
+	if err := registry.initDefaults(WithoutGoCollector()); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := registry.registerGoCollector(); err != nil {
+			t.Fatalf("%d. %s", i, err)
+		}
+		if got, want := len(registry.collectorsByID), 2; got != want {
+			t.Errorf("%d. got %d collectors, want %d", i, got, want)
+		}
+	}
+}
@@ -14,11 +14,18 @@
 package prometheus
 
 import (
+	"errors"
 	"fmt"
 	"hash/fnv"
+	"io"
+	"log"
 	"math"
+	"runtime"
 	"sort"
+	"strings"
+	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/golang/protobuf/proto"
 
@@ -40,6 +47,14 @@ import (
 // Histogram has a very low performance overhead in comparison with the Observe
 // method of a Summary.
 //
+// The Histogram created by NewHistogram guarantees that each collection is
+// consistent, i.e. the count, the sum, and the bucket counts always reflect
+// the same set of observations. A collection never sees an observation that
+// is counted in the count but not yet in its bucket or vice versa. Observe and
+// Write share a read-write lock for that, which is locked for writing only
+// while Write reads the values. Concurrent observations do not block each
+// other.
+//
 // To create Histogram instances, use NewHistogram.
 type Histogram interface {
 	Metric
@@ -56,21 +71,249 @@ var (
 	// buckets customized to your use case.
 	DefBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
 
+	// DefScrapeIntervalBuckets are the default buckets of the Collector
+	// created by NewScrapeIntervalHistogram. They cover the usual scrape
+	// intervals (in seconds).
+	DefScrapeIntervalBuckets = []float64{1, 5, 10, 15, 20, 30, 45, 60, 90, 120, 300}
+
 	errBucketLabelNotAllowed = fmt.Errorf(
 		"%q is not allowed as label name in histograms", model.BucketLabel,
 	)
+
+	// ErrInvalidObservation is passed to the ErrorHandler of a Histogram
+	// or Summary (see HistogramOpts and SummaryOpts) for observed values
+	// that are NaN or infinite.
+	ErrInvalidObservation = errors.New("observed value is NaN or infinite")
+
+	// ErrInvalidWeight is passed to the ErrorHandler of a WeightedHistogram
+	// for observations with a weight that is negative, NaN, or infinite.
+	// Such observations are discarded.
+	ErrInvalidWeight = errors.New("observation weight is negative, NaN, or infinite")
+)
+
+// LogInvalidObservation is an ErrorHandler for HistogramOpts and SummaryOpts
+// that logs the error with the standard logger. To avoid spamming the log, it
+// logs only once per call site of Observe, no matter how often invalid values
+// are observed there.
+func LogInvalidObservation(err error, v float64) {
+	site := observeCallSite()
+	invalidObservationsMtx.Lock()
+	once, ok := invalidObservationsLogged[site]
+	if !ok {
+		once = &sync.Once{}
+		invalidObservationsLogged[site] = once
+	}
+	invalidObservationsMtx.Unlock()
+	once.Do(func() {
+		log.Printf("%s: %s (%v), further occurrences are not logged", site, err, v)
+	})
+}
+
+var (
+	invalidObservationsMtx    sync.Mutex
+	invalidObservationsLogged = map[string]*sync.Once{}
+)
+
+// observeCallSite returns the file and line of the innermost caller outside of
+// this package (not counting its tests).
+func observeCallSite() string {
+	pcs := make([]uintptr, 16)
+	n := runtime.Callers(2, pcs)
+	for _, pc := range pcs[:n] {
+		f := runtime.FuncForPC(pc - 1)
+		if f == nil {
+			continue
+		}
+		file, line := f.FileLine(pc - 1)
+		if strings.HasPrefix(f.Name(), "github.com/prometheus/client_golang/prometheus.") &&
+			!strings.HasSuffix(file, "_test.go") {
+			continue
+		}
+		return fmt.Sprintf("%s:%d", file, line)
+	}
+	return "unknown call site"
+}
+
+// isInvalidObservation returns whether v is NaN or infinite.
+func isInvalidObservation(v float64) bool {
+	return math.IsNaN(v) || math.IsInf(v, 0)
+}
+
+// NaNPolicy determines what a Histogram or Summary does with observed NaN
+// values. See the NaNPolicy field in HistogramOpts.
+type NaNPolicy struct{ valuePolicy }
+
+// InfPolicy determines what a Histogram or Summary does with observed infinite
+// values. See the InfPolicy field in HistogramOpts.
+type InfPolicy struct{ valuePolicy }
+
+type valuePolicy struct {
+	action   valueAction
+	sentinel float64
+}
+
+type valueAction int
+
+const (
+	dropValue valueAction = iota
+	replaceValue
+	reportValue
+	keepValue
 )
 
+var (
+	// NaNPolicyDrop discards NaN values and counts them. It is the
+	// default.
+	NaNPolicyDrop = NaNPolicy{}
+	// NaNPolicyKeep observes NaN values like any other, which renders the
+	// sum meaningless.
+	NaNPolicyKeep = NaNPolicy{valuePolicy{action: keepValue}}
+	// NaNPolicyError discards NaN values and passes them to the
+	// ErrorHandler, which must be set.
+	NaNPolicyError = NaNPolicy{valuePolicy{action: reportValue}}
+
+	// InfPolicyDrop discards infinite values and counts them. It is the
+	// default.
+	InfPolicyDrop = InfPolicy{}
+	// InfPolicyError discards infinite values and passes them to the
+	// ErrorHandler, which must be set.
+	InfPolicyError = InfPolicy{valuePolicy{action: reportValue}}
+	// InfPolicyKeep observes infinite values like any other, i.e. they end
+	// up in the +Inf bucket of a Histogram (or the lowest bucket for -Inf)
+	// and render the sum meaningless.
+	InfPolicyKeep = InfPolicy{valuePolicy{action: keepValue}}
+)
+
+// NaNPolicyReplace returns a NaNPolicy that observes the provided sentinel
+// instead of NaN values.
+func NaNPolicyReplace(sentinel float64) NaNPolicy {
+	return NaNPolicy{valuePolicy{action: replaceValue, sentinel: sentinel}}
+}
+
+// InfPolicyReplace returns an InfPolicy that observes the provided sentinel
+// instead of +Inf and its negation instead of -Inf.
+func InfPolicyReplace(sentinel float64) InfPolicy {
+	return InfPolicy{valuePolicy{action: replaceValue, sentinel: sentinel}}
+}
+
+// invalidObservations applies the NaNPolicy and InfPolicy of a Histogram or
+// Summary and counts the dropped values. The counts are only collected if
+// nanDesc and infDesc are set, which is only the case for the Histograms and
+// Summaries created by NewHistogram and NewSummary, and for the ones shared by
+// the children of a HistogramVec or SummaryVec.
+type invalidObservations struct {
+	// The counts have to go first in the struct to guarantee alignment
+	// for atomic operations.
+	nanDropped, infDropped uint64
+
+	nan          NaNPolicy
+	inf          InfPolicy
+	errorHandler func(error, float64)
+
+	nanDesc, infDesc *Desc
+}
+
+// newInvalidObservations returns the invalidObservations for the provided
+// policies. The kind ("histogram" or "summary") is only used in the panic
+// message for a policy that requires an ErrorHandler that is not set.
+func newInvalidObservations(kind string, desc *Desc, nan NaNPolicy, inf InfPolicy, errorHandler func(error, float64)) *invalidObservations {
+	if errorHandler == nil && (nan.action == reportValue || inf.action == reportValue) {
+		panic(fmt.Errorf("%s %s has NaNPolicyError or InfPolicyError set but no ErrorHandler", kind, desc))
+	}
+	return &invalidObservations{nan: nan, inf: inf, errorHandler: errorHandler}
+}
+
+// track creates the Descs of the counts of the dropped values for the metric
+// with the provided Desc, so that they are collected.
+func (o *invalidObservations) track(desc *Desc, constLabels Labels) {
+	newDesc := func(what string) *Desc {
+		d := NewDesc(
+			desc.fqName+"_"+what+"_observations_total",
+			"Total number of "+strings.ToUpper(what)+" observations of "+desc.fqName+" dropped.",
+			nil,
+			constLabels,
+		)
+		d.deprecatedVersion = desc.deprecatedVersion
+		return d
+	}
+	if o.nan.action == dropValue {
+		o.nanDesc = newDesc("nan")
+	}
+	if o.inf.action == dropValue {
+		o.infDesc = newDesc("inf")
+	}
+}
+
+// filter returns the value to observe instead of v and whether to observe it
+// at all.
+func (o *invalidObservations) filter(v float64) (float64, bool) {
+	var (
+		policy  valuePolicy
+		dropped *uint64
+	)
+	switch {
+	case math.IsNaN(v):
+		policy, dropped = o.nan.valuePolicy, &o.nanDropped
+	case math.IsInf(v, 0):
+		policy, dropped = o.inf.valuePolicy, &o.infDropped
+	default:
+		return v, true
+	}
+	switch policy.action {
+	case keepValue:
+		return v, true
+	case replaceValue:
+		if math.IsInf(v, -1) {
+			return -policy.sentinel, true
+		}
+		return policy.sentinel, true
+	case reportValue:
+		o.errorHandler(ErrInvalidObservation, v)
+		return v, false
+	}
+	atomic.AddUint64(dropped, 1)
+	if o.errorHandler != nil {
+		o.errorHandler(ErrInvalidObservation, v)
+	}
+	return v, false
+}
+
+// Describe sends the Descs of the tracked counts.
+func (o *invalidObservations) Describe(ch chan<- *Desc) {
+	if o.nanDesc != nil {
+		ch <- o.nanDesc
+	}
+	if o.infDesc != nil {
+		ch <- o.infDesc
+	}
+}
+
+// Collect sends the tracked counts that are not zero. Only collecting them once
+// values have been dropped keeps them out of the way for the vast majority of
+// metrics, which never observe a NaN or infinite value.
+func (o *invalidObservations) Collect(ch chan<- Metric) {
+	if n := atomic.LoadUint64(&o.nanDropped); o.nanDesc != nil && n > 0 {
+		ch <- MustNewConstMetric(o.nanDesc, CounterValue, float64(n))
+	}
+	if n := atomic.LoadUint64(&o.infDropped); o.infDesc != nil && n > 0 {
+		ch <- MustNewConstMetric(o.infDesc, CounterValue, float64(n))
+	}
+}
+
 // LinearBuckets creates 'count' buckets, each 'width' wide, where the lowest
 // bucket has an upper bound of 'start'. The final +Inf bucket is not counted
 // and not included in the returned slice. The returned slice is meant to be
 // used for the Buckets field of HistogramOpts.
 //
-// The function panics if 'count' is zero or negative.
+// The function panics if 'count' is zero or negative, or if 'width' is zero or
+// negative.
 func LinearBuckets(start, width float64, count int) []float64 {
 	if count < 1 {
 		panic("LinearBuckets needs a positive count")
 	}
+	if width <= 0 {
+		panic("LinearBuckets needs a positive width")
+	}
 	buckets := make([]float64, count)
 	for i := range buckets {
 		buckets[i] = start
@@ -79,6 +322,31 @@ func LinearBuckets(start, width float64, count int) []float64 {
 	return buckets
 }
 
+// LinearBucketsAround creates 'count' equally spaced buckets centered around
+// 'center', where the lowest bucket has an upper bound of 'center' - 'halfWidth'
+// and the highest bucket has an upper bound of 'center' + 'halfWidth'. The
+// final +Inf bucket is not counted and not included in the returned slice. The
+// returned slice is meant to be used for the Buckets field of HistogramOpts.
+//
+// The function panics if 'count' is less than 2, if 'halfWidth' is 0 or
+// negative, or if the bounds are not finite.
+func LinearBucketsAround(center, halfWidth float64, count int) []float64 {
+	if count < 2 {
+		panic("LinearBucketsAround needs a count of at least 2")
+	}
+	if halfWidth <= 0 {
+		panic("LinearBucketsAround needs a positive halfWidth")
+	}
+	start, end := center-halfWidth, center+halfWidth
+	if math.IsInf(start, 0) || math.IsInf(end, 0) || math.IsNaN(start) || math.IsNaN(end) {
+		panic("LinearBucketsAround needs finite bucket bounds")
+	}
+	buckets := LinearBuckets(start, (end-start)/float64(count-1), count)
+	// Avoid rounding errors at the upper end of the range.
+	buckets[count-1] = end
+	return buckets
+}
+
 // ExponentialBuckets creates 'count' buckets, where the lowest bucket has an
 // upper bound of 'start' and each following bucket's upper bound is 'factor'
 // times the previous bucket's upper bound. The final +Inf bucket is not counted
@@ -105,6 +373,35 @@ func ExponentialBuckets(start, factor float64, count int) []float64 {
 	return buckets
 }
 
+// ExponentialBucketsRange creates 'count' buckets, where the lowest bucket has
+// an upper bound of 'min', the highest bucket has an upper bound of 'max', and
+// each bucket's upper bound is a constant factor times the previous bucket's
+// upper bound. The final +Inf bucket is not counted and not included in the
+// returned slice. The returned slice is meant to be used for the Buckets field
+// of HistogramOpts.
+//
+// The function panics if 'count' is less than 2, if 'min' is 0 or negative, or
+// if 'max' is less than or equal 'min'.
+func ExponentialBucketsRange(min, max float64, count int) []float64 {
+	if count < 2 {
+		panic("ExponentialBucketsRange needs a count of at least 2")
+	}
+	if min <= 0 {
+		panic("ExponentialBucketsRange needs a positive min value")
+	}
+	if max <= min {
+		panic("ExponentialBucketsRange needs a max value greater than min")
+	}
+	factor := math.Pow(max/min, 1/float64(count-1))
+	buckets := make([]float64, count)
+	for i := range buckets {
+		buckets[i] = min * math.Pow(factor, float64(i))
+	}
+	// Avoid rounding errors at the upper end of the range.
+	buckets[count-1] = max
+	return buckets
+}
+
 // HistogramOpts bundles the options for creating a Histogram metric. It is
 // mandatory to set Name and Help to a non-empty string. All other fields are
 // optional and can safely be left at their zero value.
@@ -143,29 +440,269 @@ type HistogramOpts struct {
 	// metric name).
 	ConstLabels Labels
 
+	// DeprecatedVersion marks this Histogram as deprecated since the given
+	// version. See the equally named field in Opts for details.
+	DeprecatedVersion string
+
+	// TrackLastObserved makes the children of a HistogramVec record the time
+	// they were last updated. See the equally named field in Opts for
+	// details.
+	TrackLastObserved bool
+
+	// HashSeed is mixed into the hash of the label values of the
+	// children of a HistogramVec. See the equally named field in Opts.
+	HashSeed uint64
+
+	// LabelAllowlist, FallbackBehavior, and FallbackValue restrict the
+	// values of the variable labels of a HistogramVec. See the equally
+	// named fields in Opts for details.
+	LabelAllowlist   map[string][]string
+	FallbackBehavior FallbackBehavior
+	FallbackValue    string
+
 	// Buckets defines the buckets into which observations are counted. Each
 	// element in the slice is the upper inclusive bound of a bucket. The
 	// values must be sorted in strictly increasing order. There is no need
 	// to add a highest bucket with +Inf bound, it will be added
 	// implicitly. The default value is DefBuckets.
 	Buckets []float64
+
+	// NoBuckets, if true, creates a Histogram that only tracks the count
+	// and the sum of observations. It is exposed without any buckets
+	// (i.e. without _bucket samples, not even the one with +Inf bound),
+	// which saves resources if only the mean of the observations is of
+	// interest. Buckets must not be set if NoBuckets is true.
+	NoBuckets bool
+
+	// DynamicBuckets, if true, makes the Histogram add a bucket whenever
+	// Observe is called with a positive value above the highest bucket
+	// but below MaxUpperBound. The upper bound of the new bucket is the
+	// value rounded up to the next power of 2 (but at most
+	// MaxUpperBound), and it is collected from then on. Earlier
+	// observations in its range remain counted in the +Inf bucket only.
+	// DynamicBuckets must not be set together with NoBuckets,
+	// TrackBucketSums, or FreezeBucketsAfter, and MaxUpperBound must be
+	// greater than the highest bucket.
+	DynamicBuckets bool
+	// MaxUpperBound limits the upper bounds of the buckets added with
+	// DynamicBuckets. Observations of values at or above it do not add
+	// buckets.
+	MaxUpperBound float64
+
+	// WeightedBuckets, if true, creates a Histogram that implements
+	// WeightedHistogram, i.e. whose observations may carry a weight. Its
+	// count and bucket counts are sums of weights rather than numbers of
+	// observations, and its sum is the sum of the values multiplied by
+	// their weights, so that the sum divided by the count is the weighted
+	// mean. Keep this in mind when querying the histogram, as PromQL
+	// functions like histogram_quantile then return weighted quantiles.
+	// WeightedBuckets must not be set together with FreezeBucketsAfter.
+	WeightedBuckets bool
+
+	// SharedBucketLayout, if true, makes a HistogramVec allocate the
+	// bucket counts of its children from large shared slabs rather than
+	// one slice per child. This saves allocations for HistogramVecs with
+	// very many children, and children created one after another have
+	// their counts next to each other in memory. A slab that is used up
+	// is followed by one of twice the size. The counts of deleted
+	// children (see Delete, DeleteLabelValues, DeleteExpired, and Reset)
+	// are zeroed and reused for new children, so a deleted Histogram must
+	// not be used anymore. SharedBucketLayout has no effect for
+	// Histograms created by NewHistogram, and it must not be set together
+	// with DynamicBuckets.
+	SharedBucketLayout bool
+
+	// ResetOnCollect, if true, resets the Histogram each time it is
+	// collected. The buckets, the count, and the sum then only represent
+	// the observations made since the previous collection, so that
+	// successive scrapes see non-overlapping windows of
+	// observations. The reset happens atomically, i.e. each observation is
+	// reported in exactly one window. Note that this comes with a
+	// performance penalty for Observe, and that a Histogram with
+	// ResetOnCollect must not be collected by more than one consumer.
+	ResetOnCollect bool
+
+	// FreezeBucketsAfter, if positive, makes the Histogram learn its
+	// buckets from the first FreezeBucketsAfter observations. Until then,
+	// observations are buffered, and instead of the Histogram, a gauge
+	// with the suffix "_learning_observations_remaining" is collected,
+	// reporting the number of observations still needed. Then, the bucket
+	// boundaries are set to evenly spaced percentiles of the buffered
+	// observations and frozen, the buffered observations are counted, and
+	// the Histogram behaves like a normal Histogram from then on. Buckets
+	// and NoBuckets must not be set together with FreezeBucketsAfter. It is
+	// only supported by NewHistogram.
+	FreezeBucketsAfter uint64
+
+	// TargetBuckets is the number of buckets to learn if
+	// FreezeBucketsAfter is set. Fewer buckets result if the buffered
+	// observations contain duplicate values. The default value is the
+	// number of DefBuckets.
+	TargetBuckets int
+
+	// RecordCreatedTimestamp, if true, makes the Histogram record the time
+	// it was created, and the time of each reset if ResetOnCollect is
+	// true. A Histogram created by NewHistogram then also collects a gauge
+	// with the suffix "_created", reporting that time as a Unix timestamp
+	// in seconds, which allows to tell when the cumulative counts started.
+	// Children of a HistogramVec only record the time, which is available
+	// via their CreatedAt method, see HistogramWithCreatedAt. RecordCreatedTimestamp must not be set
+	// together with FreezeBucketsAfter.
+	RecordCreatedTimestamp bool
+
+	// TrackBucketSums, if true, makes the Histogram additionally track
+	// the sum of the observations in each bucket. Like the bucket counts,
+	// the sums are cumulative, i.e. the sum for a bucket includes the
+	// observations in all lower buckets. They are collected as an
+	// untyped metric with the suffix "_bucket_sum" and an "le" label,
+	// which is not part of the Histogram proper, and are available
+	// in-process via HistogramWithBucketSums. This allows e.g. to tell
+	// whether the bytes transferred are concentrated in the slow
+	// requests. TrackBucketSums must not be set together with NoBuckets,
+	// ResetOnCollect, or FreezeBucketsAfter.
+	TrackBucketSums bool
+
+	// BucketLabels, if not empty, overrides the value of the "le" label for
+	// the given bucket boundaries in the text format written by
+	// EncodeMetric (see DirectEncoder), e.g. to write "100ms" rather than
+	// "0.1". Each key must be one of the Buckets or +Inf, whose label is
+	// "+Inf" by default, and no label may contain a quotation mark. The
+	// protobuf format, and with it the regular exposition via Write, has
+	// no field for the label and always uses the numeric upper bound.
+	// Note that the Prometheus server parses "le" as a number, so the
+	// labels are only useful for consumers that understand them. It is
+	// only supported by NewHistogram.
+	BucketLabels map[float64]string
+
+	// ObservationBudget, if positive, limits the rate of observations to
+	// the given number per second, with bursts of up to one second worth
+	// of observations. Once the budget is exhausted, Observe blocks until
+	// the next observation is within the budget, unless
+	// DropOnBudgetExhaustion is true. This prevents a single hot code
+	// path from monopolizing the Histogram. Only the Histograms created
+	// by NewHistogram support it, and it must not be set together with
+	// FreezeBucketsAfter. The budget only applies to Observe and
+	// ObserveWithWeight. Observations made through HistogramVec.ObserveN,
+	// a BatchObserver, or a SampledHistogram bypass it.
+	ObservationBudget float64
+	// DropOnBudgetExhaustion, if true, makes Observe drop an observation
+	// that exceeds the ObservationBudget instead of blocking. Dropped
+	// observations are counted by a counter with the suffix
+	// "_dropped_observations_total", collected along with the Histogram.
+	DropOnBudgetExhaustion bool
+
+	// Now is the clock used for RecordCreatedTimestamp and
+	// ObservationBudget. The default value is time.Now. Setting it is
+	// mostly useful for tests.
+	Now func() time.Time
+
+	// ErrorHandler, if not nil, is called with ErrInvalidObservation for
+	// each observed value that is dropped according to NaNPolicy or
+	// InfPolicy. LogInvalidObservation is a ready-to-use ErrorHandler.
+	ErrorHandler func(err error, v float64)
+
+	// NaNPolicy determines what happens to observed NaN values, which
+	// would otherwise render the sum meaningless. The default is
+	// NaNPolicyDrop, which discards them and counts them with a counter
+	// with the suffix "_nan_observations_total". That counter is
+	// collected along with the Histogram (or HistogramVec) once it is
+	// not zero. InfPolicy works the same for infinite values (with the
+	// suffix "_inf_observations_total"). Note that Histograms used to
+	// observe NaN and infinite values like any other. NaNPolicyKeep and
+	// InfPolicyKeep retain that behavior.
+	NaNPolicy NaNPolicy
+	InfPolicy InfPolicy
 }
 
 // NewHistogram creates a new Histogram based on the provided HistogramOpts. It
-// panics if the buckets in HistogramOpts are not in strictly increasing order.
+// panics if the buckets in HistogramOpts are not in strictly increasing order,
+// if buckets are set although NoBuckets is true, if buckets are set or
+// TargetBuckets is negative although FreezeBucketsAfter is positive, if both
+// FreezeBucketsAfter and RecordCreatedTimestamp are set, if TrackBucketSums,
+// ObservationBudget, or WeightedBuckets is combined with an option it must not
+// be set together with, if ObservationBudget is negative, if NaNPolicyError
+// or InfPolicyError is set without an ErrorHandler, or if BucketLabels is set
+// together with FreezeBucketsAfter or contains an invalid entry.
 func NewHistogram(opts HistogramOpts) Histogram {
-	return newHistogram(
-		NewDesc(
-			BuildFQName(opts.Namespace, opts.Subsystem, opts.Name),
-			opts.Help,
+	desc := NewDesc(
+		BuildFQName(opts.Namespace, opts.Subsystem, opts.Name),
+		opts.Help,
+		nil,
+		opts.ConstLabels,
+	)
+	desc.deprecatedVersion = opts.DeprecatedVersion
+	if opts.ObservationBudget < 0 {
+		panic(fmt.Errorf("histogram %s has a negative ObservationBudget", desc))
+	}
+	if opts.FreezeBucketsAfter > 0 {
+		if opts.ObservationBudget > 0 {
+			panic(fmt.Errorf("histogram %s has both FreezeBucketsAfter and ObservationBudget set", desc))
+		}
+		if opts.DynamicBuckets {
+			panic(fmt.Errorf("histogram %s has both FreezeBucketsAfter and DynamicBuckets set", desc))
+		}
+		if opts.RecordCreatedTimestamp {
+			panic(fmt.Errorf("histogram %s has both FreezeBucketsAfter and RecordCreatedTimestamp set", desc))
+		}
+		if opts.TrackBucketSums {
+			panic(fmt.Errorf("histogram %s has both FreezeBucketsAfter and TrackBucketSums set", desc))
+		}
+		if opts.WeightedBuckets {
+			panic(fmt.Errorf("histogram %s has both FreezeBucketsAfter and WeightedBuckets set", desc))
+		}
+		if len(opts.BucketLabels) > 0 {
+			panic(fmt.Errorf("histogram %s has both FreezeBucketsAfter and BucketLabels set", desc))
+		}
+		return newLearningHistogram(desc, opts)
+	}
+	h := newHistogram(desc, opts).(*histogram)
+	h.invalid.track(desc, opts.ConstLabels)
+	if len(opts.BucketLabels) > 0 {
+		h.bucketLabels = make(map[float64]string, len(opts.BucketLabels))
+		for upperBound, label := range opts.BucketLabels {
+			if strings.Contains(label, `"`) {
+				panic(fmt.Errorf("histogram %s has the bucket label %q, which contains a quotation mark", desc, label))
+			}
+			if !h.hasUpperBound(upperBound) {
+				panic(fmt.Errorf("histogram %s has a bucket label for %v, which is not a bucket boundary", desc, upperBound))
+			}
+			h.bucketLabels[upperBound] = label
+		}
+	}
+	if opts.RecordCreatedTimestamp {
+		h.createdDesc = NewDesc(
+			desc.fqName+"_created",
+			"Unix timestamp of the creation or the last reset of "+desc.fqName+".",
 			nil,
 			opts.ConstLabels,
-		),
-		opts,
-	)
+		)
+		h.createdDesc.deprecatedVersion = opts.DeprecatedVersion
+	}
+	if opts.ObservationBudget > 0 {
+		now := opts.Now
+		if now == nil {
+			now = time.Now
+		}
+		h.budget = newTokenBucket(opts.ObservationBudget, now)
+		if opts.DropOnBudgetExhaustion {
+			h.dropped = NewCounter(CounterOpts{
+				Name:              desc.fqName + "_dropped_observations_total",
+				Help:              "Total number of observations of " + desc.fqName + " dropped for exceeding the observation budget.",
+				ConstLabels:       opts.ConstLabels,
+				DeprecatedVersion: opts.DeprecatedVersion,
+			})
+		}
+	}
+	return h
 }
 
 func newHistogram(desc *Desc, opts HistogramOpts, labelValues ...string) Histogram {
+	return newHistogramInSlab(desc, opts, nil, labelValues...)
+}
+
+// newHistogramInSlab works like newHistogram but allocates the bucket counts
+// from the provided bucketSlab unless it is nil.
+func newHistogramInSlab(desc *Desc, opts HistogramOpts, slab *bucketSlab, labelValues ...string) Histogram {
 	if len(desc.variableLabels) != len(labelValues) {
 		panic(errInconsistentCardinality)
 	}
@@ -181,14 +718,57 @@ func newHistogram(desc *Desc, opts HistogramOpts, labelValues ...string) Histogr
 		}
 	}
 
-	if len(opts.Buckets) == 0 {
+	if opts.FreezeBucketsAfter > 0 {
+		panic(fmt.Errorf("histogram %s has FreezeBucketsAfter set, which is only supported by NewHistogram", desc))
+	}
+	if opts.ObservationBudget != 0 && len(desc.variableLabels) > 0 {
+		panic(fmt.Errorf("histogram %s has ObservationBudget set, which is only supported by NewHistogram", desc))
+	}
+	if opts.NoBuckets {
+		if len(opts.Buckets) > 0 {
+			panic(fmt.Errorf("histogram %s has Buckets set although NoBuckets is true", desc))
+		}
+	} else if len(opts.Buckets) == 0 {
 		opts.Buckets = DefBuckets
 	}
+	if opts.TrackBucketSums && (opts.NoBuckets || opts.ResetOnCollect) {
+		panic(fmt.Errorf("histogram %s has TrackBucketSums set together with NoBuckets or ResetOnCollect", desc))
+	}
+	if opts.DynamicBuckets {
+		if opts.NoBuckets || opts.TrackBucketSums || opts.SharedBucketLayout {
+			panic(fmt.Errorf("histogram %s has DynamicBuckets set together with NoBuckets, TrackBucketSums, or SharedBucketLayout", desc))
+		}
+		highest := opts.Buckets[len(opts.Buckets)-1]
+		if !(opts.MaxUpperBound > highest) {
+			panic(fmt.Errorf(
+				"histogram %s has a MaxUpperBound of %f, which is not greater than the highest bucket %f",
+				desc, opts.MaxUpperBound, highest,
+			))
+		}
+		// The upper bounds are appended to, so they must not share the
+		// array of Buckets, which might be shared with other histograms.
+		opts.Buckets = append([]float64(nil), opts.Buckets...)
+	}
 
 	h := &histogram{
-		desc:        desc,
-		upperBounds: opts.Buckets,
-		labelPairs:  makeLabelPairs(desc, labelValues),
+		desc:           desc,
+		upperBounds:    opts.Buckets,
+		noBuckets:      opts.NoBuckets,
+		resetOnCollect: opts.ResetOnCollect,
+		weighted:       opts.WeightedBuckets,
+		labelPairs:     makeLabelPairs(desc, labelValues),
+		errorHandler:   opts.ErrorHandler,
+		invalid:        newInvalidObservations("histogram", desc, opts.NaNPolicy, opts.InfPolicy, opts.ErrorHandler),
+	}
+	if opts.DynamicBuckets {
+		h.maxUpperBound = opts.MaxUpperBound
+	}
+	if opts.RecordCreatedTimestamp {
+		h.now = opts.Now
+		if h.now == nil {
+			h.now = time.Now
+		}
+		h.createdAt = h.now()
 	}
 	for i, upperBound := range h.upperBounds {
 		if i < len(h.upperBounds)-1 {
@@ -206,7 +786,25 @@ func newHistogram(desc *Desc, opts HistogramOpts, labelValues ...string) Histogr
 		}
 	}
 	// Finally we know the final length of h.upperBounds and can make counts.
-	h.counts = make([]uint64, len(h.upperBounds))
+	if slab != nil {
+		h.counts = slab.alloc(len(h.upperBounds))
+	} else {
+		h.counts = make([]uint64, len(h.upperBounds))
+	}
+	if opts.TrackBucketSums {
+		h.bucketSumBits = make([]uint64, len(h.upperBounds))
+		constLabels := Labels{}
+		for _, lp := range desc.constLabelPairs {
+			constLabels[lp.GetName()] = lp.GetValue()
+		}
+		h.bucketSumDesc = NewDesc(
+			desc.fqName+"_bucket_sum",
+			"Cumulative sum of the observations in the buckets of "+desc.fqName+".",
+			append(append([]string{}, desc.variableLabels...), model.BucketLabel),
+			constLabels,
+		)
+		h.bucketSumDesc.deprecatedVersion = desc.deprecatedVersion
+	}
 
 	h.Init(h) // Init self-collection.
 	return h
@@ -221,20 +819,187 @@ type histogram struct {
 	count   uint64
 
 	SelfCollector
-	// Note that there is no mutex required.
 
 	desc *Desc
 
 	upperBounds []float64
 	counts      []uint64
+	noBuckets   bool
+
+	// bucketSumBits contains the bits of the float64s representing the
+	// (non-cumulative) sums of the observations in each bucket. It and
+	// bucketSumDesc are nil if bucket sums are not tracked.
+	bucketSumBits []uint64
+	bucketSumDesc *Desc
+
+	// writeMtx is read-locked while observing and write-locked by Write,
+	// so that Write sees the count, the sum, and the bucket counts of the
+	// same set of observations. Observations still update the values with
+	// atomic operations, so they do not block each other. If
+	// resetOnCollect is true, Write also resets all values while holding
+	// the lock.
+	writeMtx       sync.RWMutex
+	resetOnCollect bool
 
 	labelPairs []*dto.LabelPair
+
+	// now is nil if the creation time is not recorded. Otherwise,
+	// createdAt is the time of the creation or the last reset, protected
+	// by writeMtx. createdDesc is only set for histograms created by
+	// NewHistogram, which collect the creation time.
+	now         func() time.Time
+	createdAt   time.Time
+	createdDesc *Desc
+
+	errorHandler func(error, float64)
+	invalid      *invalidObservations
+
+	// budget is nil if the observations are not limited. dropped counts
+	// the dropped observations if the Histogram drops rather than blocks
+	// and is nil otherwise. Both are only set for histograms created by
+	// NewHistogram.
+	budget  *tokenBucket
+	dropped Counter
+
+	// maxUpperBound is positive if buckets are added dynamically (see
+	// HistogramOpts.DynamicBuckets). Adding a bucket replaces upperBounds
+	// and counts while holding writeMtx.
+	maxUpperBound float64
+
+	// weighted is true for a WeightedHistogram. In that case, count and
+	// counts contain the bits of float64s representing the sums of the
+	// weights.
+	weighted bool
+
+	// bucketLabels maps bucket boundaries to the "le" label written by
+	// EncodeMetric. It is nil if no labels are overridden.
+	bucketLabels map[float64]string
+}
+
+// hasUpperBound returns whether upperBound is a bucket boundary of the
+// histogram, including the implicit +Inf bucket.
+func (h *histogram) hasUpperBound(upperBound float64) bool {
+	if h.noBuckets {
+		return false
+	}
+	if math.IsInf(upperBound, +1) {
+		return true
+	}
+	i := sort.SearchFloat64s(h.upperBounds, upperBound)
+	return i < len(h.upperBounds) && h.upperBounds[i] == upperBound
+}
+
+// bucketLabel returns the "le" label EncodeMetric writes for upperBound.
+func (h *histogram) bucketLabel(upperBound float64) string {
+	if label, ok := h.bucketLabels[upperBound]; ok {
+		return label
+	}
+	if math.IsInf(upperBound, +1) {
+		return "+Inf"
+	}
+	return fmt.Sprint(upperBound)
 }
 
 func (h *histogram) Desc() *Desc {
 	return h.desc
 }
 
+// CreatedAt implements HistogramWithCreatedAt.
+func (h *histogram) CreatedAt() time.Time {
+	h.writeMtx.RLock()
+	defer h.writeMtx.RUnlock()
+	return h.createdAt
+}
+
+// Size implements HistogramWithSize.
+func (h *histogram) Size() int {
+	h.writeMtx.RLock()
+	defer h.writeMtx.RUnlock()
+	size := HistogramBaseSize + 16*len(h.upperBounds) + 8*len(h.bucketSumBits)
+	for _, lp := range h.labelPairs {
+		size += LabelPairSize + len(lp.GetName()) + len(lp.GetValue())
+	}
+	return size
+}
+
+// BucketSums implements HistogramWithBucketSums.
+func (h *histogram) BucketSums() []float64 {
+	if h.bucketSumBits == nil {
+		return nil
+	}
+	h.writeMtx.Lock()
+	defer h.writeMtx.Unlock()
+	sums := make([]float64, len(h.bucketSumBits))
+	var cumSum float64
+	for i := range h.bucketSumBits {
+		cumSum += math.Float64frombits(atomic.LoadUint64(&h.bucketSumBits[i]))
+		sums[i] = cumSum
+	}
+	return sums
+}
+
+// collectBucketSums sends the bucket sums as untyped metrics to ch if they are
+// tracked, including the one for the implicit +Inf bucket.
+func (h *histogram) collectBucketSums(ch chan<- Metric) {
+	if h.bucketSumBits == nil {
+		return
+	}
+	sums := h.BucketSums()
+	// Recover the variable label values from the label pairs, which also
+	// contain the const labels, sorted by name.
+	lvs := make([]string, len(h.bucketSumDesc.variableLabels))
+	for i, name := range h.bucketSumDesc.variableLabels[:len(lvs)-1] {
+		for _, lp := range h.labelPairs {
+			if lp.GetName() == name {
+				lvs[i] = lp.GetValue()
+			}
+		}
+	}
+	for i, upperBound := range h.upperBounds {
+		lvs[len(lvs)-1] = fmt.Sprint(upperBound)
+		ch <- MustNewConstMetric(h.bucketSumDesc, UntypedValue, sums[i], lvs...)
+	}
+	lvs[len(lvs)-1] = "+Inf"
+	ch <- MustNewConstMetric(
+		h.bucketSumDesc, UntypedValue,
+		math.Float64frombits(atomic.LoadUint64(&h.sumBits)), lvs...,
+	)
+}
+
+// Describe implements Collector.
+func (h *histogram) Describe(ch chan<- *Desc) {
+	h.SelfCollector.Describe(ch)
+	if h.createdDesc != nil {
+		ch <- h.createdDesc
+	}
+	if h.bucketSumDesc != nil {
+		ch <- h.bucketSumDesc
+	}
+	if h.dropped != nil {
+		h.dropped.Describe(ch)
+	}
+	h.invalid.Describe(ch)
+}
+
+// Collect implements Collector. The creation time is read before the
+// histogram is written, so that it matches the written values even if the
+// histogram resets on collection.
+func (h *histogram) Collect(ch chan<- Metric) {
+	var created float64
+	if h.createdDesc != nil {
+		created = float64(h.CreatedAt().UnixNano()) / 1e9
+	}
+	h.SelfCollector.Collect(ch)
+	if h.createdDesc != nil {
+		ch <- MustNewConstMetric(h.createdDesc, GaugeValue, created)
+	}
+	h.collectBucketSums(ch)
+	if h.dropped != nil {
+		h.dropped.Collect(ch)
+	}
+	h.invalid.Collect(ch)
+}
+
 func (h *histogram) Observe(v float64) {
 	// TODO(beorn7): For small numbers of buckets (<30), a linear search is
 	// slightly faster than the binary search. If we really care, we could
@@ -245,9 +1010,38 @@ func (h *histogram) Observe(v float64) {
 	// 11 buckets: 38.3 ns/op linear - binary 48.7 ns/op
 	// 100 buckets: 78.1 ns/op linear - binary 54.9 ns/op
 	// 300 buckets: 154 ns/op linear - binary 61.6 ns/op
+	v, ok := h.invalid.filter(v)
+	if !ok {
+		return
+	}
+	if h.budget != nil {
+		// Wait for the budget before locking, so that a blocked
+		// observation does not block Write.
+		if h.dropped == nil {
+			h.budget.take()
+		} else if !h.budget.tryTake() {
+			h.dropped.Inc()
+			return
+		}
+	}
+	if h.weighted {
+		h.observeWeighted(v, 1)
+		return
+	}
+	h.writeMtx.RLock()
 	i := sort.SearchFloat64s(h.upperBounds, v)
+	if i == len(h.upperBounds) && v > 0 && v < h.maxUpperBound {
+		h.writeMtx.RUnlock()
+		h.addBucket(v)
+		h.writeMtx.RLock()
+		i = sort.SearchFloat64s(h.upperBounds, v)
+	}
+	defer h.writeMtx.RUnlock()
 	if i < len(h.counts) {
 		atomic.AddUint64(&h.counts[i], 1)
+		if h.bucketSumBits != nil {
+			addFloat64Bits(&h.bucketSumBits[i], v)
+		}
 	}
 	atomic.AddUint64(&h.count, 1)
 	for {
@@ -259,189 +1053,2993 @@ func (h *histogram) Observe(v float64) {
 	}
 }
 
-func (h *histogram) Write(out *dto.Metric) error {
-	his := &dto.Histogram{}
-	buckets := make([]*dto.Bucket, len(h.upperBounds))
-
-	his.SampleSum = proto.Float64(math.Float64frombits(atomic.LoadUint64(&h.sumBits)))
-	his.SampleCount = proto.Uint64(atomic.LoadUint64(&h.count))
-	var count uint64
-	for i, upperBound := range h.upperBounds {
-		count += atomic.LoadUint64(&h.counts[i])
-		buckets[i] = &dto.Bucket{
-			CumulativeCount: proto.Uint64(count),
-			UpperBound:      proto.Float64(upperBound),
+// observeN observes v n times with a single update of each value.
+func (h *histogram) observeN(v float64, n uint64) {
+	if n == 0 {
+		return
+	}
+	v, ok := h.invalid.filter(v)
+	if !ok {
+		return
+	}
+	if h.weighted {
+		h.observeWeighted(v, float64(n))
+		return
+	}
+	h.writeMtx.RLock()
+	i := sort.SearchFloat64s(h.upperBounds, v)
+	if i == len(h.upperBounds) && v > 0 && v < h.maxUpperBound {
+		h.writeMtx.RUnlock()
+		h.addBucket(v)
+		h.writeMtx.RLock()
+		i = sort.SearchFloat64s(h.upperBounds, v)
+	}
+	defer h.writeMtx.RUnlock()
+	if i < len(h.counts) {
+		atomic.AddUint64(&h.counts[i], n)
+		if h.bucketSumBits != nil {
+			addFloat64Bits(&h.bucketSumBits[i], v*float64(n))
 		}
 	}
-	his.Bucket = buckets
-	out.Histogram = his
-	out.Label = h.labelPairs
-	return nil
+	atomic.AddUint64(&h.count, n)
+	addFloat64Bits(&h.sumBits, v*float64(n))
 }
 
-// HistogramVec is a Collector that bundles a set of Histograms that all share the
-// same Desc, but have different values for their variable labels. This is used
-// if you want to count the same thing partitioned by various dimensions
-// (e.g. HTTP request latencies, partitioned by status code and method). Create
-// instances with NewHistogramVec.
-type HistogramVec struct {
-	MetricVec
+// ObserveWithWeight implements WeightedHistogram. It panics if the histogram
+// was not created with WeightedBuckets set.
+func (h *histogram) ObserveWithWeight(v, weight float64) {
+	if !h.weighted {
+		panic(fmt.Errorf("ObserveWithWeight called for histogram %s, which does not have WeightedBuckets set", h.desc))
+	}
+	v, ok := h.invalid.filter(v)
+	if !ok {
+		return
+	}
+	if !(weight >= 0) || math.IsInf(weight, +1) {
+		if h.errorHandler != nil {
+			h.errorHandler(ErrInvalidWeight, weight)
+		}
+		return
+	}
+	if h.budget != nil {
+		if h.dropped == nil {
+			h.budget.take()
+		} else if !h.budget.tryTake() {
+			h.dropped.Inc()
+			return
+		}
+	}
+	h.observeWeighted(v, weight)
 }
 
-// NewHistogramVec creates a new HistogramVec based on the provided HistogramOpts and
-// partitioned by the given label names. At least one label name must be
-// provided.
-func NewHistogramVec(opts HistogramOpts, labelNames []string) *HistogramVec {
-	desc := NewDesc(
-		BuildFQName(opts.Namespace, opts.Subsystem, opts.Name),
-		opts.Help,
-		labelNames,
-		opts.ConstLabels,
-	)
-	return &HistogramVec{
-		MetricVec: MetricVec{
-			children: map[uint64]Metric{},
-			desc:     desc,
-			hash:     fnv.New64a(),
-			newMetric: func(lvs ...string) Metric {
-				return newHistogram(desc, opts, lvs...)
-			},
-		},
+// observeWeighted adds weight to the bucket of v and the count, and v*weight to
+// the sum. It is only used for weighted histograms.
+func (h *histogram) observeWeighted(v, weight float64) {
+	h.writeMtx.RLock()
+	i := sort.SearchFloat64s(h.upperBounds, v)
+	if i == len(h.upperBounds) && v > 0 && v < h.maxUpperBound {
+		h.writeMtx.RUnlock()
+		h.addBucket(v)
+		h.writeMtx.RLock()
+		i = sort.SearchFloat64s(h.upperBounds, v)
 	}
+	defer h.writeMtx.RUnlock()
+	if i < len(h.counts) {
+		addFloat64Bits(&h.counts[i], weight)
+		if h.bucketSumBits != nil {
+			addFloat64Bits(&h.bucketSumBits[i], v*weight)
+		}
+	}
+	addFloat64Bits(&h.count, weight)
+	addFloat64Bits(&h.sumBits, v*weight)
 }
 
-// GetMetricWithLabelValues replaces the method of the same name in
-// MetricVec. The difference is that this method returns a Histogram and not a
-// Metric so that no type conversion is required.
-func (m *HistogramVec) GetMetricWithLabelValues(lvs ...string) (Histogram, error) {
-	metric, err := m.MetricVec.GetMetricWithLabelValues(lvs...)
-	if metric != nil {
-		return metric.(Histogram), err
+// addBucket adds a bucket for v above the highest bucket, unless a concurrent
+// call has done so already.
+func (h *histogram) addBucket(v float64) {
+	h.writeMtx.Lock()
+	defer h.writeMtx.Unlock()
+	if n := len(h.upperBounds); n > 0 && v <= h.upperBounds[n-1] {
+		return
 	}
-	return nil, err
+	upperBound := math.Min(math.Pow(2, math.Ceil(math.Log2(v))), h.maxUpperBound)
+	h.upperBounds = append(h.upperBounds, upperBound)
+	h.counts = append(h.counts, 0)
 }
 
-// GetMetricWith replaces the method of the same name in MetricVec. The
-// difference is that this method returns a Histogram and not a Metric so that no
-// type conversion is required.
-func (m *HistogramVec) GetMetricWith(labels Labels) (Histogram, error) {
-	metric, err := m.MetricVec.GetMetricWith(labels)
-	if metric != nil {
-		return metric.(Histogram), err
+// tokenBucket is a token-bucket rate limiter with a capacity of one second
+// worth of tokens, or one token, whichever is more.
+type tokenBucket struct {
+	rate, capacity float64 // Tokens per second and maximum tokens.
+	now            func() time.Time
+
+	mtx    sync.Mutex // Protects tokens and last.
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64, now func() time.Time) *tokenBucket {
+	b := &tokenBucket{
+		rate:     rate,
+		capacity: math.Max(rate, 1),
+		now:      now,
+		last:     now(),
 	}
-	return nil, err
+	b.tokens = b.capacity
+	return b
 }
 
-// WithLabelValues works as GetMetricWithLabelValues, but panics where
-// GetMetricWithLabelValues would have returned an error. By not returning an
+// refill adds the tokens accrued since the last refill. It must be called
+// with mtx locked.
+func (b *tokenBucket) refill() {
+	now := b.now()
+	b.tokens = math.Min(b.capacity, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+}
+
+// tryTake takes a token if one is available and returns whether it did.
+func (b *tokenBucket) tryTake() bool {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	b.refill()
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// take takes a token, waiting until it is available. Waiting callers reserve
+// their token upfront, so that they are served in order.
+func (b *tokenBucket) take() {
+	b.mtx.Lock()
+	b.refill()
+	b.tokens--
+	deficit := -b.tokens
+	b.mtx.Unlock()
+
+	if deficit > 0 {
+		time.Sleep(time.Duration(deficit / b.rate * float64(time.Second)))
+	}
+}
+
+// observeBatch observes each of the given values weight times. It updates each
+// bucket count, the count, and the sum only once. Invalid values are handled
+// according to the NaNPolicy and InfPolicy, as in Observe.
+func (h *histogram) observeBatch(values []float64, weight uint64) {
+	valid := make([]float64, 0, len(values))
+	for _, v := range values {
+		if v, ok := h.invalid.filter(v); ok {
+			valid = append(valid, v)
+		}
+	}
+	values = valid
+	if h.weighted {
+		for _, v := range values {
+			h.observeWeighted(v, float64(weight))
+		}
+		return
+	}
+	if h.maxUpperBound > 0 {
+		// Add the dynamic buckets in the order Observe would have added
+		// them before counting the batch.
+		for _, v := range values {
+			h.writeMtx.RLock()
+			grow := v > 0 && v < h.maxUpperBound && sort.SearchFloat64s(h.upperBounds, v) == len(h.upperBounds)
+			h.writeMtx.RUnlock()
+			if grow {
+				h.addBucket(v)
+			}
+		}
+	}
+	h.writeMtx.RLock()
+	defer h.writeMtx.RUnlock()
+	counts := make([]uint64, len(h.counts))
+	var sum float64
+	for _, v := range values {
+		if i := sort.SearchFloat64s(h.upperBounds, v); i < len(counts) {
+			counts[i] += weight
+			if h.bucketSumBits != nil {
+				addFloat64Bits(&h.bucketSumBits[i], v*float64(weight))
+			}
+		}
+		sum += v * float64(weight)
+	}
+	for i, c := range counts {
+		if c > 0 {
+			atomic.AddUint64(&h.counts[i], c)
+		}
+	}
+	atomic.AddUint64(&h.count, uint64(len(values))*weight)
+	for {
+		oldBits := atomic.LoadUint64(&h.sumBits)
+		newBits := math.Float64bits(math.Float64frombits(oldBits) + sum)
+		if atomic.CompareAndSwapUint64(&h.sumBits, oldBits, newBits) {
+			break
+		}
+	}
+}
+
+// snapshot returns the cumulative bucket counts, the count, and the sum of the
+// histogram. If resetOnCollect is true, it resets all values. The counts of a
+// weighted histogram are rounded to the nearest integer, as the exposition
+// formats only support integer counts.
+func (h *histogram) snapshot() (upperBounds []float64, cumCounts []uint64, count uint64, sum float64) {
+	return h.read(h.resetOnCollect)
+}
+
+// read works like snapshot, but resets all values if reset is true.
+func (h *histogram) read(reset bool) (upperBounds []float64, cumCounts []uint64, count uint64, sum float64) {
+	h.writeMtx.Lock()
+	defer h.writeMtx.Unlock()
+
+	upperBounds = h.upperBounds
+	sum = math.Float64frombits(atomic.LoadUint64(&h.sumBits))
+	cumCounts = make([]uint64, len(h.counts))
+	if h.weighted {
+		count = roundWeight(math.Float64frombits(atomic.LoadUint64(&h.count)))
+		var cumWeight float64
+		for i := range h.counts {
+			cumWeight += math.Float64frombits(atomic.LoadUint64(&h.counts[i]))
+			cumCounts[i] = roundWeight(cumWeight)
+		}
+	} else {
+		count = atomic.LoadUint64(&h.count)
+		var cumCount uint64
+		for i := range h.counts {
+			cumCount += atomic.LoadUint64(&h.counts[i])
+			cumCounts[i] = cumCount
+		}
+	}
+	if reset {
+		h.zero()
+	}
+	return upperBounds, cumCounts, count, sum
+}
+
+// Snapshot implements HistogramWithReset.
+func (h *histogram) Snapshot() HistogramSnapshot {
+	upperBounds, cumCounts, count, sum := h.read(true)
+	return HistogramSnapshot{
+		Count:            count,
+		Sum:              sum,
+		UpperBounds:      append([]float64(nil), upperBounds...),
+		CumulativeCounts: cumCounts,
+	}
+}
+
+// Reset implements HistogramWithReset.
+func (h *histogram) Reset() {
+	h.reset()
+}
+
+// roundWeight rounds a sum of weights to the nearest integer count.
+func roundWeight(w float64) uint64 {
+	return uint64(math.Floor(w + 0.5))
+}
+
+// reset sets all values to zero.
+func (h *histogram) reset() {
+	h.writeMtx.Lock()
+	defer h.writeMtx.Unlock()
+	h.zero()
+}
+
+// zero sets all values to zero. It needs writeMtx locked.
+func (h *histogram) zero() {
+	h.sumBits = 0
+	h.count = 0
+	for i := range h.counts {
+		h.counts[i] = 0
+	}
+	for i := range h.bucketSumBits {
+		h.bucketSumBits[i] = 0
+	}
+	if h.now != nil {
+		h.createdAt = h.now()
+	}
+}
+
+func (h *histogram) Write(out *dto.Metric) error {
+	upperBounds, cumCounts, count, sum := h.snapshot()
+	his := &dto.Histogram{
+		SampleCount: proto.Uint64(count),
+		SampleSum:   proto.Float64(sum),
+	}
+	buckets := make([]*dto.Bucket, len(upperBounds))
+	for i, upperBound := range upperBounds {
+		buckets[i] = &dto.Bucket{
+			CumulativeCount: proto.Uint64(cumCounts[i]),
+			UpperBound:      proto.Float64(upperBound),
+		}
+	}
+	switch {
+	case h.noBuckets:
+		// A nil Bucket field keeps the text format from adding the
+		// implicit +Inf bucket.
+		buckets = nil
+	case len(buckets) == 0:
+		// Only the implicit +Inf bucket is left. Add it explicitly as
+		// copies made by proto.Clone turn an empty Bucket field into a
+		// nil one, which would then be exposed like a NoBuckets one.
+		buckets = append(buckets, &dto.Bucket{
+			CumulativeCount: his.SampleCount,
+			UpperBound:      proto.Float64(math.Inf(+1)),
+		})
+	}
+	his.Bucket = buckets
+	out.Histogram = his
+	out.Label = h.labelPairs
+	return nil
+}
+
+// EncodeMetric implements DirectEncoder. It writes the same samples as the
+// text format would for the histogram, including the implicit +Inf bucket,
+// except that the "le" label is taken from HistogramOpts.BucketLabels where
+// set.
+func (h *histogram) EncodeMetric(w io.Writer) error {
+	upperBounds, cumCounts, count, sum := h.snapshot()
+	name := h.desc.fqName
+	for i, upperBound := range upperBounds {
+		if err := writeTextSample(
+			w, name+"_bucket", h.labelPairs,
+			model.BucketLabel, h.bucketLabel(upperBound), cumCounts[i],
+		); err != nil {
+			return err
+		}
+	}
+	if !h.noBuckets {
+		if err := writeTextSample(
+			w, name+"_bucket", h.labelPairs,
+			model.BucketLabel, h.bucketLabel(math.Inf(+1)), count,
+		); err != nil {
+			return err
+		}
+	}
+	if err := writeTextSample(w, name+"_sum", h.labelPairs, "", "", sum); err != nil {
+		return err
+	}
+	return writeTextSample(w, name+"_count", h.labelPairs, "", "", count)
+}
+
+func newLearningHistogram(desc *Desc, opts HistogramOpts) *learningHistogram {
+	if len(opts.Buckets) > 0 || opts.NoBuckets {
+		panic(fmt.Errorf("histogram %s has Buckets or NoBuckets set although FreezeBucketsAfter is set", desc))
+	}
+	if opts.TargetBuckets < 0 {
+		panic(fmt.Errorf("histogram %s has negative TargetBuckets", desc))
+	}
+	if opts.TargetBuckets == 0 {
+		opts.TargetBuckets = len(DefBuckets)
+	}
+	n := opts.FreezeBucketsAfter
+	opts.FreezeBucketsAfter = 0
+	newHistogram(desc, opts) // Let newHistogram validate the labels.
+
+	remainingDesc := NewDesc(
+		desc.fqName+"_learning_observations_remaining",
+		"Number of observations still needed before the buckets of "+desc.fqName+" are frozen.",
+		nil,
+		opts.ConstLabels,
+	)
+	remainingDesc.deprecatedVersion = opts.DeprecatedVersion
+	invalid := newInvalidObservations("histogram", desc, opts.NaNPolicy, opts.InfPolicy, opts.ErrorHandler)
+	invalid.track(desc, opts.ConstLabels)
+	return &learningHistogram{
+		desc:          desc,
+		remainingDesc: remainingDesc,
+		opts:          opts,
+		n:             n,
+		invalid:       invalid,
+	}
+}
+
+// learningHistogram is a Histogram that learns its buckets, see
+// HistogramOpts.FreezeBucketsAfter.
+type learningHistogram struct {
+	desc, remainingDesc *Desc
+	opts                HistogramOpts
+	n                   uint64
+	invalid             *invalidObservations
+
+	mtx    sync.RWMutex // Protects the fields below.
+	buffer []float64
+	frozen *histogram // Nil while learning.
+}
+
+func (h *learningHistogram) Desc() *Desc {
+	return h.desc
+}
+
+// frozenHistogram returns the frozen histogram, or nil while still learning.
+func (h *learningHistogram) frozenHistogram() *histogram {
+	h.mtx.RLock()
+	defer h.mtx.RUnlock()
+	return h.frozen
+}
+
+func (h *learningHistogram) Observe(v float64) {
+	v, ok := h.invalid.filter(v)
+	if !ok {
+		return
+	}
+	if frozen := h.frozenHistogram(); frozen != nil {
+		frozen.Observe(v)
+		return
+	}
+
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	if h.frozen != nil {
+		h.frozen.Observe(v)
+		return
+	}
+	h.buffer = append(h.buffer, v)
+	if uint64(len(h.buffer)) < h.n {
+		return
+	}
+	opts := h.opts
+	opts.Buckets = percentileBuckets(h.buffer, opts.TargetBuckets)
+	frozen := newHistogram(h.desc, opts).(*histogram)
+	frozen.observeBatch(h.buffer, 1)
+	h.frozen, h.buffer = frozen, nil
+}
+
+// percentileBuckets returns up to count upper bounds, which are the evenly
+// spaced percentiles (by the nearest-rank method) of the provided values. The
+// values are sorted in place.
+func percentileBuckets(values []float64, count int) []float64 {
+	sort.Float64s(values)
+	buckets := make([]float64, 0, count)
+	for i := 1; i <= count; i++ {
+		j := int(math.Ceil(float64(i)*float64(len(values))/float64(count))) - 1
+		if j < 0 {
+			j = 0
+		}
+		b := values[j]
+		if len(buckets) == 0 || b > buckets[len(buckets)-1] {
+			buckets = append(buckets, b)
+		}
+	}
+	return buckets
+}
+
+func (h *learningHistogram) Write(out *dto.Metric) error {
+	frozen := h.frozenHistogram()
+	if frozen == nil {
+		return fmt.Errorf("histogram %s is still learning its buckets", h.desc)
+	}
+	return frozen.Write(out)
+}
+
+// Describe implements Collector.
+func (h *learningHistogram) Describe(ch chan<- *Desc) {
+	ch <- h.desc
+	ch <- h.remainingDesc
+	h.invalid.Describe(ch)
+}
+
+// Collect implements Collector.
+func (h *learningHistogram) Collect(ch chan<- Metric) {
+	h.mtx.RLock()
+	frozen, remaining := h.frozen, h.n-uint64(len(h.buffer))
+	h.mtx.RUnlock()
+
+	h.invalid.Collect(ch)
+	if frozen != nil {
+		ch <- frozen
+		return
+	}
+	ch <- MustNewConstMetric(h.remainingDesc, GaugeValue, float64(remaining))
+}
+
+// AutoHistogramStatus reports whether an AutoHistogram is still learning its
+// buckets.
+type AutoHistogramStatus int
+
+// Possible values for AutoHistogramStatus.
+const (
+	// AutoHistogramLearning means that observations are still buffered
+	// to select the buckets.
+	AutoHistogramLearning AutoHistogramStatus = iota
+	// AutoHistogramObserving means that the buckets are selected and the
+	// AutoHistogram behaves like a normal Histogram.
+	AutoHistogramObserving
+)
+
+func (s AutoHistogramStatus) String() string {
+	if s == AutoHistogramObserving {
+		return "observing"
+	}
+	return "learning"
+}
+
+// AutoHistogram is a Histogram that selects its bucket boundaries from the
+// first observations. All Histograms created by NewHistogram with
+// FreezeBucketsAfter set implement it. Create instances with
+// NewAutoHistogram.
+type AutoHistogram interface {
+	Histogram
+
+	// BucketBoundaries returns the selected upper bounds of the buckets
+	// (without the implicit +Inf bucket), or nil while still learning.
+	BucketBoundaries() []float64
+	// Status reports whether the buckets have been selected yet.
+	Status() AutoHistogramStatus
+}
+
+// Default values for AutoHistogramOpts.
+const (
+	DefAutoHistogramMaxSamples    = 10000
+	DefAutoHistogramTargetBuckets = 20
+)
+
+// AutoHistogramOpts bundles the options for creating an AutoHistogram. The
+// FreezeBucketsAfter field of the embedded HistogramOpts is ignored in favor
+// of MaxSamples, and the default value of its TargetBuckets field is
+// DefAutoHistogramTargetBuckets.
+type AutoHistogramOpts struct {
+	HistogramOpts
+
+	// MaxSamples is the number of observations buffered before the
+	// buckets are selected. The default value is
+	// DefAutoHistogramMaxSamples.
+	MaxSamples int
+}
+
+// NewAutoHistogram creates a new AutoHistogram based on the provided
+// AutoHistogramOpts. It is a convenience wrapper for NewHistogram with
+// FreezeBucketsAfter set to MaxSamples, i.e. the buckets are selected by
+// equal-frequency binning of the buffered observations, see the documentation
+// of HistogramOpts.FreezeBucketsAfter for details. This is useful when the
+// distribution of a new metric is not known upfront. NewAutoHistogram panics
+// if MaxSamples is negative and under the same conditions as NewHistogram.
+func NewAutoHistogram(opts AutoHistogramOpts) AutoHistogram {
+	if opts.MaxSamples < 0 {
+		panic(fmt.Errorf("auto histogram %s has negative MaxSamples", opts.Name))
+	}
+	if opts.MaxSamples == 0 {
+		opts.MaxSamples = DefAutoHistogramMaxSamples
+	}
+	if opts.TargetBuckets == 0 {
+		opts.TargetBuckets = DefAutoHistogramTargetBuckets
+	}
+	opts.FreezeBucketsAfter = uint64(opts.MaxSamples)
+	return NewHistogram(opts.HistogramOpts).(AutoHistogram)
+}
+
+// BucketBoundaries implements AutoHistogram.
+func (h *learningHistogram) BucketBoundaries() []float64 {
+	frozen := h.frozenHistogram()
+	if frozen == nil {
+		return nil
+	}
+	return append([]float64(nil), frozen.upperBounds...)
+}
+
+// Status implements AutoHistogram.
+func (h *learningHistogram) Status() AutoHistogramStatus {
+	if h.frozenHistogram() == nil {
+		return AutoHistogramLearning
+	}
+	return AutoHistogramObserving
+}
+
+// WeightedHistogram is a Histogram whose observations carry a weight. All
+// Histograms created by NewHistogram with WeightedBuckets set, and all children
+// of a HistogramVec with WeightedBuckets set (unless SetAnomalyHandler has been
+// called), implement it. See HistogramOpts.WeightedBuckets.
+//
+// The count and the bucket counts of a WeightedHistogram are rounded to the
+// nearest integer when collected, as the exposition formats only support
+// integer counts. Choose the unit of the weights so that the rounding is
+// negligible (e.g. bytes rather than megabytes).
+type WeightedHistogram interface {
+	Histogram
+
+	// ObserveWithWeight adds weight to the bucket of v and to the count,
+	// and v multiplied by weight to the sum. Observe(v) is equivalent to
+	// ObserveWithWeight(v, 1).
+	ObserveWithWeight(v, weight float64)
+}
+
+// HistogramWithBucketSums is a Histogram that provides in-process access to
+// the sums of the observations in its buckets. All Histograms created by
+// NewHistogram without FreezeBucketsAfter, and all children of a HistogramVec,
+// implement it.
+type HistogramWithBucketSums interface {
+	Histogram
+
+	// BucketSums returns the cumulative sums of the observations for each
+	// upper bound of the Histogram (without the implicit +Inf bucket, the
+	// sum of which is the overall sum). It returns nil if the Histogram
+	// does not track bucket sums (see HistogramOpts.TrackBucketSums).
+	BucketSums() []float64
+}
+
+// HistogramWithReset is a Histogram that can be read and reset in-process, e.g.
+// to report the distribution of the observations per interval rather than
+// cumulatively. All Histograms created by NewHistogram without
+// FreezeBucketsAfter, and all children of a HistogramVec, implement it.
+//
+// Note that resetting a Histogram that is also collected breaks the
+// monotonicity of its counts, which rate calculations on the Prometheus server
+// interpret as a counter reset.
+type HistogramWithReset interface {
+	Histogram
+
+	// Snapshot returns the current state of the Histogram and resets it
+	// to zero in the same step, so that each observation ends up in
+	// exactly one snapshot even while Observe is called concurrently.
+	Snapshot() HistogramSnapshot
+	// Reset sets the count, the sum, and all bucket counts to zero.
+	Reset()
+}
+
+// HistogramWithCreatedAt is a Histogram that can report the time it was
+// created or last reset. All Histograms created by NewHistogram without
+// FreezeBucketsAfter, and all children of a HistogramVec, implement it.
+type HistogramWithCreatedAt interface {
+	Histogram
+
+	// CreatedAt returns the time the Histogram was created or last reset
+	// if it records it (see HistogramOpts.RecordCreatedTimestamp), or the
+	// zero Time otherwise.
+	CreatedAt() time.Time
+}
+
+// HistogramWithSize is a Histogram that reports its approximate memory
+// footprint. All Histograms created by NewHistogram without FreezeBucketsAfter,
+// and all children of a HistogramVec, implement it.
+type HistogramWithSize interface {
+	Histogram
+
+	// Size returns the approximate size of the Histogram in memory in
+	// bytes. It is calculated deterministically from the structure of
+	// the Histogram rather than measured: HistogramBaseSize for the
+	// count, the sum, and the bookkeeping, 16 bytes per bucket for its
+	// upper bound and count, another 8 bytes per bucket if bucket sums
+	// are tracked, and LabelPairSize plus the length of name and value
+	// for each label pair. The size of the Desc, which is shared by all
+	// children of a HistogramVec, is not included.
+	Size() int
+}
+
+const (
+	// HistogramBaseSize is the size a Histogram without buckets and labels
+	// is accounted for by HistogramWithSize.
+	HistogramBaseSize = 192
+	// LabelPairSize is the size each label pair is accounted for by
+	// HistogramWithSize in addition to the length of its name and value.
+	LabelPairSize = 48
+)
+
+// HistogramVec is a Collector that bundles a set of Histograms that all share the
+// same Desc, but have different values for their variable labels. This is used
+// if you want to count the same thing partitioned by various dimensions
+// (e.g. HTTP request latencies, partitioned by status code and method). Create
+// instances with NewHistogramVec.
+type HistogramVec struct {
+	MetricVec
+	opts HistogramOpts
+	// bucketSumDesc is only set if bucket sums are tracked.
+	bucketSumDesc *Desc
+	// invalid is returned by WithLabelValues and With for dropped label
+	// values (see HistogramOpts.LabelAllowlist).
+	invalid Histogram
+	// invalidValues counts the observations dropped by the children
+	// because of the NaNPolicy or InfPolicy.
+	invalidValues *invalidObservations
+	// heterogeneous is true if the children do not all share the same
+	// buckets (see NewHeterogeneousHistogramVec).
+	heterogeneous bool
+	// anomalyHandler is true once SetAnomalyHandler has been called.
+	anomalyHandler bool
+	// lazyBuckets is true if the buckets of children without observations
+	// are not collected (see WithLazyBucketEmission). Protected by mtx.
+	lazyBuckets bool
+	// slab is only set if the children share their bucket layout (see
+	// HistogramOpts.SharedBucketLayout).
+	slab *bucketSlab
+}
+
+// NewHistogramVec creates a new HistogramVec based on the provided HistogramOpts and
+// partitioned by the given label names. At least one label name must be
+// provided.
+func NewHistogramVec(opts HistogramOpts, labelNames []string) *HistogramVec {
+	desc := NewDesc(
+		BuildFQName(opts.Namespace, opts.Subsystem, opts.Name),
+		opts.Help,
+		labelNames,
+		opts.ConstLabels,
+	)
+	desc.deprecatedVersion = opts.DeprecatedVersion
+	m := &HistogramVec{
+		MetricVec: MetricVec{
+			children:  map[uint64]Metric{},
+			desc:      desc,
+			hash:      fnv.New64a(),
+			seed:      hashSeed(opts.HashSeed),
+			allowlist: newLabelAllowlist(desc, opts.LabelAllowlist, opts.FallbackBehavior, opts.FallbackValue),
+		},
+		opts: opts,
+	}
+	// All children count their dropped values together.
+	m.invalidValues = newInvalidObservations("histogram", desc, opts.NaNPolicy, opts.InfPolicy, opts.ErrorHandler)
+	m.invalidValues.track(desc, opts.ConstLabels)
+	if opts.SharedBucketLayout {
+		m.slab = &bucketSlab{}
+		m.release = func(metric Metric) {
+			h := unwrapHistogram(metric)
+			h.reset()
+			m.slab.release(h.counts)
+		}
+	}
+	m.newMetric = func(lvs ...string) Metric {
+		return wrapHistogram(m.shareInvalidValues(newHistogramInSlab(desc, opts, m.slab, lvs...)), opts)
+	}
+	if m.allowlist != nil && m.allowlist.drop {
+		m.invalid = m.newMetric(make([]string, len(labelNames))...).(Histogram)
+	}
+	if opts.TrackBucketSums {
+		// All children share the same Desc for their bucket sums.
+		m.bucketSumDesc = newHistogram(
+			desc, opts, make([]string, len(labelNames))...,
+		).(*histogram).bucketSumDesc
+	}
+	return m
+}
+
+// BucketRule assigns buckets to the children of a HistogramVec created with
+// NewHeterogeneousHistogramVec whose label values contain all of the Labels of
+// the rule. Labels only needs to contain the labels that determine the choice
+// of buckets.
+type BucketRule struct {
+	Labels  Labels
+	Buckets []float64
+}
+
+// NewHeterogeneousHistogramVec works like NewHistogramVec, but the buckets of
+// each child are determined by the provided rules upon its creation. A child
+// gets the buckets of the rule with the most Labels that all match the label
+// values of the child. Children no rule matches get opts.Buckets (or
+// DefBuckets if not set). This allows different bucket ranges for the same
+// metric, e.g. for the latencies of upstream services with very different
+// response times.
+//
+// The function panics if a rule refers to a label name that is not one of the
+// provided label names, or if two rules have the same Labels. A
+// HistogramVec created this way cannot be used with WithPool.
+func NewHeterogeneousHistogramVec(opts HistogramOpts, labelNames []string, rules []BucketRule) *HistogramVec {
+	m := NewHistogramVec(opts, labelNames)
+	desc := m.desc
+	rules = append([]BucketRule(nil), rules...)
+	for i, rule := range rules {
+		for name := range rule.Labels {
+			known := false
+			for _, l := range labelNames {
+				if l == name {
+					known = true
+					break
+				}
+			}
+			if !known {
+				panic(fmt.Errorf("label %q in bucket rule is not a variable label of %s", name, desc))
+			}
+		}
+		for _, other := range rules[:i] {
+			if equalLabels(rule.Labels, other.Labels) {
+				panic(fmt.Errorf("duplicate bucket rule for labels %v of %s", rule.Labels, desc))
+			}
+		}
+	}
+	m.heterogeneous = true
+	m.newMetric = func(lvs ...string) Metric {
+		childOpts := opts
+		best := -1
+		for i, rule := range rules {
+			if best >= 0 && len(rule.Labels) <= len(rules[best].Labels) {
+				continue
+			}
+			matches := true
+			for j, name := range labelNames {
+				if v, ok := rule.Labels[name]; ok && v != lvs[j] {
+					matches = false
+					break
+				}
+			}
+			if matches {
+				best = i
+			}
+		}
+		if best >= 0 {
+			childOpts.Buckets = rules[best].Buckets
+		}
+		return wrapHistogram(m.shareInvalidValues(newHistogramInSlab(desc, childOpts, m.slab, lvs...)), opts)
+	}
+	return m
+}
+
+func equalLabels(a, b Labels) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for name, value := range a {
+		if v, ok := b[name]; !ok || v != value {
+			return false
+		}
+	}
+	return true
+}
+
+// wrapHistogram wraps the provided child of a HistogramVec as needed by the
+// provided HistogramOpts.
+func wrapHistogram(h Histogram, opts HistogramOpts) Histogram {
+	if opts.TrackLastObserved {
+		return &trackedHistogram{
+			observedAt: newObservedAt(),
+			Histogram:  h,
+		}
+	}
+	return h
+}
+
+// WithPool makes the HistogramVec recycle its Histograms. Deleted Histograms
+// (see Delete, DeleteLabelValues, DeleteExpired, and Reset) are put into the
+// provided pool, and new Histograms are taken from it and reset before use.
+// This reduces the garbage created by HistogramVecs whose Histograms are
+// frequently created and deleted. If the New function of the pool is nil,
+// WithPool sets it to allocate a new Histogram. The pool must not be shared
+// with any other HistogramVec.
+//
+// Note that a deleted Histogram must not be used anymore, as it may be reused
+// for other label values at any time. Call WithPool before the HistogramVec is
+// used for the first time. WithPool returns the HistogramVec for convenience.
+// It panics for a HistogramVec created with NewHeterogeneousHistogramVec or with
+// DynamicBuckets or SharedBucketLayout set, and if SetAnomalyHandler has been
+// called before.
+func (m *HistogramVec) WithPool(pool *sync.Pool) *HistogramVec {
+	if m.heterogeneous {
+		panic(fmt.Errorf("cannot use a pool with the heterogeneous histogram vector %s", m.desc))
+	}
+	if m.anomalyHandler {
+		panic(fmt.Errorf("cannot use a pool after setting an anomaly handler for histogram vector %s", m.desc))
+	}
+	if m.opts.DynamicBuckets {
+		panic(fmt.Errorf("cannot use a pool with the dynamically bucketed histogram vector %s", m.desc))
+	}
+	if m.slab != nil {
+		panic(fmt.Errorf("cannot use a pool with the histogram vector %s, which has SharedBucketLayout set", m.desc))
+	}
+	desc, opts := m.desc, m.opts
+	if pool.New == nil {
+		pool.New = func() interface{} {
+			return newHistogram(desc, opts, make([]string, len(desc.variableLabels))...)
+		}
+	}
+	m.newMetric = func(lvs ...string) Metric {
+		h := pool.Get().(*histogram)
+		h.reset()
+		h.labelPairs = makeLabelPairs(desc, lvs)
+		return wrapHistogram(m.shareInvalidValues(h), opts)
+	}
+	m.release = func(metric Metric) {
+		pool.Put(unwrapHistogram(metric))
+	}
+	return m
+}
+
+// bucketSlab allocates the bucket counts of the children of a HistogramVec with
+// SharedBucketLayout set. The counts handed out are never moved, so that
+// observations can update them without locking.
+type bucketSlab struct {
+	mtx   sync.Mutex // Protects the fields below.
+	chunk []uint64   // The unallocated part of the current slab.
+	size  int        // The size of the current slab.
+	free  map[int][][]uint64
+}
+
+// alloc returns n zeroed counts, either released ones or from the current
+// slab. A new slab of twice the size is allocated if the current one does not
+// have n counts left.
+func (s *bucketSlab) alloc(n int) []uint64 {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	if free := s.free[n]; len(free) > 0 {
+		counts := free[len(free)-1]
+		s.free[n] = free[:len(free)-1]
+		return counts
+	}
+	if len(s.chunk) < n {
+		s.size *= 2
+		if s.size < 64*n {
+			s.size = 64 * n
+		}
+		s.chunk = make([]uint64, s.size)
+	}
+	// Limit the capacity so that appending never writes into the counts
+	// of another child.
+	counts := s.chunk[:n:n]
+	s.chunk = s.chunk[n:]
+	return counts
+}
+
+// release makes the provided counts, which must be zeroed, available for reuse.
+func (s *bucketSlab) release(counts []uint64) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	if s.free == nil {
+		s.free = map[int][][]uint64{}
+	}
+	s.free[len(counts)] = append(s.free[len(counts)], counts)
+}
+
+// trackedHistogram is a Histogram that records the time of its last
+// observation.
+type trackedHistogram struct {
+	observedAt
+	Histogram
+}
+
+func (h *trackedHistogram) Observe(v float64) { h.touch(); h.Histogram.Observe(v) }
+
+// ObserveWithWeight implements WeightedHistogram.
+func (h *trackedHistogram) ObserveWithWeight(v, weight float64) {
+	h.touch()
+	unwrapHistogram(h).ObserveWithWeight(v, weight)
+}
+
+// BucketSums implements HistogramWithBucketSums.
+func (h *trackedHistogram) BucketSums() []float64 {
+	return unwrapHistogram(h).BucketSums()
+}
+
+// Size implements HistogramWithSize.
+func (h *trackedHistogram) Size() int {
+	return unwrapHistogram(h).Size()
+}
+
+// Snapshot implements HistogramWithReset.
+func (h *trackedHistogram) Snapshot() HistogramSnapshot {
+	return unwrapHistogram(h).Snapshot()
+}
+
+// Reset implements HistogramWithReset.
+func (h *trackedHistogram) Reset() {
+	unwrapHistogram(h).Reset()
+}
+
+// SetAnomalyHandler makes each Histogram of the HistogramVec track the running
+// mean and standard deviation of its observations (using Welford's online
+// algorithm) and call fn for each observation farther than k standard
+// deviations from the mean of the previous observations. fn is called
+// synchronously from within Observe after the Histogram has been updated, with
+// the label values of the Histogram, the observed value, and the mean and
+// standard deviation before the observation. No observation is considered an
+// outlier before at least two observations have been made. The tracked state
+// belongs to the Histogram, i.e. it is reset when the Histogram is deleted
+// (see Delete, DeleteLabelValues, DeleteExpired, and Reset). This is meant to
+// catch regressions of the instrumentation itself.
+//
+// Call SetAnomalyHandler before the HistogramVec is used for the first time,
+// and after WithPool if a pool is used. It panics if k is not positive.
+func (m *HistogramVec) SetAnomalyHandler(k float64, fn func(labels Labels, value, mean, stddev float64)) {
+	if !(k > 0) {
+		panic(fmt.Errorf("anomaly handler of histogram vector %s needs a positive k, got %f", m.desc, k))
+	}
+	m.anomalyHandler = true
+	desc, newMetric := m.desc, m.newMetric
+	m.newMetric = func(lvs ...string) Metric {
+		labels := make(Labels, len(lvs))
+		for i, name := range desc.variableLabels {
+			labels[name] = lvs[i]
+		}
+		return &anomalyHistogram{
+			Histogram: newMetric(lvs...).(Histogram),
+			labels:    labels,
+			k:         k,
+			fn:        fn,
+		}
+	}
+}
+
+// anomalyHistogram is a Histogram that reports outlying observations, see
+// HistogramVec.SetAnomalyHandler.
+type anomalyHistogram struct {
+	Histogram
+	labels Labels
+	k      float64
+	fn     func(labels Labels, value, mean, stddev float64)
+
+	mtx            sync.Mutex // Protects the fields below.
+	count          uint64
+	mean, sqDevSum float64
+}
+
+func (h *anomalyHistogram) Observe(v float64) {
+	h.Histogram.Observe(v)
+
+	h.mtx.Lock()
+	mean, stddev := h.mean, 0.
+	if h.count > 1 {
+		stddev = math.Sqrt(h.sqDevSum / float64(h.count-1))
+	}
+	outlier := h.count > 1 && math.Abs(v-mean) > h.k*stddev
+	h.count++
+	delta := v - h.mean
+	h.mean += delta / float64(h.count)
+	h.sqDevSum += delta * (v - h.mean)
+	h.mtx.Unlock()
+
+	if outlier {
+		h.fn(h.labels, v, mean, stddev)
+	}
+}
+
+// BucketSums implements HistogramWithBucketSums.
+func (h *anomalyHistogram) BucketSums() []float64 {
+	return unwrapHistogram(h).BucketSums()
+}
+
+// Size implements HistogramWithSize.
+func (h *anomalyHistogram) Size() int {
+	return unwrapHistogram(h).Size()
+}
+
+// Snapshot implements HistogramWithReset.
+func (h *anomalyHistogram) Snapshot() HistogramSnapshot {
+	return unwrapHistogram(h).Snapshot()
+}
+
+// Reset implements HistogramWithReset.
+func (h *anomalyHistogram) Reset() {
+	unwrapHistogram(h).Reset()
+}
+
+// TotalSize returns the sum of the sizes of all children of the HistogramVec
+// as reported by HistogramWithSize.
+func (m *HistogramVec) TotalSize() int {
+	m.mtx.RLock()
+	defer m.mtx.RUnlock()
+	var size int
+	for _, metric := range m.children {
+		size += unwrapHistogram(metric).Size()
+	}
+	return size
+}
+
+// unwrapHistogram returns the histogram wrapped by the provided child of a
+// HistogramVec.
+func unwrapHistogram(metric Metric) *histogram {
+	for {
+		switch h := metric.(type) {
+		case *trackedHistogram:
+			metric = h.Histogram
+		case *anomalyHistogram:
+			metric = h.Histogram
+		default:
+			return metric.(*histogram)
+		}
+	}
+}
+
+// shareInvalidValues makes the newly created child h count its dropped values
+// with the HistogramVec and returns it.
+func (m *HistogramVec) shareInvalidValues(h Histogram) Histogram {
+	h.(*histogram).invalid = m.invalidValues
+	return h
+}
+
+// Describe implements Collector. It also describes the bucket sums if they
+// are tracked, and the counts of dropped values.
+func (m *HistogramVec) Describe(ch chan<- *Desc) {
+	m.MetricVec.Describe(ch)
+	if m.bucketSumDesc != nil {
+		ch <- m.bucketSumDesc
+	}
+	m.invalidValues.Describe(ch)
+}
+
+// Collect implements Collector. It also collects the bucket sums of all
+// Histograms if they are tracked, and the counts of dropped values. See also
+// WithLazyBucketEmission.
+func (m *HistogramVec) Collect(ch chan<- Metric) {
+	m.invalidValues.Collect(ch)
+	m.mtx.RLock()
+	defer m.mtx.RUnlock()
+	for _, metric := range m.children {
+		h := unwrapHistogram(metric)
+		if !m.lazyBuckets {
+			ch <- metric
+			h.collectBucketSums(ch)
+			continue
+		}
+		ch <- lazyBucketHistogram{metric}
+		if atomic.LoadUint64(&h.count) > 0 {
+			h.collectBucketSums(ch)
+		}
+	}
+}
+
+// WithLazyBucketEmission enables or disables lazy bucket emission. If enabled,
+// the buckets (and the bucket sums, if tracked) of children without any
+// observations are not collected, only their count and sum, which are both 0.
+// Once a child has been observed, it is collected with all its buckets
+// again. This considerably reduces the size of a scrape for a HistogramVec
+// with many children that are mostly unused, e.g. after a WarmUp. However, a
+// child of a bucketed HistogramVec then looks like a NoBuckets one until it is
+// observed, so queries on its buckets only return results from that point
+// on. WithLazyBucketEmission can be called at any time and returns the
+// HistogramVec for convenience.
+func (m *HistogramVec) WithLazyBucketEmission(enable bool) *HistogramVec {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	m.lazyBuckets = enable
+	return m
+}
+
+// lazyBucketHistogram is a Histogram metric that is written without buckets
+// as long as it has no observations.
+type lazyBucketHistogram struct {
+	Metric
+}
+
+func (h lazyBucketHistogram) Write(out *dto.Metric) error {
+	if err := h.Metric.Write(out); err != nil {
+		return err
+	}
+	if out.Histogram.GetSampleCount() == 0 {
+		out.Histogram.Bucket = nil
+	}
+	return nil
+}
+
+// GetMetricWithLabelValues replaces the method of the same name in
+// MetricVec. The difference is that this method returns a Histogram and not a
+// Metric so that no type conversion is required.
+func (m *HistogramVec) GetMetricWithLabelValues(lvs ...string) (Histogram, error) {
+	metric, err := m.MetricVec.GetMetricWithLabelValues(lvs...)
+	if metric != nil {
+		return metric.(Histogram), err
+	}
+	return nil, err
+}
+
+// GetMetricWith replaces the method of the same name in MetricVec. The
+// difference is that this method returns a Histogram and not a Metric so that no
+// type conversion is required.
+func (m *HistogramVec) GetMetricWith(labels Labels) (Histogram, error) {
+	metric, err := m.MetricVec.GetMetricWith(labels)
+	if metric != nil {
+		return metric.(Histogram), err
+	}
+	return nil, err
+}
+
+// WithLabelValues works as GetMetricWithLabelValues, but panics where
+// GetMetricWithLabelValues would have returned an error. By not returning an
 // error, WithLabelValues allows shortcuts like
 //     myVec.WithLabelValues("404", "GET").Observe(42.21)
+// Label values that are dropped because they are not in the LabelAllowlist do
+// not cause a panic but result in a Histogram that is never exposed.
 func (m *HistogramVec) WithLabelValues(lvs ...string) Histogram {
-	return m.MetricVec.WithLabelValues(lvs...).(Histogram)
+	h, err := m.GetMetricWithLabelValues(lvs...)
+	if err == errLabelValueNotAllowed {
+		return m.invalid
+	}
+	if err != nil {
+		panic(err)
+	}
+	return h
+}
+
+// With works as GetMetricWith, but panics where GetMetricWithLabels would have
+// returned an error. By not returning an error, With allows shortcuts like
+//     myVec.With(Labels{"code": "404", "method": "GET"}).Observe(42.21)
+// Dropped label values are handled as in WithLabelValues.
+func (m *HistogramVec) With(labels Labels) Histogram {
+	h, err := m.GetMetricWith(labels)
+	if err == errLabelValueNotAllowed {
+		return m.invalid
+	}
+	if err != nil {
+		panic(err)
+	}
+	return h
+}
+
+// ObserveN observes value n times for the Histogram with the provided label
+// values. It is equivalent to calling
+//     myVec.WithLabelValues(lvs...).Observe(value)
+// n times, but it updates the bucket count, the count, and the sum only once,
+// so that its cost does not depend on n. (Only the Histograms of a HistogramVec
+// with an anomaly handler, see SetAnomalyHandler, are still updated n times.)
+// ObserveN panics if n is negative and under the same conditions as
+// WithLabelValues.
+func (m *HistogramVec) ObserveN(n int, value float64, labelValues ...string) {
+	if n < 0 {
+		panic(fmt.Errorf("negative n %d in ObserveN of histogram vector %s", n, m.desc))
+	}
+	observeN(m.WithLabelValues(labelValues...), value, uint64(n))
+}
+
+// ObserveIf observes value for the Histogram with the provided label values if
+// condition is true and returns condition, matching CounterVec.AddIf.
+func (m *HistogramVec) ObserveIf(condition bool, value float64, labelValues ...string) bool {
+	if condition {
+		m.WithLabelValues(labelValues...).Observe(value)
+	}
+	return condition
+}
+
+// HistogramSnapshot is the state of a Histogram at one point in time, as
+// passed to the function provided to HistogramVec.SortedForEach and as returned
+// by the Snapshot method of HistogramWithReset.
+type HistogramSnapshot struct {
+	Count uint64
+	Sum   float64
+	// UpperBounds and CumulativeCounts describe the buckets in increasing
+	// order. The implicit +Inf bucket, whose count is Count, is not
+	// included.
+	UpperBounds      []float64
+	CumulativeCounts []uint64
+}
+
+// Write stores the snapshot in out, so that it can be pushed or logged
+// independently of a collection. Like in the text format, the implicit +Inf
+// bucket is not written.
+func (s HistogramSnapshot) Write(out *dto.Histogram) {
+	out.SampleCount = proto.Uint64(s.Count)
+	out.SampleSum = proto.Float64(s.Sum)
+	out.Bucket = make([]*dto.Bucket, len(s.UpperBounds))
+	for i, upperBound := range s.UpperBounds {
+		out.Bucket[i] = &dto.Bucket{
+			CumulativeCount: proto.Uint64(s.CumulativeCounts[i]),
+			UpperBound:      proto.Float64(upperBound),
+		}
+	}
+}
+
+// SortedForEach calls fn with the variable labels and a snapshot of each
+// Histogram in the HistogramVec, in the same order as
+// GaugeVec.SortedForEach. Note that reading a Histogram with ResetOnCollect
+// set resets it like a collection does.
+func (m *HistogramVec) SortedForEach(fn func(labels Labels, snapshot HistogramSnapshot)) {
+	for _, child := range m.sortedChildren() {
+		his := child.metric.GetHistogram()
+		snapshot := HistogramSnapshot{
+			Count: his.GetSampleCount(),
+			Sum:   his.GetSampleSum(),
+		}
+		for _, b := range his.GetBucket() {
+			if math.IsInf(b.GetUpperBound(), +1) {
+				continue
+			}
+			snapshot.UpperBounds = append(snapshot.UpperBounds, b.GetUpperBound())
+			snapshot.CumulativeCounts = append(snapshot.CumulativeCounts, b.GetCumulativeCount())
+		}
+		fn(child.labels, snapshot)
+	}
+}
+
+// observeN observes v n times in h.
+func observeN(h Histogram, v float64, n uint64) {
+	switch h := h.(type) {
+	case *histogram:
+		h.observeN(v, n)
+	case *trackedHistogram:
+		h.touch()
+		observeN(h.Histogram, v, n)
+	default:
+		for i := uint64(0); i < n; i++ {
+			h.Observe(v)
+		}
+	}
+}
+
+// WithPartialLabels replaces the method of the same name in MetricVec. The
+// difference is that this method returns a PartialHistogramVec and not a
+// PartialMetricVec so that no type conversion is required.
+func (m *HistogramVec) WithPartialLabels(labels Labels) *PartialHistogramVec {
+	return &PartialHistogramVec{*m.MetricVec.WithPartialLabels(labels)}
+}
+
+// CurryWith replaces the method of the same name in MetricVec. The difference
+// is that this method returns a PartialHistogramVec and not a PartialMetricVec so
+// that no type conversion is required.
+func (m *HistogramVec) CurryWith(labels Labels) (*PartialHistogramVec, error) {
+	p, err := m.MetricVec.CurryWith(labels)
+	if err != nil {
+		return nil, err
+	}
+	return &PartialHistogramVec{*p}, nil
+}
+
+// MustCurryWith works as CurryWith, but panics where CurryWith would have
+// returned an error.
+func (m *HistogramVec) MustCurryWith(labels Labels) *PartialHistogramVec {
+	return &PartialHistogramVec{*m.MetricVec.MustCurryWith(labels)}
+}
+
+// PartialHistogramVec is a HistogramVec with some of its variable labels already bound
+// to values. Create instances with the WithPartialLabels method of HistogramVec.
+type PartialHistogramVec struct {
+	PartialMetricVec
+}
+
+// GetMetricWithLabelValues replaces the method of the same name in
+// PartialMetricVec. The difference is that this method returns a Histogram and
+// not a Metric so that no type conversion is required.
+func (p *PartialHistogramVec) GetMetricWithLabelValues(lvs ...string) (Histogram, error) {
+	metric, err := p.PartialMetricVec.GetMetricWithLabelValues(lvs...)
+	if metric != nil {
+		return metric.(Histogram), err
+	}
+	return nil, err
+}
+
+// WithLabelValues works as GetMetricWithLabelValues, but panics where
+// GetMetricWithLabelValues would have returned an error.
+func (p *PartialHistogramVec) WithLabelValues(lvs ...string) Histogram {
+	return p.PartialMetricVec.WithLabelValues(lvs...).(Histogram)
+}
+
+// GetMetricWith replaces the method of the same name in PartialMetricVec. The
+// difference is that this method returns a Histogram and not a Metric so that no
+// type conversion is required.
+func (p *PartialHistogramVec) GetMetricWith(labels Labels) (Histogram, error) {
+	metric, err := p.PartialMetricVec.GetMetricWith(labels)
+	if metric != nil {
+		return metric.(Histogram), err
+	}
+	return nil, err
+}
+
+// With works as GetMetricWith, but panics where GetMetricWith would have
+// returned an error.
+func (p *PartialHistogramVec) With(labels Labels) Histogram {
+	return p.PartialMetricVec.With(labels).(Histogram)
+}
+
+// CurryWith replaces the method of the same name in PartialMetricVec. The
+// difference is that this method returns a PartialHistogramVec and not a
+// PartialMetricVec so that no type conversion is required.
+func (p *PartialHistogramVec) CurryWith(labels Labels) (*PartialHistogramVec, error) {
+	curried, err := p.PartialMetricVec.CurryWith(labels)
+	if err != nil {
+		return nil, err
+	}
+	return &PartialHistogramVec{*curried}, nil
+}
+
+// MustCurryWith works as CurryWith, but panics where CurryWith would have
+// returned an error.
+func (p *PartialHistogramVec) MustCurryWith(labels Labels) *PartialHistogramVec {
+	return &PartialHistogramVec{*p.PartialMetricVec.MustCurryWith(labels)}
+}
+
+// GaugeHistogram is a Collector that samples a gauge-like value and tracks the
+// distribution of the sampled values in a Histogram. This is useful for values
+// that are naturally gauges (like queue depths or connection pool sizes) but
+// where their distribution over time is of interest rather than just their
+// current value.
+//
+// To create GaugeHistogram instances, use NewGaugeHistogram.
+type GaugeHistogram interface {
+	Collector
+
+	// Close stops the background sampling. It is safe to call Close more
+	// than once, and it has no effect for a GaugeHistogram in lazy mode.
+	Close()
+}
+
+// NewGaugeHistogram creates a new GaugeHistogram based on the provided
+// HistogramOpts. Every sampleInterval, the provided function is called from a
+// background goroutine, and its return value is observed by the Histogram. If
+// sampleInterval is 0, the GaugeHistogram is in lazy mode: no background
+// goroutine is started, and the function is only sampled each time the
+// GaugeHistogram is collected. In either case, the provided function must be
+// concurrency-safe. Call Close if the GaugeHistogram is not needed anymore to
+// stop the background goroutine.
+func NewGaugeHistogram(gaugeFunc func() float64, opts HistogramOpts, sampleInterval time.Duration) GaugeHistogram {
+	result := &gaugeHistogram{
+		Histogram: NewHistogram(opts),
+		gaugeFunc: gaugeFunc,
+		lazy:      sampleInterval <= 0,
+		done:      make(chan struct{}),
+	}
+	if !result.lazy {
+		go result.sample(sampleInterval)
+	}
+	return result
+}
+
+type gaugeHistogram struct {
+	Histogram
+
+	gaugeFunc func() float64
+	lazy      bool
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func (h *gaugeHistogram) sample(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			h.Observe(h.gaugeFunc())
+		case <-h.done:
+			return
+		}
+	}
+}
+
+// Collect implements Collector.
+func (h *gaugeHistogram) Collect(ch chan<- Metric) {
+	if h.lazy {
+		h.Observe(h.gaugeFunc())
+	}
+	h.Histogram.Collect(ch)
+}
+
+// Close implements GaugeHistogram.
+func (h *gaugeHistogram) Close() {
+	h.closeOnce.Do(func() { close(h.done) })
+}
+
+// BimodalHistogramOpts bundles the options for creating a Histogram with
+// NewBimodalHistogram. It is mandatory to set Name and Help to a non-empty
+// string and to set FastBuckets and SlowBuckets. See HistogramOpts for the
+// meaning of the fields shared with it.
+type BimodalHistogramOpts struct {
+	Namespace string
+	Subsystem string
+	Name      string
+
+	Help string
+
+	ConstLabels Labels
+
+	DeprecatedVersion string
+
+	// Threshold separates the two modes of the observed values. Values up
+	// to and including Threshold are counted in FastBuckets, greater
+	// values in SlowBuckets.
+	Threshold float64
+
+	// FastBuckets are the buckets for observations up to Threshold. All
+	// of them must be less than or equal to Threshold.
+	FastBuckets []float64
+
+	// SlowBuckets are the buckets for observations greater than
+	// Threshold. All of them must be greater than Threshold.
+	SlowBuckets []float64
+}
+
+// NewBimodalHistogram creates a new Histogram with two independent sets of
+// buckets, one for each side of a threshold. This gives good resolution for
+// observations with a strongly bimodal distribution (e.g. cache hits and cache
+// misses). The Histogram is exposed with the buckets of both sets, i.e. the
+// split is not visible in the exposed metric. NewBimodalHistogram panics if any
+// set of buckets is empty or not in strictly increasing order, or if a bucket
+// is on the wrong side of the threshold.
+func NewBimodalHistogram(opts BimodalHistogramOpts) Histogram {
+	if len(opts.FastBuckets) == 0 || len(opts.SlowBuckets) == 0 {
+		panic("bimodal histogram needs fast and slow buckets")
+	}
+	if opts.FastBuckets[len(opts.FastBuckets)-1] > opts.Threshold {
+		panic(fmt.Errorf(
+			"fast buckets of bimodal histogram must not exceed threshold %f", opts.Threshold,
+		))
+	}
+	if opts.SlowBuckets[0] <= opts.Threshold {
+		panic(fmt.Errorf(
+			"slow buckets of bimodal histogram must exceed threshold %f", opts.Threshold,
+		))
+	}
+	desc := NewDesc(
+		BuildFQName(opts.Namespace, opts.Subsystem, opts.Name),
+		opts.Help,
+		nil,
+		opts.ConstLabels,
+	)
+	desc.deprecatedVersion = opts.DeprecatedVersion
+	h := &bimodalHistogram{
+		desc:      desc,
+		threshold: opts.Threshold,
+		fast:      newHistogram(desc, HistogramOpts{Buckets: opts.FastBuckets}).(*histogram),
+		slow:      newHistogram(desc, HistogramOpts{Buckets: opts.SlowBuckets}).(*histogram),
+	}
+	h.Init(h) // Init self-collection.
+	return h
+}
+
+type bimodalHistogram struct {
+	SelfCollector
+
+	desc       *Desc
+	threshold  float64
+	fast, slow *histogram
+}
+
+func (h *bimodalHistogram) Desc() *Desc {
+	return h.desc
+}
+
+func (h *bimodalHistogram) Observe(v float64) {
+	if v <= h.threshold {
+		h.fast.Observe(v)
+	} else {
+		h.slow.Observe(v)
+	}
+}
+
+func (h *bimodalHistogram) Write(out *dto.Metric) error {
+	var fast, slow dto.Metric
+	if err := h.fast.Write(&fast); err != nil {
+		return err
+	}
+	if err := h.slow.Write(&slow); err != nil {
+		return err
+	}
+	// All fast observations are less than all slow buckets, while no slow
+	// observation is counted in any fast bucket.
+	fastCount := fast.Histogram.GetSampleCount()
+	buckets := fast.Histogram.Bucket
+	for _, b := range slow.Histogram.Bucket {
+		b.CumulativeCount = proto.Uint64(b.GetCumulativeCount() + fastCount)
+		buckets = append(buckets, b)
+	}
+	out.Histogram = &dto.Histogram{
+		SampleCount: proto.Uint64(fastCount + slow.Histogram.GetSampleCount()),
+		SampleSum:   proto.Float64(fast.Histogram.GetSampleSum() + slow.Histogram.GetSampleSum()),
+		Bucket:      buckets,
+	}
+	out.Label = fast.Label
+	return nil
+}
+
+// HistogramWithEMA is a Histogram that also maintains an exponential moving
+// average (EMA) of its observations. The EMA is not part of the exposed
+// Histogram. It is meant for in-process use, or it can be exposed as a
+// separate gauge (see EMAGauge).
+//
+// To create HistogramWithEMA instances, use NewHistogramWithEMA.
+type HistogramWithEMA interface {
+	Histogram
+
+	// EMA returns the current exponential moving average of the
+	// observations. It returns NaN if nothing has been observed yet.
+	EMA() float64
+	// EMAGauge returns a GaugeFunc based on the provided GaugeOpts that
+	// reports the current EMA. It can be registered like any other
+	// GaugeFunc.
+	EMAGauge(opts GaugeOpts) GaugeFunc
+}
+
+// NewHistogramWithEMA creates a new HistogramWithEMA based on the provided
+// HistogramOpts. Each observation updates the EMA with the smoothing factor
+// alpha, i.e. the new EMA is alpha * observation + (1 - alpha) * previous EMA,
+// and the first observation initializes it. NewHistogramWithEMA panics
+// under the same conditions as NewHistogram, and if alpha is not in the
+// interval (0, 1].
+func NewHistogramWithEMA(opts HistogramOpts, alpha float64) HistogramWithEMA {
+	if !(alpha > 0 && alpha <= 1) {
+		panic(fmt.Errorf("EMA smoothing factor must be in (0, 1], got %f", alpha))
+	}
+	return &histogramWithEMA{
+		emaBits:   math.Float64bits(math.NaN()),
+		Histogram: NewHistogram(opts),
+		alpha:     alpha,
+	}
+}
+
+type histogramWithEMA struct {
+	// emaBits contains the bits of the float64 representing the EMA. It
+	// has to go first in the struct to guarantee alignment for atomic
+	// operations.  http://golang.org/pkg/sync/atomic/#pkg-note-BUG
+	emaBits uint64
+
+	Histogram
+
+	alpha float64
+}
+
+func (h *histogramWithEMA) Observe(v float64) {
+	h.Histogram.Observe(v)
+	for {
+		oldBits := atomic.LoadUint64(&h.emaBits)
+		ema := math.Float64frombits(oldBits)
+		if math.IsNaN(ema) {
+			ema = v
+		} else {
+			ema = h.alpha*v + (1-h.alpha)*ema
+		}
+		if atomic.CompareAndSwapUint64(&h.emaBits, oldBits, math.Float64bits(ema)) {
+			return
+		}
+	}
+}
+
+func (h *histogramWithEMA) EMA() float64 {
+	return math.Float64frombits(atomic.LoadUint64(&h.emaBits))
+}
+
+func (h *histogramWithEMA) EMAGauge(opts GaugeOpts) GaugeFunc {
+	return NewGaugeFunc(opts, h.EMA)
+}
+
+// NewStepHistogram creates a new Histogram based on the provided HistogramOpts
+// that only exposes recent observations. Time is divided into steps of the
+// given duration, and the exposed Histogram contains the observations of the
+// current step and of the windowCount-1 steps before it. Older observations are
+// dropped. Hence, unlike a regular Histogram, the exposed buckets, count, and
+// sum can decrease. This is similar to the MaxAge and AgeBuckets options of a
+// Summary and useful for visualizations that expect the distribution of
+// recent observations rather than cumulative counts. A windowCount of 0 is
+// treated as 1. NewStepHistogram panics under the same conditions as
+// NewHistogram, if step is not positive, or if windowCount is negative.
+func NewStepHistogram(opts HistogramOpts, step time.Duration, windowCount int) Histogram {
+	if step <= 0 {
+		panic(fmt.Errorf("step histogram needs a positive step, got %v", step))
+	}
+	if windowCount < 0 {
+		panic(fmt.Errorf("step histogram needs a non-negative window count, got %d", windowCount))
+	}
+	if windowCount == 0 {
+		windowCount = 1
+	}
+	desc := NewDesc(
+		BuildFQName(opts.Namespace, opts.Subsystem, opts.Name),
+		opts.Help,
+		nil,
+		opts.ConstLabels,
+	)
+	desc.deprecatedVersion = opts.DeprecatedVersion
+	// Let newHistogram validate and normalize the buckets.
+	upperBounds := newHistogram(desc, opts).(*histogram).upperBounds
+
+	h := &stepHistogram{
+		desc:        desc,
+		upperBounds: upperBounds,
+		labelPairs:  desc.constLabelPairs,
+		step:        step,
+		windows:     make([]stepWindow, windowCount),
+		now:         time.Now,
+	}
+	for i := range h.windows {
+		h.windows[i].counts = make([]uint64, len(upperBounds))
+	}
+	h.headEnd = h.now().Add(step)
+	h.Init(h) // Init self-collection.
+	return h
+}
+
+type stepHistogram struct {
+	SelfCollector
+
+	desc        *Desc
+	upperBounds []float64
+	labelPairs  []*dto.LabelPair
+	step        time.Duration
+	now         func() time.Time
+
+	mtx     sync.Mutex // Protects the fields below.
+	windows []stepWindow
+	head    int       // Index of the window of the current step.
+	headEnd time.Time // End of the current step.
+}
+
+// stepWindow holds the (non-cumulative) bucket counts, the count, and the sum
+// of the observations within one step.
+type stepWindow struct {
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+func (w *stepWindow) reset() {
+	for i := range w.counts {
+		w.counts[i] = 0
+	}
+	w.count, w.sum = 0, 0
+}
+
+// rotate needs mtx locked.
+func (h *stepHistogram) rotate() {
+	now := h.now()
+	for rotated := 0; !now.Before(h.headEnd); rotated++ {
+		if rotated >= len(h.windows) {
+			// All windows are outdated. Skip the remaining steps.
+			skipped := now.Sub(h.headEnd) / h.step
+			h.headEnd = h.headEnd.Add((skipped + 1) * h.step)
+			break
+		}
+		h.head = (h.head + 1) % len(h.windows)
+		h.windows[h.head].reset()
+		h.headEnd = h.headEnd.Add(h.step)
+	}
+}
+
+func (h *stepHistogram) Desc() *Desc {
+	return h.desc
+}
+
+func (h *stepHistogram) Observe(v float64) {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+
+	h.rotate()
+	w := &h.windows[h.head]
+	if i := sort.SearchFloat64s(h.upperBounds, v); i < len(w.counts) {
+		w.counts[i]++
+	}
+	w.count++
+	w.sum += v
+}
+
+func (h *stepHistogram) Write(out *dto.Metric) error {
+	h.mtx.Lock()
+	h.rotate()
+	counts := make([]uint64, len(h.upperBounds))
+	var (
+		count uint64
+		sum   float64
+	)
+	for _, w := range h.windows {
+		for i, c := range w.counts {
+			counts[i] += c
+		}
+		count += w.count
+		sum += w.sum
+	}
+	h.mtx.Unlock()
+
+	buckets := make([]*dto.Bucket, len(h.upperBounds))
+	var cumCount uint64
+	for i, upperBound := range h.upperBounds {
+		cumCount += counts[i]
+		buckets[i] = &dto.Bucket{
+			CumulativeCount: proto.Uint64(cumCount),
+			UpperBound:      proto.Float64(upperBound),
+		}
+	}
+	out.Histogram = &dto.Histogram{
+		SampleCount: proto.Uint64(count),
+		SampleSum:   proto.Float64(sum),
+		Bucket:      buckets,
+	}
+	out.Label = h.labelPairs
+	return nil
+}
+
+// SampledHistogram is a Histogram that only records every n-th observation to
+// reduce the overhead of observing on very hot code paths. Each recorded
+// observation is weighted by n, i.e. it is counted n times in its bucket and
+// in the count, and it is added n times to the sum. Thereby, the exposed
+// Histogram extrapolates to all observations, at the cost of accuracy.
+//
+// To create SampledHistogram instances, use NewSampledHistogram or
+// NewAdaptiveSampledHistogram.
+type SampledHistogram interface {
+	Histogram
+
+	// SamplingRate returns the fraction of observations currently
+	// recorded, i.e. 1/n.
+	SamplingRate() float64
+}
+
+// NewSampledHistogram creates a new SampledHistogram based on the provided
+// HistogramOpts that records every every-th observation. It panics under the
+// same conditions as NewHistogram, if FreezeBucketsAfter is set, and if every
+// is not positive.
+func NewSampledHistogram(opts HistogramOpts, every int) SampledHistogram {
+	if every < 1 {
+		panic(fmt.Errorf("sampled histogram needs a positive sampling interval, got %d", every))
+	}
+	return &sampledHistogram{
+		every:     uint64(every),
+		histogram: newSampledBase(opts),
+	}
+}
+
+// NewAdaptiveSampledHistogram creates a new SampledHistogram based on the
+// provided HistogramOpts that adjusts its sampling interval to the rate of
+// observations. It starts recording every observation. Whenever the estimated
+// rate of recorded observations exceeds maxRate (in observations per second),
+// the sampling interval is doubled. Once that rate has dropped below a quarter
+// of maxRate, the sampling interval is halved again. The rate is estimated from
+// an exponential moving average of the time between recorded observations, so
+// the estimation does not add overhead to the observations that are not
+// recorded.
+// NewAdaptiveSampledHistogram panics under the same conditions as
+// NewSampledHistogram and if maxRate is not positive.
+func NewAdaptiveSampledHistogram(opts HistogramOpts, maxRate float64) SampledHistogram {
+	if !(maxRate > 0) {
+		panic(fmt.Errorf("adaptive sampled histogram needs a positive maximum rate, got %f", maxRate))
+	}
+	return &sampledHistogram{
+		every:     1,
+		histogram: newSampledBase(opts),
+		maxRate:   maxRate,
+		now:       time.Now,
+	}
+}
+
+// newSampledBase creates the histogram a SampledHistogram records into. The
+// learning Histogram created for FreezeBucketsAfter cannot record weighted
+// observations, so that option is rejected.
+func newSampledBase(opts HistogramOpts) *histogram {
+	if opts.FreezeBucketsAfter > 0 {
+		panic(fmt.Errorf(
+			"sampled histogram %s has FreezeBucketsAfter set",
+			BuildFQName(opts.Namespace, opts.Subsystem, opts.Name),
+		))
+	}
+	return NewHistogram(opts).(*histogram)
+}
+
+// rateAlpha is the smoothing factor of the EMA used to estimate the rate of
+// observations of an adaptive SampledHistogram.
+const rateAlpha = 0.1
+
+type sampledHistogram struct {
+	// calls is the number of calls of Observe, every the current sampling
+	// interval. They have to go first in the struct to guarantee alignment
+	// for atomic operations.
+	// http://golang.org/pkg/sync/atomic/#pkg-note-BUG
+	calls, every uint64
+
+	*histogram
+
+	// maxRate is 0 for a non-adaptive SampledHistogram.
+	maxRate float64
+	now     func() time.Time
+
+	mtx          sync.Mutex // Protects the fields below.
+	lastRecorded time.Time
+	interval     float64 // EMA of the seconds between calls of Observe.
+}
+
+func (h *sampledHistogram) Observe(v float64) {
+	every := atomic.LoadUint64(&h.every)
+	if atomic.AddUint64(&h.calls, 1)%every != 0 {
+		return
+	}
+	h.histogram.observeN(v, every)
+	if h.maxRate > 0 {
+		h.adapt(every)
+	}
+}
+
+// adapt updates the rate estimation after an observation recorded with the
+// given sampling interval and adjusts the sampling interval if needed.
+func (h *sampledHistogram) adapt(every uint64) {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+
+	now := h.now()
+	last := h.lastRecorded
+	h.lastRecorded = now
+	if last.IsZero() {
+		return
+	}
+	interval := now.Sub(last).Seconds() / float64(every)
+	if h.interval == 0 {
+		h.interval = interval
+	} else {
+		h.interval = rateAlpha*interval + (1-rateAlpha)*h.interval
+	}
+	recordedRate := 1 / h.interval / float64(every)
+	switch {
+	case recordedRate > h.maxRate:
+		atomic.StoreUint64(&h.every, every*2)
+	case recordedRate < h.maxRate/4 && every > 1:
+		atomic.StoreUint64(&h.every, every/2)
+	}
+}
+
+func (h *sampledHistogram) SamplingRate() float64 {
+	return 1 / float64(atomic.LoadUint64(&h.every))
+}
+
+// BatchObserver observes many values at once. Create instances with
+// NewBatchObserver.
+type BatchObserver interface {
+	// ObserveBatch observes all the given values.
+	ObserveBatch(values []float64)
+	// ObserveAll observes each of the given values weight times, which is
+	// useful for pre-aggregated data. weight must be a non-negative
+	// integer. ObserveAll panics otherwise.
+	ObserveAll(values []float64, weight float64)
+}
+
+// NewBatchObserver returns a BatchObserver for the provided Histogram. For a
+// Histogram created by this package, a batch of observations updates the
+// bucket counts, the count, and the sum of the Histogram only once instead of
+// once per value, which is considerably faster for large batches. For other
+// implementations of Histogram, the values are simply observed one by one.
+func NewBatchObserver(h Histogram) BatchObserver {
+	return batchObserver{h}
+}
+
+type batchObserver struct {
+	h Histogram
+}
+
+func (b batchObserver) ObserveBatch(values []float64) {
+	b.observe(values, 1)
+}
+
+func (b batchObserver) ObserveAll(values []float64, weight float64) {
+	if weight < 0 || weight != math.Floor(weight) || math.IsInf(weight, 0) {
+		panic(fmt.Errorf("weight must be a non-negative integer, got %f", weight))
+	}
+	b.observe(values, uint64(weight))
+}
+
+func (b batchObserver) observe(values []float64, weight uint64) {
+	if h, ok := b.h.(*histogram); ok {
+		h.observeBatch(values, weight)
+		return
+	}
+	for _, v := range values {
+		for i := uint64(0); i < weight; i++ {
+			b.h.Observe(v)
+		}
+	}
+}
+
+// NewHistogramBucketSelector returns an Observer that observes each value into
+// the Histogram returned by calling selector with the value, e.g. to keep the
+// latencies of cache hits and cache misses apart without changing the call
+// site. selector must be free of side effects and return one of the provided
+// histograms. A value for which it returns nil or another Histogram is
+// dropped. The histograms are not collected by the returned Observer, so they
+// have to be registered on their own. NewHistogramBucketSelector panics if
+// selector is nil or no histograms are provided.
+func NewHistogramBucketSelector(selector func(value float64) Histogram, histograms ...Histogram) Observer {
+	if selector == nil {
+		panic(errors.New("NewHistogramBucketSelector needs a selector"))
+	}
+	if len(histograms) == 0 {
+		panic(errors.New("NewHistogramBucketSelector needs at least one histogram"))
+	}
+	return histogramSelector{selector, histograms}
+}
+
+type histogramSelector struct {
+	selector   func(float64) Histogram
+	histograms []Histogram
+}
+
+func (s histogramSelector) Observe(v float64) {
+	h := s.selector(v)
+	if h == nil {
+		return
+	}
+	for _, his := range s.histograms {
+		if his == h {
+			h.Observe(v)
+			return
+		}
+	}
+}
+
+// DeadlineHistogram is a Histogram for durations of operations that have a
+// deadline. In addition to the Histogram, it collects a counter with the suffix
+// "_deadline_exceeded_total" that counts the observed operations that exceeded
+// their deadline. This allows to track the rate of timeouts separately from the
+// distribution of latencies.
+//
+// To create DeadlineHistogram instances, use NewDeadlineHistogram.
+type DeadlineHistogram interface {
+	Histogram
+
+	// ObserveWithDeadline observes the time elapsed since start in
+	// seconds. If deadline is not the zero time and has passed, the
+	// deadline-exceeded counter is incremented, too.
+	ObserveWithDeadline(start, deadline time.Time)
+}
+
+// NewDeadlineHistogram creates a new DeadlineHistogram based on the provided
+// HistogramOpts. It panics under the same conditions as NewHistogram.
+func NewDeadlineHistogram(opts HistogramOpts) DeadlineHistogram {
+	h := NewHistogram(opts)
+	exceeded := NewCounter(CounterOpts{
+		Namespace:         opts.Namespace,
+		Subsystem:         opts.Subsystem,
+		Name:              opts.Name + "_deadline_exceeded_total",
+		Help:              "Number of operations that exceeded their deadline, observed by " + h.Desc().fqName + ".",
+		ConstLabels:       opts.ConstLabels,
+		DeprecatedVersion: opts.DeprecatedVersion,
+	})
+	result := &deadlineHistogram{Histogram: h, exceeded: exceeded}
+	result.MustInit(h, exceeded)
+	return result
+}
+
+type deadlineHistogram struct {
+	Histogram
+	SelfCollector
+
+	exceeded Counter
+}
+
+// Describe implements Collector.
+func (h *deadlineHistogram) Describe(ch chan<- *Desc) {
+	h.SelfCollector.Describe(ch)
+}
+
+// Collect implements Collector.
+func (h *deadlineHistogram) Collect(ch chan<- Metric) {
+	h.SelfCollector.Collect(ch)
+}
+
+func (h *deadlineHistogram) ObserveWithDeadline(start, deadline time.Time) {
+	now := time.Now()
+	h.Observe(now.Sub(start).Seconds())
+	if !deadline.IsZero() && now.After(deadline) {
+		h.exceeded.Inc()
+	}
+}
+
+type constHistogram struct {
+	desc       *Desc
+	count      uint64
+	sum        float64
+	buckets    map[float64]uint64
+	labelPairs []*dto.LabelPair
+}
+
+func (h *constHistogram) Desc() *Desc {
+	return h.desc
+}
+
+func (h *constHistogram) Write(out *dto.Metric) error {
+	his := &dto.Histogram{}
+	buckets := make([]*dto.Bucket, 0, len(h.buckets))
+
+	his.SampleCount = proto.Uint64(h.count)
+	his.SampleSum = proto.Float64(h.sum)
+
+	for upperBound, count := range h.buckets {
+		buckets = append(buckets, &dto.Bucket{
+			CumulativeCount: proto.Uint64(count),
+			UpperBound:      proto.Float64(upperBound),
+		})
+	}
+
+	if len(buckets) > 0 {
+		sort.Sort(buckSort(buckets))
+	}
+	his.Bucket = buckets
+
+	out.Histogram = his
+	out.Label = h.labelPairs
+
+	return nil
+}
+
+// NewConstHistogram returns a metric representing a Prometheus histogram with
+// fixed values for the count, sum, and bucket counts. As those parameters
+// cannot be changed, the returned value does not implement the Histogram
+// interface (but only the Metric interface). Users of this package will not
+// have much use for it in regular operations. However, when implementing custom
+// Collectors, it is useful as a throw-away metric that is generated on the fly
+// to send it to Prometheus in the Collect method.
+//
+// buckets is a map of upper bounds to cumulative counts, excluding the +Inf
+// bucket.
+//
+// NewConstHistogram returns an error if the length of labelValues is not
+// consistent with the variable labels in Desc.
+func NewConstHistogram(
+	desc *Desc,
+	count uint64,
+	sum float64,
+	buckets map[float64]uint64,
+	labelValues ...string,
+) (Metric, error) {
+	if len(desc.variableLabels) != len(labelValues) {
+		return nil, errInconsistentCardinality
+	}
+	return &constHistogram{
+		desc:       desc,
+		count:      count,
+		sum:        sum,
+		buckets:    buckets,
+		labelPairs: makeLabelPairs(desc, labelValues),
+	}, nil
+}
+
+// MustNewConstHistogram is a version of NewConstHistogram that panics where
+// NewConstMetric would have returned an error.
+func MustNewConstHistogram(
+	desc *Desc,
+	count uint64,
+	sum float64,
+	buckets map[float64]uint64,
+	labelValues ...string,
+) Metric {
+	m, err := NewConstHistogram(desc, count, sum, buckets, labelValues...)
+	if err != nil {
+		panic(err)
+	}
+	return m
+}
+
+// NewHistogramFromFunction creates a Collector that exposes pre-aggregated
+// histogram data, as provided by many systems bridged to Prometheus. The
+// provided function is called from within the Collect method and returns the
+// count, the sum, and the buckets of the histogram, in the same form as taken
+// by NewConstHistogram. If it returns an error, nothing is collected for that
+// collection. The function must be concurrency-safe. The Desc must not have any
+// variable labels.
+func NewHistogramFromFunction(
+	desc *Desc,
+	function func() (count uint64, sum float64, buckets map[float64]uint64, err error),
+) Collector {
+	return &histogramFunc{desc: desc, function: function}
+}
+
+type histogramFunc struct {
+	desc     *Desc
+	function func() (uint64, float64, map[float64]uint64, error)
+}
+
+// Describe implements Collector.
+func (h *histogramFunc) Describe(ch chan<- *Desc) {
+	ch <- h.desc
+}
+
+// Collect implements Collector.
+func (h *histogramFunc) Collect(ch chan<- Metric) {
+	count, sum, buckets, err := h.function()
+	if err != nil {
+		return
+	}
+	m, err := NewConstHistogram(h.desc, count, sum, buckets)
+	if err != nil {
+		m = NewInvalidMetric(h.desc, err)
+	}
+	ch <- m
+}
+
+type buckSort []*dto.Bucket
+
+func (s buckSort) Len() int {
+	return len(s)
+}
+
+func (s buckSort) Swap(i, j int) {
+	s[i], s[j] = s[j], s[i]
+}
+
+func (s buckSort) Less(i, j int) bool {
+	return s[i].GetUpperBound() < s[j].GetUpperBound()
+}
+
+// HdrHistogramOpts bundles the options for creating a Histogram with
+// NewHdrLikeHistogram. It is mandatory to set Name and Help to a non-empty
+// string. See HistogramOpts for the meaning of the fields shared with it.
+type HdrHistogramOpts struct {
+	Namespace string
+	Subsystem string
+	Name      string
+
+	Help string
+
+	ConstLabels Labels
+
+	DeprecatedVersion string
+
+	// LowestDiscernibleValue is the lowest value that can be told apart
+	// from 0. It must be at least 1. Observations are integers in a unit
+	// chosen by the caller (e.g. microseconds), so that
+	// LowestDiscernibleValue is usually 1.
+	LowestDiscernibleValue int64
+	// HighestTrackableValue is the highest value that still gets a bucket
+	// of the required precision. It must be at least twice
+	// LowestDiscernibleValue.
+	HighestTrackableValue int64
+	// NumberOfSignificantValueDigits is the number of significant decimal
+	// digits to which observations are resolved. It must be between 0 and
+	// 5. Note that each additional digit increases the number of buckets
+	// tenfold.
+	NumberOfSignificantValueDigits int
+}
+
+// HdrLikeHistogram is a Histogram with bucket boundaries computed like the
+// (sub-)buckets of an HdrHistogram.
+//
+// To create HdrLikeHistogram instances, use NewHdrLikeHistogram.
+type HdrLikeHistogram interface {
+	Histogram
+
+	// ComputedBuckets returns the upper bounds of the buckets computed
+	// from the HdrHistogramOpts.
+	ComputedBuckets() []float64
+}
+
+// NewHdrLikeHistogram creates a new HdrLikeHistogram based on the provided
+// HdrHistogramOpts. The bucket boundaries follow the HdrHistogram algorithm:
+// Values are resolved to NumberOfSignificantValueDigits decimal digits by
+// linear sub-buckets, the width of which doubles with each power of two. This
+// gives very high resolution for low values and a constant relative
+// resolution across many decades, e.g. for latencies. As the number of
+// buckets grows fast with the number of significant digits, consider the
+// size of the exposed Histogram before using more than 2 digits.
+// NewHdrLikeHistogram panics if any of the HdrHistogramOpts fields is out of
+// its valid range.
+func NewHdrLikeHistogram(opts HdrHistogramOpts) HdrLikeHistogram {
+	buckets := hdrBuckets(
+		opts.LowestDiscernibleValue,
+		opts.HighestTrackableValue,
+		opts.NumberOfSignificantValueDigits,
+	)
+	return &hdrLikeHistogram{
+		Histogram: NewHistogram(HistogramOpts{
+			Namespace:         opts.Namespace,
+			Subsystem:         opts.Subsystem,
+			Name:              opts.Name,
+			Help:              opts.Help,
+			ConstLabels:       opts.ConstLabels,
+			DeprecatedVersion: opts.DeprecatedVersion,
+			Buckets:           buckets,
+		}),
+		buckets: buckets,
+	}
+}
+
+type hdrLikeHistogram struct {
+	Histogram
+
+	buckets []float64
+}
+
+func (h *hdrLikeHistogram) ComputedBuckets() []float64 {
+	buckets := make([]float64, len(h.buckets))
+	copy(buckets, h.buckets)
+	return buckets
+}
+
+// hdrBuckets returns the inclusive upper bounds of the sub-buckets of an
+// HdrHistogram with the given parameters, up to the first one covering
+// highest.
+func hdrBuckets(lowest, highest int64, digits int) []float64 {
+	if lowest < 1 {
+		panic(fmt.Errorf("HDR histogram needs a lowest discernible value of at least 1, got %d", lowest))
+	}
+	if highest < 2*lowest {
+		panic(fmt.Errorf(
+			"HDR histogram needs a highest trackable value of at least %d, got %d", 2*lowest, highest,
+		))
+	}
+	if digits < 0 || digits > 5 {
+		panic(fmt.Errorf("HDR histogram needs 0 to 5 significant value digits, got %d", digits))
+	}
+
+	largestSingleUnitValue := 2 * int64(math.Pow10(digits))
+	subBucketCountMagnitude := uint(math.Ceil(math.Log2(float64(largestSingleUnitValue))))
+	if subBucketCountMagnitude < 1 {
+		subBucketCountMagnitude = 1
+	}
+	subBucketCount := int64(1) << subBucketCountMagnitude
+	subBucketHalfCount := subBucketCount / 2
+	unitMagnitude := uint(math.Floor(math.Log2(float64(lowest))))
+
+	var buckets []float64
+	// The first bucket uses all sub-buckets, all following ones only the
+	// upper half, as their lower half is covered by the previous bucket.
+	for b, first := uint(0), int64(0); ; b, first = b+1, subBucketHalfCount {
+		shift := b + unitMagnitude
+		for i := first; i < subBucketCount; i++ {
+			upperBound := (i+1)<<shift - 1
+			buckets = append(buckets, float64(upperBound))
+			if upperBound >= highest {
+				return buckets
+			}
+		}
+	}
+}
+
+// HistogramRule assigns HistogramOpts to the Histograms of a HistogramFactory
+// whose const labels contain all of the Labels of the rule.
+type HistogramRule struct {
+	Labels Labels
+	Opts   HistogramOpts
 }
 
-// With works as GetMetricWith, but panics where GetMetricWithLabels would have
-// returned an error. By not returning an error, With allows shortcuts like
-//     myVec.With(Labels{"code": "404", "method": "GET"}).Observe(42.21)
-func (m *HistogramVec) With(labels Labels) Histogram {
-	return m.MetricVec.With(labels).(Histogram)
+// HistogramFactory creates Histograms that differ in their const labels, with
+// HistogramOpts (e.g. buckets) chosen per label set by rules. This is useful if
+// the Histograms of a HistogramVec would need different buckets, e.g. because
+// different services have different latency profiles. Histograms are created
+// and registered with the default registry on first use. Create instances
+// with NewHistogramFactory.
+type HistogramFactory struct {
+	rules       []HistogramRule
+	defaultOpts HistogramOpts
+	registry    *registry
+
+	mtx        sync.Mutex // Protects histograms.
+	histograms map[uint64]Histogram
 }
 
-type constHistogram struct {
-	desc       *Desc
-	count      uint64
-	sum        float64
-	buckets    map[float64]uint64
-	labelPairs []*dto.LabelPair
+// NewHistogramFactory creates a new HistogramFactory with the provided rules.
+// A Histogram uses the Opts of the rule with the most Labels that are all
+// contained in the const labels of the Histogram, or defaultOpts if no rule
+// matches. If several matching rules have the same number of Labels, the
+// first one wins. Namespace, Subsystem, Name, and Help of the rules default to
+// those of defaultOpts. The rules are copied, so modifying them afterwards
+// has no effect.
+func NewHistogramFactory(rules []HistogramRule, defaultOpts HistogramOpts) *HistogramFactory {
+	f := &HistogramFactory{
+		rules:       make([]HistogramRule, len(rules)),
+		defaultOpts: defaultOpts,
+		registry:    defRegistry,
+		histograms:  map[uint64]Histogram{},
+	}
+	copy(f.rules, rules)
+	return f
 }
 
-func (h *constHistogram) Desc() *Desc {
-	return h.desc
+// Get returns the Histogram with the provided const labels, creating and
+// registering it if it does not exist yet. The provided Labels are merged
+// into the ConstLabels of the HistogramOpts used. Get panics if the Histogram
+// cannot be created or registered.
+func (f *HistogramFactory) Get(l Labels) Histogram {
+	key := model.LabelsToSignature(l)
+
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	if h, ok := f.histograms[key]; ok {
+		return h
+	}
+	opts := f.optsFor(l)
+	constLabels := make(Labels, len(opts.ConstLabels)+len(l))
+	for name, value := range opts.ConstLabels {
+		constLabels[name] = value
+	}
+	for name, value := range l {
+		constLabels[name] = value
+	}
+	opts.ConstLabels = constLabels
+	h := NewHistogram(opts)
+	if _, err := f.registry.Register(h); err != nil {
+		panic(err)
+	}
+	f.histograms[key] = h
+	return h
 }
 
-func (h *constHistogram) Write(out *dto.Metric) error {
-	his := &dto.Histogram{}
-	buckets := make([]*dto.Bucket, 0, len(h.buckets))
+// Delete unregisters and forgets the Histogram with the provided const
+// labels. It returns whether such a Histogram existed. A later call of Get
+// with the same Labels creates a new Histogram.
+func (f *HistogramFactory) Delete(l Labels) bool {
+	key := model.LabelsToSignature(l)
 
-	his.SampleCount = proto.Uint64(h.count)
-	his.SampleSum = proto.Float64(h.sum)
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	h, ok := f.histograms[key]
+	if !ok {
+		return false
+	}
+	f.registry.Unregister(h)
+	delete(f.histograms, key)
+	return true
+}
 
-	for upperBound, count := range h.buckets {
-		buckets = append(buckets, &dto.Bucket{
-			CumulativeCount: proto.Uint64(count),
+// optsFor returns the HistogramOpts of the best matching rule for the provided
+// Labels.
+func (f *HistogramFactory) optsFor(l Labels) HistogramOpts {
+	best := -1
+	for i, rule := range f.rules {
+		if best >= 0 && len(rule.Labels) <= len(f.rules[best].Labels) {
+			continue
+		}
+		matches := true
+		for name, value := range rule.Labels {
+			if v, ok := l[name]; !ok || v != value {
+				matches = false
+				break
+			}
+		}
+		if matches {
+			best = i
+		}
+	}
+	if best < 0 {
+		return f.defaultOpts
+	}
+	opts := f.rules[best].Opts
+	if opts.Namespace == "" {
+		opts.Namespace = f.defaultOpts.Namespace
+	}
+	if opts.Subsystem == "" {
+		opts.Subsystem = f.defaultOpts.Subsystem
+	}
+	if opts.Name == "" {
+		opts.Name = f.defaultOpts.Name
+	}
+	if opts.Help == "" {
+		opts.Help = f.defaultOpts.Help
+	}
+	return opts
+}
+
+// NewHistogramWithRate creates a new Histogram based on the provided
+// HistogramOpts together with a Counter based on the provided CounterOpts that
+// is incremented by each observation of the Histogram. The Counter thus
+// counts the same as the "_count" of the Histogram, but under a name of its
+// own, which saves maintaining a Counter next to the Histogram just to query
+// the rate of observations. The returned Histogram also describes and
+// collects the Counter, so only register the Histogram. Registering the
+// Counter in addition fails as its descriptor is already registered. The
+// Counter is returned for in-process use. NewHistogramWithRate panics under
+// the same conditions as NewHistogram.
+func NewHistogramWithRate(opts HistogramOpts, rateOpts CounterOpts) (Histogram, Counter) {
+	h := &histogramWithRate{
+		Histogram: NewHistogram(opts),
+		rate:      NewCounter(rateOpts),
+	}
+	return h, h.rate
+}
+
+type histogramWithRate struct {
+	Histogram
+	rate Counter
+}
+
+func (h *histogramWithRate) Observe(v float64) {
+	h.Histogram.Observe(v)
+	h.rate.Inc()
+}
+
+// Describe implements Collector.
+func (h *histogramWithRate) Describe(ch chan<- *Desc) {
+	h.Histogram.Describe(ch)
+	h.rate.Describe(ch)
+}
+
+// Collect implements Collector.
+func (h *histogramWithRate) Collect(ch chan<- Metric) {
+	h.Histogram.Collect(ch)
+	h.rate.Collect(ch)
+}
+
+// MeterHistogramOpts bundles the options for creating a MeterHistogram. The
+// embedded HistogramOpts configure the Histogram and the naming of the rates.
+type MeterHistogramOpts struct {
+	HistogramOpts
+
+	// TickInterval is the interval in which the rates are updated. The
+	// default value is DefMeterTickInterval.
+	TickInterval time.Duration
+
+	// Alphas are the smoothing factors applied at each tick to the 1m,
+	// 5m, and 15m rate, respectively. A zero element defaults to
+	// 1 - exp(-TickInterval / window), which gives the rates the
+	// semantics of the moving averages in Dropwizard Metrics and of the
+	// Unix load average.
+	Alphas [3]float64
+}
+
+// DefMeterTickInterval is the default interval in which the rates of a
+// MeterHistogram are updated.
+const DefMeterTickInterval = 5 * time.Second
+
+// MeterHistogram is a Histogram that also maintains exponentially weighted
+// moving averages (EWMAs) of the rate of observations per second over 1, 5,
+// and 15 minutes, like a meter in Dropwizard Metrics. The rates are collected
+// as gauges with the suffixes "_rate_1m", "_rate_5m", and "_rate_15m" next to
+// the Histogram, the "_count" of which already counts the observations. Note
+// that the rate() function of the Prometheus query language is usually
+// preferable, as it works over arbitrary time ranges. The MeterHistogram is
+// meant for users familiar with meters and for in-process use.
+//
+// To create MeterHistogram instances, use NewMeterHistogram.
+type MeterHistogram interface {
+	Histogram
+
+	// Rates returns the current 1m, 5m, and 15m rates of observations per
+	// second.
+	Rates() (rate1m, rate5m, rate15m float64)
+}
+
+// NewMeterHistogram creates a new MeterHistogram based on the provided
+// MeterHistogramOpts. The rates are updated lazily upon observation and
+// collection, so no goroutine is needed. NewMeterHistogram panics under the same
+// conditions as NewHistogram, if the TickInterval is negative, and if any of the
+// Alphas is not in the interval [0, 1].
+func NewMeterHistogram(opts MeterHistogramOpts) MeterHistogram {
+	if opts.TickInterval < 0 {
+		panic(fmt.Errorf("meter histogram needs a non-negative tick interval, got %v", opts.TickInterval))
+	}
+	if opts.TickInterval == 0 {
+		opts.TickInterval = DefMeterTickInterval
+	}
+	h := &meterHistogram{
+		Histogram: NewHistogram(opts.HistogramOpts),
+		tick:      opts.TickInterval,
+		now:       time.Now,
+	}
+	fqName := BuildFQName(opts.Namespace, opts.Subsystem, opts.Name)
+	for i, window := range []struct {
+		suffix string
+		d      time.Duration
+	}{{"1m", time.Minute}, {"5m", 5 * time.Minute}, {"15m", 15 * time.Minute}} {
+		alpha := opts.Alphas[i]
+		if alpha < 0 || alpha > 1 {
+			panic(fmt.Errorf("meter histogram needs alphas in [0, 1], got %f", alpha))
+		}
+		if alpha == 0 {
+			alpha = 1 - math.Exp(-opts.TickInterval.Seconds()/window.d.Seconds())
+		}
+		h.alphas[i] = alpha
+		h.rateDescs[i] = NewDesc(
+			fqName+"_rate_"+window.suffix,
+			"Moving average over "+window.suffix+" of the rate of observations per second of "+fqName+".",
+			nil,
+			opts.ConstLabels,
+		)
+		h.rateDescs[i].deprecatedVersion = opts.DeprecatedVersion
+	}
+	h.lastTick = h.now()
+	return h
+}
+
+type meterHistogram struct {
+	Histogram
+
+	tick      time.Duration
+	alphas    [3]float64
+	rateDescs [3]*Desc
+	now       func() time.Time
+
+	mtx       sync.Mutex // Protects the fields below.
+	lastTick  time.Time
+	uncounted uint64
+	rates     [3]float64
+	ticked    bool // Whether the rates have been initialized.
+}
+
+// tickIfNecessary applies all ticks that have passed since the last one. It
+// needs mtx locked.
+func (h *meterHistogram) tickIfNecessary() {
+	ticks := int64(h.now().Sub(h.lastTick) / h.tick)
+	if ticks <= 0 {
+		return
+	}
+	h.lastTick = h.lastTick.Add(time.Duration(ticks) * h.tick)
+	for t := int64(0); t < ticks; t++ {
+		instant := float64(h.uncounted) / h.tick.Seconds()
+		h.uncounted = 0
+		for i, alpha := range h.alphas {
+			if h.ticked {
+				h.rates[i] += alpha * (instant - h.rates[i])
+			} else {
+				h.rates[i] = instant
+			}
+		}
+		h.ticked = true
+		if instant == 0 && h.rates[0] == 0 && h.rates[1] == 0 && h.rates[2] == 0 {
+			// Further idle ticks change nothing.
+			break
+		}
+	}
+}
+
+func (h *meterHistogram) Observe(v float64) {
+	h.Histogram.Observe(v)
+
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	h.tickIfNecessary()
+	h.uncounted++
+}
+
+func (h *meterHistogram) Rates() (rate1m, rate5m, rate15m float64) {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	h.tickIfNecessary()
+	return h.rates[0], h.rates[1], h.rates[2]
+}
+
+// Describe implements Collector.
+func (h *meterHistogram) Describe(ch chan<- *Desc) {
+	h.Histogram.Describe(ch)
+	for _, desc := range h.rateDescs {
+		ch <- desc
+	}
+}
+
+// Collect implements Collector.
+func (h *meterHistogram) Collect(ch chan<- Metric) {
+	h.Histogram.Collect(ch)
+	rate1m, rate5m, rate15m := h.Rates()
+	for i, rate := range []float64{rate1m, rate5m, rate15m} {
+		ch <- MustNewConstMetric(h.rateDescs[i], GaugeValue, rate)
+	}
+}
+
+// MaxInlineHistogramBuckets is the maximum number of buckets (not counting the
+// implicit +Inf bucket) of a Histogram created with NewInlineHistogram.
+const MaxInlineHistogramBuckets = 16
+
+// InlineHistogramStorage is the memory backing a Histogram created with
+// NewInlineHistogram. It holds the bucket counts, the count, and the sum of
+// the observations in a fixed-size block, so that it can be embedded in other
+// structs or allocated on the stack. The zero value is ready to use. As its
+// fields are accessed atomically, InlineHistogramStorage must be 64-bit
+// aligned, i.e. it should be the first field of the struct it is embedded in
+// (see the bugs section of the sync/atomic documentation).
+type InlineHistogramStorage struct {
+	counts  [MaxInlineHistogramBuckets]uint64
+	count   uint64
+	sumBits uint64
+}
+
+// InlineHistogramOpts bundles the options for creating a Histogram with
+// NewInlineHistogram. See HistogramOpts for the meaning of the fields.
+type InlineHistogramOpts struct {
+	Namespace string
+	Subsystem string
+	Name      string
+
+	Help string
+
+	ConstLabels Labels
+
+	DeprecatedVersion string
+
+	// Buckets defines the buckets into which observations are counted. It
+	// must not contain more than MaxInlineHistogramBuckets buckets, not
+	// counting a trailing +Inf bucket, which is implicit. As for
+	// HistogramOpts, nil means DefBuckets. The slice is not
+	// copied, so it must not be modified after creating the Histogram.
+	// Sharing it between many histograms is fine and saves memory.
+	Buckets []float64
+}
+
+// NewInlineHistogram creates a new Histogram that keeps its values in the
+// provided storage rather than allocating memory for them. This is meant for
+// histograms embedded in a large number of small objects (e.g. connections),
+// where the bucket slices and the lock of a regular Histogram would add
+// significant overhead. Observe does not allocate.
+//
+// In contrast to the Histogram created by NewHistogram, collections are not
+// guaranteed to be consistent: A collection concurrent with an observation
+// might see the observation in some of the values but not yet in others.
+//
+// NewInlineHistogram panics if storage is nil, or if the buckets are not in
+// increasing order or exceed MaxInlineHistogramBuckets.
+func NewInlineHistogram(opts InlineHistogramOpts, storage *InlineHistogramStorage) Histogram {
+	if storage == nil {
+		panic(errors.New("inline histogram needs storage"))
+	}
+	buckets := opts.Buckets
+	if buckets == nil {
+		buckets = DefBuckets
+	}
+	if len(buckets) > 0 && math.IsInf(buckets[len(buckets)-1], +1) {
+		// The +Inf bucket is implicit. Remove it here.
+		buckets = buckets[:len(buckets)-1]
+	}
+	if len(buckets) > MaxInlineHistogramBuckets {
+		panic(fmt.Errorf(
+			"inline histogram has %d buckets, at most %d are supported",
+			len(buckets), MaxInlineHistogramBuckets,
+		))
+	}
+	for i := 1; i < len(buckets); i++ {
+		if buckets[i-1] >= buckets[i] {
+			panic(fmt.Errorf(
+				"histogram buckets must be in increasing order: %f >= %f",
+				buckets[i-1], buckets[i],
+			))
+		}
+	}
+	desc := NewDesc(
+		BuildFQName(opts.Namespace, opts.Subsystem, opts.Name),
+		opts.Help,
+		nil,
+		opts.ConstLabels,
+	)
+	desc.deprecatedVersion = opts.DeprecatedVersion
+	h := &inlineHistogram{
+		desc:        desc,
+		upperBounds: buckets,
+		storage:     storage,
+	}
+	h.Init(h) // Init self-collection.
+	return h
+}
+
+type inlineHistogram struct {
+	SelfCollector
+
+	desc        *Desc
+	upperBounds []float64
+	storage     *InlineHistogramStorage
+}
+
+func (h *inlineHistogram) Desc() *Desc {
+	return h.desc
+}
+
+func (h *inlineHistogram) Observe(v float64) {
+	s := h.storage
+	if i := sort.SearchFloat64s(h.upperBounds, v); i < len(h.upperBounds) {
+		atomic.AddUint64(&s.counts[i], 1)
+	}
+	atomic.AddUint64(&s.count, 1)
+	addFloat64Bits(&s.sumBits, v)
+}
+
+func (h *inlineHistogram) Write(out *dto.Metric) error {
+	s := h.storage
+	his := &dto.Histogram{
+		SampleCount: proto.Uint64(atomic.LoadUint64(&s.count)),
+		SampleSum:   proto.Float64(math.Float64frombits(atomic.LoadUint64(&s.sumBits))),
+	}
+	buckets := make([]*dto.Bucket, len(h.upperBounds))
+	var cumCount uint64
+	for i, upperBound := range h.upperBounds {
+		cumCount += atomic.LoadUint64(&s.counts[i])
+		buckets[i] = &dto.Bucket{
+			CumulativeCount: proto.Uint64(cumCount),
 			UpperBound:      proto.Float64(upperBound),
+		}
+	}
+	if len(buckets) == 0 {
+		// See histogram.Write.
+		buckets = append(buckets, &dto.Bucket{
+			CumulativeCount: his.SampleCount,
+			UpperBound:      proto.Float64(math.Inf(+1)),
 		})
 	}
+	his.Bucket = buckets
+	out.Histogram = his
+	out.Label = h.desc.constLabelPairs
+	return nil
+}
 
-	if len(buckets) > 0 {
-		sort.Sort(buckSort(buckets))
+// ScrapeIntervalOpts bundles the options for NewScrapeIntervalHistogram.
+type ScrapeIntervalOpts struct {
+	// Help provides the help string of the histogram. The default help
+	// string is used if it is empty.
+	Help string
+	// Buckets defines the buckets of the histogram. The default value is
+	// DefScrapeIntervalBuckets.
+	Buckets []float64
+
+	// now is the clock, time.Now if nil. It is only set by tests.
+	now func() time.Time
+}
+
+// NewScrapeIntervalHistogram returns a Collector that measures the time
+// between its collections, i.e. the actual scrape interval as seen from the
+// scraped target. Upon each collection, the time since the previous
+// collection is observed by the histogram prometheus_scrape_interval_seconds
+// and set as the value of the gauge prometheus_scrape_interval_seconds_last.
+// The first collection has no previous one, so it only starts the
+// measurement. Note that every collection counts as a scrape, so the Collector
+// only measures the scrape interval as intended if a single Prometheus server
+// scrapes the registry it is registered with.
+func NewScrapeIntervalHistogram(opts ScrapeIntervalOpts) Collector {
+	if opts.Help == "" {
+		opts.Help = "Time between two scrapes of this target in seconds."
 	}
-	his.Bucket = buckets
+	if len(opts.Buckets) == 0 {
+		opts.Buckets = DefScrapeIntervalBuckets
+	}
+	if opts.now == nil {
+		opts.now = time.Now
+	}
+	return &scrapeIntervalHistogram{
+		histogram: NewHistogram(HistogramOpts{
+			Name:    "prometheus_scrape_interval_seconds",
+			Help:    opts.Help,
+			Buckets: opts.Buckets,
+		}),
+		last: NewGauge(GaugeOpts{
+			Name: "prometheus_scrape_interval_seconds_last",
+			Help: "Time between the last two scrapes of this target in seconds.",
+		}),
+		now: opts.now,
+	}
+}
 
-	out.Histogram = his
-	out.Label = h.labelPairs
+type scrapeIntervalHistogram struct {
+	histogram Histogram
+	last      Gauge
+	now       func() time.Time
 
-	return nil
+	mtx         sync.Mutex // Protects lastCollect.
+	lastCollect time.Time
 }
 
-// NewConstHistogram returns a metric representing a Prometheus histogram with
-// fixed values for the count, sum, and bucket counts. As those parameters
-// cannot be changed, the returned value does not implement the Histogram
-// interface (but only the Metric interface). Users of this package will not
-// have much use for it in regular operations. However, when implementing custom
-// Collectors, it is useful as a throw-away metric that is generated on the fly
-// to send it to Prometheus in the Collect method.
+// Describe implements Collector.
+func (c *scrapeIntervalHistogram) Describe(ch chan<- *Desc) {
+	c.histogram.Describe(ch)
+	c.last.Describe(ch)
+}
+
+// Collect implements Collector.
+func (c *scrapeIntervalHistogram) Collect(ch chan<- Metric) {
+	c.mtx.Lock()
+	now := c.now()
+	if !c.lastCollect.IsZero() {
+		interval := now.Sub(c.lastCollect).Seconds()
+		c.histogram.Observe(interval)
+		c.last.Set(interval)
+	}
+	c.lastCollect = now
+	c.mtx.Unlock()
+
+	c.histogram.Collect(ch)
+	c.last.Collect(ch)
+}
+
+// DeltaHistogramHelpSuffix is appended to the help string of a DeltaHistogram
+// so that its non-standard semantics show in its Desc and in the exposition.
+const DeltaHistogramHelpSuffix = " (Delta histogram: reset on each collection, not compatible with standard Prometheus queries.)"
+
+// DeltaHistogram is a Histogram whose collected count, sum, and bucket counts
+// are deltas, i.e. they only represent the observations since the previous
+// collection. The bucket counts are still cumulative across buckets. This is
+// not what Prometheus expects from a histogram, and functions like rate and
+// histogram_quantile return wrong results for it. It is only useful for
+// bridges to backends that ingest delta histograms, e.g. CloudWatch or Azure
+// Monitor, which are fed by a custom consumer of the collected metrics.
 //
-// buckets is a map of upper bounds to cumulative counts, excluding the +Inf
-// bucket.
+// To create DeltaHistogram instances, use NewDeltaHistogram.
+type DeltaHistogram interface {
+	Histogram
+}
+
+// NewDeltaHistogram creates a new DeltaHistogram based on the provided
+// HistogramOpts. It works like NewHistogram with ResetOnCollect set, see there,
+// and it appends DeltaHistogramHelpSuffix to the help string. A DeltaHistogram
+// must not be collected by more than one consumer, as each collection resets
+// it.
+func NewDeltaHistogram(opts HistogramOpts) DeltaHistogram {
+	opts.ResetOnCollect = true
+	opts.Help += DeltaHistogramHelpSuffix
+	return NewHistogram(opts)
+}
+
+// HistogramLevel is an aggregation level of a LeveledHistogram. The variable
+// labels of Desc must be a subset of the variable labels of the
+// LeveledHistogram. A Desc without variable labels yields the overall total.
+// If Labels is not empty, the level only aggregates observations whose label
+// values match all of Labels, e.g. to roll up per endpoint only for one
+// service of interest.
+type HistogramLevel struct {
+	Desc   *Desc
+	Labels Labels
+}
+
+// LeveledHistogram is a Collector that exposes the same observations at
+// multiple aggregation levels, each as a separate metric family. This avoids
+// updating a metric for each level separately, and it avoids the need to
+// aggregate many children at query time, which is expensive for label
+// combinations of high cardinality.
 //
-// NewConstHistogram returns an error if the length of labelValues is not
-// consistent with the variable labels in Desc.
-func NewConstHistogram(
-	desc *Desc,
-	count uint64,
-	sum float64,
-	buckets map[float64]uint64,
-	labelValues ...string,
-) (Metric, error) {
-	if len(desc.variableLabels) != len(labelValues) {
-		return nil, errInconsistentCardinality
+// To create LeveledHistogram instances, use NewLeveledHistogram.
+type LeveledHistogram interface {
+	Collector
+
+	// Observe adds a single observation with the provided label values
+	// (in the order of the variable labels of the Desc of the
+	// LeveledHistogram) to every level. It panics if the number of label
+	// values does not match.
+	Observe(labelValues []string, value float64)
+}
+
+// NewLeveledHistogram creates a new LeveledHistogram that observes into the
+// fully labeled Desc and into each of the provided levels. All levels use the
+// provided buckets (or DefBuckets if nil), see HistogramOpts.Buckets. The
+// function panics if a level refers to a label name that is not a variable
+// label of desc or if the buckets are invalid.
+func NewLeveledHistogram(desc *Desc, buckets []float64, levels []HistogramLevel) LeveledHistogram {
+	opts := HistogramOpts{Buckets: buckets}
+	h := &leveledHistogram{
+		size:   len(desc.variableLabels),
+		levels: make([]*histogramLevel, 0, len(levels)+1),
 	}
-	return &constHistogram{
-		desc:       desc,
-		count:      count,
-		sum:        sum,
-		buckets:    buckets,
-		labelPairs: makeLabelPairs(desc, labelValues),
-	}, nil
+	all := make([]HistogramLevel, 0, len(levels)+1)
+	all = append(all, HistogramLevel{Desc: desc})
+	all = append(all, levels...)
+	for _, level := range all {
+		l := &histogramLevel{
+			vec: &MetricVec{
+				children: map[uint64]Metric{},
+				desc:     level.Desc,
+				hash:     fnv.New64a(),
+			},
+		}
+		levelDesc := level.Desc
+		l.vec.newMetric = func(lvs ...string) Metric {
+			return newHistogram(levelDesc, opts, lvs...)
+		}
+		for _, name := range level.Desc.variableLabels {
+			l.indexes = append(l.indexes, labelIndex(desc, name))
+		}
+		for name, value := range level.Labels {
+			l.matchIndexes = append(l.matchIndexes, labelIndex(desc, name))
+			l.matchValues = append(l.matchValues, value)
+		}
+		if level.Desc.err == nil {
+			// Validate the buckets and labels right away.
+			newHistogram(level.Desc, opts, make([]string, len(l.indexes))...)
+		}
+		h.levels = append(h.levels, l)
+	}
+	return h
 }
 
-// MustNewConstHistogram is a version of NewConstHistogram that panics where
-// NewConstMetric would have returned an error.
-func MustNewConstHistogram(
-	desc *Desc,
-	count uint64,
-	sum float64,
-	buckets map[float64]uint64,
-	labelValues ...string,
-) Metric {
-	m, err := NewConstHistogram(desc, count, sum, buckets, labelValues...)
-	if err != nil {
-		panic(err)
+// labelIndex returns the index of the variable label name in desc. It panics
+// if desc has no such variable label.
+func labelIndex(desc *Desc, name string) int {
+	for i, l := range desc.variableLabels {
+		if l == name {
+			return i
+		}
 	}
-	return m
+	panic(fmt.Errorf("label %q is not a variable label of %s", name, desc))
 }
 
-type buckSort []*dto.Bucket
+type leveledHistogram struct {
+	size   int // Number of label values.
+	levels []*histogramLevel
+}
 
-func (s buckSort) Len() int {
-	return len(s)
+// histogramLevel is a level of a leveledHistogram. indexes are the indexes of
+// the label values of the level in the label values of the leveledHistogram,
+// and matchIndexes and matchValues are those of HistogramLevel.Labels.
+type histogramLevel struct {
+	vec                   *MetricVec
+	indexes, matchIndexes []int
+	matchValues           []string
 }
 
-func (s buckSort) Swap(i, j int) {
-	s[i], s[j] = s[j], s[i]
+func (h *leveledHistogram) Observe(labelValues []string, value float64) {
+	if len(labelValues) != h.size {
+		panic(errInconsistentCardinality)
+	}
+	lvs := make([]string, 0, h.size)
+levels:
+	for _, l := range h.levels {
+		for i, idx := range l.matchIndexes {
+			if labelValues[idx] != l.matchValues[i] {
+				continue levels
+			}
+		}
+		lvs = lvs[:0]
+		for _, idx := range l.indexes {
+			lvs = append(lvs, labelValues[idx])
+		}
+		l.vec.WithLabelValues(lvs...).(Histogram).Observe(value)
+	}
 }
 
-func (s buckSort) Less(i, j int) bool {
-	return s[i].GetUpperBound() < s[j].GetUpperBound()
+// Describe implements Collector.
+func (h *leveledHistogram) Describe(ch chan<- *Desc) {
+	for _, l := range h.levels {
+		l.vec.Describe(ch)
+	}
+}
+
+// Collect implements Collector.
+func (h *leveledHistogram) Collect(ch chan<- Metric) {
+	for _, l := range h.levels {
+		l.vec.Collect(ch)
+	}
 }
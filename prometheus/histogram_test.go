@@ -14,15 +14,25 @@
 package prometheus
 
 import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
 	"math"
 	"math/rand"
+	"os"
 	"reflect"
 	"sort"
+	"strings"
 	"sync"
 	"testing"
 	"testing/quick"
+	"time"
 
+	"github.com/golang/protobuf/proto"
 	dto "github.com/prometheus/client_model/go"
+
+	"github.com/prometheus/client_golang/text"
 )
 
 func benchmarkHistogramObserve(w int, b *testing.B) {
@@ -315,4 +325,2115 @@ func TestBuckets(t *testing.T) {
 	if !reflect.DeepEqual(got, want) {
 		t.Errorf("linear buckets: got %v, want %v", got, want)
 	}
+
+	got = LinearBucketsAround(0.1, 0.05, 5)
+	want = []float64{0.05, 0.075, 0.1, 0.125, 0.15}
+	for i := range want {
+		if math.Abs(got[i]-want[i]) > 1e-9 {
+			t.Errorf("linear buckets around: got %v, want %v", got, want)
+			break
+		}
+	}
+
+	got = ExponentialBucketsRange(1, 1000, 4)
+	want = []float64{1, 10, 100, 1000}
+	for i := range want {
+		if math.Abs(got[i]-want[i]) > 1e-9 {
+			t.Errorf("exponential buckets range: got %v, want %v", got, want)
+			break
+		}
+	}
+	if got[0] != 1 || got[len(got)-1] != 1000 {
+		t.Errorf("exponential buckets range: got bounds %v and %v, want 1 and 1000", got[0], got[len(got)-1])
+	}
+
+	for name, invalid := range map[string]func(){
+		"linear buckets with zero count":       func() { LinearBuckets(1, 1, 0) },
+		"linear buckets with zero width":       func() { LinearBuckets(1, 0, 3) },
+		"linear buckets with negative width":   func() { LinearBuckets(1, -1, 3) },
+		"exponential buckets with zero count":  func() { ExponentialBuckets(1, 2, 0) },
+		"exponential buckets with zero start":  func() { ExponentialBuckets(0, 2, 3) },
+		"exponential buckets with factor of 1": func() { ExponentialBuckets(1, 1, 3) },
+	} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("expected panic for %s", name)
+				}
+			}()
+			invalid()
+		}()
+	}
+}
+
+func TestGaugeHistogramLazy(t *testing.T) {
+	depth := 0.
+	gh := NewGaugeHistogram(
+		func() float64 { depth++; return depth },
+		HistogramOpts{Name: "queue_depth", Help: "test help", Buckets: []float64{1, 2, 5}},
+		0,
+	)
+	defer gh.Close()
+
+	var m Metric
+	for i := 0; i < 3; i++ {
+		ch := make(chan Metric, 1)
+		gh.Collect(ch)
+		m = <-ch
+	}
+
+	out := &dto.Metric{}
+	m.Write(out)
+	if got, want := out.GetHistogram().GetSampleCount(), uint64(3); got != want {
+		t.Errorf("got sample count %d, want %d", got, want)
+	}
+	if got, want := out.GetHistogram().GetSampleSum(), 6.; got != want {
+		t.Errorf("got sample sum %f, want %f", got, want)
+	}
+	if got, want := out.GetHistogram().GetBucket()[1].GetCumulativeCount(), uint64(2); got != want {
+		t.Errorf("got cumulative count %d for bucket 2, want %d", got, want)
+	}
+}
+
+func TestGaugeHistogramBackground(t *testing.T) {
+	sampled := make(chan struct{}, 100)
+	gh := NewGaugeHistogram(
+		func() float64 { sampled <- struct{}{}; return 1 },
+		HistogramOpts{Name: "queue_depth", Help: "test help"},
+		time.Millisecond,
+	)
+	// Once the function is called for the third time, the first two
+	// samples have been observed.
+	for i := 0; i < 3; i++ {
+		<-sampled
+	}
+	gh.Close()
+	gh.Close() // Closing twice must not panic.
+
+	ch := make(chan Metric, 1)
+	gh.Collect(ch)
+	out := &dto.Metric{}
+	(<-ch).Write(out)
+	if got := out.GetHistogram().GetSampleCount(); got < 2 {
+		t.Errorf("got sample count %d, want at least 2", got)
+	}
+}
+
+func TestHistogramNoBuckets(t *testing.T) {
+	his := NewHistogram(HistogramOpts{
+		Name:      "test_histogram",
+		Help:      "helpless",
+		NoBuckets: true,
+	})
+	var o Observer = his
+	o.Observe(1)
+	o.Observe(2)
+
+	m := &dto.Metric{}
+	his.Write(m)
+	if got, want := m.String(), `histogram:<sample_count:2 sample_sum:3 > `; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	// Without NoBuckets, removing the +Inf bucket must not result in a
+	// histogram without buckets.
+	inf := NewHistogram(HistogramOpts{
+		Name:    "test_histogram",
+		Help:    "helpless",
+		Buckets: []float64{math.Inf(+1)},
+	})
+	inf.Observe(1)
+	m.Reset()
+	inf.Write(m)
+	if got, want := len(m.GetHistogram().GetBucket()), 1; got != want {
+		t.Errorf("got %d buckets, want %d", got, want)
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Error("expected panic for NoBuckets combined with Buckets")
+		}
+	}()
+	NewHistogram(HistogramOpts{
+		Name:      "test_histogram",
+		Help:      "helpless",
+		NoBuckets: true,
+		Buckets:   []float64{1, 2},
+	})
+}
+
+func TestHistogramResetOnCollect(t *testing.T) {
+	his := NewHistogram(HistogramOpts{
+		Name:           "test_histogram",
+		Help:           "helpless",
+		Buckets:        []float64{1},
+		ResetOnCollect: true,
+	})
+	his.Observe(0.5)
+	his.Observe(2)
+
+	m := &dto.Metric{}
+	his.Write(m)
+	if got, want := m.String(), `histogram:<sample_count:2 sample_sum:2.5 bucket:<cumulative_count:1 upper_bound:1 > > `; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	his.Observe(3)
+	m.Reset()
+	his.Write(m)
+	if got, want := m.String(), `histogram:<sample_count:1 sample_sum:3 bucket:<cumulative_count:0 upper_bound:1 > > `; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestDeadlineHistogram(t *testing.T) {
+	dh := NewDeadlineHistogram(HistogramOpts{
+		Name: "op_duration_seconds",
+		Help: "helpless",
+	})
+	now := time.Now()
+	dh.ObserveWithDeadline(now, time.Time{})
+	dh.ObserveWithDeadline(now, now.Add(time.Hour))
+	dh.ObserveWithDeadline(now.Add(-time.Second), now.Add(-time.Millisecond))
+
+	ch := make(chan Metric, 2)
+	dh.Collect(ch)
+	m := &dto.Metric{}
+	(<-ch).Write(m)
+	if got, want := m.GetHistogram().GetSampleCount(), uint64(3); got != want {
+		t.Errorf("got sample count %d, want %d", got, want)
+	}
+	exceeded := <-ch
+	if got, want := exceeded.Desc().fqName, "op_duration_seconds_deadline_exceeded_total"; got != want {
+		t.Errorf("got name %q, want %q", got, want)
+	}
+	m.Reset()
+	exceeded.Write(m)
+	if got, want := m.GetCounter().GetValue(), 1.; got != want {
+		t.Errorf("got %f exceeded deadlines, want %f", got, want)
+	}
+
+	if _, err := newRegistry().Register(dh); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestBimodalHistogram(t *testing.T) {
+	his := NewBimodalHistogram(BimodalHistogramOpts{
+		Name:        "cache_latency_seconds",
+		Help:        "helpless",
+		Threshold:   0.001,
+		FastBuckets: []float64{0.0001, 0.0005},
+		SlowBuckets: []float64{0.01, 0.1},
+	})
+	for _, v := range []float64{0.00005, 0.0002, 0.0008, 0.005, 0.05, 1} {
+		his.Observe(v)
+	}
+
+	m := &dto.Metric{}
+	his.Write(m)
+	if got, want := m.GetHistogram().GetSampleCount(), uint64(6); got != want {
+		t.Errorf("got sample count %d, want %d", got, want)
+	}
+	wantBounds := []float64{0.0001, 0.0005, 0.01, 0.1}
+	wantCounts := []uint64{1, 2, 4, 5}
+	buckets := m.GetHistogram().GetBucket()
+	if len(buckets) != len(wantBounds) {
+		t.Fatalf("got %d buckets, want %d", len(buckets), len(wantBounds))
+	}
+	for i, b := range buckets {
+		if got, want := b.GetUpperBound(), wantBounds[i]; got != want {
+			t.Errorf("bucket %d: got upper bound %f, want %f", i, got, want)
+		}
+		if got, want := b.GetCumulativeCount(), wantCounts[i]; got != want {
+			t.Errorf("bucket %d: got cumulative count %d, want %d", i, got, want)
+		}
+	}
+}
+
+func TestHistogramWithEMA(t *testing.T) {
+	his := NewHistogramWithEMA(HistogramOpts{
+		Name: "test_histogram",
+		Help: "helpless",
+	}, 0.5)
+	if ema := his.EMA(); !math.IsNaN(ema) {
+		t.Errorf("got EMA %f before first observation, want NaN", ema)
+	}
+	his.Observe(4)
+	his.Observe(8)
+	his.Observe(2)
+	if got, want := his.EMA(), 4.; got != want {
+		t.Errorf("got EMA %f, want %f", got, want)
+	}
+
+	m := &dto.Metric{}
+	his.EMAGauge(GaugeOpts{Name: "test_ema", Help: "helpless"}).Write(m)
+	if got, want := m.GetGauge().GetValue(), 4.; got != want {
+		t.Errorf("got EMA gauge %f, want %f", got, want)
+	}
+
+	m.Reset()
+	his.Write(m)
+	if got, want := m.GetHistogram().GetSampleCount(), uint64(3); got != want {
+		t.Errorf("got sample count %d, want %d", got, want)
+	}
+}
+
+func TestHistogramBucketSelector(t *testing.T) {
+	newHis := func(name string) Histogram {
+		return NewHistogram(HistogramOpts{
+			Name:    name,
+			Help:    "helpless",
+			Buckets: []float64{1, 2},
+		})
+	}
+	fast, slow, other := newHis("fast"), newHis("slow"), newHis("other")
+	o := NewHistogramBucketSelector(func(v float64) Histogram {
+		switch {
+		case v < 0:
+			return nil
+		case v > 100:
+			return other
+		case v < 1:
+			return fast
+		}
+		return slow
+	}, fast, slow)
+	for _, v := range []float64{0.5, 0.25, 1.5, -1, 200} {
+		o.Observe(v)
+	}
+
+	for _, c := range []struct {
+		his   Histogram
+		count uint64
+		sum   float64
+	}{
+		{fast, 2, 0.75},
+		{slow, 1, 1.5},
+		{other, 0, 0},
+	} {
+		m := &dto.Metric{}
+		c.his.Write(m)
+		if got, want := m.GetHistogram().GetSampleCount(), c.count; got != want {
+			t.Errorf("%s: got count %d, want %d", c.his.Desc(), got, want)
+		}
+		if got, want := m.GetHistogram().GetSampleSum(), c.sum; got != want {
+			t.Errorf("%s: got sum %f, want %f", c.his.Desc(), got, want)
+		}
+	}
+}
+
+func TestBatchObserver(t *testing.T) {
+	newHis := func() Histogram {
+		return NewHistogram(HistogramOpts{
+			Name:    "test_histogram",
+			Help:    "helpless",
+			Buckets: []float64{1, 2},
+		})
+	}
+	values := []float64{0.5, 1.5, 1.75, 3}
+
+	batched, looped := newHis(), newHis()
+	NewBatchObserver(batched).ObserveBatch(values)
+	NewBatchObserver(batched).ObserveAll(values, 2)
+	for i := 0; i < 3; i++ {
+		for _, v := range values {
+			looped.Observe(v)
+		}
+	}
+
+	got, want := &dto.Metric{}, &dto.Metric{}
+	batched.Write(got)
+	looped.Write(want)
+	if got.String() != want.String() {
+		t.Errorf("got %s, want %s", got, want)
+	}
+
+	// Other Histogram implementations are observed one by one.
+	bimodal := NewBimodalHistogram(BimodalHistogramOpts{
+		Name:        "test_histogram",
+		Help:        "helpless",
+		Threshold:   1,
+		FastBuckets: []float64{1},
+		SlowBuckets: []float64{2},
+	})
+	NewBatchObserver(bimodal).ObserveAll(values, 3)
+	got.Reset()
+	bimodal.Write(got)
+	if got.String() != want.String() {
+		t.Errorf("got %s, want %s", got, want)
+	}
+}
+
+func TestBatchObserverNaN(t *testing.T) {
+	for i, policy := range []NaNPolicy{NaNPolicyKeep, NaNPolicyDrop} {
+		newHis := func() Histogram {
+			return NewHistogram(HistogramOpts{
+				Name:      "test_histogram",
+				Help:      "helpless",
+				Buckets:   []float64{1, 2},
+				NaNPolicy: policy,
+			})
+		}
+		values := []float64{1, math.NaN(), 1.5}
+
+		batched, looped := newHis(), newHis()
+		NewBatchObserver(batched).ObserveAll(values, 2)
+		for j := 0; j < 2; j++ {
+			for _, v := range values {
+				looped.Observe(v)
+			}
+		}
+
+		got, want := &dto.Metric{}, &dto.Metric{}
+		batched.Write(got)
+		looped.Write(want)
+		if got.String() != want.String() {
+			t.Errorf("%d. got %s, want %s", i, got, want)
+		}
+	}
+}
+
+func TestStepHistogram(t *testing.T) {
+	now := time.Unix(1000, 0)
+	his := NewStepHistogram(HistogramOpts{
+		Name:    "test_histogram",
+		Help:    "helpless",
+		Buckets: []float64{1, 10},
+	}, time.Minute, 2)
+	sh := his.(*stepHistogram)
+	sh.now = func() time.Time { return now }
+	sh.headEnd = now.Add(time.Minute)
+
+	write := func() *dto.Histogram {
+		m := &dto.Metric{}
+		his.Write(m)
+		return m.GetHistogram()
+	}
+
+	his.Observe(0.5)
+	his.Observe(5)
+	now = now.Add(time.Minute) // Second step.
+	his.Observe(50)
+	if got, want := write().GetSampleCount(), uint64(3); got != want {
+		t.Errorf("got sample count %d, want %d", got, want)
+	}
+
+	now = now.Add(time.Minute) // Third step, first one drops out.
+	h := write()
+	if got, want := h.GetSampleCount(), uint64(1); got != want {
+		t.Errorf("got sample count %d, want %d", got, want)
+	}
+	if got, want := h.GetSampleSum(), 50.; got != want {
+		t.Errorf("got sample sum %f, want %f", got, want)
+	}
+	if got, want := h.GetBucket()[1].GetCumulativeCount(), uint64(0); got != want {
+		t.Errorf("got cumulative count %d, want %d", got, want)
+	}
+
+	now = now.Add(time.Hour) // Everything drops out.
+	if got, want := write().GetSampleCount(), uint64(0); got != want {
+		t.Errorf("got sample count %d, want %d", got, want)
+	}
+	his.Observe(2)
+	now = now.Add(time.Minute)
+	h = write()
+	if got, want := h.GetSampleCount(), uint64(1); got != want {
+		t.Errorf("got sample count %d, want %d", got, want)
+	}
+	if got, want := h.GetBucket()[1].GetCumulativeCount(), uint64(1); got != want {
+		t.Errorf("got cumulative count %d, want %d", got, want)
+	}
+}
+
+func TestHistogramFromFunction(t *testing.T) {
+	var err error
+	hf := NewHistogramFromFunction(
+		NewDesc("db_query_duration_seconds", "test help", nil, Labels{"db": "main"}),
+		func() (uint64, float64, map[float64]uint64, error) {
+			return 10, 4.5, map[float64]uint64{0.1: 4, 1: 9}, err
+		},
+	)
+
+	collect := func() []*dto.Metric {
+		ch := make(chan Metric, 1)
+		hf.Collect(ch)
+		close(ch)
+		var result []*dto.Metric
+		for m := range ch {
+			out := &dto.Metric{}
+			m.Write(out)
+			result = append(result, out)
+		}
+		return result
+	}
+
+	got := collect()
+	if len(got) != 1 {
+		t.Fatalf("got %d metrics, want 1", len(got))
+	}
+	if want := `label:<name:"db" value:"main" > histogram:<sample_count:10 sample_sum:4.5 bucket:<cumulative_count:4 upper_bound:0.1 > bucket:<cumulative_count:9 upper_bound:1 > > `; got[0].String() != want {
+		t.Errorf("got %q, want %q", got[0].String(), want)
+	}
+
+	err = errors.New("backend unavailable")
+	if got := collect(); len(got) != 0 {
+		t.Errorf("got %d metrics, want 0", len(got))
+	}
+
+	if _, err := newRegistry().Register(hf); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestHistogramWriteConsistency(t *testing.T) {
+	his := NewHistogram(HistogramOpts{
+		Name:    "test_histogram",
+		Help:    "helpless",
+		Buckets: []float64{1, 2},
+	})
+
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+					his.Observe(1)
+				}
+			}
+		}()
+	}
+
+	for i := 0; i < 1000; i++ {
+		m := &dto.Metric{}
+		his.Write(m)
+		h := m.GetHistogram()
+		count := h.GetSampleCount()
+		if got := h.GetSampleSum(); got != float64(count) {
+			t.Errorf("%d. got sample sum %f for sample count %d", i, got, count)
+		}
+		for j, b := range h.GetBucket() {
+			if got := b.GetCumulativeCount(); got != count {
+				t.Errorf("%d.%d. got cumulative count %d for sample count %d", i, j, got, count)
+			}
+		}
+	}
+	close(done)
+	wg.Wait()
+}
+
+func TestSampledHistogram(t *testing.T) {
+	his := NewSampledHistogram(HistogramOpts{
+		Name:    "test_histogram",
+		Help:    "helpless",
+		Buckets: []float64{1, 10},
+	}, 4)
+	if got, want := his.SamplingRate(), 0.25; got != want {
+		t.Errorf("got sampling rate %f, want %f", got, want)
+	}
+	for i := 0; i < 10; i++ {
+		his.Observe(2)
+	}
+
+	m := &dto.Metric{}
+	his.Write(m)
+	h := m.GetHistogram()
+	if got, want := h.GetSampleCount(), uint64(8); got != want {
+		t.Errorf("got sample count %d, want %d", got, want)
+	}
+	if got, want := h.GetSampleSum(), 16.; got != want {
+		t.Errorf("got sample sum %f, want %f", got, want)
+	}
+	if got, want := h.GetBucket()[1].GetCumulativeCount(), uint64(8); got != want {
+		t.Errorf("got cumulative count %d, want %d", got, want)
+	}
+
+	if allocs := testing.AllocsPerRun(100, func() { his.Observe(2) }); allocs != 0 {
+		t.Errorf("got %f allocations per observation, want none", allocs)
+	}
+
+	for _, newSampled := range []func(HistogramOpts){
+		func(opts HistogramOpts) { NewSampledHistogram(opts, 4) },
+		func(opts HistogramOpts) { NewAdaptiveSampledHistogram(opts, 100) },
+	} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Error("expected panic for FreezeBucketsAfter")
+				}
+			}()
+			newSampled(HistogramOpts{
+				Name:               "test_histogram",
+				Help:               "helpless",
+				FreezeBucketsAfter: 10,
+			})
+		}()
+	}
+}
+
+func TestAdaptiveSampledHistogram(t *testing.T) {
+	his := NewAdaptiveSampledHistogram(HistogramOpts{
+		Name: "test_histogram",
+		Help: "helpless",
+	}, 100)
+	now := time.Unix(1000, 0)
+	his.(*sampledHistogram).now = func() time.Time { return now }
+
+	// 1000 observations per second.
+	for i := 0; i < 100; i++ {
+		now = now.Add(time.Millisecond)
+		his.Observe(1)
+	}
+	// Recording at most 100 of 1000 observations per second needs a
+	// sampling interval of 16, the next power of two above 10.
+	if got := his.SamplingRate(); got >= 1 || got < 1./16 {
+		t.Errorf("got sampling rate %f for high observation rate, want in [1/16, 1)", got)
+	}
+
+	// 1 observation per second.
+	for i := 0; i < 200; i++ {
+		now = now.Add(time.Second)
+		his.Observe(1)
+	}
+	if got, want := his.SamplingRate(), 1.; got != want {
+		t.Errorf("got sampling rate %f for low observation rate, want %f", got, want)
+	}
+}
+
+func TestHistogramEncodeMetric(t *testing.T) {
+	for _, opts := range []HistogramOpts{
+		{Buckets: []float64{1, 2.5}},
+		{Buckets: []float64{math.Inf(+1)}},
+		{NoBuckets: true},
+	} {
+		opts.Name = "test_histogram"
+		opts.Help = "helpless"
+		opts.ConstLabels = Labels{"path": `C:\dir "x"` + "\n"}
+		his := NewHistogram(opts)
+		his.Observe(2)
+		his.Observe(0.5)
+
+		var got bytes.Buffer
+		if err := his.(DirectEncoder).EncodeMetric(&got); err != nil {
+			t.Fatal(err)
+		}
+
+		m := &dto.Metric{}
+		his.Write(m)
+		var buf bytes.Buffer
+		if _, err := text.MetricFamilyToText(&buf, &dto.MetricFamily{
+			Name:   proto.String("test_histogram"),
+			Help:   proto.String("helpless"),
+			Type:   dto.MetricType_HISTOGRAM.Enum(),
+			Metric: []*dto.Metric{m},
+		}); err != nil {
+			t.Fatal(err)
+		}
+		var want []string
+		for _, line := range strings.SplitAfter(buf.String(), "\n") {
+			if !strings.HasPrefix(line, "#") {
+				want = append(want, line)
+			}
+		}
+
+		if got.String() != strings.Join(want, "") {
+			t.Errorf("got\n%s\nwant\n%s", got.String(), strings.Join(want, ""))
+		}
+	}
+}
+
+func TestHistogramBucketLabels(t *testing.T) {
+	his := NewHistogram(HistogramOpts{
+		Name:    "test_histogram",
+		Help:    "helpless",
+		Buckets: []float64{0.1, 0.5, 1},
+		BucketLabels: map[float64]string{
+			0.1:          "100ms",
+			1:            "1s",
+			math.Inf(+1): "inf",
+		},
+	})
+	his.Observe(0.3)
+
+	var got bytes.Buffer
+	if err := his.(DirectEncoder).EncodeMetric(&got); err != nil {
+		t.Fatal(err)
+	}
+	want := `test_histogram_bucket{le="100ms"} 0
+test_histogram_bucket{le="0.5"} 1
+test_histogram_bucket{le="1s"} 1
+test_histogram_bucket{le="inf"} 1
+test_histogram_sum 0.3
+test_histogram_count 1
+`
+	if got.String() != want {
+		t.Errorf("got\n%s\nwant\n%s", got.String(), want)
+	}
+
+	// The protobuf format keeps the numeric upper bounds.
+	m := &dto.Metric{}
+	his.Write(m)
+	if got, want := m.GetHistogram().GetBucket()[0].GetUpperBound(), 0.1; got != want {
+		t.Errorf("got upper bound %f, want %f", got, want)
+	}
+
+	for _, labels := range []map[float64]string{
+		{0.2: "200ms"},
+		{0.1: `100"ms`},
+	} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("expected panic for bucket labels %v", labels)
+				}
+			}()
+			NewHistogram(HistogramOpts{
+				Name:         "test_histogram",
+				Help:         "helpless",
+				Buckets:      []float64{0.1, 0.5, 1},
+				BucketLabels: labels,
+			})
+		}()
+	}
+}
+
+func TestHistogramFreezeBucketsAfter(t *testing.T) {
+	his := NewHistogram(HistogramOpts{
+		Name:               "test_histogram",
+		Help:               "helpless",
+		FreezeBucketsAfter: 8,
+		TargetBuckets:      4,
+	})
+
+	collect := func() *dto.Metric {
+		ch := make(chan Metric, 1)
+		his.Collect(ch)
+		m := &dto.Metric{}
+		(<-ch).Write(m)
+		return m
+	}
+
+	for _, v := range []float64{8, 7, 6, 5, 4, 3, 2} {
+		his.Observe(v)
+	}
+	if got, want := collect().GetGauge().GetValue(), 1.; got != want {
+		t.Errorf("got %f remaining observations, want %f", got, want)
+	}
+	if err := his.Write(&dto.Metric{}); err == nil {
+		t.Error("expected error when writing a learning histogram")
+	}
+
+	his.Observe(1)
+	his.Observe(100)
+	h := collect().GetHistogram()
+	if got, want := h.GetSampleCount(), uint64(9); got != want {
+		t.Errorf("got sample count %d, want %d", got, want)
+	}
+	var bounds []float64
+	var counts []uint64
+	for _, b := range h.GetBucket() {
+		bounds = append(bounds, b.GetUpperBound())
+		counts = append(counts, b.GetCumulativeCount())
+	}
+	if want := []float64{2, 4, 6, 8}; !reflect.DeepEqual(bounds, want) {
+		t.Errorf("got buckets %v, want %v", bounds, want)
+	}
+	if want := []uint64{2, 4, 6, 8}; !reflect.DeepEqual(counts, want) {
+		t.Errorf("got cumulative counts %v, want %v", counts, want)
+	}
+
+	if _, err := newRegistry().Register(his); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestHistogramVecWithPool(t *testing.T) {
+	var pool sync.Pool
+	vec := NewHistogramVec(HistogramOpts{
+		Name:              "test_histogram",
+		Help:              "helpless",
+		TrackLastObserved: true,
+	}, []string{"request"}).WithPool(&pool)
+
+	vec.WithLabelValues("a").Observe(1)
+	old := vec.WithLabelValues("a").(*trackedHistogram).Histogram
+	vec.DeleteLabelValues("a")
+	// The pool may drop its items at any time, so only check for a reset
+	// Histogram with the new labels if the old one got reused.
+	his := vec.WithLabelValues("b")
+	if his.(*trackedHistogram).Histogram != old {
+		t.Skip("pool dropped the deleted histogram")
+	}
+	m := &dto.Metric{}
+	his.Write(m)
+	if got, want := m.GetHistogram().GetSampleCount(), uint64(0); got != want {
+		t.Errorf("got sample count %d, want %d", got, want)
+	}
+	if got, want := m.Label[0].GetValue(), "b"; got != want {
+		t.Errorf("got label value %q, want %q", got, want)
+	}
+}
+
+func TestHdrLikeHistogram(t *testing.T) {
+	his := NewHdrLikeHistogram(HdrHistogramOpts{
+		Name:                           "test_histogram",
+		Help:                           "helpless",
+		LowestDiscernibleValue:         1,
+		HighestTrackableValue:          100,
+		NumberOfSignificantValueDigits: 1,
+	})
+	// One significant digit needs 32 sub-buckets of unit width, followed
+	// by 16 sub-buckets per doubling of the width.
+	var want []float64
+	for i := 0; i < 32; i++ {
+		want = append(want, float64(i))
+	}
+	for i := 33; i < 64; i += 2 {
+		want = append(want, float64(i))
+	}
+	for i := 67; i <= 103; i += 4 {
+		want = append(want, float64(i))
+	}
+	if got := his.ComputedBuckets(); !reflect.DeepEqual(got, want) {
+		t.Errorf("got buckets %v, want %v", got, want)
+	}
+
+	his.Observe(42)
+	m := &dto.Metric{}
+	his.Write(m)
+	if got, want := len(m.GetHistogram().GetBucket()), len(want); got != want {
+		t.Errorf("got %d buckets, want %d", got, want)
+	}
+	if got, want := m.GetHistogram().GetBucket()[37].GetCumulativeCount(), uint64(1); got != want {
+		t.Errorf("got cumulative count %d, want %d", got, want)
+	}
+	if got, want := m.GetHistogram().GetBucket()[37].GetUpperBound(), 43.; got != want {
+		t.Errorf("got upper bound %f, want %f", got, want)
+	}
+
+	// A lowest discernible value of 4 shifts all sub-buckets by 2 bits.
+	got := NewHdrLikeHistogram(HdrHistogramOpts{
+		Name:                           "test_histogram",
+		Help:                           "helpless",
+		LowestDiscernibleValue:         4,
+		HighestTrackableValue:          1000,
+		NumberOfSignificantValueDigits: 1,
+	}).ComputedBuckets()
+	if got[0] != 3 || got[1] != 7 {
+		t.Errorf("got first buckets %v, want [3 7]", got[:2])
+	}
+}
+
+func TestHistogramRecordCreatedTimestamp(t *testing.T) {
+	now := time.Unix(1400000000, 500000000)
+	his := NewHistogram(HistogramOpts{
+		Name:                   "test_histogram",
+		Help:                   "helpless",
+		ConstLabels:            Labels{"instance": "a"},
+		ResetOnCollect:         true,
+		RecordCreatedTimestamp: true,
+		Now:                    func() time.Time { return now },
+	})
+	if got, want := his.(HistogramWithCreatedAt).CreatedAt(), now; !got.Equal(want) {
+		t.Errorf("got creation time %v, want %v", got, want)
+	}
+
+	if _, err := newRegistry().Register(his); err != nil {
+		t.Fatal(err)
+	}
+	created := now
+	now = now.Add(time.Minute)
+	ch := make(chan Metric, 2)
+	his.Collect(ch)
+	close(ch)
+	if got, want := len(ch), 2; got != want {
+		t.Fatalf("got %d metrics, want %d", got, want)
+	}
+	<-ch
+	createdMetric := <-ch
+	if got, want := createdMetric.Desc().fqName, "test_histogram_created"; got != want {
+		t.Errorf("got name %q, want %q", got, want)
+	}
+	m := &dto.Metric{}
+	createdMetric.Write(m)
+	if got, want := m.GetGauge().GetValue(), 1400000000.5; got != want {
+		t.Errorf("got created timestamp %f, want %f", got, want)
+	}
+	if got, want := m.GetLabel()[0].GetValue(), "a"; got != want {
+		t.Errorf("got label value %q, want %q", got, want)
+	}
+	his.Write(m)
+	// The collection has reset the histogram.
+	if got := his.(HistogramWithCreatedAt).CreatedAt(); got.Equal(created) {
+		t.Errorf("creation time %v not updated by reset", got)
+	}
+
+	if got := NewHistogram(HistogramOpts{Name: "test", Help: "helpless"}).(HistogramWithCreatedAt).CreatedAt(); !got.IsZero() {
+		t.Errorf("got creation time %v for histogram not recording it", got)
+	}
+
+	vec := NewHistogramVec(HistogramOpts{
+		Name:                   "test_histogram",
+		Help:                   "helpless",
+		RecordCreatedTimestamp: true,
+		Now:                    func() time.Time { return now },
+	}, []string{"code"})
+	if got, want := vec.WithLabelValues("200").(HistogramWithCreatedAt).CreatedAt(), now; !got.Equal(want) {
+		t.Errorf("got creation time %v for child, want %v", got, want)
+	}
+}
+
+func TestHistogramTrackBucketSums(t *testing.T) {
+	his := NewHistogram(HistogramOpts{
+		Name:            "test_histogram",
+		Help:            "helpless",
+		Buckets:         []float64{1, 10},
+		TrackBucketSums: true,
+	})
+	for _, v := range []float64{0.5, 0.25, 5, 20} {
+		his.Observe(v)
+	}
+	if got, want := his.(HistogramWithBucketSums).BucketSums(), []float64{0.75, 5.75}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got bucket sums %v, want %v", got, want)
+	}
+
+	ch := make(chan Metric, 5)
+	his.Collect(ch)
+	close(ch)
+	if got, want := len(ch), 4; got != want {
+		t.Fatalf("got %d metrics, want %d", got, want)
+	}
+	<-ch
+	var sums []float64
+	for sum := range ch {
+		m := &dto.Metric{}
+		sum.Write(m)
+		if got, want := m.GetLabel()[0].GetName(), "le"; got != want {
+			t.Errorf("got label name %q, want %q", got, want)
+		}
+		sums = append(sums, m.GetUntyped().GetValue())
+	}
+	if want := []float64{0.75, 5.75, 25.75}; !reflect.DeepEqual(sums, want) {
+		t.Errorf("got collected bucket sums %v, want %v", sums, want)
+	}
+	if _, err := newRegistry().Register(his); err != nil {
+		t.Error(err)
+	}
+
+	vec := NewHistogramVec(HistogramOpts{
+		Name:              "test_histogram_vec",
+		Help:              "helpless",
+		ConstLabels:       Labels{"a": "const"},
+		Buckets:           []float64{1},
+		TrackBucketSums:   true,
+		TrackLastObserved: true,
+	}, []string{"z"})
+	vec.WithLabelValues("x").Observe(0.5)
+	if got, want := vec.WithLabelValues("x").(HistogramWithBucketSums).BucketSums(), []float64{0.5}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got bucket sums %v, want %v", got, want)
+	}
+	ch = make(chan Metric, 3)
+	vec.Collect(ch)
+	close(ch)
+	if got, want := len(ch), 3; got != want {
+		t.Fatalf("got %d metrics, want %d", got, want)
+	}
+	<-ch
+	m := &dto.Metric{}
+	(<-ch).Write(m)
+	if got, want := labelPairsString(m.GetLabel()), "a=const,le=1,z=x"; got != want {
+		t.Errorf("got labels %s, want %s", got, want)
+	}
+	if _, err := newRegistry().Register(vec); err != nil {
+		t.Error(err)
+	}
+
+	if got := NewHistogram(HistogramOpts{Name: "test", Help: "helpless"}).(HistogramWithBucketSums).BucketSums(); got != nil {
+		t.Errorf("got bucket sums %v for histogram not tracking them", got)
+	}
+}
+
+func labelPairsString(lps []*dto.LabelPair) string {
+	s := make([]string, len(lps))
+	for i, lp := range lps {
+		s[i] = lp.GetName() + "=" + lp.GetValue()
+	}
+	return strings.Join(s, ",")
+}
+
+func TestHistogramFactory(t *testing.T) {
+	f := NewHistogramFactory([]HistogramRule{
+		{Labels: Labels{"service": "db"}, Opts: HistogramOpts{Buckets: []float64{1, 2}}},
+		{Labels: Labels{"service": "db", "op": "scan"}, Opts: HistogramOpts{Buckets: []float64{10, 20, 30}}},
+		{Labels: Labels{"op": "scan"}, Opts: HistogramOpts{Buckets: []float64{100}}},
+	}, HistogramOpts{
+		Name: "request_duration_seconds",
+		Help: "helpless",
+	})
+	f.registry = newRegistry()
+
+	bucketCount := func(h Histogram) int {
+		m := &dto.Metric{}
+		h.Write(m)
+		return len(m.GetHistogram().GetBucket())
+	}
+	for _, s := range []struct {
+		labels Labels
+		want   int
+	}{
+		{Labels{"service": "db", "op": "get"}, 2},
+		{Labels{"service": "db", "op": "scan"}, 3},
+		{Labels{"service": "web", "op": "scan"}, 1},
+		{Labels{"service": "web", "op": "get"}, len(DefBuckets)},
+	} {
+		if got := bucketCount(f.Get(s.labels)); got != s.want {
+			t.Errorf("%v: got %d buckets, want %d", s.labels, got, s.want)
+		}
+	}
+
+	l := Labels{"service": "db", "op": "get"}
+	h := f.Get(l)
+	if f.Get(l) != h {
+		t.Error("expected the same histogram for the same labels")
+	}
+	if got, want := h.Desc().fqName, "request_duration_seconds"; got != want {
+		t.Errorf("got name %q, want %q", got, want)
+	}
+	if !f.Delete(l) {
+		t.Error("expected histogram to be deleted")
+	}
+	if f.Delete(l) {
+		t.Error("expected histogram to be already deleted")
+	}
+	if f.Get(l) == h {
+		t.Error("expected a new histogram after deletion")
+	}
+}
+
+func TestHistogramWithRate(t *testing.T) {
+	his, rate := NewHistogramWithRate(
+		HistogramOpts{Name: "request_duration_seconds", Help: "helpless"},
+		CounterOpts{Name: "requests_total", Help: "helpless"},
+	)
+	his.Observe(0.1)
+	his.Observe(2)
+
+	m := &dto.Metric{}
+	rate.Write(m)
+	if got, want := m.GetCounter().GetValue(), 2.; got != want {
+		t.Errorf("got rate counter %f, want %f", got, want)
+	}
+	m.Reset()
+	his.Write(m)
+	if got, want := m.GetHistogram().GetSampleCount(), uint64(2); got != want {
+		t.Errorf("got sample count %d, want %d", got, want)
+	}
+
+	ch := make(chan Metric, 3)
+	his.Collect(ch)
+	close(ch)
+	if got, want := len(ch), 2; got != want {
+		t.Errorf("got %d collected metrics, want %d", got, want)
+	}
+	reg := newRegistry()
+	if _, err := reg.Register(his); err != nil {
+		t.Error(err)
+	}
+	if _, err := reg.Register(rate); err == nil {
+		t.Error("expected error when registering the rate counter separately")
+	}
+}
+
+func TestMeterHistogram(t *testing.T) {
+	his := NewMeterHistogram(MeterHistogramOpts{
+		HistogramOpts: HistogramOpts{Name: "requests", Help: "helpless"},
+		TickInterval:  time.Second,
+		Alphas:        [3]float64{0.5, 0, 1},
+	})
+	mh := his.(*meterHistogram)
+	now := mh.lastTick
+	mh.now = func() time.Time { return now }
+
+	for i := 0; i < 10; i++ {
+		his.Observe(1)
+	}
+	if r1, r5, r15 := his.Rates(); r1 != 0 || r5 != 0 || r15 != 0 {
+		t.Errorf("got rates %f, %f, %f before the first tick, want 0", r1, r5, r15)
+	}
+	now = now.Add(time.Second)
+	// The first tick initializes all rates to the instant rate.
+	if r1, r5, r15 := his.Rates(); r1 != 10 || r5 != 10 || r15 != 10 {
+		t.Errorf("got rates %f, %f, %f, want 10", r1, r5, r15)
+	}
+	for i := 0; i < 20; i++ {
+		his.Observe(1)
+	}
+	now = now.Add(2 * time.Second)
+	// Two ticks, with 20 observations in the first and none in the second.
+	r1, r5, r15 := his.Rates()
+	if got, want := r1, 7.5; got != want {
+		t.Errorf("got 1m rate %f, want %f", got, want)
+	}
+	alpha5m := 1 - math.Exp(-1./300)
+	if got, want := r5, (10+alpha5m*10)*(1-alpha5m); math.Abs(got-want) > 1e-9 {
+		t.Errorf("got 5m rate %f, want %f", got, want)
+	}
+	if got, want := r15, 0.; got != want {
+		t.Errorf("got 15m rate %f, want %f", got, want)
+	}
+
+	ch := make(chan Metric, 4)
+	his.Collect(ch)
+	close(ch)
+	var names []string
+	for metric := range ch {
+		names = append(names, metric.Desc().fqName)
+	}
+	if want := []string{"requests", "requests_rate_1m", "requests_rate_5m", "requests_rate_15m"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("got metrics %v, want %v", names, want)
+	}
+	m := &dto.Metric{}
+	his.Write(m)
+	if got, want := m.GetHistogram().GetSampleCount(), uint64(30); got != want {
+		t.Errorf("got sample count %d, want %d", got, want)
+	}
+	if _, err := newRegistry().Register(his); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestInlineHistogram(t *testing.T) {
+	var conn struct {
+		storage InlineHistogramStorage
+		id      int
+	}
+	his := NewInlineHistogram(InlineHistogramOpts{
+		Name:    "conn_latency_seconds",
+		Help:    "helpless",
+		Buckets: []float64{0.1, 1, math.Inf(+1)},
+	}, &conn.storage)
+	for _, v := range []float64{0.05, 0.5, 0.7, 5} {
+		his.Observe(v)
+	}
+	if allocs := testing.AllocsPerRun(100, func() { his.Observe(0.3) }); allocs != 0 {
+		t.Errorf("got %f allocations per observation, want 0", allocs)
+	}
+	// AllocsPerRun calls the function once more to warm up.
+	if got, want := conn.storage.count, uint64(105); got != want {
+		t.Errorf("got storage count %d, want %d", got, want)
+	}
+
+	m := &dto.Metric{}
+	his.Write(m)
+	if got, want := m.GetHistogram().GetSampleCount(), uint64(105); got != want {
+		t.Errorf("got sample count %d, want %d", got, want)
+	}
+	if got, want := m.GetHistogram().GetSampleSum(), 6.25+101*0.3; math.Abs(got-want) > 1e-9 {
+		t.Errorf("got sample sum %f, want %f", got, want)
+	}
+	wantCounts := []uint64{1, 104}
+	buckets := m.GetHistogram().GetBucket()
+	if len(buckets) != len(wantCounts) {
+		t.Fatalf("got %d buckets, want %d", len(buckets), len(wantCounts))
+	}
+	for i, b := range buckets {
+		if got, want := b.GetCumulativeCount(), wantCounts[i]; got != want {
+			t.Errorf("bucket %d: got cumulative count %d, want %d", i, got, want)
+		}
+	}
+
+	NewInlineHistogram(InlineHistogramOpts{
+		Name: "conn_latency_seconds",
+		Help: "helpless",
+	}, &conn.storage).Write(m)
+	if got, want := len(m.GetHistogram().GetBucket()), len(DefBuckets); got != want {
+		t.Errorf("got %d buckets without Buckets set, want %d", got, want)
+	}
+
+	func() {
+		defer func() {
+			if _, ok := recover().(error); !ok {
+				t.Error("expected error panic for nil storage")
+			}
+		}()
+		NewInlineHistogram(InlineHistogramOpts{Name: "conn_latency_seconds", Help: "helpless"}, nil)
+	}()
+
+	defer func() {
+		if r := recover(); r == nil {
+			t.Error("expected panic for too many buckets")
+		}
+	}()
+	NewInlineHistogram(InlineHistogramOpts{
+		Name:    "conn_latency_seconds",
+		Help:    "helpless",
+		Buckets: LinearBuckets(1, 1, MaxInlineHistogramBuckets+1),
+	}, &conn.storage)
+}
+
+func TestHeterogeneousHistogramVec(t *testing.T) {
+	vec := NewHeterogeneousHistogramVec(HistogramOpts{
+		Name:    "upstream_latency_seconds",
+		Help:    "helpless",
+		Buckets: []float64{1, 2},
+	}, []string{"service", "method"}, []BucketRule{
+		{Labels: Labels{"service": "payments"}, Buckets: []float64{0.1, 0.2, 0.5}},
+		{Labels: Labels{"service": "payments", "method": "refund"}, Buckets: []float64{10}},
+		{Labels: Labels{"method": "search"}, Buckets: []float64{0.01}},
+	})
+	for _, s := range []struct {
+		service, method string
+		want            []float64
+	}{
+		{"payments", "charge", []float64{0.1, 0.2, 0.5}},
+		{"payments", "refund", []float64{10}},
+		{"recommendations", "search", []float64{0.01}},
+		{"recommendations", "list", []float64{1, 2}},
+	} {
+		m := &dto.Metric{}
+		vec.WithLabelValues(s.service, s.method).Write(m)
+		buckets := m.GetHistogram().GetBucket()
+		if len(buckets) != len(s.want) {
+			t.Errorf("%s/%s: got %d buckets, want %d", s.service, s.method, len(buckets), len(s.want))
+			continue
+		}
+		for i, b := range buckets {
+			if got, want := b.GetUpperBound(), s.want[i]; got != want {
+				t.Errorf("%s/%s: got upper bound %f for bucket %d, want %f", s.service, s.method, got, i, want)
+			}
+		}
+	}
+
+	for _, rules := range [][]BucketRule{
+		{{Labels: Labels{"region": "eu"}, Buckets: []float64{1}}},
+		{{Labels: Labels{"service": "a"}}, {Labels: Labels{"service": "a"}}},
+	} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("expected panic for rules %v", rules)
+				}
+			}()
+			NewHeterogeneousHistogramVec(HistogramOpts{
+				Name: "test",
+				Help: "helpless",
+			}, []string{"service"}, rules)
+		}()
+	}
+}
+
+func TestHistogramErrorHandler(t *testing.T) {
+	var got []float64
+	his := NewHistogram(HistogramOpts{
+		Name:    "test_histogram",
+		Help:    "helpless",
+		Buckets: []float64{1},
+		ErrorHandler: func(err error, v float64) {
+			if err != ErrInvalidObservation {
+				t.Errorf("got error %v, want %v", err, ErrInvalidObservation)
+			}
+			got = append(got, v)
+		},
+	})
+	for _, v := range []float64{0.5, math.NaN(), math.Inf(+1), 2, math.Inf(-1)} {
+		his.Observe(v)
+	}
+	if len(got) != 3 || !math.IsNaN(got[0]) || !math.IsInf(got[1], +1) || !math.IsInf(got[2], -1) {
+		t.Errorf("got invalid values %v, want NaN, +Inf, -Inf", got)
+	}
+	m := &dto.Metric{}
+	his.Write(m)
+	if got, want := m.GetHistogram().GetSampleCount(), uint64(2); got != want {
+		t.Errorf("got sample count %d, want %d", got, want)
+	}
+	if got, want := m.GetHistogram().GetSampleSum(), 2.5; got != want {
+		t.Errorf("got sample sum %f, want %f", got, want)
+	}
+
+	sum := NewSummary(SummaryOpts{
+		Name:         "test_summary",
+		Help:         "helpless",
+		ErrorHandler: func(err error, v float64) { got = append(got, v) },
+	})
+	got = nil
+	sum.Observe(math.NaN())
+	sum.Observe(1)
+	m.Reset()
+	sum.Write(m)
+	if len(got) != 1 || m.GetSummary().GetSampleCount() != 1 {
+		t.Errorf("got %d invalid values and sample count %d, want 1 and 1", len(got), m.GetSummary().GetSampleCount())
+	}
+}
+
+func TestLogInvalidObservation(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+
+	his := NewHistogram(HistogramOpts{
+		Name:         "test_histogram",
+		Help:         "helpless",
+		ErrorHandler: LogInvalidObservation,
+	})
+	for i := 0; i < 3; i++ {
+		his.Observe(math.NaN())
+	}
+	his.Observe(math.Inf(+1))
+	if got, want := strings.Count(buf.String(), "histogram_test.go:"), 2; got != want {
+		t.Errorf("got %d log lines, want %d:\n%s", got, want, buf.String())
+	}
+}
+
+func TestHistogramNaNPolicy(t *testing.T) {
+	his := NewHistogram(HistogramOpts{
+		Name:    "test_histogram",
+		Help:    "helpless",
+		Buckets: []float64{1},
+	})
+	reg := newRegistry()
+	if _, err := reg.Register(his); err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if _, err := reg.writePB(&buf, text.MetricFamilyToText, nil); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(buf.String(), "_observations_total") {
+		t.Errorf("got counts of dropped values before any were dropped:\n%s", buf.String())
+	}
+	for _, v := range []float64{0.5, math.NaN(), math.NaN(), math.Inf(+1), 2} {
+		his.Observe(v)
+	}
+	buf.Reset()
+	if _, err := reg.writePB(&buf, text.MetricFamilyToText, nil); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"test_histogram_count 2",
+		"test_histogram_sum 2.5",
+		"test_histogram_nan_observations_total 2",
+		"test_histogram_inf_observations_total 1",
+	} {
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("want %q in output:\n%s", want, buf.String())
+		}
+	}
+
+	his = NewHistogram(HistogramOpts{
+		Name:      "test_histogram",
+		Help:      "helpless",
+		Buckets:   []float64{1},
+		NaNPolicy: NaNPolicyReplace(0),
+		InfPolicy: InfPolicyReplace(10),
+	})
+	for _, v := range []float64{math.NaN(), math.Inf(+1), math.Inf(-1)} {
+		his.Observe(v)
+	}
+	m := &dto.Metric{}
+	his.Write(m)
+	if got, want := m.GetHistogram().GetSampleCount(), uint64(3); got != want {
+		t.Errorf("got sample count %d, want %d", got, want)
+	}
+	if got, want := m.GetHistogram().GetBucket()[0].GetCumulativeCount(), uint64(2); got != want {
+		t.Errorf("got %d observations in the lowest bucket, want %d", got, want)
+	}
+
+	his = NewHistogram(HistogramOpts{
+		Name:      "test_histogram",
+		Help:      "helpless",
+		Buckets:   []float64{1},
+		InfPolicy: InfPolicyKeep,
+	})
+	his.Observe(math.Inf(+1))
+	m.Reset()
+	his.Write(m)
+	if got, want := m.GetHistogram().GetSampleCount(), uint64(1); got != want {
+		t.Errorf("got sample count %d, want %d", got, want)
+	}
+
+	vec := NewHistogramVec(HistogramOpts{
+		Name:    "test_histogram",
+		Help:    "helpless",
+		Buckets: []float64{1},
+	}, []string{"handler"})
+	vec.WithLabelValues("a").Observe(math.NaN())
+	m.Reset()
+	vec.WithLabelValues("a").Write(m)
+	if got, want := m.GetHistogram().GetSampleCount(), uint64(0); got != want {
+		t.Errorf("got sample count %d, want %d", got, want)
+	}
+
+	defer func() {
+		if r := recover(); r == nil {
+			t.Error("expected panic for NaNPolicyError without ErrorHandler")
+		}
+	}()
+	NewHistogramVec(HistogramOpts{
+		Name:      "test_histogram",
+		Help:      "helpless",
+		NaNPolicy: NaNPolicyError,
+	}, []string{"handler"})
+}
+
+func TestVecNaNPolicy(t *testing.T) {
+	his := NewHistogramVec(HistogramOpts{
+		Name:    "test_histogram",
+		Help:    "helpless",
+		Buckets: []float64{1},
+	}, []string{"handler"})
+	his.WithLabelValues("a").Observe(math.NaN())
+	his.WithLabelValues("b").Observe(math.NaN())
+	his.WithLabelValues("b").Observe(math.Inf(+1))
+	sum := NewSummaryVec(SummaryOpts{
+		Name: "test_summary",
+		Help: "helpless",
+	}, []string{"handler"})
+	sum.WithLabelValues("a").Observe(math.NaN())
+
+	reg := newRegistry()
+	reg.collectChecksEnabled = true
+	for _, c := range []Collector{his, sum} {
+		if _, err := reg.Register(c); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var buf bytes.Buffer
+	if _, err := reg.writePB(&buf, text.MetricFamilyToText, nil); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"test_histogram_nan_observations_total 2",
+		"test_histogram_inf_observations_total 1",
+		`test_histogram_count{handler="b"} 0`,
+		"test_summary_nan_observations_total 1",
+	} {
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("want %q in output:\n%s", want, buf.String())
+		}
+	}
+}
+
+func TestSummaryNaNPolicy(t *testing.T) {
+	var got []float64
+	sum := NewSummary(SummaryOpts{
+		Name:         "test_summary",
+		Help:         "helpless",
+		NaNPolicy:    NaNPolicyError,
+		ErrorHandler: func(err error, v float64) { got = append(got, v) },
+	})
+	for _, v := range []float64{math.NaN(), 1, math.Inf(-1)} {
+		sum.Observe(v)
+	}
+	if len(got) != 2 {
+		t.Errorf("got invalid values %v, want NaN and -Inf", got)
+	}
+	reg := newRegistry()
+	if _, err := reg.Register(sum); err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if _, err := reg.writePB(&buf, text.MetricFamilyToText, nil); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"test_summary_count 1",
+		"test_summary_inf_observations_total 1",
+	} {
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("want %q in output:\n%s", want, buf.String())
+		}
+	}
+	if strings.Contains(buf.String(), "test_summary_nan_observations_total") {
+		t.Errorf("got count of NaN values although they are not dropped:\n%s", buf.String())
+	}
+}
+
+func TestAutoHistogram(t *testing.T) {
+	his := NewAutoHistogram(AutoHistogramOpts{
+		HistogramOpts: HistogramOpts{
+			Name: "test_histogram",
+			Help: "helpless",
+		},
+		MaxSamples: 100,
+	})
+	if got, want := his.Status(), AutoHistogramLearning; got != want {
+		t.Errorf("got status %s, want %s", got, want)
+	}
+	if got := his.BucketBoundaries(); got != nil {
+		t.Errorf("got bucket boundaries %v while learning, want nil", got)
+	}
+	for i := 1; i <= 100; i++ {
+		his.Observe(float64(i))
+	}
+	if got, want := his.Status(), AutoHistogramObserving; got != want {
+		t.Errorf("got status %s, want %s", got, want)
+	}
+	boundaries := his.BucketBoundaries()
+	if got, want := len(boundaries), DefAutoHistogramTargetBuckets; got != want {
+		t.Fatalf("got %d bucket boundaries, want %d", got, want)
+	}
+	if got, want := boundaries[0], 5.; got != want {
+		t.Errorf("got first bucket boundary %f, want %f", got, want)
+	}
+
+	m := &dto.Metric{}
+	his.Observe(1000)
+	if err := his.Write(m); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := m.GetHistogram().GetSampleCount(), uint64(101); got != want {
+		t.Errorf("got sample count %d, want %d", got, want)
+	}
+}
+
+func TestHistogramVecAnomalyHandler(t *testing.T) {
+	vec := NewHistogramVec(HistogramOpts{
+		Name:              "test_histogram",
+		Help:              "helpless",
+		TrackLastObserved: true,
+		TrackBucketSums:   true,
+	}, []string{"handler"})
+	type anomaly struct {
+		labels              Labels
+		value, mean, stddev float64
+	}
+	var anomalies []anomaly
+	vec.SetAnomalyHandler(3, func(labels Labels, value, mean, stddev float64) {
+		anomalies = append(anomalies, anomaly{labels, value, mean, stddev})
+	})
+
+	h := vec.WithLabelValues("api")
+	for _, v := range []float64{1, 3, 1, 3, 1, 3} {
+		h.Observe(v)
+	}
+	if len(anomalies) != 0 {
+		t.Fatalf("got anomalies %v for normal observations", anomalies)
+	}
+	h.Observe(100)
+	if got, want := len(anomalies), 1; got != want {
+		t.Fatalf("got %d anomalies, want %d", got, want)
+	}
+	a := anomalies[0]
+	if a.labels["handler"] != "api" || a.value != 100 || a.mean != 2 || math.Abs(a.stddev-math.Sqrt(1.2)) > 1e-9 {
+		t.Errorf("got anomaly %+v", a)
+	}
+	if got := h.(HistogramWithBucketSums).BucketSums(); len(got) != len(DefBuckets) {
+		t.Errorf("got %d bucket sums, want %d", len(got), len(DefBuckets))
+	}
+
+	// The state is reset along with the Histogram.
+	vec.Reset()
+	h = vec.WithLabelValues("api")
+	h.Observe(1)
+	h.Observe(1)
+	h.Observe(1000)
+	if got, want := len(anomalies), 2; got != want {
+		t.Errorf("got %d anomalies after reset, want %d", got, want)
+	}
+
+	ch := make(chan Metric, len(DefBuckets)+2)
+	vec.Collect(ch)
+	if got, want := len(ch), len(DefBuckets)+2; got != want {
+		t.Errorf("got %d collected metrics, want %d", got, want)
+	}
+}
+
+func TestHistogramObservationBudget(t *testing.T) {
+	now := time.Unix(0, 0)
+	his := NewHistogram(HistogramOpts{
+		Name:                   "test_histogram",
+		Help:                   "helpless",
+		ObservationBudget:      10,
+		DropOnBudgetExhaustion: true,
+		Now:                    func() time.Time { return now },
+	})
+	for i := 0; i < 15; i++ {
+		his.Observe(1)
+	}
+	now = now.Add(500 * time.Millisecond)
+	for i := 0; i < 10; i++ {
+		his.Observe(1)
+	}
+
+	ch := make(chan Metric, 2)
+	his.Collect(ch)
+	if got, want := len(ch), 2; got != want {
+		t.Fatalf("got %d collected metrics, want %d", got, want)
+	}
+	m := &dto.Metric{}
+	if err := (<-ch).Write(m); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := m.GetHistogram().GetSampleCount(), uint64(15); got != want {
+		t.Errorf("got sample count %d, want %d", got, want)
+	}
+	dropped := <-ch
+	if got, want := dropped.Desc().fqName, "test_histogram_dropped_observations_total"; got != want {
+		t.Errorf("got dropped counter %q, want %q", got, want)
+	}
+	if err := dropped.Write(m); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := m.GetCounter().GetValue(), 10.; got != want {
+		t.Errorf("got %f dropped observations, want %f", got, want)
+	}
+
+	// Without dropping, Observe blocks until the observation is within the
+	// budget.
+	his = NewHistogram(HistogramOpts{
+		Name:              "test_histogram",
+		Help:              "helpless",
+		ObservationBudget: 100,
+	})
+	start := time.Now()
+	for i := 0; i < 110; i++ {
+		his.Observe(1)
+	}
+	if elapsed := time.Since(start); elapsed < 90*time.Millisecond {
+		t.Errorf("observing took %s, want at least 90ms", elapsed)
+	}
+	his.Collect(ch)
+	if err := (<-ch).Write(m); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := m.GetHistogram().GetSampleCount(), uint64(110); got != want {
+		t.Errorf("got sample count %d, want %d", got, want)
+	}
+	if got, want := len(ch), 0; got != want {
+		t.Errorf("got %d additional metrics, want %d", got, want)
+	}
+}
+
+func TestScrapeIntervalHistogram(t *testing.T) {
+	now := time.Unix(0, 0)
+	c := NewScrapeIntervalHistogram(ScrapeIntervalOpts{
+		Buckets: []float64{10, 20},
+		now:     func() time.Time { return now },
+	})
+	collect := func() (*dto.Histogram, float64) {
+		ch := make(chan Metric, 2)
+		c.Collect(ch)
+		var his, last dto.Metric
+		if err := (<-ch).Write(&his); err != nil {
+			t.Fatal(err)
+		}
+		if err := (<-ch).Write(&last); err != nil {
+			t.Fatal(err)
+		}
+		return his.GetHistogram(), last.GetGauge().GetValue()
+	}
+
+	his, last := collect()
+	if got, want := his.GetSampleCount(), uint64(0); got != want {
+		t.Errorf("got sample count %d after first scrape, want %d", got, want)
+	}
+	now = now.Add(15 * time.Second)
+	collect()
+	now = now.Add(5 * time.Second)
+	his, last = collect()
+	if got, want := his.GetSampleCount(), uint64(2); got != want {
+		t.Errorf("got sample count %d, want %d", got, want)
+	}
+	if got, want := his.GetSampleSum(), 20.; got != want {
+		t.Errorf("got sample sum %f, want %f", got, want)
+	}
+	if got, want := his.GetBucket()[0].GetCumulativeCount(), uint64(1); got != want {
+		t.Errorf("got %d intervals up to 10s, want %d", got, want)
+	}
+	if got, want := last, 5.; got != want {
+		t.Errorf("got last interval %f, want %f", got, want)
+	}
+
+	if _, err := newRegistry().Register(c); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestHistogramVecLazyBucketEmission(t *testing.T) {
+	vec := NewHistogramVec(HistogramOpts{
+		Name:            "test_histogram",
+		Help:            "helpless",
+		Buckets:         []float64{1, 2},
+		TrackBucketSums: true,
+	}, []string{"handler"}).WithLazyBucketEmission(true)
+	vec.WithLabelValues("unused")
+	vec.WithLabelValues("used").Observe(1.5)
+
+	reg := newRegistry()
+	if _, err := reg.Register(vec); err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if _, err := reg.writePB(&buf, text.MetricFamilyToText, nil); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		`test_histogram_bucket{handler="used",le="2"} 1`,
+		`test_histogram_bucket{handler="used",le="+Inf"} 1`,
+		`test_histogram_count{handler="unused"} 0`,
+		`test_histogram_sum{handler="unused"} 0`,
+		`test_histogram_bucket_sum{handler="used",le="2"} 1.5`,
+	} {
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("want %q in output:\n%s", want, buf.String())
+		}
+	}
+	if strings.Contains(buf.String(), `handler="unused",le=`) {
+		t.Errorf("got buckets for unused histogram:\n%s", buf.String())
+	}
+
+	vec.WithLazyBucketEmission(false)
+	buf.Reset()
+	if _, err := reg.writePB(&buf, text.MetricFamilyToText, nil); err != nil {
+		t.Fatal(err)
+	}
+	if want := `test_histogram_bucket{handler="unused",le="+Inf"} 0`; !strings.Contains(buf.String(), want) {
+		t.Errorf("want %q in output:\n%s", want, buf.String())
+	}
+}
+
+func TestHistogramSize(t *testing.T) {
+	his := NewHistogram(HistogramOpts{
+		Name:        "test_histogram",
+		Help:        "helpless",
+		Buckets:     []float64{1, 2, 3},
+		ConstLabels: Labels{"a": "bc"},
+	})
+	if got, want := his.(HistogramWithSize).Size(), HistogramBaseSize+3*16+LabelPairSize+3; got != want {
+		t.Errorf("got size %d, want %d", got, want)
+	}
+
+	vec := NewHistogramVec(HistogramOpts{
+		Name:              "test_histogram",
+		Help:              "helpless",
+		Buckets:           []float64{1, 2},
+		TrackBucketSums:   true,
+		TrackLastObserved: true,
+	}, []string{"handler"})
+	if got, want := vec.TotalSize(), 0; got != want {
+		t.Errorf("got total size %d, want %d", got, want)
+	}
+	a := vec.WithLabelValues("a").(HistogramWithSize).Size()
+	if want := HistogramBaseSize + 2*24 + LabelPairSize + len("handler") + 1; a != want {
+		t.Errorf("got size %d, want %d", a, want)
+	}
+	vec.WithLabelValues("b")
+	if got, want := vec.TotalSize(), 2*a; got != want {
+		t.Errorf("got total size %d, want %d", got, want)
+	}
+}
+
+func TestHistogramDynamicBuckets(t *testing.T) {
+	his := NewHistogram(HistogramOpts{
+		Name:           "test_histogram",
+		Help:           "helpless",
+		Buckets:        []float64{1, 2},
+		DynamicBuckets: true,
+		MaxUpperBound:  100,
+	})
+	values := []float64{0.5, 3, 4, 5, 70, 100, 1000}
+	for _, v := range values {
+		his.Observe(v)
+	}
+
+	m := &dto.Metric{}
+	if err := his.Write(m); err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, b := range m.GetHistogram().GetBucket() {
+		got = append(got, fmt.Sprintf("%v:%d", b.GetUpperBound(), b.GetCumulativeCount()))
+	}
+	// 3 adds a bucket up to 4, which 4 then falls into. 70 would round up
+	// to 128 and is capped at MaxUpperBound, so that 100 falls into its
+	// bucket, too.
+	want := []string{"1:1", "2:1", "4:3", "8:4", "100:6"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got buckets %v, want %v", got, want)
+	}
+	if got, want := m.GetHistogram().GetSampleCount(), uint64(7); got != want {
+		t.Errorf("got sample count %d, want %d", got, want)
+	}
+
+	// A batch adds the same buckets.
+	batched := NewHistogram(HistogramOpts{
+		Name:           "test_histogram",
+		Help:           "helpless",
+		Buckets:        []float64{1, 2},
+		DynamicBuckets: true,
+		MaxUpperBound:  100,
+	})
+	NewBatchObserver(batched).ObserveBatch(values)
+	bm := &dto.Metric{}
+	if err := batched.Write(bm); err != nil {
+		t.Fatal(err)
+	}
+	if bm.String() != m.String() {
+		t.Errorf("got %s, want %s", bm, m)
+	}
+
+	// The DefBuckets must not have been modified.
+	if got, want := len(DefBuckets), 11; got != want {
+		t.Errorf("got %d DefBuckets, want %d", got, want)
+	}
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Error("expected panic for MaxUpperBound below the highest bucket")
+			}
+		}()
+		NewHistogram(HistogramOpts{
+			Name:           "test_histogram",
+			Help:           "helpless",
+			DynamicBuckets: true,
+			MaxUpperBound:  1,
+		})
+	}()
+}
+
+func TestDeltaHistogram(t *testing.T) {
+	his := NewDeltaHistogram(HistogramOpts{
+		Name:    "test_histogram",
+		Help:    "helpless",
+		Buckets: []float64{1, 2},
+	})
+	if got, want := his.Desc().help, "helpless"+DeltaHistogramHelpSuffix; got != want {
+		t.Errorf("got help %q, want %q", got, want)
+	}
+
+	for _, observations := range [][]float64{{0.5, 1.5, 3}, {1.5}, {}} {
+		for _, v := range observations {
+			his.Observe(v)
+		}
+		m := &dto.Metric{}
+		if err := his.Write(m); err != nil {
+			t.Fatal(err)
+		}
+		var sum float64
+		for _, v := range observations {
+			sum += v
+		}
+		if got, want := m.GetHistogram().GetSampleCount(), uint64(len(observations)); got != want {
+			t.Errorf("got sample count %d, want %d", got, want)
+		}
+		if got, want := m.GetHistogram().GetSampleSum(), sum; got != want {
+			t.Errorf("got sample sum %f, want %f", got, want)
+		}
+	}
+}
+
+func TestWeightedHistogram(t *testing.T) {
+	var handled []error
+	his := NewHistogram(HistogramOpts{
+		Name:            "test_histogram",
+		Help:            "helpless",
+		Buckets:         []float64{1, 2},
+		WeightedBuckets: true,
+		ErrorHandler:    func(err error, v float64) { handled = append(handled, err) },
+	}).(WeightedHistogram)
+	his.ObserveWithWeight(0.5, 10)
+	his.ObserveWithWeight(1.5, 2.5)
+	his.ObserveWithWeight(3, 0.5)
+	his.Observe(1.5)
+	his.ObserveWithWeight(1.5, -1)
+	his.ObserveWithWeight(1.5, math.NaN())
+
+	if got, want := handled, []error{ErrInvalidWeight, ErrInvalidWeight}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got handled errors %v, want %v", got, want)
+	}
+	m := &dto.Metric{}
+	if err := his.Write(m); err != nil {
+		t.Fatal(err)
+	}
+	// The weights sum up to 14, with 10 in the first and 3.5 in the second
+	// bucket.
+	if got, want := m.GetHistogram().GetSampleCount(), uint64(14); got != want {
+		t.Errorf("got sample count %d, want %d", got, want)
+	}
+	if got, want := m.GetHistogram().GetSampleSum(), 5+3.75+1.5+1.5; got != want {
+		t.Errorf("got sample sum %f, want %f", got, want)
+	}
+	for i, want := range []uint64{10, 14} {
+		if got := m.GetHistogram().GetBucket()[i].GetCumulativeCount(); got != want {
+			t.Errorf("%d. got cumulative count %d, want %d", i, got, want)
+		}
+	}
+
+	vec := NewHistogramVec(HistogramOpts{
+		Name:              "test_histogram",
+		Help:              "helpless",
+		Buckets:           []float64{1, 2},
+		WeightedBuckets:   true,
+		TrackLastObserved: true,
+	}, []string{"l"})
+	vec.WithLabelValues("a").(WeightedHistogram).ObserveWithWeight(1.5, 3)
+	m = &dto.Metric{}
+	if err := vec.WithLabelValues("a").Write(m); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := m.GetHistogram().GetSampleSum(), 4.5; got != want {
+		t.Errorf("got sample sum %f, want %f", got, want)
+	}
+
+	defer func() {
+		if r := recover(); r == nil {
+			t.Error("expected panic for unweighted histogram")
+		}
+	}()
+	NewHistogram(HistogramOpts{
+		Name: "test_histogram",
+		Help: "helpless",
+	}).(WeightedHistogram).ObserveWithWeight(1, 2)
+}
+
+func TestHistogramVecSharedBucketLayout(t *testing.T) {
+	vec := NewHistogramVec(HistogramOpts{
+		Name:               "test_histogram",
+		Help:               "helpless",
+		Buckets:            []float64{1, 2},
+		SharedBucketLayout: true,
+	}, []string{"l"})
+
+	// Create more children than fit into the first slab.
+	for i := 0; i < 100; i++ {
+		vec.WithLabelValues(fmt.Sprint(i)).Observe(float64(i%3) + 0.5)
+	}
+	for i := 0; i < 100; i++ {
+		counts := unwrapHistogram(vec.WithLabelValues(fmt.Sprint(i))).counts
+		want := []uint64{0, 0}
+		if i%3 < 2 {
+			want[i%3] = 1
+		}
+		if !reflect.DeepEqual(counts, want) {
+			t.Errorf("%d. got counts %v, want %v", i, counts, want)
+		}
+		if got, want := cap(counts), 2; got != want {
+			t.Errorf("%d. got capacity %d, want %d", i, got, want)
+		}
+	}
+
+	released := unwrapHistogram(vec.WithLabelValues("1")).counts
+	vec.DeleteLabelValues("1")
+	reused := unwrapHistogram(vec.WithLabelValues("new")).counts
+	if &reused[0] != &released[0] {
+		t.Error("counts of deleted child not reused")
+	}
+	if got, want := reused, []uint64{0, 0}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got reused counts %v, want %v", got, want)
+	}
+
+	defer func() {
+		if r := recover(); r == nil {
+			t.Error("expected panic for WithPool")
+		}
+	}()
+	vec.WithPool(&sync.Pool{})
+}
+
+func TestLeveledHistogram(t *testing.T) {
+	h := NewLeveledHistogram(
+		NewDesc("latency_seconds", "helpless", []string{"service", "endpoint"}, nil),
+		[]float64{1},
+		[]HistogramLevel{
+			{Desc: NewDesc("latency_by_service_seconds", "helpless", []string{"service"}, nil)},
+			{Desc: NewDesc("latency_total_seconds", "helpless", nil, nil)},
+			{
+				Desc:   NewDesc("latency_api_seconds", "helpless", []string{"endpoint"}, nil),
+				Labels: Labels{"service": "api"},
+			},
+		},
+	)
+	h.Observe([]string{"api", "/a"}, 0.5)
+	h.Observe([]string{"api", "/b"}, 2)
+	h.Observe([]string{"web", "/a"}, 0.5)
+
+	reg := newRegistry()
+	if _, err := reg.Register(h); err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if _, err := reg.writePB(&buf, text.MetricFamilyToText, nil); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		`latency_seconds_count{endpoint="/a",service="web"} 1`,
+		`latency_by_service_seconds_count{service="api"} 2`,
+		`latency_by_service_seconds_bucket{service="api",le="1"} 1`,
+		`latency_total_seconds_count 3`,
+		`latency_total_seconds_sum 3`,
+		`latency_api_seconds_count{endpoint="/b"} 1`,
+	} {
+		if !strings.Contains(buf.String(), want+"\n") {
+			t.Errorf("missing %q in:\n%s", want, buf.String())
+		}
+	}
+	if strings.Contains(buf.String(), `latency_api_seconds_count{endpoint="/a"} 2`) {
+		t.Error("filtered level aggregated non-matching observations")
+	}
+
+	defer func() {
+		if r := recover(); r == nil {
+			t.Error("expected panic for unknown label")
+		}
+	}()
+	NewLeveledHistogram(
+		NewDesc("latency_seconds", "helpless", []string{"service"}, nil),
+		nil,
+		[]HistogramLevel{{Desc: NewDesc("latency_by_dc_seconds", "helpless", []string{"dc"}, nil)}},
+	)
+}
+
+func TestHistogramVecObserveIf(t *testing.T) {
+	vec := NewHistogramVec(HistogramOpts{
+		Name: "test_histogram",
+		Help: "helpless",
+	}, []string{"l"})
+	if got, want := vec.ObserveIf(true, 1.5, "a"), true; got != want {
+		t.Errorf("got %t, want %t", got, want)
+	}
+	if got, want := vec.ObserveIf(false, 1.5, "b"), false; got != want {
+		t.Errorf("got %t, want %t", got, want)
+	}
+	if got, want := len(vec.children), 1; got != want {
+		t.Errorf("got %d histograms, want %d", got, want)
+	}
+}
+
+func TestHistogramVecObserveN(t *testing.T) {
+	vec := NewHistogramVec(HistogramOpts{
+		Name:              "test_histogram",
+		Help:              "helpless",
+		Buckets:           []float64{1, 2},
+		TrackBucketSums:   true,
+		TrackLastObserved: true,
+	}, []string{"l"})
+	vec.ObserveN(1000000, 1.5, "a")
+	vec.ObserveN(0, 0.5, "a")
+	vec.WithLabelValues("a").Observe(0.5)
+
+	m := &dto.Metric{}
+	if err := vec.WithLabelValues("a").Write(m); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := m.GetHistogram().GetSampleCount(), uint64(1000001); got != want {
+		t.Errorf("got sample count %d, want %d", got, want)
+	}
+	if got, want := m.GetHistogram().GetSampleSum(), 1500000.5; got != want {
+		t.Errorf("got sample sum %f, want %f", got, want)
+	}
+	for i, want := range []uint64{1, 1000001} {
+		if got := m.GetHistogram().GetBucket()[i].GetCumulativeCount(); got != want {
+			t.Errorf("%d. got cumulative count %d, want %d", i, got, want)
+		}
+	}
+	sums := vec.WithLabelValues("a").(HistogramWithBucketSums).BucketSums()
+	if got, want := sums, []float64{0.5, 1500000.5}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got bucket sums %v, want %v", got, want)
+	}
+
+	anomalous := NewHistogramVec(HistogramOpts{
+		Name: "test_histogram",
+		Help: "helpless",
+	}, []string{"l"})
+	anomalous.SetAnomalyHandler(1, func(Labels, float64, float64, float64) {})
+	anomalous.ObserveN(3, 1, "a")
+	m.Reset()
+	anomalous.WithLabelValues("a").Write(m)
+	if got, want := m.GetHistogram().GetSampleCount(), uint64(3); got != want {
+		t.Errorf("got sample count %d, want %d", got, want)
+	}
+
+	defer func() {
+		if r := recover(); r == nil {
+			t.Error("expected panic for negative n")
+		}
+	}()
+	vec.ObserveN(-1, 1, "a")
+}
+
+func TestHistogramWithReset(t *testing.T) {
+	his := NewHistogram(HistogramOpts{
+		Name:    "test",
+		Help:    "helpless",
+		Buckets: []float64{1, 2},
+	}).(HistogramWithReset)
+
+	const goroutines, observations = 4, 1000
+	var wg sync.WaitGroup
+	for i := 0; i < goroutines; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < observations; j++ {
+				his.Observe(1.5)
+			}
+		}()
+	}
+	var total, totalInBucket uint64
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	for finished := false; !finished; {
+		select {
+		case <-done:
+			finished = true
+		default:
+		}
+		snapshot := his.Snapshot()
+		if got, want := snapshot.UpperBounds, []float64{1, 2}; !reflect.DeepEqual(got, want) {
+			t.Fatalf("got upper bounds %v, want %v", got, want)
+		}
+		if got, want := snapshot.CumulativeCounts[0], uint64(0); got != want {
+			t.Fatalf("got count %d in first bucket, want %d", got, want)
+		}
+		if got, want := snapshot.Sum, 1.5*float64(snapshot.Count); got != want {
+			t.Fatalf("got sum %f, want %f", got, want)
+		}
+		total += snapshot.Count
+		totalInBucket += snapshot.CumulativeCounts[1]
+	}
+	if got, want := total, uint64(goroutines*observations); got != want {
+		t.Errorf("got %d observations in all snapshots, want %d", got, want)
+	}
+	if got, want := totalInBucket, uint64(goroutines*observations); got != want {
+		t.Errorf("got %d observations in bucket 2 of all snapshots, want %d", got, want)
+	}
+
+	his.Observe(0.5)
+	his.Reset()
+	if got, want := his.Snapshot().Count, uint64(0); got != want {
+		t.Errorf("got count %d after Reset, want %d", got, want)
+	}
+
+	vec := NewHistogramVec(HistogramOpts{Name: "test", Help: "helpless", Buckets: []float64{1}}, []string{"l"})
+	child := vec.WithLabelValues("x").(HistogramWithReset)
+	child.Observe(0.5)
+	child.Observe(3)
+	out := &dto.Histogram{}
+	child.Snapshot().Write(out)
+	if got, want := out.GetSampleCount(), uint64(2); got != want {
+		t.Errorf("got sample count %d, want %d", got, want)
+	}
+	if got, want := out.GetSampleSum(), 3.5; got != want {
+		t.Errorf("got sample sum %f, want %f", got, want)
+	}
+	if got, want := len(out.Bucket), 1; got != want {
+		t.Fatalf("got %d buckets, want %d", got, want)
+	}
+	if got, want := out.Bucket[0].GetCumulativeCount(), uint64(1); got != want {
+		t.Errorf("got cumulative count %d, want %d", got, want)
+	}
+	m := &dto.Metric{}
+	child.Write(m)
+	if got, want := m.GetHistogram().GetSampleCount(), uint64(0); got != want {
+		t.Errorf("got sample count %d after Snapshot, want %d", got, want)
+	}
 }
@@ -56,7 +56,9 @@ func nowSeries(t ...time.Time) nower {
 // http_request_size_bytes (Summary), http_response_size_bytes (Summary). Each
 // has a constant label named "handler" with the provided handlerName as
 // value. http_requests_total is a metric vector partitioned by HTTP method
-// (label name "method") and HTTP status code (label name "code").
+// (label name "method") and HTTP status code (label name "code"). The metrics
+// are also reported if the handler panics, in which case the request is counted
+// with code 500 unless the handler has already written a status code.
 func InstrumentHandler(handlerName string, handler http.Handler) http.HandlerFunc {
 	return InstrumentHandlerFunc(handlerName, handler.ServeHTTP)
 }
@@ -68,6 +70,7 @@ func InstrumentHandlerFunc(handlerName string, handlerFunc func(http.ResponseWri
 		SummaryOpts{
 			Subsystem:   "http",
 			ConstLabels: Labels{"handler": handlerName},
+			Objectives:  DefObjectives,
 		},
 		handlerFunc,
 	)
@@ -90,6 +93,7 @@ func InstrumentHandlerFunc(handlerName string, handlerFunc func(http.ResponseWri
 //         prometheus.SummaryOpts{
 //              Subsystem:   "http",
 //              ConstLabels: prometheus.Labels{"handler": handlerName},
+//              Objectives:  prometheus.DefObjectives,
 //         },
 //         handler,
 //     )
@@ -155,16 +159,32 @@ func InstrumentHandlerFuncWithOpts(opts SummaryOpts, handlerFunc func(http.Respo
 		} else {
 			rw = delegate
 		}
-		handlerFunc(rw, r)
-
-		elapsed := float64(time.Since(now)) / float64(time.Microsecond)
 
-		method := sanitizeMethod(r.Method)
-		code := sanitizeCode(delegate.status)
-		regReqCnt.WithLabelValues(method, code).Inc()
-		regReqDur.Observe(elapsed)
-		regResSz.Observe(float64(delegate.written))
-		regReqSz.Observe(float64(<-out))
+		// Observe in a deferred function so that a panicking handler
+		// is still accounted for.
+		completed := false
+		defer func() {
+			elapsed := float64(time.Since(now)) / float64(time.Microsecond)
+
+			status := delegate.status
+			if status == 0 {
+				// Nothing written. The server replies with 200 if
+				// the handler returned and drops the connection
+				// if it panicked.
+				status = http.StatusOK
+				if !completed {
+					status = http.StatusInternalServerError
+				}
+			}
+			method := sanitizeMethod(r.Method)
+			code := sanitizeCode(status)
+			regReqCnt.WithLabelValues(method, code).Inc()
+			regReqDur.Observe(elapsed)
+			regResSz.Observe(float64(delegate.written))
+			regReqSz.Observe(float64(<-out))
+		}()
+		handlerFunc(rw, r)
+		completed = true
 	})
 }
 
@@ -119,3 +119,46 @@ func TestInstrumentHandler(t *testing.T) {
 		t.Errorf("want reqCnt of %f, got %f", want, got)
 	}
 }
+
+func TestInstrumentHandlerPanic(t *testing.T) {
+	opts := SummaryOpts{
+		Subsystem:   "http",
+		ConstLabels: Labels{"handler": "panic-handler"},
+	}
+	hndlr := InstrumentHandlerFuncWithOpts(opts, func(w http.ResponseWriter, r *http.Request) {
+		panic("bad request handling")
+	})
+
+	reqCnt := MustRegisterOrGet(NewCounterVec(
+		CounterOpts{
+			Subsystem:   opts.Subsystem,
+			Name:        "requests_total",
+			Help:        "Total number of HTTP requests made.",
+			ConstLabels: opts.ConstLabels,
+		},
+		instLabels,
+	)).(*CounterVec)
+	opts.Name = "request_duration_microseconds"
+	opts.Help = "The HTTP request latencies in microseconds."
+	reqDur := MustRegisterOrGet(NewSummary(opts)).(Summary)
+
+	func() {
+		defer func() {
+			if r := recover(); r == nil {
+				t.Error("expected panic to be propagated")
+			}
+		}()
+		hndlr.ServeHTTP(httptest.NewRecorder(), &http.Request{Method: "GET"})
+	}()
+
+	out := &dto.Metric{}
+	reqDur.Write(out)
+	if want, got := uint64(1), out.Summary.GetSampleCount(); want != got {
+		t.Errorf("want sample count %d in reqDur, got %d", want, got)
+	}
+	out.Reset()
+	reqCnt.WithLabelValues("get", "500").Write(out)
+	if want, got := 1., out.Counter.GetValue(); want != got {
+		t.Errorf("want reqCnt of %f, got %f", want, got)
+	}
+}
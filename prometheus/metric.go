@@ -14,7 +14,10 @@
 package prometheus
 
 import (
+	"fmt"
+	"io"
 	"strings"
+	"unicode"
 
 	dto "github.com/prometheus/client_model/go"
 )
@@ -92,8 +95,127 @@ type Opts struct {
 	// that label most likely should not be a label at all (but part of the
 	// metric name).
 	ConstLabels Labels
+
+	// DeprecatedVersion marks this metric as deprecated since the given
+	// version (of the instrumented program, not of this library). If set,
+	// the text format exposition announces the deprecation with a
+	// "# DEPRECATED since version ..." comment line preceding the metric
+	// family. See also DeprecatedCollector.
+	DeprecatedVersion string
+
+	// TrackLastObserved, if true, makes each child of a metric vector
+	// (like CounterVec or GaugeVec) record the time it was last updated,
+	// so that stale children can be deleted with the DeleteExpired method
+	// of MetricVec. It has no effect for metrics that are not vectors.
+	TrackLastObserved bool
+
+	// LabelAllowlist maps names of variable labels to their allowed
+	// values. Children of a vector with any other value for such a label
+	// are handled according to FallbackBehavior. This protects against an
+	// explosion of the number of children for labels with a small, known
+	// set of valid values, e.g. HTTP methods. All names must be variable
+	// labels, and each needs at least one allowed value. It is used by all
+	// vectors created from CounterOpts, GaugeOpts, or UntypedOpts, except
+	// for the HierarchicalGaugeVec, whose constructor panics if it is set.
+	LabelAllowlist map[string][]string
+
+	// FallbackBehavior determines how values not contained in the
+	// LabelAllowlist are handled. The default is FallbackRemap.
+	FallbackBehavior FallbackBehavior
+
+	// FallbackValue is the value FallbackRemap replaces disallowed label
+	// values with. The default value is DefFallbackValue.
+	FallbackValue string
+
+	// LockFreeHotPath, if true, makes WithLabelValues and
+	// GetMetricWithLabelValues look up existing children without locking,
+	// so that concurrent accesses to existing children do not serialize on
+	// the lock of the vector. In return, each creation or deletion of a
+	// child copies the map of all children, which is expensive for vectors
+	// with many children or frequent child creation. Like LabelAllowlist,
+	// it is not supported by NewHierarchicalGaugeVec.
+	LockFreeHotPath bool
+
+	// TrackRate, if true, makes each child of a CounterVec record the time
+	// and value of its most recent updates, so that the Rate method of
+	// CounterVec can estimate its per-second rate in-process. It is only
+	// used by NewCounterVec.
+	TrackRate bool
+
+	// RateSamples is the number of updates recorded per child if TrackRate
+	// is true. The default value is DefRateSamples.
+	RateSamples int
+
+	// HashSeed, if not zero, is mixed into the hash of the label values
+	// that identifies the children of a metric vector. Changing it
+	// changes which label value combinations collide (which is extremely
+	// rare), so that tests and benchmarks generating arbitrary label
+	// values can pick a seed that is known to work for them. The default
+	// of zero results in the unseeded FNV-1a hash. It is used by
+	// NewCounterVec, NewGaugeVec, and NewUntypedVec.
+	HashSeed uint64
+}
+
+// DirectEncoder is an optional interface for Metrics that can write their
+// samples in the text format directly, without creating a dto.Metric
+// first. This is an opt-in fast path for custom exposition loops, e.g. for
+// backends that consume the text format at a high rate. It does not change
+// the regular collection via Write. The Histogram created by NewHistogram
+// implements DirectEncoder.
+type DirectEncoder interface {
+	// EncodeMetric writes the samples of the Metric in the text format
+	// to the provided io.Writer, one line per sample. The HELP and TYPE
+	// lines of the metric family are not written, as they are the same
+	// for all Metrics of the same family.
+	EncodeMetric(w io.Writer) error
+}
+
+// writeTextSample writes a single sample in the text format to w, given the
+// metric name, the (sorted) label pairs, optionally an additional label name
+// and value (use empty strings if not required), and the value. Like in the
+// text package, the value is a float64 or, for counts, a uint64, which is
+// written exactly.
+func writeTextSample(
+	w io.Writer,
+	name string,
+	labelPairs []*dto.LabelPair,
+	additionalLabelName, additionalLabelValue string,
+	value interface{},
+) error {
+	if _, err := io.WriteString(w, name); err != nil {
+		return err
+	}
+	separator := '{'
+	for _, lp := range labelPairs {
+		if _, err := fmt.Fprintf(
+			w, `%c%s="%s"`,
+			separator, lp.GetName(), labelValueEscaper.Replace(lp.GetValue()),
+		); err != nil {
+			return err
+		}
+		separator = ','
+	}
+	if additionalLabelName != "" {
+		if _, err := fmt.Fprintf(
+			w, `%c%s="%s"`,
+			separator, additionalLabelName,
+			labelValueEscaper.Replace(additionalLabelValue),
+		); err != nil {
+			return err
+		}
+		separator = ','
+	}
+	if separator == ',' {
+		if _, err := io.WriteString(w, "}"); err != nil {
+			return err
+		}
+	}
+	_, err := fmt.Fprintf(w, " %v\n", value)
+	return err
 }
 
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+
 // BuildFQName joins the given three name components by "_". Empty name
 // components are ignored. If the name parameter itself is empty, an empty
 // string is returned, no matter what. Metric implementations included in this
@@ -116,6 +238,57 @@ func BuildFQName(namespace, subsystem, name string) string {
 	return name
 }
 
+// MetricNameToSnakeCase converts a camelCase (or CamelCase) name, as used by
+// many other monitoring systems, into the snake_case convention of Prometheus
+// metric names. An underscore is inserted before an upper-case letter that
+// follows a lower-case letter or a digit, and before the last upper-case letter
+// of a sequence of upper-case letters that is followed by a lower-case letter,
+// so that "HTTPRequest" becomes "http_request" and "request2Seconds" becomes
+// "request2_seconds". All letters are converted to lower case. Names without
+// upper-case letters are returned unchanged, so the conversion is idempotent.
+func MetricNameToSnakeCase(s string) string {
+	if strings.IndexFunc(s, unicode.IsUpper) == -1 {
+		return s
+	}
+	runes := []rune(s)
+	result := make([]rune, 0, len(runes)+len(runes)/2)
+	for i, r := range runes {
+		if unicode.IsUpper(r) && i > 0 {
+			prev := runes[i-1]
+			nextIsLower := i+1 < len(runes) && unicode.IsLower(runes[i+1])
+			if unicode.IsLower(prev) || unicode.IsDigit(prev) ||
+				(unicode.IsUpper(prev) && nextIsLower) {
+				result = append(result, '_')
+			}
+		}
+		result = append(result, unicode.ToLower(r))
+	}
+	return string(result)
+}
+
+// MetricNameToCamelCase converts a snake_case name into camelCase. It is the
+// inverse of MetricNameToSnakeCase for names without sequences of upper-case
+// letters, i.e. "http_request" becomes "httpRequest" rather than
+// "HTTPRequest". Each underscore followed by a letter is removed, and the letter
+// is converted to upper case. Other underscores are kept. Names without
+// underscores are returned unchanged.
+func MetricNameToCamelCase(s string) string {
+	if strings.IndexByte(s, '_') == -1 {
+		return s
+	}
+	runes := []rune(s)
+	result := make([]rune, 0, len(runes))
+	for i := 0; i < len(runes); i++ {
+		if runes[i] == '_' && i+1 < len(runes) && unicode.IsLetter(runes[i+1]) {
+			i++
+			result = append(result, unicode.ToUpper(runes[i]))
+			continue
+		}
+		result = append(result, runes[i])
+	}
+	return string(result)
+}
+
 // LabelPairSorter implements sort.Interface. It is used to sort a slice of
 // dto.LabelPair pointers. This is useful for implementing the Write method of
 // custom metrics.
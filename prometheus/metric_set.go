@@ -0,0 +1,215 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package prometheus
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+// MetricSet declares a logical group of related metrics, e.g. "HTTP server
+// metrics", as a single unit. All metrics added to a MetricSet share its
+// Namespace, Subsystem, ConstLabels, and DeprecatedVersion, and the whole set
+// can be registered at once and documented with DocumentationTable.
+//
+// The exported fields are applied to metrics when they are added, so set them
+// before calling Add. Create instances with NewMetricSet.
+type MetricSet struct {
+	// Namespace and Subsystem are used for added metrics that do not set
+	// their own.
+	Namespace string
+	Subsystem string
+
+	// ConstLabels are added to the ConstLabels of each added metric. The
+	// ConstLabels of a metric take precedence over these.
+	ConstLabels Labels
+
+	// DeprecatedVersion is used for added metrics that do not set their
+	// own.
+	DeprecatedVersion string
+
+	name, description string
+	entries           []metricSetEntry
+}
+
+type metricSetEntry struct {
+	collector                    Collector
+	name, typ, help, deprecation string
+}
+
+// NewMetricSet creates a new, empty MetricSet with the given name and
+// description, which are used for its documentation.
+func NewMetricSet(name, description string) *MetricSet {
+	return &MetricSet{name: name, description: description}
+}
+
+// Add creates a metric from the provided options, which must be a pointer to
+// CounterOpts, GaugeOpts, UntypedOpts, HistogramOpts, or SummaryOpts, and adds
+// it to the MetricSet. The provided options are not modified. The created
+// metric is returned, so that it can be type-asserted to the Counter, Gauge,
+// Untyped, Histogram, or Summary it is. Add panics for other option types and
+// under the same conditions as the constructor of the respective metric.
+func (s *MetricSet) Add(opts interface{}) Collector {
+	var (
+		c                          Collector
+		typ                        string
+		namespace, subsystem, name string
+		help, deprecatedVersion    string
+	)
+	switch o := opts.(type) {
+	case *CounterOpts:
+		co := *o
+		s.applyTo((*Opts)(&co))
+		c, typ = NewCounter(co), "counter"
+		namespace, subsystem, name = co.Namespace, co.Subsystem, co.Name
+		help, deprecatedVersion = co.Help, co.DeprecatedVersion
+	case *GaugeOpts:
+		g := *o
+		s.applyTo((*Opts)(&g))
+		c, typ = NewGauge(g), "gauge"
+		namespace, subsystem, name = g.Namespace, g.Subsystem, g.Name
+		help, deprecatedVersion = g.Help, g.DeprecatedVersion
+	case *UntypedOpts:
+		u := *o
+		s.applyTo((*Opts)(&u))
+		c, typ = NewUntyped(u), "untyped"
+		namespace, subsystem, name = u.Namespace, u.Subsystem, u.Name
+		help, deprecatedVersion = u.Help, u.DeprecatedVersion
+	case *HistogramOpts:
+		h := *o
+		h.Namespace, h.Subsystem, h.DeprecatedVersion = s.defaults(h.Namespace, h.Subsystem, h.DeprecatedVersion)
+		h.ConstLabels = s.constLabels(h.ConstLabels)
+		c, typ = NewHistogram(h), "histogram"
+		namespace, subsystem, name = h.Namespace, h.Subsystem, h.Name
+		help, deprecatedVersion = h.Help, h.DeprecatedVersion
+	case *SummaryOpts:
+		su := *o
+		su.Namespace, su.Subsystem, su.DeprecatedVersion = s.defaults(su.Namespace, su.Subsystem, su.DeprecatedVersion)
+		su.ConstLabels = s.constLabels(su.ConstLabels)
+		c, typ = NewSummary(su), "summary"
+		namespace, subsystem, name = su.Namespace, su.Subsystem, su.Name
+		help, deprecatedVersion = su.Help, su.DeprecatedVersion
+	default:
+		panic(fmt.Errorf("metric set %q cannot add metric with options of type %T", s.name, opts))
+	}
+	s.entries = append(s.entries, metricSetEntry{
+		collector:   c,
+		name:        BuildFQName(namespace, subsystem, name),
+		typ:         typ,
+		help:        help,
+		deprecation: deprecatedVersion,
+	})
+	return c
+}
+
+// applyTo applies the shared settings of the MetricSet to the provided Opts.
+func (s *MetricSet) applyTo(opts *Opts) {
+	opts.Namespace, opts.Subsystem, opts.DeprecatedVersion = s.defaults(opts.Namespace, opts.Subsystem, opts.DeprecatedVersion)
+	opts.ConstLabels = s.constLabels(opts.ConstLabels)
+}
+
+func (s *MetricSet) defaults(namespace, subsystem, deprecatedVersion string) (string, string, string) {
+	if namespace == "" {
+		namespace = s.Namespace
+	}
+	if subsystem == "" {
+		subsystem = s.Subsystem
+	}
+	if deprecatedVersion == "" {
+		deprecatedVersion = s.DeprecatedVersion
+	}
+	return namespace, subsystem, deprecatedVersion
+}
+
+func (s *MetricSet) constLabels(labels Labels) Labels {
+	if len(s.ConstLabels) == 0 {
+		return labels
+	}
+	merged := make(Labels, len(s.ConstLabels)+len(labels))
+	for name, value := range s.ConstLabels {
+		merged[name] = value
+	}
+	for name, value := range labels {
+		merged[name] = value
+	}
+	return merged
+}
+
+// Register registers all metrics of the MetricSet with the default
+// registry. If one of them cannot be registered, the ones registered before
+// are unregistered again, and the error is returned.
+func (s *MetricSet) Register() error {
+	return s.register(defRegistry)
+}
+
+func (s *MetricSet) register(r *registry) error {
+	for i, e := range s.entries {
+		if _, err := r.Register(e.collector); err != nil {
+			for _, registered := range s.entries[:i] {
+				r.Unregister(registered.collector)
+			}
+			return fmt.Errorf("metric set %q: cannot register %s: %s", s.name, e.name, err)
+		}
+	}
+	return nil
+}
+
+// DocumentationTable returns a Markdown section documenting the MetricSet. It
+// consists of a heading with the name of the MetricSet, its description, and
+// a table with the name, type, unit, and help string of each metric in the
+// order they were added. The unit is derived from the suffix of the metric
+// name (e.g. "seconds" for "http_request_duration_seconds") and left empty if
+// the name does not end with a known base unit.
+func (s *MetricSet) DocumentationTable() string {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "## %s\n\n", s.name)
+	if s.description != "" {
+		fmt.Fprintf(&buf, "%s\n\n", s.description)
+	}
+	buf.WriteString("| Name | Type | Unit | Help |\n")
+	buf.WriteString("| --- | --- | --- | --- |\n")
+	for _, e := range s.entries {
+		help := e.help
+		if e.deprecation != "" {
+			help += " (deprecated since " + e.deprecation + ")"
+		}
+		fmt.Fprintf(
+			&buf, "| `%s` | %s | %s | %s |\n",
+			e.name, e.typ, metricUnit(e.name), markdownCellEscaper.Replace(help),
+		)
+	}
+	return buf.String()
+}
+
+var (
+	markdownCellEscaper = strings.NewReplacer("|", `\|`, "\n", " ")
+
+	baseUnits = []string{
+		"seconds", "bytes", "ratio", "celsius", "meters", "grams",
+		"volts", "amperes", "joules",
+	}
+)
+
+// metricUnit returns the base unit the provided metric name ends with,
+// ignoring a "_total" suffix, or "" if it does not end with one.
+func metricUnit(name string) string {
+	name = strings.TrimSuffix(name, "_total")
+	for _, unit := range baseUnits {
+		if strings.HasSuffix(name, "_"+unit) {
+			return unit
+		}
+	}
+	return ""
+}
@@ -0,0 +1,86 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package prometheus
+
+import "testing"
+
+func TestMetricSet(t *testing.T) {
+	set := NewMetricSet("HTTP server metrics", "Metrics of the HTTP server.")
+	set.Namespace = "http"
+	set.ConstLabels = Labels{"server": "api"}
+
+	requests := set.Add(&CounterOpts{
+		Name: "requests_total",
+		Help: "Total number of requests.",
+	}).(Counter)
+	set.Add(&HistogramOpts{
+		Name: "request_duration_seconds",
+		Help: "Request latency | in seconds.",
+	})
+	set.Add(&GaugeOpts{
+		Namespace:         "legacy",
+		Name:              "connections",
+		Help:              "Open connections.",
+		DeprecatedVersion: "0.8.0",
+	})
+
+	if got, want := requests.Desc().fqName, "http_requests_total"; got != want {
+		t.Errorf("got name %q, want %q", got, want)
+	}
+	if got, want := requests.Desc().constLabelPairs[0].GetValue(), "api"; got != want {
+		t.Errorf("got label value %q, want %q", got, want)
+	}
+
+	want := `## HTTP server metrics
+
+Metrics of the HTTP server.
+
+| Name | Type | Unit | Help |
+| --- | --- | --- | --- |
+| ` + "`http_requests_total`" + ` | counter |  | Total number of requests. |
+| ` + "`http_request_duration_seconds`" + ` | histogram | seconds | Request latency \| in seconds. |
+| ` + "`legacy_connections`" + ` | gauge |  | Open connections. (deprecated since 0.8.0) |
+`
+	if got := set.DocumentationTable(); got != want {
+		t.Errorf("got documentation\n%s\nwant\n%s", got, want)
+	}
+
+	reg := newRegistry()
+	if err := set.register(reg); err != nil {
+		t.Fatal(err)
+	}
+	// Registering again fails without leaving anything registered.
+	if err := set.register(reg); err == nil {
+		t.Error("expected error when registering twice")
+	}
+	reg = newRegistry()
+	dup := NewMetricSet("dup", "")
+	dup.Add(&GaugeOpts{Name: "a", Help: "help"})
+	dup.Add(&GaugeOpts{Name: "a", Help: "help"})
+	if err := dup.register(reg); err == nil {
+		t.Fatal("expected error for duplicate metric")
+	}
+	if len(reg.collectorsByID) != 0 {
+		t.Errorf("got %d registered collectors, want 0", len(reg.collectorsByID))
+	}
+
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Error("expected panic for unsupported options")
+			}
+		}()
+		set.Add(Opts{Name: "x", Help: "help"})
+	}()
+}
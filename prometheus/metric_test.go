@@ -33,3 +33,44 @@ func TestBuildFQName(t *testing.T) {
 		}
 	}
 }
+
+func TestMetricNameToSnakeCase(t *testing.T) {
+	scenarios := []struct{ in, out string }{
+		{"camelCaseName", "camel_case_name"},
+		{"CamelCaseName", "camel_case_name"},
+		{"HTTPRequest", "http_request"},
+		{"requestHTTP", "request_http"},
+		{"request2Seconds", "request2_seconds"},
+		{"already_snake_case", "already_snake_case"},
+		{"mixed_caseName", "mixed_case_name"},
+		{"größeÄnderung", "größe_änderung"},
+		{"", ""},
+	}
+	for i, s := range scenarios {
+		if got := MetricNameToSnakeCase(s.in); got != s.out {
+			t.Errorf("%d. want %s, got %s", i, s.out, got)
+		}
+		if got := MetricNameToSnakeCase(s.out); got != s.out {
+			t.Errorf("%d. conversion of %s not idempotent, got %s", i, s.out, got)
+		}
+	}
+}
+
+func TestMetricNameToCamelCase(t *testing.T) {
+	scenarios := []struct{ in, out string }{
+		{"camel_case_name", "camelCaseName"},
+		{"http_request", "httpRequest"},
+		{"request2_seconds", "request2Seconds"},
+		{"_leading", "Leading"},
+		{"trailing_", "trailing_"},
+		{"before_2_digit", "before_2Digit"},
+		{"größe_änderung", "größeÄnderung"},
+		{"alreadyCamelCase", "alreadyCamelCase"},
+		{"", ""},
+	}
+	for i, s := range scenarios {
+		if got := MetricNameToCamelCase(s.in); got != s.out {
+			t.Errorf("%d. want %s, got %s", i, s.out, got)
+		}
+	}
+}
@@ -0,0 +1,94 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package prometheus
+
+import (
+	"sync"
+	"time"
+)
+
+// InstrumentedRWMutex is a sync.RWMutex that records the time spent waiting
+// for the lock and the time the write lock was held in a Histogram. Create
+// instances with NewInstrumentedRWMutex. An InstrumentedRWMutex must not be
+// copied after first use.
+type InstrumentedRWMutex struct {
+	mtx sync.RWMutex
+
+	writeWait, readWait, writeHold Histogram
+
+	// locked is the time the write lock was acquired. It is only accessed
+	// while holding the write lock.
+	locked time.Time
+}
+
+// NewInstrumentedRWMutex returns a new InstrumentedRWMutex that records its
+// durations in the provided HistogramVec, which has to be partitioned by the
+// label names "mutex" and "type". The "mutex" label is set to the provided
+// name so that many mutexes can share one HistogramVec. The "type" label is
+// set to "write" or "read" for the time Lock or RLock, respectively, waited
+// for the lock, and to "write_hold" for the time between Lock and Unlock.
+// (The time a read lock is held is not recorded because RUnlock cannot tell
+// which of the concurrent readers releases the lock.)
+//
+// The HistogramVec is not registered by NewInstrumentedRWMutex. The function
+// panics if the HistogramVec is not partitioned by the label names described
+// above.
+func NewInstrumentedRWMutex(h *HistogramVec, name string) *InstrumentedRWMutex {
+	return &InstrumentedRWMutex{
+		writeWait: h.With(Labels{"mutex": name, "type": "write"}),
+		readWait:  h.With(Labels{"mutex": name, "type": "read"}),
+		writeHold: h.With(Labels{"mutex": name, "type": "write_hold"}),
+	}
+}
+
+// Lock locks the mutex for writing and records the time spent waiting for the
+// lock. See sync.RWMutex for details.
+func (m *InstrumentedRWMutex) Lock() {
+	begin := time.Now()
+	m.mtx.Lock()
+	m.locked = time.Now()
+	m.writeWait.Observe(m.locked.Sub(begin).Seconds())
+}
+
+// Unlock unlocks the mutex for writing and records the time the write lock was
+// held. See sync.RWMutex for details.
+func (m *InstrumentedRWMutex) Unlock() {
+	held := time.Since(m.locked)
+	m.mtx.Unlock()
+	m.writeHold.Observe(held.Seconds())
+}
+
+// RLock locks the mutex for reading and records the time spent waiting for the
+// lock. See sync.RWMutex for details.
+func (m *InstrumentedRWMutex) RLock() {
+	begin := time.Now()
+	m.mtx.RLock()
+	m.readWait.Observe(time.Since(begin).Seconds())
+}
+
+// RUnlock undoes a single RLock call. See sync.RWMutex for details.
+func (m *InstrumentedRWMutex) RUnlock() {
+	m.mtx.RUnlock()
+}
+
+// RLocker returns a sync.Locker interface that implements the Lock and Unlock
+// methods by calling RLock and RUnlock.
+func (m *InstrumentedRWMutex) RLocker() sync.Locker {
+	return (*rlocker)(m)
+}
+
+type rlocker InstrumentedRWMutex
+
+func (r *rlocker) Lock()   { (*InstrumentedRWMutex)(r).RLock() }
+func (r *rlocker) Unlock() { (*InstrumentedRWMutex)(r).RUnlock() }
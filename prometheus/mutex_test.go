@@ -0,0 +1,45 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package prometheus
+
+import (
+	"sync"
+	"testing"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+func TestInstrumentedRWMutex(t *testing.T) {
+	vec := NewHistogramVec(
+		HistogramOpts{Name: "mutex_seconds", Help: "test help"},
+		[]string{"mutex", "type"},
+	)
+	var mtx sync.Locker = NewInstrumentedRWMutex(vec, "cache")
+
+	mtx.Lock()
+	mtx.Unlock()
+	mtx.Lock()
+	mtx.Unlock()
+	rl := mtx.(*InstrumentedRWMutex).RLocker()
+	rl.Lock()
+	rl.Unlock()
+
+	for typ, want := range map[string]uint64{"write": 2, "write_hold": 2, "read": 1} {
+		m := &dto.Metric{}
+		vec.WithLabelValues("cache", typ).Write(m)
+		if got := m.GetHistogram().GetSampleCount(); got != want {
+			t.Errorf("got %d observations for type %q, want %d", got, typ, want)
+		}
+	}
+}
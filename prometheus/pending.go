@@ -0,0 +1,236 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package prometheus
+
+import (
+	"fmt"
+	"sync"
+)
+
+// pendingRegistration registers a Collector with the default registry upon
+// first use. It is the building block of PendingCounterVec, PendingGaugeVec,
+// and PendingHistogramVec.
+type pendingRegistration struct {
+	mtx              sync.Mutex
+	collector        Collector
+	registered       bool
+	closed           bool
+	register         func(Collector) error
+	unregister       func(Collector) bool
+	typeName, fqName string
+}
+
+func newPendingRegistration(c Collector, typeName string, desc *Desc) pendingRegistration {
+	return pendingRegistration{
+		collector:  c,
+		register:   Register,
+		unregister: Unregister,
+		typeName:   typeName,
+		fqName:     desc.fqName,
+	}
+}
+
+// use registers the Collector if that has not happened yet. It returns an error
+// if the registration fails and panics if Close has been called before.
+func (p *pendingRegistration) use() error {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	if p.closed {
+		panic(fmt.Errorf("%s %q used after Close", p.typeName, p.fqName))
+	}
+	if p.registered {
+		return nil
+	}
+	if err := p.register(p.collector); err != nil {
+		return err
+	}
+	p.registered = true
+	return nil
+}
+
+func (p *pendingRegistration) mustUse() {
+	if err := p.use(); err != nil {
+		panic(err)
+	}
+}
+
+// Close unregisters the vector if it has been registered. Any use of the vector
+// after Close panics.
+func (p *pendingRegistration) Close() {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	if p.registered {
+		p.unregister(p.collector)
+	}
+	p.closed = true
+}
+
+// PendingCounterVec is a CounterVec that is not registered upon creation but
+// registers itself with the default registry when it is used for the first
+// time, i.e. upon the first call of GetMetricWithLabelValues, GetMetricWith,
+// WithLabelValues, or With. This is useful for libraries that create metrics
+// in init functions without knowing whether they will ever be used. Call Close
+// to unregister the PendingCounterVec. Any later use panics.
+type PendingCounterVec struct {
+	*CounterVec
+	pendingRegistration
+}
+
+// NewPendingCounterVec creates a new PendingCounterVec based on the provided
+// CounterOpts and partitioned by the given label names. See NewCounterVec.
+func NewPendingCounterVec(opts CounterOpts, labelNames []string) *PendingCounterVec {
+	v := NewCounterVec(opts, labelNames)
+	return &PendingCounterVec{
+		CounterVec:          v,
+		pendingRegistration: newPendingRegistration(v, "PendingCounterVec", v.desc),
+	}
+}
+
+// GetMetricWithLabelValues works as the method of the same name in CounterVec,
+// but registers the PendingCounterVec first if needed. It returns an error
+// if the registration fails.
+func (m *PendingCounterVec) GetMetricWithLabelValues(lvs ...string) (Counter, error) {
+	if err := m.use(); err != nil {
+		return nil, err
+	}
+	return m.CounterVec.GetMetricWithLabelValues(lvs...)
+}
+
+// GetMetricWith works as the method of the same name in CounterVec, but
+// registers the PendingCounterVec first if needed. It returns an error if the
+// registration fails.
+func (m *PendingCounterVec) GetMetricWith(labels Labels) (Counter, error) {
+	if err := m.use(); err != nil {
+		return nil, err
+	}
+	return m.CounterVec.GetMetricWith(labels)
+}
+
+// WithLabelValues works as GetMetricWithLabelValues, but panics where
+// GetMetricWithLabelValues would have returned an error.
+func (m *PendingCounterVec) WithLabelValues(lvs ...string) Counter {
+	m.mustUse()
+	return m.CounterVec.WithLabelValues(lvs...)
+}
+
+// With works as GetMetricWith, but panics where GetMetricWith would have
+// returned an error.
+func (m *PendingCounterVec) With(labels Labels) Counter {
+	m.mustUse()
+	return m.CounterVec.With(labels)
+}
+
+// PendingGaugeVec is a GaugeVec that registers itself upon first use. See
+// PendingCounterVec for details.
+type PendingGaugeVec struct {
+	*GaugeVec
+	pendingRegistration
+}
+
+// NewPendingGaugeVec creates a new PendingGaugeVec based on the provided
+// GaugeOpts and partitioned by the given label names. See NewGaugeVec.
+func NewPendingGaugeVec(opts GaugeOpts, labelNames []string) *PendingGaugeVec {
+	v := NewGaugeVec(opts, labelNames)
+	return &PendingGaugeVec{
+		GaugeVec:            v,
+		pendingRegistration: newPendingRegistration(v, "PendingGaugeVec", v.desc),
+	}
+}
+
+// GetMetricWithLabelValues works as the method of the same name in GaugeVec,
+// but registers the PendingGaugeVec first if needed. It returns an error
+// if the registration fails.
+func (m *PendingGaugeVec) GetMetricWithLabelValues(lvs ...string) (Gauge, error) {
+	if err := m.use(); err != nil {
+		return nil, err
+	}
+	return m.GaugeVec.GetMetricWithLabelValues(lvs...)
+}
+
+// GetMetricWith works as the method of the same name in GaugeVec, but
+// registers the PendingGaugeVec first if needed. It returns an error if the
+// registration fails.
+func (m *PendingGaugeVec) GetMetricWith(labels Labels) (Gauge, error) {
+	if err := m.use(); err != nil {
+		return nil, err
+	}
+	return m.GaugeVec.GetMetricWith(labels)
+}
+
+// WithLabelValues works as GetMetricWithLabelValues, but panics where
+// GetMetricWithLabelValues would have returned an error.
+func (m *PendingGaugeVec) WithLabelValues(lvs ...string) Gauge {
+	m.mustUse()
+	return m.GaugeVec.WithLabelValues(lvs...)
+}
+
+// With works as GetMetricWith, but panics where GetMetricWith would have
+// returned an error.
+func (m *PendingGaugeVec) With(labels Labels) Gauge {
+	m.mustUse()
+	return m.GaugeVec.With(labels)
+}
+
+// PendingHistogramVec is a HistogramVec that registers itself upon first use. See
+// PendingCounterVec for details.
+type PendingHistogramVec struct {
+	*HistogramVec
+	pendingRegistration
+}
+
+// NewPendingHistogramVec creates a new PendingHistogramVec based on the provided
+// HistogramOpts and partitioned by the given label names. See NewHistogramVec.
+func NewPendingHistogramVec(opts HistogramOpts, labelNames []string) *PendingHistogramVec {
+	v := NewHistogramVec(opts, labelNames)
+	return &PendingHistogramVec{
+		HistogramVec:        v,
+		pendingRegistration: newPendingRegistration(v, "PendingHistogramVec", v.desc),
+	}
+}
+
+// GetMetricWithLabelValues works as the method of the same name in HistogramVec,
+// but registers the PendingHistogramVec first if needed. It returns an error
+// if the registration fails.
+func (m *PendingHistogramVec) GetMetricWithLabelValues(lvs ...string) (Histogram, error) {
+	if err := m.use(); err != nil {
+		return nil, err
+	}
+	return m.HistogramVec.GetMetricWithLabelValues(lvs...)
+}
+
+// GetMetricWith works as the method of the same name in HistogramVec, but
+// registers the PendingHistogramVec first if needed. It returns an error if the
+// registration fails.
+func (m *PendingHistogramVec) GetMetricWith(labels Labels) (Histogram, error) {
+	if err := m.use(); err != nil {
+		return nil, err
+	}
+	return m.HistogramVec.GetMetricWith(labels)
+}
+
+// WithLabelValues works as GetMetricWithLabelValues, but panics where
+// GetMetricWithLabelValues would have returned an error.
+func (m *PendingHistogramVec) WithLabelValues(lvs ...string) Histogram {
+	m.mustUse()
+	return m.HistogramVec.WithLabelValues(lvs...)
+}
+
+// With works as GetMetricWith, but panics where GetMetricWith would have
+// returned an error.
+func (m *PendingHistogramVec) With(labels Labels) Histogram {
+	m.mustUse()
+	return m.HistogramVec.With(labels)
+}
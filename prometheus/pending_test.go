@@ -0,0 +1,60 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package prometheus
+
+import "testing"
+
+func TestPendingCounterVec(t *testing.T) {
+	registry := newRegistry()
+	vec := NewPendingCounterVec(CounterOpts{Name: "test", Help: "helpless"}, []string{"code"})
+	vec.register = func(c Collector) error {
+		_, err := registry.Register(c)
+		return err
+	}
+	vec.unregister = registry.Unregister
+
+	if got, want := len(registry.collectorsByID), 0; got != want {
+		t.Fatalf("got %d registered collectors before first use, want %d", got, want)
+	}
+	vec.WithLabelValues("200").Inc()
+	vec.With(Labels{"code": "404"}).Inc()
+	if got, want := len(registry.collectorsByID), 1; got != want {
+		t.Fatalf("got %d registered collectors after first use, want %d", got, want)
+	}
+
+	vec.Close()
+	if got, want := len(registry.collectorsByID), 0; got != want {
+		t.Errorf("got %d registered collectors after Close, want %d", got, want)
+	}
+	defer func() {
+		if recover() == nil {
+			t.Error("expected panic for use after Close")
+		}
+	}()
+	vec.WithLabelValues("200")
+}
+
+func TestPendingGaugeVecRegistrationError(t *testing.T) {
+	registry := newRegistry()
+	registry.Register(NewGauge(GaugeOpts{Name: "test", Help: "other help"}))
+	vec := NewPendingGaugeVec(GaugeOpts{Name: "test", Help: "helpless"}, []string{"code"})
+	vec.register = func(c Collector) error {
+		_, err := registry.Register(c)
+		return err
+	}
+
+	if _, err := vec.GetMetricWithLabelValues("200"); err == nil {
+		t.Error("expected registration error")
+	}
+}
@@ -0,0 +1,238 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package prometheus
+
+import (
+	"log"
+	"sort"
+	"strings"
+	"sync"
+
+	dto "github.com/prometheus/client_model/go"
+
+	"github.com/prometheus/client_golang/model"
+)
+
+// PersistentStore is a key-value store for the values of the Counters in a
+// PersistentCounterVec. Get returns 0 and no error for keys that have never
+// been set. Implementations must be safe for concurrent use.
+type PersistentStore interface {
+	Get(key string) (float64, error)
+	Set(key string, value float64) error
+}
+
+// PersistentStoreLister is a PersistentStore that can also list all keys it
+// has stored. NewPersistentCounterVec restores all previously persisted
+// Counters right away if its store implements PersistentStoreLister. For
+// other stores, a Counter is restored when it is first used.
+type PersistentStoreLister interface {
+	PersistentStore
+	Keys() ([]string, error)
+}
+
+// PersistentCounterVec is a CounterVec whose Counters persist their values to
+// a PersistentStore and restore them on creation. A process that restarts
+// with the same store thus continues its counts rather than starting from 0,
+// which avoids spurious resets in rate calculations. Create instances with
+// NewPersistentCounterVec.
+//
+// Updates are written to the store asynchronously. Each Counter is written
+// with its latest value, so intermediate values might never be written. Call
+// Flush, e.g. on shutdown, to write all pending updates. Deleting a Counter
+// from the PersistentCounterVec does not delete its value from the store.
+type PersistentCounterVec struct {
+	*CounterVec
+	store  PersistentStore
+	prefix string // Key prefix of this PersistentCounterVec.
+	size   int    // Number of label values.
+
+	mtx     sync.Mutex         // Protects dirty and writing.
+	dirty   map[string]Counter // Counters to be written by key.
+	writing bool
+
+	writeMtx sync.Mutex // Serializes writes to the store.
+}
+
+// NewPersistentCounterVec creates a new PersistentCounterVec based on the
+// provided CounterOpts, partitioned by the given label names, and backed by
+// the provided PersistentStore. See NewCounterVec.
+//
+// The store keys are the fully-qualified name of the Counters, followed by
+// the label values, separated by model.SeparatorByte. Several
+// PersistentCounterVecs may therefore share a store. Errors returned by the
+// store are logged, and a Counter that cannot be restored starts from 0.
+func NewPersistentCounterVec(opts CounterOpts, labelNames []string, store PersistentStore) *PersistentCounterVec {
+	v := NewCounterVec(opts, labelNames)
+	m := &PersistentCounterVec{
+		CounterVec: v,
+		store:      store,
+		prefix:     v.desc.fqName + string(model.SeparatorByte),
+		size:       len(labelNames),
+		dirty:      map[string]Counter{},
+	}
+	newMetric := v.newMetric
+	v.newMetric = func(lvs ...string) Metric {
+		c := &persistentCounter{
+			Counter: newMetric(lvs...).(Counter),
+			vec:     m,
+			key:     m.prefix + strings.Join(lvs, string(model.SeparatorByte)),
+		}
+		initial, err := store.Get(c.key)
+		if err != nil {
+			log.Printf("error restoring counter %q: %s", c.key, err)
+		}
+		if initial > 0 {
+			c.Counter.Set(initial)
+		}
+		return c
+	}
+
+	lister, ok := store.(PersistentStoreLister)
+	if !ok {
+		return m
+	}
+	keys, err := lister.Keys()
+	if err != nil {
+		log.Printf("error listing keys of persistent store: %s", err)
+		return m
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if !strings.HasPrefix(key, m.prefix) {
+			continue
+		}
+		lvs := strings.Split(key[len(m.prefix):], string(model.SeparatorByte))
+		if len(lvs) != m.size {
+			continue
+		}
+		if _, err := m.GetMetricWithLabelValues(lvs...); err != nil {
+			log.Printf("error restoring counter %q: %s", key, err)
+		}
+	}
+	return m
+}
+
+// Flush writes all pending updates to the store synchronously. It returns the
+// first error returned by the store. Updates that failed are not retried.
+func (m *PersistentCounterVec) Flush() error {
+	return m.write()
+}
+
+// markDirty schedules c to be written to the store and starts the background
+// writer if it is not running yet.
+func (m *PersistentCounterVec) markDirty(key string, c Counter) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	m.dirty[key] = c
+	if !m.writing {
+		m.writing = true
+		go m.writeLoop()
+	}
+}
+
+// writeLoop writes pending updates until there are none left.
+func (m *PersistentCounterVec) writeLoop() {
+	for {
+		m.mtx.Lock()
+		if len(m.dirty) == 0 {
+			m.writing = false
+			m.mtx.Unlock()
+			return
+		}
+		m.mtx.Unlock()
+		if err := m.write(); err != nil {
+			log.Printf("error persisting counters: %s", err)
+		}
+	}
+}
+
+// write writes the current values of all pending Counters to the store. As
+// writes are serialized and the values are read while holding writeMtx, an
+// older value never overwrites a newer one.
+func (m *PersistentCounterVec) write() error {
+	m.writeMtx.Lock()
+	defer m.writeMtx.Unlock()
+
+	m.mtx.Lock()
+	dirty := m.dirty
+	m.dirty = map[string]Counter{}
+	m.mtx.Unlock()
+
+	var firstErr error
+	for key, c := range dirty {
+		metric := &dto.Metric{}
+		if err := c.Write(metric); err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		if err := m.store.Set(key, metric.GetCounter().GetValue()); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// persistentCounter is a Counter that schedules a write of its value to the
+// store of its PersistentCounterVec upon each update.
+type persistentCounter struct {
+	Counter
+	vec *PersistentCounterVec
+	key string
+}
+
+func (c *persistentCounter) Set(v float64) { c.Counter.Set(v); c.vec.markDirty(c.key, c.Counter) }
+func (c *persistentCounter) Inc()          { c.Counter.Inc(); c.vec.markDirty(c.key, c.Counter) }
+func (c *persistentCounter) Add(v float64) { c.Counter.Add(v); c.vec.markDirty(c.key, c.Counter) }
+
+// InMemoryPersistentStore is a PersistentStoreLister that keeps all values in
+// memory. It is meant as a stub for testing. Create instances with
+// NewInMemoryPersistentStore.
+type InMemoryPersistentStore struct {
+	mtx    sync.RWMutex
+	values map[string]float64
+}
+
+// NewInMemoryPersistentStore creates a new, empty InMemoryPersistentStore.
+func NewInMemoryPersistentStore() *InMemoryPersistentStore {
+	return &InMemoryPersistentStore{values: map[string]float64{}}
+}
+
+// Get implements PersistentStore.
+func (s *InMemoryPersistentStore) Get(key string) (float64, error) {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+	return s.values[key], nil
+}
+
+// Set implements PersistentStore.
+func (s *InMemoryPersistentStore) Set(key string, value float64) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.values[key] = value
+	return nil
+}
+
+// Keys implements PersistentStoreLister.
+func (s *InMemoryPersistentStore) Keys() ([]string, error) {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+	keys := make([]string, 0, len(s.values))
+	for key := range s.values {
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
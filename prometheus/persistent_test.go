@@ -0,0 +1,86 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package prometheus
+
+import (
+	"testing"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+// getOnlyStore is a PersistentStore that cannot list its keys.
+type getOnlyStore struct {
+	store *InMemoryPersistentStore
+}
+
+func (s getOnlyStore) Get(key string) (float64, error) { return s.store.Get(key) }
+func (s getOnlyStore) Set(key string, v float64) error { return s.store.Set(key, v) }
+
+func TestPersistentCounterVec(t *testing.T) {
+	store := NewInMemoryPersistentStore()
+	opts := CounterOpts{Name: "test_counter", Help: "helpless"}
+
+	vec := NewPersistentCounterVec(opts, []string{"code"}, store)
+	vec.WithLabelValues("200").Add(3)
+	vec.WithLabelValues("200").Inc()
+	vec.WithLabelValues("500").Inc()
+	if err := vec.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(store.values), 2; got != want {
+		t.Fatalf("got %d persisted counters, want %d", got, want)
+	}
+
+	// A new PersistentCounterVec with the same store, as after a restart,
+	// restores all counters right away.
+	vec = NewPersistentCounterVec(opts, []string{"code"}, store)
+	ch := make(chan Metric, 2)
+	vec.Collect(ch)
+	if got, want := len(ch), 2; got != want {
+		t.Fatalf("got %d restored counters, want %d", got, want)
+	}
+	vec.WithLabelValues("200").Inc()
+	m := &dto.Metric{}
+	if err := vec.WithLabelValues("200").Write(m); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := m.GetCounter().GetValue(), 5.; got != want {
+		t.Errorf("got value %f, want %f", got, want)
+	}
+	if err := vec.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Without a listing, counters are restored when first used.
+	vec = NewPersistentCounterVec(opts, []string{"code"}, getOnlyStore{store})
+	ch = make(chan Metric, 2)
+	vec.Collect(ch)
+	if got, want := len(ch), 0; got != want {
+		t.Errorf("got %d restored counters, want %d", got, want)
+	}
+	if err := vec.WithLabelValues("200").Write(m); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := m.GetCounter().GetValue(), 5.; got != want {
+		t.Errorf("got value %f, want %f", got, want)
+	}
+
+	// Other PersistentCounterVecs sharing the store are not affected.
+	other := NewPersistentCounterVec(CounterOpts{Name: "other_counter", Help: "helpless"}, []string{"code"}, store)
+	ch = make(chan Metric, 2)
+	other.Collect(ch)
+	if got, want := len(ch), 0; got != want {
+		t.Errorf("got %d restored counters in other vector, want %d", got, want)
+	}
+}
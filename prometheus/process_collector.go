@@ -13,7 +13,11 @@
 
 package prometheus
 
-import "github.com/prometheus/procfs"
+import (
+	"os"
+
+	"github.com/prometheus/procfs"
+)
 
 type processCollector struct {
 	pid             int
@@ -28,7 +32,13 @@ type processCollector struct {
 // NewProcessCollector returns a collector which exports the current state of
 // process metrics including cpu, memory and file descriptor usage as well as
 // the process start time for the given process id under the given namespace.
+// A pid of 0 stands for the current process. The metrics are read from the
+// proc filesystem. If it is not available, e.g. on platforms other than Linux,
+// the collector does not collect any metrics.
 func NewProcessCollector(pid int, namespace string) *processCollector {
+	if pid == 0 {
+		pid = os.Getpid()
+	}
 	return NewProcessCollectorPIDFn(
 		func() (int, error) { return pid, nil },
 		namespace,
@@ -20,6 +20,7 @@ func TestProcessCollector(t *testing.T) {
 	registry.Register(NewProcessCollector(os.Getpid(), ""))
 	registry.Register(NewProcessCollectorPIDFn(
 		func() (int, error) { return os.Getpid(), nil }, "foobar"))
+	registry.Register(NewProcessCollector(0, "self"))
 
 	s := httptest.NewServer(InstrumentHandler("prometheus", registry))
 	defer s.Close()
@@ -46,6 +47,8 @@ func TestProcessCollector(t *testing.T) {
 		regexp.MustCompile("foobar_process_virtual_memory_bytes [1-9]"),
 		regexp.MustCompile("foobar_process_resident_memory_bytes [1-9]"),
 		regexp.MustCompile("foobar_process_start_time_seconds [0-9.]{10,}"),
+		regexp.MustCompile("self_process_open_fds [1-9]"),
+		regexp.MustCompile("self_process_resident_memory_bytes [1-9]"),
 	} {
 		if !re.Match(body) {
 			t.Errorf("want body to match %s\n%s", re, body)
@@ -0,0 +1,186 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package prometheus
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+
+	dto "github.com/prometheus/client_model/go"
+
+	"github.com/prometheus/client_golang/text"
+)
+
+// ProxyCollectorOpts bundles the options for creating a Collector with
+// NewProxyCollector. All fields are optional.
+type ProxyCollectorOpts struct {
+	// Timeout limits the duration of each fetch. If 0, the timeout of
+	// the http.Client applies.
+	Timeout time.Duration
+
+	// MetricPrefix is prepended to the names of all proxied metrics.
+	MetricPrefix string
+
+	// LabelFilters, if not empty, restricts the proxied metrics to those
+	// that have all of the given label values (before LabelPrefix is
+	// applied).
+	LabelFilters Labels
+
+	// LabelPrefix is prepended to the label names of all proxied
+	// metrics, e.g. to avoid clashes with the labels the Prometheus
+	// server attaches to the proxying target.
+	LabelPrefix string
+
+	// FetchDurationBuckets defines the buckets of the fetch duration
+	// histogram. If nil, DefBuckets is used, see HistogramOpts.
+	FetchDurationBuckets []float64
+}
+
+// NewProxyCollector returns a Collector that re-exposes the metrics exposed by
+// another process. Each collection fetches the provided URL with the provided
+// http.Client (http.DefaultClient if nil), parses the response in the text
+// format, and passes the metrics on, modified according to the provided
+// ProxyCollectorOpts. This is the client side of federation, e.g. for a
+// sidecar exposing the metrics of a process that cannot be scraped directly.
+//
+// The Collector additionally collects the histogram
+// prometheus_proxy_collector_fetch_duration_seconds and the counter
+// prometheus_proxy_collector_fetch_errors_total, both with a "target" label
+// set to the URL. A failed fetch increments the counter, and no proxied
+// metrics are collected in that collection.
+//
+// The proxied metrics are not known in advance, so only the two metrics above
+// are described. Therefore, the Collector cannot be used together with
+// EnableCollectChecks, which rejects metrics with undescribed descriptors.
+func NewProxyCollector(url string, httpClient *http.Client, opts ProxyCollectorOpts) Collector {
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	if opts.Timeout > 0 {
+		c := *httpClient
+		c.Timeout = opts.Timeout
+		httpClient = &c
+	}
+	return &proxyCollector{
+		url:    url,
+		client: httpClient,
+		opts:   opts,
+		fetchDuration: NewHistogram(HistogramOpts{
+			Name:        "prometheus_proxy_collector_fetch_duration_seconds",
+			Help:        "Duration of fetching the metrics to proxy.",
+			ConstLabels: Labels{"target": url},
+			Buckets:     opts.FetchDurationBuckets,
+		}),
+		fetchErrors: NewCounter(CounterOpts{
+			Name:        "prometheus_proxy_collector_fetch_errors_total",
+			Help:        "Total number of failed fetches of the metrics to proxy.",
+			ConstLabels: Labels{"target": url},
+		}),
+	}
+}
+
+type proxyCollector struct {
+	url    string
+	client *http.Client
+	opts   ProxyCollectorOpts
+
+	fetchDuration Histogram
+	fetchErrors   Counter
+}
+
+// Describe implements Collector.
+func (c *proxyCollector) Describe(ch chan<- *Desc) {
+	c.fetchDuration.Describe(ch)
+	c.fetchErrors.Describe(ch)
+}
+
+// Collect implements Collector.
+func (c *proxyCollector) Collect(ch chan<- Metric) {
+	begin := time.Now()
+	mfs, err := c.fetch()
+	c.fetchDuration.Observe(time.Since(begin).Seconds())
+	if err != nil {
+		c.fetchErrors.Inc()
+	}
+	c.fetchDuration.Collect(ch)
+	c.fetchErrors.Collect(ch)
+	if err != nil {
+		return
+	}
+
+	names := make([]string, 0, len(mfs))
+	for name := range mfs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		mf := mfs[name]
+		help := mf.GetHelp()
+		if help == "" {
+			help = "Proxied metric family " + name + "."
+		}
+		desc := NewDesc(c.opts.MetricPrefix+name, help, nil, nil)
+		for _, m := range mf.Metric {
+			if !c.matches(m) {
+				continue
+			}
+			if c.opts.LabelPrefix != "" {
+				for _, lp := range m.Label {
+					lp.Name = proto.String(c.opts.LabelPrefix + lp.GetName())
+				}
+			}
+			ch <- &writtenMetric{desc: desc, pb: m}
+		}
+	}
+}
+
+// fetch fetches and parses the metrics to proxy.
+func (c *proxyCollector) fetch() (map[string]*dto.MetricFamily, error) {
+	req, err := http.NewRequest("GET", c.url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set(acceptHeader, TextTelemetryContentType)
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status code %d while fetching %s", resp.StatusCode, c.url)
+	}
+	var parser text.Parser
+	return parser.TextToMetricFamilies(resp.Body)
+}
+
+// matches returns whether m has all label values of the LabelFilters.
+func (c *proxyCollector) matches(m *dto.Metric) bool {
+	for name, value := range c.opts.LabelFilters {
+		found := false
+		for _, lp := range m.Label {
+			if lp.GetName() == name {
+				found = lp.GetValue() == value
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,89 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package prometheus
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/text"
+)
+
+func TestProxyCollector(t *testing.T) {
+	upstream := `# HELP requests_total Total requests.
+# TYPE requests_total counter
+requests_total{code="200",job="a"} 10
+requests_total{code="500",job="a"} 1
+requests_total{code="200",job="b"} 7
+# TYPE temperature gauge
+temperature{job="a"} 21.5
+`
+	failing := false
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if failing {
+			http.Error(w, "failing", http.StatusInternalServerError)
+			return
+		}
+		fmt.Fprint(w, upstream)
+	}))
+	defer server.Close()
+
+	c := NewProxyCollector(server.URL, nil, ProxyCollectorOpts{
+		MetricPrefix: "upstream_",
+		LabelFilters: Labels{"job": "a"},
+		LabelPrefix:  "exported_",
+	})
+	registry := newRegistry()
+	if _, err := registry.Register(c); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if _, err := registry.writePB(&buf, text.MetricFamilyToText, nil); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"# HELP upstream_requests_total Total requests.\n",
+		"# TYPE upstream_requests_total counter\n",
+		`upstream_requests_total{exported_code="200",exported_job="a"} 10` + "\n",
+		`upstream_requests_total{exported_code="500",exported_job="a"} 1` + "\n",
+		"# HELP upstream_temperature Proxied metric family temperature.\n",
+		`upstream_temperature{exported_job="a"} 21.5` + "\n",
+		fmt.Sprintf(`prometheus_proxy_collector_fetch_duration_seconds_count{target=%q} 1`, server.URL) + "\n",
+		fmt.Sprintf(`prometheus_proxy_collector_fetch_errors_total{target=%q} 0`, server.URL) + "\n",
+	} {
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("missing %q in:\n%s", want, buf.String())
+		}
+	}
+	if strings.Contains(buf.String(), `job="b"`) {
+		t.Errorf("filtered metric proxied:\n%s", buf.String())
+	}
+
+	failing = true
+	buf.Reset()
+	if _, err := registry.writePB(&buf, text.MetricFamilyToText, nil); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(buf.String(), "upstream_") {
+		t.Errorf("metrics proxied despite failed fetch:\n%s", buf.String())
+	}
+	if want := fmt.Sprintf(`prometheus_proxy_collector_fetch_errors_total{target=%q} 1`, server.URL); !strings.Contains(buf.String(), want) {
+		t.Errorf("missing %q in:\n%s", want, buf.String())
+	}
+}
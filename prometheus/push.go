@@ -19,6 +19,25 @@
 
 package prometheus
 
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	neturl "net/url"
+	"sort"
+	"strings"
+	"sync"
+
+	dto "github.com/prometheus/client_model/go"
+
+	"github.com/prometheus/client_golang/model"
+	"github.com/prometheus/client_golang/text"
+)
+
 // Push triggers a metric collection by the default registry and pushes all
 // collected metrics to the Pushgateway specified by addr. See the Pushgateway
 // documentation for detailed implications of the job and instance
@@ -63,3 +82,379 @@ func pushCollectors(job, instance, url, method string, collectors ...Collector)
 	}
 	return r.Push(job, instance, url, method)
 }
+
+// PusherCollectorOpts bundles the options for creating a Collector with
+// NewPusherCollector.
+type PusherCollectorOpts struct {
+	// URL is the complete URL to push to, e.g.
+	// "http://pushgateway:9091/metrics/jobs/some_job". Mandatory!
+	URL string
+	// Method is the HTTP method used to push. The default value is "POST".
+	Method string
+	// Username and Password, if Username is not empty, are sent with each
+	// push for HTTP basic authentication.
+	Username, Password string
+	// Header contains additional headers sent with each push, e.g. for
+	// bearer token authentication.
+	Header http.Header
+	// Client is the HTTP client used to push. The default value is
+	// http.DefaultClient.
+	Client *http.Client
+
+	// Collectors are the Collectors to gather the pushed metrics from.
+	Collectors []Collector
+
+	// ErrorHandler is called with the error if a push fails. The default
+	// handler logs the error with the standard logger.
+	ErrorHandler func(error)
+}
+
+// NewPusherCollector creates a Collector that pushes the metrics of the
+// provided Collectors to an HTTP endpoint each time it is collected, and also
+// forwards them as its own metrics. Registered with a registry, every scrape of
+// the registry results in a push. This "push on scrape" pattern is useful if a
+// sidecar scrapes the application while the metrics are required elsewhere,
+// too. The metrics are pushed in the delimited protocol buffer format, as
+// understood by the Pushgateway.
+//
+// Each collection only collects the provided Collectors once, so the pushed
+// and the forwarded metrics are the same. A failing push does not fail the
+// collection. It is reported to the ErrorHandler instead. The push happens
+// synchronously within Collect, so a slow endpoint slows down the collection.
+// Collections are serialized.
+//
+// NewPusherCollector panics if the URL is empty or if the provided Collectors
+// cannot be registered together with a registry.
+func NewPusherCollector(opts PusherCollectorOpts) Collector {
+	if opts.URL == "" {
+		panic("pusher collector needs a URL")
+	}
+	if opts.Method == "" {
+		opts.Method = "POST"
+	}
+	if opts.Client == nil {
+		opts.Client = http.DefaultClient
+	}
+	if opts.ErrorHandler == nil {
+		opts.ErrorHandler = func(err error) {
+			log.Printf("error pushing metrics to %s: %s", opts.URL, err)
+		}
+	}
+	c := &pusherCollector{opts: opts, registry: newRegistry()}
+	for _, collector := range opts.Collectors {
+		tee := &teeCollector{Collector: collector}
+		if _, err := c.registry.Register(tee); err != nil {
+			panic(err)
+		}
+		c.tees = append(c.tees, tee)
+	}
+	return c
+}
+
+type pusherCollector struct {
+	opts     PusherCollectorOpts
+	registry *registry
+	tees     []*teeCollector
+
+	mtx sync.Mutex // Serializes collections.
+}
+
+// Describe implements Collector.
+func (c *pusherCollector) Describe(ch chan<- *Desc) {
+	for _, tee := range c.tees {
+		tee.Describe(ch)
+	}
+}
+
+// Collect implements Collector.
+func (c *pusherCollector) Collect(ch chan<- Metric) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	var buf bytes.Buffer
+	_, err := c.registry.writePB(&buf, text.WriteProtoDelimited, nil)
+	for _, tee := range c.tees {
+		for _, m := range tee.take() {
+			ch <- m
+		}
+	}
+	if err == nil {
+		err = c.push(&buf)
+	}
+	if err != nil {
+		c.opts.ErrorHandler(err)
+	}
+}
+
+func (c *pusherCollector) push(body io.Reader) error {
+	req, err := http.NewRequest(c.opts.Method, c.opts.URL, body)
+	if err != nil {
+		return err
+	}
+	for name, values := range c.opts.Header {
+		for _, v := range values {
+			req.Header.Add(name, v)
+		}
+	}
+	req.Header.Set(contentTypeHeader, DelimitedTelemetryContentType)
+	if c.opts.Username != "" {
+		req.SetBasicAuth(c.opts.Username, c.opts.Password)
+	}
+	resp, err := c.opts.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("unexpected status code %d while pushing to %s", resp.StatusCode, c.opts.URL)
+	}
+	return nil
+}
+
+// teeCollector is a Collector that keeps the metrics collected from the
+// wrapped Collector until they are taken.
+type teeCollector struct {
+	Collector
+
+	mtx     sync.Mutex
+	metrics []Metric
+}
+
+// Collect implements Collector.
+func (t *teeCollector) Collect(ch chan<- Metric) {
+	inner := make(chan Metric, capMetricChan)
+	go func() {
+		t.Collector.Collect(inner)
+		close(inner)
+	}()
+	for m := range inner {
+		t.mtx.Lock()
+		t.metrics = append(t.metrics, m)
+		t.mtx.Unlock()
+		ch <- m
+	}
+}
+
+// take returns the kept metrics and forgets them.
+func (t *teeCollector) take() []Metric {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	metrics := t.metrics
+	t.metrics = nil
+	return metrics
+}
+
+// Pusher pushes metrics to a Pushgateway, using the grouping key API of the
+// Pushgateway, i.e. the metrics are pushed to the group identified by the job
+// name and the grouping labels. Create instances with NewPusher and configure
+// them with the chainable methods Gatherer, Collector, Collectors,
+// CollectorSlice, Grouping, Client, and Protobuf, e.g.:
+//
+//	err := prometheus.NewPusher("http://pushgateway:9091", "db_backup").
+//	    Collector(completionTime).
+//	    Grouping("db", "customers").
+//	    Push()
+//
+// Errors caused by the configuration, e.g. an invalid grouping label, are
+// detected when the configuring method is called and then returned by Push
+// and Add, which do not send anything in that case.
+type Pusher struct {
+	err error
+
+	url, job  string
+	grouping  map[string]string
+	gatherers []Gatherer
+	registry  *Registry
+	client    *http.Client
+	protobuf  bool
+}
+
+// NewPusher creates a new Pusher to push to the Pushgateway at the provided
+// URL, using the provided job name, which must not be empty. You can use just
+// host:port or ip:port as url, in which case 'http://' is added automatically.
+// Do not include the '/metrics/job/...' part. The Pusher pushes nothing until
+// Gatherers or Collectors are added.
+func NewPusher(url, job string) *Pusher {
+	var err error
+	if job == "" {
+		err = errors.New("job name must not be empty")
+	}
+	if !strings.Contains(url, "://") {
+		url = "http://" + url
+	}
+	return &Pusher{
+		err:      err,
+		url:      strings.TrimSuffix(url, "/"),
+		job:      job,
+		grouping: map[string]string{},
+		registry: NewRegistry(),
+		client:   http.DefaultClient,
+	}
+}
+
+// Gatherer adds a Gatherer to the Pusher, from which metrics will be gathered
+// to push them to the Pushgateway. The gathered metrics must not contain a job
+// label or any of the grouping labels. For convenience, this method returns a
+// pointer to the Pusher itself.
+func (p *Pusher) Gatherer(g Gatherer) *Pusher {
+	p.gatherers = append(p.gatherers, g)
+	return p
+}
+
+// Collector adds a Collector to the Pusher, from which metrics will be
+// collected to push them to the Pushgateway. The Collectors of a Pusher are
+// registered with a Registry of their own, so they have to be consistent with
+// each other. For convenience, this method returns a pointer to the Pusher
+// itself.
+func (p *Pusher) Collector(c Collector) *Pusher {
+	if p.err == nil {
+		p.err = p.registry.Register(c)
+	}
+	return p
+}
+
+// Collectors adds all the provided Collectors to the Pusher as if Collector
+// was called for each of them. For convenience, this method returns a pointer
+// to the Pusher itself.
+func (p *Pusher) Collectors(cs ...Collector) *Pusher {
+	return p.CollectorSlice(cs)
+}
+
+// CollectorSlice works like Collectors but takes a slice, e.g. one that is
+// built at runtime. For convenience, this method returns a pointer to the
+// Pusher itself.
+func (p *Pusher) CollectorSlice(cs []Collector) *Pusher {
+	for _, c := range cs {
+		p.Collector(c)
+	}
+	return p
+}
+
+// Grouping adds a label pair to the grouping key of the Pusher. The name must
+// be a valid label name other than "job", and the value must not be empty or
+// contain a '/'. A later call with the same name replaces the value. For
+// convenience, this method returns a pointer to the Pusher itself.
+func (p *Pusher) Grouping(name, value string) *Pusher {
+	if p.err != nil {
+		return p
+	}
+	switch {
+	case !model.LabelNameRE.MatchString(name) || strings.HasPrefix(name, model.ReservedLabelPrefix):
+		p.err = fmt.Errorf("grouping label has invalid name: %s", name)
+	case name == string(model.JobLabel):
+		p.err = errors.New("the job label is set by NewPusher and must not be used for grouping")
+	case value == "" || strings.Contains(value, "/"):
+		p.err = fmt.Errorf("value of grouping label %s must not be empty or contain '/': %q", name, value)
+	default:
+		p.grouping[name] = value
+	}
+	return p
+}
+
+// Client sets the HTTP client used to push, e.g. to configure TLS or
+// authentication by means of its Transport. The default is http.DefaultClient.
+// For convenience, this method returns a pointer to the Pusher itself.
+func (p *Pusher) Client(c *http.Client) *Pusher {
+	p.client = c
+	return p
+}
+
+// Protobuf makes the Pusher push in the delimited protocol buffer format
+// instead of the text format, which is the default. Both are understood by the
+// Pushgateway. For convenience, this method returns a pointer to the Pusher
+// itself.
+func (p *Pusher) Protobuf() *Pusher {
+	p.protobuf = true
+	return p
+}
+
+// Push gathers all metrics from the Gatherers and Collectors added to the
+// Pusher and pushes them to the Pushgateway, replacing all metrics previously
+// pushed with the same job and grouping labels. (It uses HTTP method 'PUT'.)
+func (p *Pusher) Push() error {
+	return p.push("PUT")
+}
+
+// Add works like Push, but only previously pushed metrics with the same name
+// (and the same job and grouping labels) are replaced. (It uses HTTP method
+// 'POST'.)
+func (p *Pusher) Add() error {
+	return p.push("POST")
+}
+
+func (p *Pusher) push(method string) error {
+	if p.err != nil {
+		return p.err
+	}
+	mfs, err := p.registry.Gather()
+	if err != nil {
+		return err
+	}
+	for _, g := range p.gatherers {
+		gathered, err := g.Gather()
+		if err != nil {
+			return err
+		}
+		mfs = append(mfs, gathered...)
+	}
+
+	names := make([]string, 0, len(p.grouping))
+	for name := range p.grouping {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	enc, contentType := text.MetricFamilyToText, TextTelemetryContentType
+	if p.protobuf {
+		enc, contentType = text.WriteProtoDelimited, DelimitedTelemetryContentType
+	}
+	var buf bytes.Buffer
+	for _, mf := range mfs {
+		if err := checkPushedLabels(mf, names); err != nil {
+			return err
+		}
+		if _, err := enc(&buf, mf); err != nil {
+			return err
+		}
+	}
+
+	url := fmt.Sprintf("%s/metrics/job/%s", p.url, neturl.QueryEscape(p.job))
+	for _, name := range names {
+		url += "/" + name + "/" + neturl.QueryEscape(p.grouping[name])
+	}
+	req, err := http.NewRequest(method, url, &buf)
+	if err != nil {
+		return err
+	}
+	req.Header.Set(contentTypeHeader, contentType)
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("unexpected status code %d while pushing to %s: %s", resp.StatusCode, url, body)
+	}
+	return nil
+}
+
+// checkPushedLabels returns an error if a metric in the provided MetricFamily
+// has the job label or one of the provided grouping labels, which would be
+// overwritten by the Pushgateway.
+func checkPushedLabels(mf *dto.MetricFamily, grouping []string) error {
+	for _, m := range mf.Metric {
+		for _, lp := range m.Label {
+			name := lp.GetName()
+			if name == string(model.JobLabel) {
+				return fmt.Errorf("pushed metric %s (%s) already contains a job label", mf.GetName(), m)
+			}
+			for _, g := range grouping {
+				if name == g {
+					return fmt.Errorf("pushed metric %s (%s) already contains grouping label %s", mf.GetName(), m, g)
+				}
+			}
+		}
+	}
+	return nil
+}
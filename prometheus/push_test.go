@@ -0,0 +1,205 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package prometheus
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/matttproud/golang_protobuf_extensions/pbutil"
+	dto "github.com/prometheus/client_model/go"
+)
+
+func TestPusherCollector(t *testing.T) {
+	var (
+		pushed  []*dto.MetricFamily
+		user    string
+		method  string
+		failing bool
+	)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if failing {
+			http.Error(w, "nope", http.StatusInternalServerError)
+			return
+		}
+		method = r.Method
+		user, _, _ = r.BasicAuth()
+		for {
+			mf := &dto.MetricFamily{}
+			if _, err := pbutil.ReadDelimited(r.Body, mf); err != nil {
+				break
+			}
+			pushed = append(pushed, mf)
+		}
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer server.Close()
+
+	counter := NewCounter(CounterOpts{Name: "requests_total", Help: "help"})
+	counter.Add(3)
+	var pushErr error
+	pc := NewPusherCollector(PusherCollectorOpts{
+		URL:          server.URL + "/metrics/jobs/test",
+		Username:     "admin",
+		Password:     "secret",
+		Collectors:   []Collector{counter},
+		ErrorHandler: func(err error) { pushErr = err },
+	})
+
+	registry := newRegistry()
+	if _, err := registry.Register(pc); err != nil {
+		t.Fatal(err)
+	}
+	ch := make(chan Metric, 10)
+	pc.Collect(ch)
+	close(ch)
+	var forwarded int
+	for m := range ch {
+		forwarded++
+		if got, want := m.Desc(), counter.Desc(); got != want {
+			t.Errorf("got forwarded desc %s, want %s", got, want)
+		}
+	}
+	if got, want := forwarded, 1; got != want {
+		t.Errorf("got %d forwarded metrics, want %d", got, want)
+	}
+	if pushErr != nil {
+		t.Fatal(pushErr)
+	}
+	if got, want := len(pushed), 1; got != want {
+		t.Fatalf("got %d pushed metric families, want %d", got, want)
+	}
+	if got, want := pushed[0].Metric[0].GetCounter().GetValue(), 3.; got != want {
+		t.Errorf("got pushed value %f, want %f", got, want)
+	}
+	if method != "POST" || user != "admin" {
+		t.Errorf("got method %q and user %q, want POST and admin", method, user)
+	}
+
+	failing = true
+	ch = make(chan Metric, 10)
+	pc.Collect(ch)
+	if got, want := len(ch), 1; got != want {
+		t.Errorf("got %d forwarded metrics with failing push, want %d", got, want)
+	}
+	if pushErr == nil {
+		t.Error("expected push error")
+	}
+}
+
+func TestPusher(t *testing.T) {
+	var (
+		method, path, contentType string
+		body                      []byte
+		requests                  int
+	)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		method = r.Method
+		path = r.URL.Path
+		contentType = r.Header.Get(contentTypeHeader)
+		body, _ = ioutil.ReadAll(r.Body)
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer server.Close()
+
+	counter := NewCounter(CounterOpts{Name: "requests_total", Help: "help"})
+	counter.Add(3)
+	gauge := NewGauge(GaugeOpts{Name: "last_run_seconds", Help: "help"})
+	gauge.Set(42)
+	registry := NewRegistry()
+	registry.MustRegister(gauge)
+
+	pusher := NewPusher(server.URL+"/", "test job").
+		Collector(counter).
+		Gatherer(registry).
+		Grouping("instance", "a").
+		Grouping("db", "customers")
+	if err := pusher.Push(); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := method, "PUT"; got != want {
+		t.Errorf("got method %q, want %q", got, want)
+	}
+	if got, want := path, "/metrics/job/test+job/db/customers/instance/a"; got != want {
+		t.Errorf("got path %q, want %q", got, want)
+	}
+	if got, want := contentType, TextTelemetryContentType; got != want {
+		t.Errorf("got content type %q, want %q", got, want)
+	}
+	for _, want := range []string{"requests_total 3\n", "last_run_seconds 42\n"} {
+		if !strings.Contains(string(body), want) {
+			t.Errorf("got body %q, want it to contain %q", body, want)
+		}
+	}
+
+	if err := pusher.Protobuf().Add(); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := method, "POST"; got != want {
+		t.Errorf("got method %q, want %q", got, want)
+	}
+	if got, want := contentType, DelimitedTelemetryContentType; got != want {
+		t.Errorf("got content type %q, want %q", got, want)
+	}
+	mf := &dto.MetricFamily{}
+	if _, err := pbutil.ReadDelimited(bytes.NewReader(body), mf); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := mf.GetName(), "requests_total"; got != want {
+		t.Errorf("got metric family %q, want %q", got, want)
+	}
+
+	// Several Collectors at once.
+	other := NewGauge(GaugeOpts{Name: "other_seconds", Help: "help"})
+	other.Set(7)
+	for _, p := range []*Pusher{
+		NewPusher(server.URL, "test").Collectors(counter, gauge, other),
+		NewPusher(server.URL, "test").CollectorSlice([]Collector{counter, gauge, other}),
+	} {
+		if err := p.Push(); err != nil {
+			t.Fatal(err)
+		}
+		for _, want := range []string{"requests_total 3\n", "last_run_seconds 42\n", "other_seconds 7\n"} {
+			if !strings.Contains(string(body), want) {
+				t.Errorf("got body %q, want it to contain %q", body, want)
+			}
+		}
+	}
+
+	requests = 0
+	vec := NewCounterVec(CounterOpts{Name: "test_total", Help: "help"}, []string{"db"})
+	vec.WithLabelValues("customers").Inc()
+	for _, p := range []*Pusher{
+		NewPusher(server.URL, ""),
+		NewPusher(server.URL, "test").Grouping("in-valid", "x"),
+		NewPusher(server.URL, "test").Grouping("job", "x"),
+		NewPusher(server.URL, "test").Grouping("instance", "a/b"),
+		NewPusher(server.URL, "test").Grouping("instance", ""),
+		NewPusher(server.URL, "test").Collector(counter).Collector(counter),
+		NewPusher(server.URL, "test").Collectors(counter, counter),
+		NewPusher(server.URL, "test").Collector(vec).Grouping("db", "customers"),
+	} {
+		if p.Gatherer(GathererFunc(func() ([]*dto.MetricFamily, error) { return nil, nil })).Push() == nil {
+			t.Errorf("expected error for invalid pusher %+v", p)
+		}
+	}
+	if got, want := requests, 0; got != want {
+		t.Errorf("got %d requests for invalid pushers, want %d", got, want)
+	}
+}
@@ -26,12 +26,14 @@ import (
 	"fmt"
 	"hash/fnv"
 	"io"
+	"io/ioutil"
 	"net/http"
 	"net/url"
 	"os"
 	"sort"
 	"strings"
 	"sync"
+	"time"
 
 	"bitbucket.org/ww/goautoneg"
 	"github.com/golang/protobuf/proto"
@@ -42,10 +44,31 @@ import (
 	"github.com/prometheus/client_golang/text"
 )
 
-var (
-	defRegistry   = newDefaultRegistry()
-	errAlreadyReg = errors.New("duplicate metrics collector registration attempted")
-)
+var defRegistry = newDefaultRegistry()
+
+// AlreadyRegisteredError is returned by the Register method if the Collector to
+// be registered has already been registered before, or a different Collector
+// that collects the same metrics has been registered before. Registration fails
+// in that case, but you can detect from the kind of error what has
+// happened. The error contains fields for the existing Collector and the
+// (rejected) new Collector that equals the existing one. This can be used to
+// find out if an equal Collector has been registered before and switch over to
+// using the old one:
+//
+//	if err := prometheus.Register(c); err != nil {
+//	    if are, ok := err.(prometheus.AlreadyRegisteredError); ok {
+//	        c = are.ExistingCollector.(prometheus.Counter)
+//	    } else {
+//	        panic(err)
+//	    }
+//	}
+type AlreadyRegisteredError struct {
+	ExistingCollector, NewCollector Collector
+}
+
+func (err AlreadyRegisteredError) Error() string {
+	return "duplicate metrics collector registration attempted"
+}
 
 // Constants relevant to the HTTP interface.
 const (
@@ -83,6 +106,8 @@ const (
 
 	acceptEncodingHeader = "Accept-Encoding"
 	acceptHeader         = "Accept"
+
+	deprecatedMetricsHeader = "X-Prometheus-Deprecated-Metrics"
 )
 
 // Handler returns the HTTP handler for the global Prometheus registry. It is
@@ -105,7 +130,8 @@ func UninstrumentedHandler() http.Handler {
 // returns an error if the descriptors provided by the Collector are invalid or
 // if they - in combination with descriptors of already registered Collectors -
 // do not fulfill the consistency and uniqueness criteria described in the Desc
-// documentation.
+// documentation. If a Collector equal to the provided one has been registered
+// before, the error is an AlreadyRegisteredError.
 //
 // Do not register the same Collector multiple times concurrently. (Registering
 // the same Collector twice would result in an error anyway, but on top of that,
@@ -151,10 +177,270 @@ func MustRegisterOrGet(m Collector) Collector {
 // an argument. (Two Collectors are considered equal if their Describe method
 // yields the same set of descriptors.) The function returns whether a Collector
 // was unregistered.
+//
+// If the unregistered Collector is a metric vector (like a CounterVec), all its
+// children are deleted so that registering it again starts from a clean state.
 func Unregister(c Collector) bool {
 	return defRegistry.Unregister(c)
 }
 
+// UnregisterAll unregisters all Collectors from the default registry, including
+// the process and Go collectors registered by default. Metric vectors are reset
+// as described for Unregister. The function is mostly useful for tearing down
+// tests.
+func UnregisterAll() {
+	defRegistry.UnregisterAll()
+}
+
+// Registerer is the interface for the part of a registry in charge of
+// registering and unregistering Collectors. It is implemented by Registry.
+type Registerer interface {
+	// Register works like the package-level function of the same name.
+	Register(Collector) error
+	// MustRegister works like Register but panics where Register would
+	// have returned an error.
+	MustRegister(Collector)
+	// Unregister works like the package-level function of the same
+	// name.
+	Unregister(Collector) bool
+}
+
+// Registry is a registry of Collectors that is independent of the global
+// registry used by the package-level functions like Register and Handler. It
+// has no Collectors registered upon creation, not even the process and Go
+// collectors of the global registry. A fresh Registry per test allows to
+// register and gather metrics without interfering with other tests, and
+// multiple Registries allow to expose separate sets of metrics, e.g. one per
+// tenant. Registry implements Registerer and Gatherer. Create instances with
+// NewRegistry, and expose them with HandlerFor.
+type Registry struct {
+	r *registry
+}
+
+// NewRegistry returns a new, empty Registry.
+func NewRegistry() *Registry {
+	return &Registry{r: newRegistry()}
+}
+
+// Register implements Registerer.
+func (r *Registry) Register(c Collector) error {
+	_, err := r.r.Register(c)
+	return err
+}
+
+// MustRegister implements Registerer.
+func (r *Registry) MustRegister(c Collector) {
+	if err := r.Register(c); err != nil {
+		panic(err)
+	}
+}
+
+// Unregister implements Registerer.
+func (r *Registry) Unregister(c Collector) bool {
+	return r.r.Unregister(c)
+}
+
+// UnregisterAll works like the package-level function of the same name, but
+// for this Registry.
+func (r *Registry) UnregisterAll() {
+	r.r.UnregisterAll()
+}
+
+// Gather implements Gatherer. It collects all registered Collectors and
+// returns the resulting MetricFamilies sorted by name. An error is returned
+// if the collection fails, e.g. if a Collector collects an invalid Metric.
+func (r *Registry) Gather() ([]*dto.MetricFamily, error) {
+	return r.r.gather()
+}
+
+// HandlerFor returns an HTTP handler exposing the metrics provided by g. For a
+// Registry, the handler behaves like the one returned by
+// UninstrumentedHandler for the global registry. For other Gatherers, it
+// encodes the gathered MetricFamilies in the format negotiated with the
+// client and responds with an internal server error if Gather fails. Unlike
+// Handler, the returned handler is not instrumented, as the instrumentation
+// would go to the global registry.
+func HandlerFor(g Gatherer) http.Handler {
+	if r, ok := g.(*Registry); ok {
+		return r.r
+	}
+	return gathererHandler{g}
+}
+
+type gathererHandler struct {
+	gatherer Gatherer
+}
+
+func (h gathererHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	mfs, err := h.gatherer.Gather()
+	if err != nil {
+		http.Error(w, "An error has occurred:\n\n"+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	enc, contentType := chooseEncoder(req)
+	var buf bytes.Buffer
+	writer, encoding := decorateWriter(req, &buf)
+	for _, mf := range mfs {
+		if _, err := enc(writer, mf); err != nil {
+			http.Error(w, "An error has occurred:\n\n"+err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	if closer, ok := writer.(io.Closer); ok {
+		closer.Close()
+	}
+	header := w.Header()
+	header.Set(contentTypeHeader, contentType)
+	header.Set(contentLengthHeader, fmt.Sprint(buf.Len()))
+	if encoding != "" {
+		header.Set(contentEncodingHeader, encoding)
+	}
+	w.Write(buf.Bytes())
+}
+
+// DefaultRegisterer is a Registerer for the default registry. Its methods work
+// like the package-level functions of the same name. It is meant to be passed
+// to code that accepts a Registerer, e.g. to WrapRegistererWith.
+var DefaultRegisterer Registerer = defaultRegisterer{}
+
+type defaultRegisterer struct{}
+
+func (defaultRegisterer) Register(c Collector) error  { return Register(c) }
+func (defaultRegisterer) MustRegister(c Collector)    { MustRegister(c) }
+func (defaultRegisterer) Unregister(c Collector) bool { return Unregister(c) }
+
+// WrapRegistererWith returns a Registerer that wraps each Collector with
+// WrapCollectorWithLabels before registering it with reg, so that all its
+// descriptors and metrics have the provided Labels as additional const
+// labels. Register returns the error of WrapCollectorWithLabels if any of the
+// label names is already used by the Collector. Unregister wraps the
+// Collector in the same way, so the unwrapped Collector can be passed to it.
+//
+// This allows to add labels like the region or the cluster to all metrics of a
+// library that accepts a Registerer, without changing the library.
+func WrapRegistererWith(labels Labels, reg Registerer) Registerer {
+	l := make(Labels, len(labels))
+	for name, value := range labels {
+		l[name] = value
+	}
+	return &wrappingRegisterer{wrapped: reg, labels: l}
+}
+
+// WrapRegistererWithPrefix returns a Registerer that prepends the provided
+// prefix to the names of all descriptors and metrics of each Collector before
+// registering it with reg. It works like WrapRegistererWith otherwise. The
+// prefix is prepended as is, i.e. it usually ends with an underscore.
+func WrapRegistererWithPrefix(prefix string, reg Registerer) Registerer {
+	return &wrappingRegisterer{wrapped: reg, prefix: prefix}
+}
+
+type wrappingRegisterer struct {
+	wrapped Registerer
+	prefix  string
+	labels  Labels
+}
+
+func (r *wrappingRegisterer) wrap(c Collector) (Collector, error) {
+	if len(r.labels) > 0 {
+		var err error
+		if c, err = WrapCollectorWithLabels(c, r.labels); err != nil {
+			return nil, err
+		}
+	}
+	if r.prefix != "" {
+		c = &prefixedCollector{
+			Collector: c,
+			prefix:    r.prefix,
+			descs:     map[*Desc]*Desc{},
+		}
+	}
+	return c, nil
+}
+
+// Register implements Registerer. An AlreadyRegisteredError refers to the
+// Collectors as they were passed in, not to their wrapped versions.
+func (r *wrappingRegisterer) Register(c Collector) error {
+	wrapped, err := r.wrap(c)
+	if err != nil {
+		return err
+	}
+	err = r.wrapped.Register(wrapped)
+	if are, ok := err.(AlreadyRegisteredError); ok {
+		are.ExistingCollector = unwrapCollector(are.ExistingCollector)
+		are.NewCollector = c
+		return are
+	}
+	return err
+}
+
+// MustRegister implements Registerer.
+func (r *wrappingRegisterer) MustRegister(c Collector) {
+	if err := r.Register(c); err != nil {
+		panic(err)
+	}
+}
+
+// Unregister implements Registerer.
+func (r *wrappingRegisterer) Unregister(c Collector) bool {
+	wrapped, err := r.wrap(c)
+	if err != nil {
+		return false
+	}
+	return r.wrapped.Unregister(wrapped)
+}
+
+// unwrapCollector returns the Collector wrapped by the Registerers returned
+// from WrapRegistererWith and WrapRegistererWithPrefix.
+func unwrapCollector(c Collector) Collector {
+	for {
+		switch w := c.(type) {
+		case *prefixedCollector:
+			c = w.Collector
+		case *labeledCollector:
+			c = w.Collector
+		default:
+			return c
+		}
+	}
+}
+
+// DefaultRegistryOption changes the set of Collectors the default registry
+// registers by default, see InitDefaultRegistry.
+type DefaultRegistryOption func(*defaultCollectors)
+
+// WithoutProcessCollector is a DefaultRegistryOption that removes the process
+// Collector (see NewProcessCollector) from the default registry.
+func WithoutProcessCollector() DefaultRegistryOption {
+	return func(d *defaultCollectors) { d.process = nil }
+}
+
+// WithoutGoCollector is a DefaultRegistryOption that removes the Go Collector
+// (see NewGoCollector) from the default registry.
+func WithoutGoCollector() DefaultRegistryOption {
+	return func(d *defaultCollectors) { d.goroutines = nil }
+}
+
+// WithCustomGoCollector is a DefaultRegistryOption that registers the provided
+// Collector in place of the Go Collector (see NewGoCollector).
+func WithCustomGoCollector(c Collector) DefaultRegistryOption {
+	return func(d *defaultCollectors) { d.goroutines = c }
+}
+
+// InitDefaultRegistry changes the set of Collectors the default registry
+// registers by default, i.e. the process Collector and the Go Collector. This
+// is useful for test binaries or libraries that do not want to expose these
+// metrics, without having to give up the default registry. The options are
+// always applied to the initial set of default Collectors, so calling
+// InitDefaultRegistry repeatedly with the same options has the same effect as
+// calling it once, and calling it without options restores the initial set.
+//
+// Call InitDefaultRegistry early, e.g. at the beginning of main. It returns an
+// error if any other Collector has been registered with the default registry
+// before, as it would be too late to change the defaults then.
+func InitDefaultRegistry(opts ...DefaultRegistryOption) error {
+	return defRegistry.initDefaults(opts...)
+}
+
 // SetMetricFamilyInjectionHook sets a function that is called whenever metrics
 // are collected. The hook function must be set before metrics collection begins
 // (i.e. call SetMetricFamilyInjectionHook before setting the HTTP handler.) The
@@ -180,6 +466,52 @@ func SetMetricFamilyInjectionHook(hook func() []*dto.MetricFamily) {
 	defRegistry.metricFamilyInjectionHook = hook
 }
 
+// LoadFromReader parses metric families in the text exposition format from the
+// provided io.Reader and exposes them alongside the metrics collected from
+// registered Collectors. This is useful for proxies or replay tools that
+// re-expose an existing scrape response, e.g. directly from the body of an
+// HTTP response. Each call replaces all metric families loaded by a previous
+// call in one step. Loading from an empty reader thus removes them all.
+//
+// If overwriteExisting is false, an error is returned (and nothing is changed)
+// if any of the parsed metric families has the same name as a metric of a
+// registered Collector. If overwriteExisting is true, a loaded metric family
+// takes precedence over collected metrics of the same name.
+//
+// As for metric families injected with SetMetricFamilyInjectionHook, there are
+// no registration-time checks for loaded metric families.
+func LoadFromReader(r io.Reader, overwriteExisting bool) error {
+	return defRegistry.LoadFromReader(r, overwriteExisting)
+}
+
+// Precompute collects the metrics of all Collectors registered with the default
+// registry once and discards them. It is meant to be called in main before the
+// HTTP handler starts serving, so that Collectors which cache expensive
+// results (e.g. read from a database) have a warm cache by the time of the
+// first scrape, which could time out otherwise. The Collectors are called one
+// after another so that the duration of each can be reported. If logf is not
+// nil, it is called for each Collector with its Go type, the number of
+// collected metrics, and the duration of the collection (log.Printf fits). The
+// returned error combines the errors encountered while collecting.
+func Precompute(logf func(format string, args ...interface{})) error {
+	return defRegistry.precompute(logf)
+}
+
+// Snapshot collects all metrics registered with the default registry (plus
+// loaded and injected metric families) once and returns them as a
+// RegistrySnapshot. All metrics in the snapshot carry the same timestamp, the
+// time the collection started, so that they are ingested as one point in time.
+//
+// Updates of the metrics are not paused while collecting, as that would
+// require a lock on every update. The values are therefore only consistent to
+// the degree the collection is fast. Snapshot is meant for auditing and
+// debugging, e.g. to compare the state of a process at different times. It
+// should not be used for regular scrapes, as the timestamps prevent the
+// Prometheus server from detecting stale metrics.
+func Snapshot() (RegistrySnapshot, error) {
+	return defRegistry.snapshot()
+}
+
 // PanicOnCollectError sets the behavior whether a panic is caused upon an error
 // while metrics are collected and served to the HTTP endpoint. By default, an
 // internal server error (status code 500) is served with an error message.
@@ -197,12 +529,88 @@ func EnableCollectChecks(b bool) {
 	defRegistry.collectChecksEnabled = b
 }
 
+// EnableCollectorLatency enables (or disables) the instrumentation of metrics
+// collection. If enabled, the duration of the Collect call of each registered
+// Collector is observed in a histogram named
+// "prometheus_collector_gather_duration_seconds", partitioned by the label
+// "collector", which is the Go type name of the Collector. This helps to find
+// slow Collectors in a slow metrics endpoint. The histogram is exposed after
+// all other metrics have been collected. It uses DefBuckets unless buckets are
+// provided. Enabling it again replaces the histogram and its observations so
+// far. Like the other options, it must be set before metrics collection
+// begins. By default, the instrumentation is disabled.
+func EnableCollectorLatency(b bool, buckets ...float64) {
+	defRegistry.enableCollectorLatency(b, buckets...)
+}
+
+// ConflictStrategy determines what happens if a Collector is registered that
+// equals a previously registered Collector, i.e. whose Describe method yields
+// the same set of descriptors. See SetConflictStrategy.
+type ConflictStrategy int
+
+// Possible values for ConflictStrategy.
+const (
+	// ConflictReject makes the registration fail. It is the default.
+	ConflictReject ConflictStrategy = iota
+	// ConflictReplace registers the new Collector in place of the
+	// previously registered one.
+	ConflictReplace
+	// ConflictIgnore keeps the previously registered Collector and drops
+	// the new one without returning an error.
+	ConflictIgnore
+	// ConflictMerge keeps both Collectors and merges the metrics they
+	// collect into the same metric families. This is useful for proxies
+	// and federation. Note that it is the responsibility of the caller to
+	// avoid duplicate metrics (with the same label values) between the
+	// merged Collectors. Unregistering one of the merged Collectors
+	// unregisters all of them.
+	ConflictMerge
+)
+
+// SetConflictStrategy sets the ConflictStrategy of the default registry. All
+// other registration checks (descriptor validity and consistency) are still
+// performed with any strategy. Like the other options, it must be set before
+// Collectors are registered. The default strategy is ConflictReject.
+func SetConflictStrategy(s ConflictStrategy) {
+	defRegistry.conflictStrategy = s
+}
+
+// EnableDeprecatedMetricsHeader enables (or disables) the
+// X-Prometheus-Deprecated-Metrics header in responses of the HTTP handler. If
+// enabled, the header lists the names of all exposed metric families marked as
+// deprecated (see the DeprecatedVersion field in Opts), separated by
+// commas. The header is omitted if no deprecated metrics are exposed. By
+// default, the header is disabled.
+func EnableDeprecatedMetricsHeader(b bool) {
+	defRegistry.deprecatedMetricsHeaderEnabled = b
+}
+
 // encoder is a function that writes a dto.MetricFamily to an io.Writer in a
 // certain encoding. It returns the number of bytes written and any error
 // encountered.  Note that pbutil.WriteDelimited and pbutil.MetricFamilyToText
 // are encoders.
 type encoder func(io.Writer, *dto.MetricFamily) (int, error)
 
+// RegistrySnapshot holds the metric families collected at one point in time
+// by Snapshot. It implements Gatherer, returning the collected metric families
+// without collecting again.
+type RegistrySnapshot struct {
+	// Timestamp is the time the collection started. It is also set as the
+	// timestamp of each metric.
+	Timestamp time.Time
+	families  []*dto.MetricFamily // Sorted by name.
+}
+
+// Gather implements Gatherer. It returns a copy of the metric families, so that
+// the snapshot is not modified by the caller.
+func (s RegistrySnapshot) Gather() ([]*dto.MetricFamily, error) {
+	mfs := make([]*dto.MetricFamily, 0, len(s.families))
+	for _, mf := range s.families {
+		mfs = append(mfs, proto.Clone(mf).(*dto.MetricFamily))
+	}
+	return mfs, nil
+}
+
 type registry struct {
 	mtx                       sync.RWMutex
 	collectorsByID            map[uint64]Collector // ID is a hash of the descIDs.
@@ -212,26 +620,76 @@ type registry struct {
 	metricFamilyPool          chan *dto.MetricFamily
 	metricPool                chan *dto.Metric
 	metricFamilyInjectionHook func() []*dto.MetricFamily
+	loadedFamilies            map[string]*dto.MetricFamily
 
 	panicOnCollectError, collectChecksEnabled bool
+	deprecatedMetricsHeaderEnabled            bool
+	collectorLatency                          *HistogramVec // nil if disabled.
+	conflictStrategy                          ConflictStrategy
+
+	// defaults are the default Collectors currently registered, see
+	// InitDefaultRegistry, and builtinDefaults the ones registered
+	// initially. registeredSinceDefaults is true if any Collector has been
+	// registered since the default Collectors were (re-)registered.
+	defaults, builtinDefaults defaultCollectors
+	registeredSinceDefaults   bool
+}
+
+// defaultCollectors are the Collectors registered with the default
+// registry. Each of them is nil if not registered.
+type defaultCollectors struct {
+	process, goroutines Collector
+}
+
+// mergedCollector is a Collector registered in place of Collectors with the
+// same descriptors if the ConflictMerge strategy is used.
+type mergedCollector []Collector
+
+func (m mergedCollector) Describe(ch chan<- *Desc) {
+	m[0].Describe(ch)
+}
+
+func (m mergedCollector) Collect(ch chan<- Metric) {
+	for _, c := range m {
+		c.Collect(ch)
+	}
+}
+
+func (r *registry) enableCollectorLatency(b bool, buckets ...float64) {
+	if !b {
+		r.collectorLatency = nil
+		return
+	}
+	r.collectorLatency = NewHistogramVec(
+		HistogramOpts{
+			Namespace: "prometheus",
+			Subsystem: "collector",
+			Name:      "gather_duration_seconds",
+			Help:      "Duration of the metrics collection of each collector in seconds.",
+			Buckets:   buckets,
+		},
+		[]string{"collector"},
+	)
 }
 
 func (r *registry) Register(c Collector) (Collector, error) {
-	descChan := make(chan *Desc, capDescChan)
-	go func() {
-		c.Describe(descChan)
-		close(descChan)
-	}()
+	descs := describe(c)
 
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	return r.register(c, descs)
+}
+
+// register registers c, which has the provided descriptors. It must be called
+// with mtx locked.
+func (r *registry) register(c Collector, descs []*Desc) (Collector, error) {
 	newDescIDs := map[uint64]struct{}{}
 	newDimHashesByName := map[string]uint64{}
 	var collectorID uint64 // Just a sum of all desc IDs.
 	var duplicateDescErr error
 
-	r.mtx.Lock()
-	defer r.mtx.Unlock()
 	// Coduct various tests...
-	for desc := range descChan {
+	for _, desc := range descs {
 
 		// Is the descriptor valid at all?
 		if desc.err != nil {
@@ -274,7 +732,26 @@ func (r *registry) Register(c Collector) (Collector, error) {
 		return nil, errors.New("collector has no descriptors")
 	}
 	if existing, exists := r.collectorsByID[collectorID]; exists {
-		return existing, errAlreadyReg
+		switch r.conflictStrategy {
+		case ConflictReplace:
+			r.registeredSinceDefaults = true
+			r.collectorsByID[collectorID] = c
+			return c, nil
+		case ConflictIgnore:
+			return existing, nil
+		case ConflictMerge:
+			r.registeredSinceDefaults = true
+			if merged, ok := existing.(mergedCollector); ok {
+				r.collectorsByID[collectorID] = append(merged, c)
+			} else {
+				r.collectorsByID[collectorID] = mergedCollector{existing, c}
+			}
+			return c, nil
+		}
+		return existing, AlreadyRegisteredError{
+			ExistingCollector: existing,
+			NewCollector:      c,
+		}
 	}
 	// If the collectorID is new, but at least one of the descs existed
 	// before, we are in trouble.
@@ -283,6 +760,7 @@ func (r *registry) Register(c Collector) (Collector, error) {
 	}
 
 	// Only after all tests have passed, actually register.
+	r.registeredSinceDefaults = true
 	r.collectorsByID[collectorID] = c
 	for hash := range newDescIDs {
 		r.descIDs[hash] = struct{}{}
@@ -295,45 +773,190 @@ func (r *registry) Register(c Collector) (Collector, error) {
 
 func (r *registry) RegisterOrGet(m Collector) (Collector, error) {
 	existing, err := r.Register(m)
-	if err != nil && err != errAlreadyReg {
+	if _, ok := err.(AlreadyRegisteredError); err != nil && !ok {
 		return nil, err
 	}
 	return existing, nil
 }
 
 func (r *registry) Unregister(c Collector) bool {
-	descChan := make(chan *Desc, capDescChan)
-	go func() {
-		c.Describe(descChan)
-		close(descChan)
-	}()
+	descs := describe(c)
 
+	r.mtx.Lock()
+	existing, exists := r.unregister(descs)
+	r.mtx.Unlock()
+
+	if exists {
+		notifyUnregistered(existing)
+	}
+	return exists
+}
+
+// unregister removes the Collector with the provided descriptors and returns
+// it, or false if no such Collector is registered. It must be called with mtx
+// locked. The caller has to notify the removed Collector via
+// notifyUnregistered once mtx is unlocked.
+func (r *registry) unregister(descs []*Desc) (Collector, bool) {
 	descIDs := map[uint64]struct{}{}
 	var collectorID uint64 // Just a sum of the desc IDs.
-	for desc := range descChan {
+	for _, desc := range descs {
 		if _, exists := descIDs[desc.id]; !exists {
 			collectorID += desc.id
 			descIDs[desc.id] = struct{}{}
 		}
 	}
 
+	existing, exists := r.collectorsByID[collectorID]
+	if !exists {
+		return nil, false
+	}
+	delete(r.collectorsByID, collectorID)
+	for id := range descIDs {
+		delete(r.descIDs, id)
+	}
+	// dimHashesByName is left untouched as those must be consistent
+	// throughout the lifetime of a program.
+	return existing, true
+}
+
+// UnregisterAll unregisters all Collectors. As for Unregister,
+// dimHashesByName is left untouched.
+func (r *registry) UnregisterAll() {
+	r.mtx.Lock()
+	collectors := r.collectorsByID
+	r.collectorsByID = map[uint64]Collector{}
+	r.descIDs = map[uint64]struct{}{}
+	r.mtx.Unlock()
+
+	for _, c := range collectors {
+		notifyUnregistered(c)
+	}
+}
+
+// unregisterNotifiee is implemented by Collectors that need to know when they
+// have been unregistered, i.e. the metric vectors.
+type unregisterNotifiee interface {
+	unregistered()
+}
+
+// notifyUnregistered notifies c (or, for a mergedCollector, all the Collectors
+// it is made of) about having been unregistered. Collectors registered via
+// WrapRegistererWith or WrapRegistererWithPrefix are unwrapped first. It must
+// be called without holding the registry's mtx.
+func notifyUnregistered(c Collector) {
+	if merged, ok := c.(mergedCollector); ok {
+		for _, m := range merged {
+			notifyUnregistered(m)
+		}
+		return
+	}
+	if n, ok := unwrapCollector(c).(unregisterNotifiee); ok {
+		n.unregistered()
+	}
+}
+
+func (r *registry) precompute(logf func(format string, args ...interface{})) error {
 	r.mtx.RLock()
-	if _, exists := r.collectorsByID[collectorID]; !exists {
-		r.mtx.RUnlock()
-		return false
+	collectors := make([]Collector, 0, len(r.collectorsByID))
+	for _, c := range r.collectorsByID {
+		collectors = append(collectors, c)
 	}
 	r.mtx.RUnlock()
 
+	var errs []string
+	for _, c := range collectors {
+		begin := time.Now()
+		n, err := collectAndWrite(c)
+		if logf != nil {
+			logf("precomputed collector %T: %d metrics in %v", c, n, time.Since(begin))
+		}
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("collector %T: %s", c, err))
+		}
+	}
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// collectAndWrite collects the metrics of the provided Collector and writes
+// each of them. It returns the number of collected metrics and the first error
+// encountered while writing them.
+func collectAndWrite(c Collector) (int, error) {
+	metricChan := make(chan Metric, capMetricChan)
+	go func() {
+		c.Collect(metricChan)
+		close(metricChan)
+	}()
+	var (
+		n        int
+		firstErr error
+	)
+	for metric := range metricChan {
+		n++
+		if err := metric.Write(&dto.Metric{}); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return n, firstErr
+}
+
+func (r *registry) LoadFromReader(in io.Reader, overwriteExisting bool) error {
+	var parser text.Parser
+	families, err := parser.TextToMetricFamilies(in)
+	if err != nil {
+		return err
+	}
+	for _, mf := range families {
+		for _, m := range mf.Metric {
+			sort.Sort(LabelPairSorter(m.Label))
+		}
+	}
+
 	r.mtx.Lock()
 	defer r.mtx.Unlock()
+	if !overwriteExisting {
+		for name := range families {
+			if _, exists := r.dimHashesByName[name]; exists {
+				return fmt.Errorf("loaded metric family %q conflicts with a registered metric of the same name", name)
+			}
+		}
+	}
+	r.loadedFamilies = families
+	return nil
+}
 
-	delete(r.collectorsByID, collectorID)
-	for id := range descIDs {
-		delete(r.descIDs, id)
+func (r *registry) snapshot() (RegistrySnapshot, error) {
+	snap := RegistrySnapshot{Timestamp: time.Now()}
+	ts := proto.Int64(snap.Timestamp.UnixNano() / int64(time.Millisecond))
+	_, err := r.writePB(ioutil.Discard, func(_ io.Writer, mf *dto.MetricFamily) (int, error) {
+		// The metric families are pooled, so a deep copy is needed.
+		mf = proto.Clone(mf).(*dto.MetricFamily)
+		for _, m := range mf.Metric {
+			m.TimestampMs = ts
+		}
+		snap.families = append(snap.families, mf)
+		return 0, nil
+	}, nil)
+	if err != nil {
+		return RegistrySnapshot{}, err
 	}
-	// dimHashesByName is left untouched as those must be consistent
-	// throughout the lifetime of a program.
-	return true
+	return snap, nil
+}
+
+// gather collects all metrics and returns deep copies of the resulting
+// MetricFamilies, which are pooled by writePB.
+func (r *registry) gather() ([]*dto.MetricFamily, error) {
+	var mfs []*dto.MetricFamily
+	_, err := r.writePB(ioutil.Discard, func(_ io.Writer, mf *dto.MetricFamily) (int, error) {
+		mfs = append(mfs, proto.Clone(mf).(*dto.MetricFamily))
+		return 0, nil
+	}, nil)
+	if err != nil {
+		return nil, err
+	}
+	return mfs, nil
 }
 
 func (r *registry) Push(job, instance, pushURL, method string) error {
@@ -346,7 +969,7 @@ func (r *registry) Push(job, instance, pushURL, method string) error {
 	}
 	buf := r.getBuf()
 	defer r.giveBuf(buf)
-	if _, err := r.writePB(buf, text.WriteProtoDelimited); err != nil {
+	if _, err := r.writePB(buf, text.WriteProtoDelimited, nil); err != nil {
 		if r.panicOnCollectError {
 			panic(err)
 		}
@@ -370,10 +993,14 @@ func (r *registry) Push(job, instance, pushURL, method string) error {
 
 func (r *registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	enc, contentType := chooseEncoder(req)
+	deprecatedVersions := map[string]string{}
+	if contentType == TextTelemetryContentType {
+		enc = annotateDeprecations(enc, deprecatedVersions)
+	}
 	buf := r.getBuf()
 	defer r.giveBuf(buf)
 	writer, encoding := decorateWriter(req, buf)
-	if _, err := r.writePB(writer, enc); err != nil {
+	if _, err := r.writePB(writer, enc, deprecatedVersions); err != nil {
 		if r.panicOnCollectError {
 			panic(err)
 		}
@@ -389,10 +1016,22 @@ func (r *registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	if encoding != "" {
 		header.Set(contentEncodingHeader, encoding)
 	}
+	if r.deprecatedMetricsHeaderEnabled && len(deprecatedVersions) > 0 {
+		names := make([]string, 0, len(deprecatedVersions))
+		for name := range deprecatedVersions {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		header.Set(deprecatedMetricsHeader, strings.Join(names, ","))
+	}
 	w.Write(buf.Bytes())
 }
 
-func (r *registry) writePB(w io.Writer, writeEncoded encoder) (int, error) {
+// writePB collects all metrics and writes them with the given encoder. If
+// deprecatedVersions is not nil, the names of deprecated metric families are
+// added to it (mapped to the version since which they are deprecated) before
+// the first metric family is encoded.
+func (r *registry) writePB(w io.Writer, writeEncoded encoder, deprecatedVersions map[string]string) (int, error) {
 	var metricHashes map[uint64]struct{}
 	if r.collectChecksEnabled {
 		metricHashes = make(map[uint64]struct{})
@@ -402,6 +1041,7 @@ func (r *registry) writePB(w io.Writer, writeEncoded encoder) (int, error) {
 
 	r.mtx.RLock()
 	metricFamiliesByName := make(map[string]*dto.MetricFamily, len(r.dimHashesByName))
+	loadedFamilies := r.loadedFamilies
 
 	// Scatter.
 	// (Collectors could be complex and slow, so we call them all at once.)
@@ -410,10 +1050,19 @@ func (r *registry) writePB(w io.Writer, writeEncoded encoder) (int, error) {
 		wg.Wait()
 		close(metricChan)
 	}()
+	collectorLatency := r.collectorLatency
 	for _, collector := range r.collectorsByID {
 		go func(collector Collector) {
 			defer wg.Done()
+			if collectorLatency == nil {
+				collector.Collect(metricChan)
+				return
+			}
+			begin := time.Now()
 			collector.Collect(metricChan)
+			collectorLatency.WithLabelValues(fmt.Sprintf("%T", collector)).Observe(
+				time.Since(begin).Seconds(),
+			)
 		}(collector)
 	}
 	r.mtx.RUnlock()
@@ -430,6 +1079,9 @@ func (r *registry) writePB(w io.Writer, writeEncoded encoder) (int, error) {
 		// of metricFamiliesByName (and of metricHashes if checks are
 		// enabled). Most likely not worth it.
 		desc := metric.Desc()
+		if _, loaded := loadedFamilies[desc.fqName]; loaded {
+			continue // Loaded metric families take precedence.
+		}
 		metricFamily, ok := metricFamiliesByName[desc.fqName]
 		if !ok {
 			metricFamily = r.getMetricFamily()
@@ -438,6 +1090,9 @@ func (r *registry) writePB(w io.Writer, writeEncoded encoder) (int, error) {
 			metricFamily.Help = proto.String(desc.help)
 			metricFamiliesByName[desc.fqName] = metricFamily
 		}
+		if deprecatedVersions != nil && desc.deprecatedVersion != "" {
+			deprecatedVersions[desc.fqName] = desc.deprecatedVersion
+		}
 		dtoMetric := r.getMetric()
 		defer r.giveMetric(dtoMetric)
 		if err := metric.Write(dtoMetric); err != nil {
@@ -470,6 +1125,26 @@ func (r *registry) writePB(w io.Writer, writeEncoded encoder) (int, error) {
 		metricFamily.Metric = append(metricFamily.Metric, dtoMetric)
 	}
 
+	for name, mf := range loadedFamilies {
+		// Shallow copy as the metrics get sorted (and possibly merged
+		// with injected ones) below, while other collections might be
+		// going on concurrently.
+		metricFamily := &dto.MetricFamily{
+			Name:   mf.Name,
+			Help:   mf.Help,
+			Type:   mf.Type,
+			Metric: append([]*dto.Metric(nil), mf.Metric...),
+		}
+		if r.collectChecksEnabled {
+			for _, m := range metricFamily.Metric {
+				if err := r.checkConsistency(metricFamily, m, nil, metricHashes); err != nil {
+					return 0, err
+				}
+			}
+		}
+		metricFamiliesByName[name] = metricFamily
+	}
+
 	if r.metricFamilyInjectionHook != nil {
 		for _, mf := range r.metricFamilyInjectionHook() {
 			existingMF, exists := metricFamiliesByName[mf.GetName()]
@@ -495,6 +1170,19 @@ func (r *registry) writePB(w io.Writer, writeEncoded encoder) (int, error) {
 		}
 	}
 
+	// All collectors are done now, so their durations can be added.
+	if collectorLatency != nil {
+		if _, exists := metricFamiliesByName[collectorLatency.desc.fqName]; !exists {
+			mf, err := collectorLatencyFamily(collectorLatency)
+			if err != nil {
+				return 0, err
+			}
+			if len(mf.Metric) > 0 {
+				metricFamiliesByName[mf.GetName()] = mf
+			}
+		}
+	}
+
 	// Now that MetricFamilies are all set, sort their Metrics
 	// lexicographically by their label values.
 	for _, mf := range metricFamiliesByName {
@@ -519,6 +1207,30 @@ func (r *registry) writePB(w io.Writer, writeEncoded encoder) (int, error) {
 	return written, nil
 }
 
+// collectorLatencyFamily returns the metrics collected from the provided
+// HistogramVec as a MetricFamily.
+func collectorLatencyFamily(v *HistogramVec) (*dto.MetricFamily, error) {
+	mf := &dto.MetricFamily{
+		Name: proto.String(v.desc.fqName),
+		Help: proto.String(v.desc.help),
+		Type: dto.MetricType_HISTOGRAM.Enum(),
+	}
+	metricChan := make(chan Metric, capMetricChan)
+	go func() {
+		v.Collect(metricChan)
+		close(metricChan)
+	}()
+	var err error
+	for metric := range metricChan {
+		dtoMetric := &dto.Metric{}
+		if e := metric.Write(dtoMetric); e != nil && err == nil {
+			err = fmt.Errorf("error collecting metric %v: %s", metric.Desc(), e)
+		}
+		mf.Metric = append(mf.Metric, dtoMetric)
+	}
+	return mf, err
+}
+
 func (r *registry) checkConsistency(metricFamily *dto.MetricFamily, dtoMetric *dto.Metric, desc *Desc, metricHashes map[uint64]struct{}) error {
 
 	// Type consistency with metric family.
@@ -681,13 +1393,101 @@ func newRegistry() *registry {
 
 func newDefaultRegistry() *registry {
 	r := newRegistry()
-	r.Register(NewProcessCollector(os.Getpid(), ""))
-	r.Register(NewGoCollector())
+	r.builtinDefaults = defaultCollectors{
+		process:    NewProcessCollector(os.Getpid(), ""),
+		goroutines: NewGoCollector(),
+	}
+	r.Register(r.builtinDefaults.process)
+	r.Register(r.builtinDefaults.goroutines)
+	r.defaults = r.builtinDefaults
+	r.registeredSinceDefaults = false
 	return r
 }
 
-func chooseEncoder(req *http.Request) (encoder, string) {
-	accepts := goautoneg.ParseAccept(req.Header.Get(acceptHeader))
+func (r *registry) initDefaults(opts ...DefaultRegistryOption) error {
+	wanted := r.builtinDefaults
+	for _, opt := range opts {
+		opt(&wanted)
+	}
+
+	// Check and swap under the same lock so that no Collector can be
+	// registered in between. If a wanted Collector fails to register, the
+	// swap is rolled back, and the current defaults stay registered.
+	var removed, added []Collector
+	r.mtx.Lock()
+	err := func() error {
+		if r.registeredSinceDefaults {
+			return errors.New("default registry must be initialized before any collector is registered")
+		}
+		for _, c := range []Collector{r.defaults.process, r.defaults.goroutines} {
+			if c == nil {
+				continue
+			}
+			if existing, ok := r.unregister(describe(c)); ok {
+				removed = append(removed, existing)
+			}
+		}
+		for _, c := range []Collector{wanted.process, wanted.goroutines} {
+			if c == nil {
+				continue
+			}
+			if _, err := r.register(c, describe(c)); err != nil {
+				for _, c := range added {
+					r.unregister(describe(c))
+				}
+				for _, c := range removed {
+					r.register(c, describe(c))
+				}
+				removed = nil
+				r.registeredSinceDefaults = false
+				return err
+			}
+			added = append(added, c)
+		}
+		r.defaults = wanted
+		r.registeredSinceDefaults = false
+		return nil
+	}()
+	r.mtx.Unlock()
+
+	for _, c := range removed {
+		notifyUnregistered(c)
+	}
+	return err
+}
+
+// Format is the value of the Content-Type header of a response in one of the
+// exposition formats. It is returned by NegotiateIncludingOpenMetrics.
+type Format string
+
+// The exposition formats known to NegotiateIncludingOpenMetrics.
+const (
+	FmtText             Format = TextTelemetryContentType
+	FmtProtoDelim       Format = DelimitedTelemetryContentType
+	FmtProtoText        Format = ProtoTextTelemetryContentType
+	FmtProtoCompactText Format = ProtoCompactTextTelemetryContentType
+	// FmtOpenMetrics is only returned by NegotiateIncludingOpenMetrics.
+	// The handlers of this package cannot encode it and never serve it.
+	FmtOpenMetrics Format = `application/openmetrics-text; version=0.0.1; charset=utf-8`
+)
+
+// NegotiateIncludingOpenMetrics returns the exposition format preferred by the
+// Accept header in h. The Accept header is processed in order of preference,
+// and the first recognized media type wins. The protobuf formats are only
+// recognized with the proto=io.prometheus.client.MetricFamily parameter and a
+// known encoding. FmtText is returned if no recognized media type is found,
+// which includes a missing Accept header and "*/*". So clients like curl get
+// the text format.
+//
+// The function is meant for users who write their own handler. The handlers
+// of this package negotiate in the same way, but they do not consider
+// OpenMetrics.
+func NegotiateIncludingOpenMetrics(h http.Header) Format {
+	return negotiate(h, true)
+}
+
+func negotiate(h http.Header, openMetrics bool) Format {
+	accepts := goautoneg.ParseAccept(h.Get(acceptHeader))
 	for _, accept := range accepts {
 		switch {
 		case accept.Type == "application" &&
@@ -695,23 +1495,60 @@ func chooseEncoder(req *http.Request) (encoder, string) {
 			accept.Params["proto"] == "io.prometheus.client.MetricFamily":
 			switch accept.Params["encoding"] {
 			case "delimited":
-				return text.WriteProtoDelimited, DelimitedTelemetryContentType
+				return FmtProtoDelim
 			case "text":
-				return text.WriteProtoText, ProtoTextTelemetryContentType
+				return FmtProtoText
 			case "compact-text":
-				return text.WriteProtoCompactText, ProtoCompactTextTelemetryContentType
+				return FmtProtoCompactText
 			default:
 				continue
 			}
 		case accept.Type == "text" &&
 			accept.SubType == "plain" &&
 			(accept.Params["version"] == "0.0.4" || accept.Params["version"] == ""):
-			return text.MetricFamilyToText, TextTelemetryContentType
+			return FmtText
+		case openMetrics &&
+			accept.Type == "application" &&
+			accept.SubType == "openmetrics-text" &&
+			(accept.Params["version"] == "0.0.1" || accept.Params["version"] == ""):
+			return FmtOpenMetrics
 		default:
 			continue
 		}
 	}
-	return text.MetricFamilyToText, TextTelemetryContentType
+	return FmtText
+}
+
+func chooseEncoder(req *http.Request) (encoder, string) {
+	format := negotiate(req.Header, false)
+	switch format {
+	case FmtProtoDelim:
+		return text.WriteProtoDelimited, string(format)
+	case FmtProtoText:
+		return text.WriteProtoText, string(format)
+	case FmtProtoCompactText:
+		return text.WriteProtoCompactText, string(format)
+	default:
+		return text.MetricFamilyToText, TextTelemetryContentType
+	}
+}
+
+// annotateDeprecations wraps the provided encoder so that a "# DEPRECATED" comment
+// line is written before each metric family whose name is contained in
+// deprecatedVersions.
+func annotateDeprecations(enc encoder, deprecatedVersions map[string]string) encoder {
+	return func(w io.Writer, mf *dto.MetricFamily) (int, error) {
+		var written int
+		if version, ok := deprecatedVersions[mf.GetName()]; ok {
+			n, err := fmt.Fprintf(w, "# DEPRECATED since version %s\n", version)
+			written += n
+			if err != nil {
+				return written, err
+			}
+		}
+		n, err := enc(w, mf)
+		return written + n, err
+	}
 }
 
 // decorateWriter wraps a writer to handle gzip compression if requested.  It
@@ -22,8 +22,13 @@ package prometheus
 import (
 	"bytes"
 	"encoding/binary"
+	"fmt"
+	"io"
 	"net/http"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/golang/protobuf/proto"
 	dto "github.com/prometheus/client_model/go"
@@ -533,3 +538,619 @@ func BenchmarkHandler(b *testing.B) {
 		testHandler(b)
 	}
 }
+
+func TestDeprecatedMetrics(t *testing.T) {
+	registry := newRegistry()
+	registry.deprecatedMetricsHeaderEnabled = true
+
+	counter := NewCounter(CounterOpts{
+		Name:              "old_counter",
+		Help:              "docstring",
+		DeprecatedVersion: "1.2.0",
+	})
+	gauge := NewGauge(GaugeOpts{
+		Name: "old_gauge",
+		Help: "docstring",
+	})
+	current := NewGauge(GaugeOpts{
+		Name: "current_gauge",
+		Help: "docstring",
+	})
+	if got, want := counter.Desc().DeprecatedVersion(), "1.2.0"; got != want {
+		t.Errorf("got deprecated version %q, want %q", got, want)
+	}
+	if _, err := registry.Register(counter); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := registry.Register(DeprecatedCollector(gauge, "1.3.0")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := registry.Register(current); err != nil {
+		t.Fatal(err)
+	}
+
+	writer := &fakeResponseWriter{
+		header: http.Header{},
+	}
+	request, _ := http.NewRequest("GET", "/", nil)
+	request.Header.Add("Accept", "text/plain")
+	registry.ServeHTTP(writer, request)
+
+	if got, want := writer.Header().Get(deprecatedMetricsHeader), "old_counter,old_gauge"; got != want {
+		t.Errorf("got %q for header %q, want %q", got, deprecatedMetricsHeader, want)
+	}
+	expectedBody := `# HELP current_gauge docstring
+# TYPE current_gauge gauge
+current_gauge 0
+# DEPRECATED since version 1.2.0
+# HELP old_counter docstring
+# TYPE old_counter counter
+old_counter 0
+# DEPRECATED since version 1.3.0
+# HELP old_gauge docstring
+# TYPE old_gauge gauge
+old_gauge 0
+`
+	if got := writer.body.String(); got != expectedBody {
+		t.Errorf("got body %q, want %q", got, expectedBody)
+	}
+}
+
+func TestLoadFromReader(t *testing.T) {
+	registry := newRegistry()
+	registry.collectChecksEnabled = true
+	counter := NewCounter(CounterOpts{
+		Name: "local_total",
+		Help: "docstring",
+	})
+	if _, err := registry.Register(counter); err != nil {
+		t.Fatal(err)
+	}
+
+	scrape := func() string {
+		writer := &fakeResponseWriter{
+			header: http.Header{},
+		}
+		request, _ := http.NewRequest("GET", "/", nil)
+		request.Header.Add("Accept", "text/plain")
+		registry.ServeHTTP(writer, request)
+		return writer.body.String()
+	}
+
+	if err := registry.LoadFromReader(strings.NewReader(`# HELP remote_up remote docstring
+# TYPE remote_up gauge
+remote_up{instance="b"} 0
+remote_up{instance="a"} 1
+`), false); err != nil {
+		t.Fatal(err)
+	}
+	expected := `# HELP local_total docstring
+# TYPE local_total counter
+local_total 0
+# HELP remote_up remote docstring
+# TYPE remote_up gauge
+remote_up{instance="a"} 1
+remote_up{instance="b"} 0
+`
+	if got := scrape(); got != expected {
+		t.Errorf("got body %q, want %q", got, expected)
+	}
+
+	conflicting := `# TYPE local_total counter
+local_total 42
+`
+	if err := registry.LoadFromReader(strings.NewReader(conflicting), false); err == nil {
+		t.Error("expected error for conflicting metric family")
+	}
+	if got := scrape(); got != expected {
+		t.Errorf("got body %q after failed load, want %q", got, expected)
+	}
+
+	if err := registry.LoadFromReader(strings.NewReader(conflicting), true); err != nil {
+		t.Fatal(err)
+	}
+	expected = `# TYPE local_total counter
+local_total 42
+`
+	if got := scrape(); got != expected {
+		t.Errorf("got body %q after overwriting load, want %q", got, expected)
+	}
+
+	if err := registry.LoadFromReader(strings.NewReader(""), false); err != nil {
+		t.Fatal(err)
+	}
+	expected = `# HELP local_total docstring
+# TYPE local_total counter
+local_total 0
+`
+	if got := scrape(); got != expected {
+		t.Errorf("got body %q after empty load, want %q", got, expected)
+	}
+}
+
+func TestCollectorLatency(t *testing.T) {
+	registry := newRegistry()
+	registry.enableCollectorLatency(true, 1, 10)
+	if _, err := registry.Register(NewGauge(GaugeOpts{Name: "g", Help: "help"})); err != nil {
+		t.Fatal(err)
+	}
+
+	var (
+		families = map[string]*dto.MetricFamily{}
+		buf      bytes.Buffer
+	)
+	for i := 0; i < 2; i++ {
+		buf.Reset()
+		if _, err := registry.writePB(&buf, func(w io.Writer, mf *dto.MetricFamily) (int, error) {
+			families[mf.GetName()] = proto.Clone(mf).(*dto.MetricFamily)
+			return 0, nil
+		}, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	mf, ok := families["prometheus_collector_gather_duration_seconds"]
+	if !ok {
+		t.Fatal("collector latency histogram not exposed")
+	}
+	if got, want := len(mf.Metric), 1; got != want {
+		t.Fatalf("got %d metrics, want %d", got, want)
+	}
+	m := mf.Metric[0]
+	if got, want := m.Label[0].GetValue(), "*prometheus.value"; got != want {
+		t.Errorf("got collector label %q, want %q", got, want)
+	}
+	if got, want := m.GetHistogram().GetSampleCount(), uint64(2); got != want {
+		t.Errorf("got sample count %d, want %d", got, want)
+	}
+	if got, want := len(m.GetHistogram().GetBucket()), 2; got != want {
+		t.Errorf("got %d buckets, want %d", got, want)
+	}
+}
+
+func TestConflictStrategy(t *testing.T) {
+	newVec := func(lv string) *CounterVec {
+		v := NewCounterVec(CounterOpts{Name: "c", Help: "help"}, []string{"source"})
+		v.WithLabelValues(lv).Inc()
+		return v
+	}
+	collect := func(r *registry) []*dto.Metric {
+		var metrics []*dto.Metric
+		var buf bytes.Buffer
+		if _, err := r.writePB(&buf, func(w io.Writer, mf *dto.MetricFamily) (int, error) {
+			metrics = append(metrics, proto.Clone(mf).(*dto.MetricFamily).Metric...)
+			return 0, nil
+		}, nil); err != nil {
+			t.Fatal(err)
+		}
+		return metrics
+	}
+
+	scenarios := []struct {
+		strategy     ConflictStrategy
+		wantErr      bool
+		wantSources  []string
+		wantReturned string
+	}{
+		{ConflictReject, true, []string{"a"}, "a"},
+		{ConflictReplace, false, []string{"b"}, "b"},
+		{ConflictIgnore, false, []string{"a"}, "a"},
+		{ConflictMerge, false, []string{"a", "b"}, "b"},
+	}
+	for i, s := range scenarios {
+		registry := newRegistry()
+		registry.conflictStrategy = s.strategy
+		a, b := newVec("a"), newVec("b")
+		if _, err := registry.Register(a); err != nil {
+			t.Fatal(err)
+		}
+		returned, err := registry.Register(b)
+		if got := err != nil; got != s.wantErr {
+			t.Errorf("%d. got error %v, want error %t", i, err, s.wantErr)
+		}
+		want := map[string]Collector{"a": a, "b": b}[s.wantReturned]
+		if returned != want {
+			t.Errorf("%d. got returned collector %v, want %v", i, returned, want)
+		}
+		metrics := collect(registry)
+		if got, want := len(metrics), len(s.wantSources); got != want {
+			t.Errorf("%d. got %d metrics, want %d", i, got, want)
+			continue
+		}
+		for j, m := range metrics {
+			if got, want := m.Label[0].GetValue(), s.wantSources[j]; got != want {
+				t.Errorf("%d.%d. got source %q, want %q", i, j, got, want)
+			}
+		}
+		if !registry.Unregister(a) {
+			t.Errorf("%d. unregistering failed", i)
+		}
+		if got := len(collect(registry)); got != 0 {
+			t.Errorf("%d. got %d metrics after unregistering, want 0", i, got)
+		}
+	}
+}
+
+func TestInitDefaultRegistry(t *testing.T) {
+	registry := newDefaultRegistry()
+	if got, want := len(registry.collectorsByID), 2; got != want {
+		t.Fatalf("got %d default collectors, want %d", got, want)
+	}
+
+	custom := NewGauge(GaugeOpts{Name: "custom_go", Help: "help"})
+	for i := 0; i < 2; i++ {
+		if err := registry.initDefaults(WithoutProcessCollector(), WithCustomGoCollector(custom)); err != nil {
+			t.Fatal(err)
+		}
+		if got, want := len(registry.collectorsByID), 1; got != want {
+			t.Errorf("%d. got %d default collectors, want %d", i, got, want)
+		}
+		if _, err := registry.Register(custom); err != (AlreadyRegisteredError{custom, custom}) {
+			t.Errorf("%d. custom Go collector not registered, got error %v", i, err)
+		}
+	}
+
+	if err := registry.initDefaults(WithoutProcessCollector(), WithoutGoCollector()); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(registry.collectorsByID), 0; got != want {
+		t.Errorf("got %d default collectors, want %d", got, want)
+	}
+	if err := registry.initDefaults(); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(registry.collectorsByID), 2; got != want {
+		t.Errorf("got %d default collectors, want %d", got, want)
+	}
+
+	// The process Collector is registered as wanted, but the custom Go
+	// Collector conflicts with it.
+	conflicting := NewGauge(GaugeOpts{Name: "process_open_fds", Help: "other help"})
+	if err := registry.initDefaults(WithCustomGoCollector(conflicting)); err == nil {
+		t.Error("expected error for conflicting default collector")
+	}
+	if got, want := len(registry.collectorsByID), 2; got != want {
+		t.Errorf("got %d default collectors after failed initialization, want %d", got, want)
+	}
+	if _, err := registry.Register(registry.builtinDefaults.goroutines); err != (AlreadyRegisteredError{registry.builtinDefaults.goroutines, registry.builtinDefaults.goroutines}) {
+		t.Errorf("Go collector not registered after failed initialization, got error %v", err)
+	}
+	if err := registry.initDefaults(WithoutGoCollector()); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(registry.collectorsByID), 1; got != want {
+		t.Errorf("got %d default collectors, want %d", got, want)
+	}
+
+	if _, err := registry.Register(NewGauge(GaugeOpts{Name: "g", Help: "help"})); err != nil {
+		t.Fatal(err)
+	}
+	if err := registry.initDefaults(WithoutGoCollector()); err == nil {
+		t.Error("expected error when initializing after registration")
+	}
+}
+
+func TestPrecompute(t *testing.T) {
+	registry := newRegistry()
+	calls := 0
+	if _, err := registry.Register(NewGaugeFunc(
+		GaugeOpts{Name: "g", Help: "help"},
+		func() float64 { calls++; return 1 },
+	)); err != nil {
+		t.Fatal(err)
+	}
+
+	var logged []string
+	logf := func(format string, args ...interface{}) {
+		logged = append(logged, fmt.Sprintf(format, args...))
+	}
+	if err := registry.precompute(logf); err != nil {
+		t.Error(err)
+	}
+	if got, want := calls, 1; got != want {
+		t.Errorf("got %d calls, want %d", got, want)
+	}
+	if got, want := len(logged), 1; got != want {
+		t.Fatalf("got %d log lines, want %d", got, want)
+	}
+	if want := "precomputed collector *prometheus.valueFunc: 1 metrics in "; !strings.HasPrefix(logged[0], want) {
+		t.Errorf("got log line %q, want prefix %q", logged[0], want)
+	}
+
+	if _, err := registry.Register(NewHistogramFromFunction(
+		NewDesc("invalid", "help", []string{"l"}, nil),
+		func() (uint64, float64, map[float64]uint64, error) { return 0, 0, nil, nil },
+	)); err != nil {
+		t.Fatal(err)
+	}
+	if err := registry.precompute(nil); err == nil {
+		t.Error("expected error from invalid metric")
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	registry := newRegistry()
+	calls := 0
+	c := NewCounterVec(CounterOpts{Name: "c", Help: "help"}, []string{"l"})
+	c.WithLabelValues("a").Inc()
+	c.WithLabelValues("b").Add(2)
+	if _, err := registry.Register(c); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := registry.Register(NewGaugeFunc(
+		GaugeOpts{Name: "g", Help: "help"},
+		func() float64 { calls++; return 1 },
+	)); err != nil {
+		t.Fatal(err)
+	}
+
+	snap, err := registry.snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.WithLabelValues("a").Inc()
+	for i := 0; i < 2; i++ {
+		mfs, err := snap.Gather()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := len(mfs), 2; got != want {
+			t.Fatalf("got %d metric families, want %d", got, want)
+		}
+		if got, want := mfs[0].GetName(), "c"; got != want {
+			t.Errorf("got metric family %q, want %q", got, want)
+		}
+		if got, want := mfs[0].Metric[0].GetCounter().GetValue(), 1.; got != want {
+			t.Errorf("got counter value %f, want %f", got, want)
+		}
+		ts := snap.Timestamp.UnixNano() / int64(time.Millisecond)
+		for _, mf := range mfs {
+			for _, m := range mf.Metric {
+				if got := m.GetTimestampMs(); got != ts {
+					t.Errorf("got timestamp %d in %s, want %d", got, mf.GetName(), ts)
+				}
+			}
+		}
+		// Modifying the gathered families must not change the snapshot.
+		mfs[0].Metric = nil
+	}
+	if got, want := calls, 1; got != want {
+		t.Errorf("got %d calls, want %d", got, want)
+	}
+}
+
+func TestRegistry(t *testing.T) {
+	newCounter := func() Counter {
+		return NewCounter(CounterOpts{Name: "test_counter", Help: "helpless"})
+	}
+	r1, r2 := NewRegistry(), NewRegistry()
+	c1, c2 := newCounter(), newCounter()
+	r1.MustRegister(c1)
+	// The same metric name in another Registry is no conflict.
+	if err := r2.Register(c2); err != nil {
+		t.Fatal(err)
+	}
+	c1.Add(1)
+	c2.Add(2)
+
+	var r Registerer = r1
+	if err := r.Register(newCounter()); err == nil {
+		t.Error("expected error for duplicate registration")
+	}
+
+	var g Gatherer = r2
+	mfs, err := g.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(mfs), 1; got != want {
+		t.Fatalf("got %d metric families, want %d", got, want)
+	}
+	if got, want := mfs[0].Metric[0].GetCounter().GetValue(), 2.; got != want {
+		t.Errorf("got %f, want %f", got, want)
+	}
+
+	writer := &fakeResponseWriter{
+		header: http.Header{},
+	}
+	request, _ := http.NewRequest("GET", "/", nil)
+	request.Header.Add("Accept", "text/plain")
+	HandlerFor(r1).ServeHTTP(writer, request)
+	if got, want := writer.body.String(), "# HELP test_counter helpless\n# TYPE test_counter counter\ntest_counter 1\n"; got != want {
+		t.Errorf("got body %q, want %q", got, want)
+	}
+
+	writer = &fakeResponseWriter{
+		header: http.Header{},
+	}
+	HandlerFor(GathererFunc(func() ([]*dto.MetricFamily, error) { return mfs, nil })).ServeHTTP(writer, request)
+	if got, want := writer.body.String(), "# HELP test_counter helpless\n# TYPE test_counter counter\ntest_counter 2\n"; got != want {
+		t.Errorf("got body %q, want %q", got, want)
+	}
+	if got, want := writer.Header().Get(contentTypeHeader), TextTelemetryContentType; got != want {
+		t.Errorf("got content type %q, want %q", got, want)
+	}
+
+	if !r1.Unregister(c1) {
+		t.Error("expected successful unregistration")
+	}
+	mfs, err = r1.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(mfs), 0; got != want {
+		t.Errorf("got %d metric families, want %d", got, want)
+	}
+}
+
+func TestAlreadyRegisteredError(t *testing.T) {
+	registry := newRegistry()
+	newCounter := func() Counter {
+		return NewCounter(CounterOpts{Name: "test_counter", Help: "helpless"})
+	}
+	existing, c := newCounter(), newCounter()
+	if _, err := registry.Register(existing); err != nil {
+		t.Fatal(err)
+	}
+	_, err := registry.Register(c)
+	are, ok := err.(AlreadyRegisteredError)
+	if !ok {
+		t.Fatalf("got error %v, want AlreadyRegisteredError", err)
+	}
+	if are.ExistingCollector != existing {
+		t.Errorf("got existing collector %v, want %v", are.ExistingCollector, existing)
+	}
+	if are.NewCollector != c {
+		t.Errorf("got new collector %v, want %v", are.NewCollector, c)
+	}
+
+	// RegisterOrGet still returns the existing collector without error.
+	got, err := registry.RegisterOrGet(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != existing {
+		t.Errorf("got collector %v, want %v", got, existing)
+	}
+}
+
+func TestNegotiateIncludingOpenMetrics(t *testing.T) {
+	scenarios := []struct {
+		accept string
+		want   Format
+	}{
+		{"", FmtText},
+		{"*/*", FmtText},
+		{"text/plain", FmtText},
+		{"application/json", FmtText},
+		{"application/vnd.google.protobuf;proto=io.prometheus.client.MetricFamily;encoding=delimited;q=0.7,text/plain;version=0.0.4;q=0.3", FmtProtoDelim},
+		{"application/vnd.google.protobuf;proto=io.prometheus.client.MetricFamily;encoding=compact-text", FmtProtoCompactText},
+		{"application/vnd.google.protobuf;proto=io.prometheus.client.MetricFamily;encoding=bla,text/plain", FmtText},
+		{"application/openmetrics-text;version=0.0.1,text/plain;q=0.5", FmtOpenMetrics},
+		{"application/openmetrics-text;version=2.0.0,text/plain;q=0.5", FmtText},
+	}
+	for i, s := range scenarios {
+		h := http.Header{}
+		if s.accept != "" {
+			h.Set("Accept", s.accept)
+		}
+		if got := NegotiateIncludingOpenMetrics(h); got != s.want {
+			t.Errorf("%d. got %q, want %q", i, got, s.want)
+		}
+	}
+
+	// The handlers never serve OpenMetrics as they cannot encode it.
+	h := http.Header{}
+	h.Set("Accept", "application/openmetrics-text;version=0.0.1,text/plain;q=0.5")
+	if _, got := chooseEncoder(&http.Request{Header: h}); got != TextTelemetryContentType {
+		t.Errorf("got %q, want %q", got, TextTelemetryContentType)
+	}
+}
+
+func TestUnregister(t *testing.T) {
+	registry := newRegistry()
+	vec := NewCounterVec(
+		CounterOpts{Name: "test", Help: "helpless"},
+		[]string{"code"},
+	)
+	if _, err := registry.Register(vec); err != nil {
+		t.Fatal(err)
+	}
+	vec.WithLabelValues("200").Inc()
+
+	var wg sync.WaitGroup
+	results := make(chan bool, 10)
+	for i := 0; i < cap(results); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results <- registry.Unregister(vec)
+		}()
+	}
+	wg.Wait()
+	close(results)
+	unregistered := 0
+	for ok := range results {
+		if ok {
+			unregistered++
+		}
+	}
+	if got, want := unregistered, 1; got != want {
+		t.Errorf("got %d successful unregistrations, want %d", got, want)
+	}
+	if got, want := len(vec.children), 0; got != want {
+		t.Errorf("got %d children after unregistering, want %d", got, want)
+	}
+
+	if _, err := registry.Register(vec); err != nil {
+		t.Fatal(err)
+	}
+	vec.WithLabelValues("500").Inc()
+	if _, err := registry.Register(NewGauge(GaugeOpts{Name: "other", Help: "helpless"})); err != nil {
+		t.Fatal(err)
+	}
+	registry.UnregisterAll()
+	if got, want := len(registry.collectorsByID), 0; got != want {
+		t.Errorf("got %d collectors after UnregisterAll, want %d", got, want)
+	}
+	if got, want := len(vec.children), 0; got != want {
+		t.Errorf("got %d children after UnregisterAll, want %d", got, want)
+	}
+	if _, err := registry.Register(vec); err != nil {
+		t.Errorf("registering again after UnregisterAll failed: %s", err)
+	}
+}
+
+func TestWrapRegistererWith(t *testing.T) {
+	r := NewRegistry()
+	reg := WrapRegistererWithPrefix("lib_", WrapRegistererWith(Labels{"region": "us-east-1"}, r))
+	vec := NewCounterVec(CounterOpts{Name: "requests_total", Help: "helpless"}, []string{"code"})
+	reg.MustRegister(vec)
+	vec.WithLabelValues("200").Inc()
+
+	mfs, err := r.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(mfs), 1; got != want {
+		t.Fatalf("got %d metric families, want %d", got, want)
+	}
+	if got, want := mfs[0].GetName(), "lib_requests_total"; got != want {
+		t.Errorf("got name %q, want %q", got, want)
+	}
+	var labels []string
+	for _, lp := range mfs[0].Metric[0].Label {
+		labels = append(labels, lp.GetName()+"="+lp.GetValue())
+	}
+	if got, want := strings.Join(labels, ","), "code=200,region=us-east-1"; got != want {
+		t.Errorf("got labels %q, want %q", got, want)
+	}
+
+	err = reg.Register(vec)
+	are, ok := err.(AlreadyRegisteredError)
+	if !ok {
+		t.Fatalf("got error %v, want an AlreadyRegisteredError", err)
+	}
+	if are.ExistingCollector != vec || are.NewCollector != vec {
+		t.Error("expected AlreadyRegisteredError to refer to the unwrapped collectors")
+	}
+
+	colliding := NewGauge(GaugeOpts{Name: "g", Help: "helpless", ConstLabels: Labels{"region": "eu"}})
+	if err := reg.Register(colliding); err == nil {
+		t.Error("expected error registering a collector with a colliding label")
+	}
+	collidingVec := NewGaugeVec(GaugeOpts{Name: "gv", Help: "helpless"}, []string{"region"})
+	if err := reg.Register(collidingVec); err == nil {
+		t.Error("expected error registering a collector with a colliding variable label")
+	}
+
+	if !reg.Unregister(vec) {
+		t.Error("expected Unregister of the unwrapped collector to succeed")
+	}
+	if mfs, err := r.Gather(); err != nil || len(mfs) != 0 {
+		t.Errorf("got %d metric families and error %v after Unregister, want none", len(mfs), err)
+	}
+	if got := len(vec.children); got != 0 {
+		t.Errorf("got %d children after Unregister, want the vector to be reset", got)
+	}
+}
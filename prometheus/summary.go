@@ -53,7 +53,8 @@ type Summary interface {
 }
 
 var (
-	// DefObjectives are the default Summary quantile values.
+	// DefObjectives are commonly used Summary quantile values with their
+	// absolute errors, see SummaryOpts.Objectives.
 	DefObjectives = map[float64]float64{0.5: 0.05, 0.9: 0.01, 0.99: 0.001}
 
 	errQuantileLabelNotAllowed = fmt.Errorf(
@@ -111,10 +112,38 @@ type SummaryOpts struct {
 	// metric name).
 	ConstLabels Labels
 
+	// DeprecatedVersion marks this Summary as deprecated since the given
+	// version. See the equally named field in Opts for details.
+	DeprecatedVersion string
+
+	// TrackLastObserved makes the children of a SummaryVec record the time
+	// they were last updated. See the equally named field in Opts for
+	// details.
+	TrackLastObserved bool
+
+	// HashSeed is mixed into the hash of the label values of the
+	// children of a SummaryVec. See the equally named field in Opts.
+	HashSeed uint64
+
 	// Objectives defines the quantile rank estimates with their respective
-	// absolute error. The default value is DefObjectives.
+	// absolute error. If Objectives is nil or empty, no quantiles are
+	// calculated, and the Summary only exposes its sum and count. Use
+	// DefObjectives for a reasonable set of quantiles. (The
+	// Summaries created by NewRingBufferSummary, NewDDSketchSummary, and
+	// NewTDigestSummary still default to DefObjectives, as estimating
+	// quantiles is their sole purpose.)
 	Objectives map[float64]float64
 
+	// ObjectivesOverrides replaces Objectives for selected Summaries of a
+	// SummaryVec. When a new Summary is created within a SummaryVec, the
+	// overrides are checked in order, and the Objectives of the first
+	// override whose Labels all match the variable label values of the new
+	// Summary are used instead of the Objectives above. Summaries without a
+	// matching override use the Objectives above. Overrides naming labels
+	// that are not variable labels of the SummaryVec never match. The field
+	// is ignored by NewSummary.
+	ObjectivesOverrides []ObjectivesOverride
+
 	// MaxAge defines the duration for which an observation stays relevant
 	// for the summary. Must be positive. The default value is DefMaxAge.
 	MaxAge time.Duration
@@ -128,12 +157,82 @@ type SummaryOpts struct {
 	// passed. The default value is DefAgeBuckets.
 	AgeBuckets uint32
 
+	// StreamDuration, if positive, is the interval at which the age
+	// buckets are rotated, i.e. the time span each of them covers. It
+	// allows to choose the temporal resolution independently of MaxAge,
+	// e.g. a MaxAge of one hour with a StreamDuration of one minute,
+	// which results in 60 age buckets. MaxAge must be a multiple of
+	// StreamDuration, and AgeBuckets must either be left at 0 or be
+	// MaxAge / StreamDuration.
+	StreamDuration time.Duration
+
 	// BufCap defines the default sample stream buffer size.  The default
 	// value of DefBufCap should suffice for most uses. If there is a need
 	// to increase the value, a multiple of 500 is recommended (because that
 	// is the internal buffer size of the underlying package
 	// "github.com/bmizerany/perks/quantile").
 	BufCap uint32
+
+	// Algorithm selects the algorithm used to estimate the quantiles.
+	// The default value is AlgoCkms. See SummaryAlgorithm for the
+	// tradeoffs.
+	Algorithm SummaryAlgorithm
+
+	// NewEstimator, if not nil, is called with the Objectives to create
+	// the QuantileEstimator for each age bucket, which allows to plug in
+	// an algorithm of choice. It takes precedence over Algorithm.
+	NewEstimator func(objectives map[float64]float64) QuantileEstimator
+
+	// ErrorHandler, if not nil, is called with ErrInvalidObservation for
+	// each observed value that is dropped according to NaNPolicy or
+	// InfPolicy.
+	ErrorHandler func(err error, v float64)
+
+	// NaNPolicy and InfPolicy determine what happens to observed NaN and
+	// infinite values, which would otherwise render the sum and possibly
+	// the quantiles meaningless. See the equally named fields in
+	// HistogramOpts, also for the defaults. The counters of the dropped
+	// values are collected along with the Summary (or SummaryVec).
+	NaNPolicy NaNPolicy
+	InfPolicy InfPolicy
+}
+
+// ObjectivesOverride pairs a set of label values with the quantile objectives to
+// use for Summaries in a SummaryVec that carry those label values. See the
+// ObjectivesOverrides field in SummaryOpts.
+type ObjectivesOverride struct {
+	// Labels is the (partial) set of variable label values a Summary must
+	// have for the override to apply.
+	Labels Labels
+	// Objectives is used instead of SummaryOpts.Objectives for matching
+	// Summaries.
+	Objectives map[float64]float64
+}
+
+// objectivesFor returns the objectives of the first override matching the
+// given label values (in the order of the variable labels in desc), or the
+// default objectives in opts if no override matches.
+func (opts SummaryOpts) objectivesFor(desc *Desc, labelValues []string) map[float64]float64 {
+overrides:
+	for _, o := range opts.ObjectivesOverrides {
+		for name, value := range o.Labels {
+			found := false
+			for i, n := range desc.variableLabels {
+				if n == name {
+					if labelValues[i] != value {
+						continue overrides
+					}
+					found = true
+					break
+				}
+			}
+			if !found {
+				continue overrides
+			}
+		}
+		return o.Objectives
+	}
+	return opts.Objectives
 }
 
 // TODO: Great fuck-up with the sliding-window decay algorithm... The Merge
@@ -151,17 +250,19 @@ type SummaryOpts struct {
 // on scrape time (see code up commit 6b9530d72ea715f0ba612c0120e6e09fbf1d49d0)
 // can't be used anymore.
 
-// NewSummary creates a new Summary based on the provided SummaryOpts.
+// NewSummary creates a new Summary based on the provided SummaryOpts. It panics
+// if NaNPolicyError or InfPolicyError is set without an ErrorHandler.
 func NewSummary(opts SummaryOpts) Summary {
-	return newSummary(
-		NewDesc(
-			BuildFQName(opts.Namespace, opts.Subsystem, opts.Name),
-			opts.Help,
-			nil,
-			opts.ConstLabels,
-		),
-		opts,
+	desc := NewDesc(
+		BuildFQName(opts.Namespace, opts.Subsystem, opts.Name),
+		opts.Help,
+		nil,
+		opts.ConstLabels,
 	)
+	desc.deprecatedVersion = opts.DeprecatedVersion
+	s := newSummary(desc, opts).(*summary)
+	s.invalid.track(desc, opts.ConstLabels)
+	return s
 }
 
 func newSummary(desc *Desc, opts SummaryOpts, labelValues ...string) Summary {
@@ -180,10 +281,6 @@ func newSummary(desc *Desc, opts SummaryOpts, labelValues ...string) Summary {
 		}
 	}
 
-	if len(opts.Objectives) == 0 {
-		opts.Objectives = DefObjectives
-	}
-
 	if opts.MaxAge < 0 {
 		panic(fmt.Errorf("illegal max age MaxAge=%v", opts.MaxAge))
 	}
@@ -191,6 +288,25 @@ func newSummary(desc *Desc, opts SummaryOpts, labelValues ...string) Summary {
 		opts.MaxAge = DefMaxAge
 	}
 
+	if opts.StreamDuration < 0 {
+		panic(fmt.Errorf("illegal stream duration StreamDuration=%v", opts.StreamDuration))
+	}
+	if opts.StreamDuration > 0 {
+		if opts.MaxAge%opts.StreamDuration != 0 {
+			panic(fmt.Errorf(
+				"max age MaxAge=%v of summary %s is not a multiple of StreamDuration=%v",
+				opts.MaxAge, desc, opts.StreamDuration,
+			))
+		}
+		ageBuckets := uint32(opts.MaxAge / opts.StreamDuration)
+		if opts.AgeBuckets != 0 && opts.AgeBuckets != ageBuckets {
+			panic(fmt.Errorf(
+				"AgeBuckets=%d of summary %s contradicts MaxAge=%v and StreamDuration=%v",
+				opts.AgeBuckets, desc, opts.MaxAge, opts.StreamDuration,
+			))
+		}
+		opts.AgeBuckets = ageBuckets
+	}
 	if opts.AgeBuckets == 0 {
 		opts.AgeBuckets = DefAgeBuckets
 	}
@@ -199,9 +315,15 @@ func newSummary(desc *Desc, opts SummaryOpts, labelValues ...string) Summary {
 		opts.BufCap = DefBufCap
 	}
 
+	newEstimator := opts.NewEstimator
+	if newEstimator == nil {
+		newEstimator = opts.Algorithm.newEstimator(desc)
+	}
+
 	s := &summary{
 		desc: desc,
 
+		newEstimator:     newEstimator,
 		objectives:       opts.Objectives,
 		sortedObjectives: make([]float64, 0, len(opts.Objectives)),
 
@@ -210,6 +332,7 @@ func newSummary(desc *Desc, opts SummaryOpts, labelValues ...string) Summary {
 		hotBuf:         make([]float64, 0, opts.BufCap),
 		coldBuf:        make([]float64, 0, opts.BufCap),
 		streamDuration: opts.MaxAge / time.Duration(opts.AgeBuckets),
+		invalid:        newInvalidObservations("summary", desc, opts.NaNPolicy, opts.InfPolicy, opts.ErrorHandler),
 	}
 	s.headStreamExpTime = time.Now().Add(s.streamDuration)
 	s.hotBufExpTime = s.headStreamExpTime
@@ -237,6 +360,7 @@ type summary struct {
 
 	desc *Desc
 
+	newEstimator     func(objectives map[float64]float64) QuantileEstimator
 	objectives       map[float64]float64
 	sortedObjectives []float64
 
@@ -247,11 +371,13 @@ type summary struct {
 
 	hotBuf, coldBuf []float64
 
-	streams                          []*quantile.Stream
+	streams                          []QuantileEstimator
 	streamDuration                   time.Duration
-	headStream                       *quantile.Stream
+	headStream                       QuantileEstimator
 	headStreamIdx                    int
 	headStreamExpTime, hotBufExpTime time.Time
+
+	invalid *invalidObservations
 }
 
 func (s *summary) Desc() *Desc {
@@ -259,6 +385,10 @@ func (s *summary) Desc() *Desc {
 }
 
 func (s *summary) Observe(v float64) {
+	v, ok := s.invalid.filter(v)
+	if !ok {
+		return
+	}
 	s.bufMtx.Lock()
 	defer s.bufMtx.Unlock()
 
@@ -272,6 +402,18 @@ func (s *summary) Observe(v float64) {
 	}
 }
 
+// Describe implements Collector.
+func (s *summary) Describe(ch chan<- *Desc) {
+	s.SelfCollector.Describe(ch)
+	s.invalid.Describe(ch)
+}
+
+// Collect implements Collector.
+func (s *summary) Collect(ch chan<- Metric) {
+	s.SelfCollector.Collect(ch)
+	s.invalid.Collect(ch)
+}
+
 func (s *summary) Write(out *dto.Metric) error {
 	sum := &dto.Summary{}
 	qs := make([]*dto.Quantile, 0, len(s.objectives))
@@ -287,15 +429,9 @@ func (s *summary) Write(out *dto.Metric) error {
 	sum.SampleSum = proto.Float64(s.sum)
 
 	for _, rank := range s.sortedObjectives {
-		var q float64
-		if s.headStream.Count() == 0 {
-			q = math.NaN()
-		} else {
-			q = s.headStream.Query(rank)
-		}
 		qs = append(qs, &dto.Quantile{
 			Quantile: proto.Float64(rank),
-			Value:    proto.Float64(q),
+			Value:    proto.Float64(s.headStream.Quantile(rank)),
 		})
 	}
 
@@ -311,8 +447,8 @@ func (s *summary) Write(out *dto.Metric) error {
 	return nil
 }
 
-func (s *summary) newStream() *quantile.Stream {
-	return quantile.NewTargeted(s.objectives)
+func (s *summary) newStream() QuantileEstimator {
+	return s.newEstimator(s.objectives)
 }
 
 // asyncFlush needs bufMtx locked.
@@ -346,7 +482,7 @@ func (s *summary) maybeRotateStreams() {
 func (s *summary) flushColdBuf() {
 	for _, v := range s.coldBuf {
 		for _, stream := range s.streams {
-			stream.Insert(v)
+			stream.Observe(v)
 		}
 		s.cnt++
 		s.sum += v
@@ -367,6 +503,1080 @@ func (s *summary) swapBufs(now time.Time) {
 	}
 }
 
+// reset discards all observations made so far if fewer than n observations
+// have been made (or unconditionally if n is negative). It returns whether the
+// observations were discarded.
+func (s *summary) reset(n int) bool {
+	s.bufMtx.Lock()
+	defer s.bufMtx.Unlock()
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	// coldBuf is always empty while mtx is unlocked.
+	if n >= 0 && s.cnt+uint64(len(s.hotBuf)) >= uint64(n) {
+		return false
+	}
+	s.hotBuf = s.hotBuf[0:0]
+	for _, stream := range s.streams {
+		stream.Reset()
+	}
+	s.cnt = 0
+	s.sum = 0
+	return true
+}
+
+// QuantileEstimator estimates quantiles of a stream of observations. A Summary
+// delegates to one QuantileEstimator per age bucket. The methods of a
+// QuantileEstimator are never called concurrently.
+type QuantileEstimator interface {
+	// Observe adds an observation.
+	Observe(float64)
+	// Quantile returns the estimate of the given quantile. It is only
+	// called for the objectives the QuantileEstimator was created with.
+	// It returns NaN if there are no observations.
+	Quantile(float64) float64
+	// Reset discards all observations.
+	Reset()
+}
+
+// SummaryAlgorithm is the algorithm a Summary uses to estimate its quantiles.
+type SummaryAlgorithm int
+
+// Possible values for SummaryAlgorithm.
+const (
+	// AlgoCkms is the targeted quantile algorithm by Cormode, Korn,
+	// Muthukrishnan, and Srivastava, as implemented by the package
+	// "github.com/beorn7/perks/quantile". It honors the error of each
+	// objective, and its memory usage grows slowly with the number of
+	// observations.
+	AlgoCkms SummaryAlgorithm = iota
+	// AlgoP2 is the P-square algorithm by Jain and Chlamtac. It keeps only
+	// five markers per objective, so it uses constant memory and time per
+	// observation, but it does not guarantee any error bound, and its
+	// estimates are poor for multimodal distributions.
+	AlgoP2
+	// AlgoGK is the algorithm by Greenwald and Khanna. It guarantees the
+	// smallest error of all objectives for every quantile, so it uses
+	// more memory than AlgoCkms for objectives with different errors.
+	AlgoGK
+)
+
+// newEstimator returns the function creating QuantileEstimators for a. It
+// panics for unknown algorithms.
+func (a SummaryAlgorithm) newEstimator(desc *Desc) func(map[float64]float64) QuantileEstimator {
+	switch a {
+	case AlgoCkms:
+		return func(objectives map[float64]float64) QuantileEstimator {
+			return ckmsEstimator{quantile.NewTargeted(objectives)}
+		}
+	case AlgoP2:
+		return newP2Estimator
+	case AlgoGK:
+		return newGKEstimator
+	}
+	panic(fmt.Errorf("unknown summary algorithm %d for summary %s", a, desc))
+}
+
+// ckmsEstimator is a QuantileEstimator for AlgoCkms.
+type ckmsEstimator struct {
+	*quantile.Stream
+}
+
+func (e ckmsEstimator) Observe(v float64) {
+	e.Insert(v)
+}
+
+func (e ckmsEstimator) Quantile(q float64) float64 {
+	if e.Count() == 0 {
+		return math.NaN()
+	}
+	return e.Query(q)
+}
+
+// p2Estimator is a QuantileEstimator for AlgoP2, which estimates each
+// objective with its own set of five markers.
+type p2Estimator map[float64]*p2Markers
+
+func newP2Estimator(objectives map[float64]float64) QuantileEstimator {
+	e := make(p2Estimator, len(objectives))
+	for q := range objectives {
+		e[q] = newP2Markers(q)
+	}
+	return e
+}
+
+func (e p2Estimator) Observe(v float64) {
+	for _, m := range e {
+		m.observe(v)
+	}
+}
+
+func (e p2Estimator) Quantile(q float64) float64 {
+	m, ok := e[q]
+	if !ok {
+		return math.NaN()
+	}
+	return m.quantile()
+}
+
+func (e p2Estimator) Reset() {
+	for q := range e {
+		e[q] = newP2Markers(q)
+	}
+}
+
+// p2Markers are the five markers of the P-square algorithm estimating the
+// p-quantile. The middle marker is the estimate.
+type p2Markers struct {
+	p       float64
+	count   int
+	heights [5]float64 // Sorted observations while count < 5.
+	pos     [5]float64 // Actual positions.
+	desired [5]float64 // Desired positions.
+	inc     [5]float64 // Increments of the desired positions.
+}
+
+func newP2Markers(p float64) *p2Markers {
+	return &p2Markers{
+		p:       p,
+		pos:     [5]float64{0, 1, 2, 3, 4},
+		desired: [5]float64{0, 2 * p, 4 * p, 2 + 2*p, 4},
+		inc:     [5]float64{0, p / 2, p, (1 + p) / 2, 1},
+	}
+}
+
+func (m *p2Markers) observe(v float64) {
+	if m.count < 5 {
+		m.heights[m.count] = v
+		m.count++
+		sort.Float64s(m.heights[:m.count])
+		return
+	}
+	m.count++
+
+	// Find the cell of v, extending the extreme markers if needed.
+	var k int
+	switch {
+	case v < m.heights[0]:
+		m.heights[0] = v
+	case v >= m.heights[4]:
+		m.heights[4] = v
+		k = 3
+	default:
+		for k = 0; k < 3 && v >= m.heights[k+1]; k++ {
+		}
+	}
+	for i := k + 1; i < 5; i++ {
+		m.pos[i]++
+	}
+	for i := range m.desired {
+		m.desired[i] += m.inc[i]
+	}
+
+	// Adjust the middle markers towards their desired positions.
+	for i := 1; i < 4; i++ {
+		d := m.desired[i] - m.pos[i]
+		if !(d >= 1 && m.pos[i+1]-m.pos[i] > 1) && !(d <= -1 && m.pos[i-1]-m.pos[i] < -1) {
+			continue
+		}
+		sign := math.Copysign(1, d)
+		if h := m.parabolic(i, sign); m.heights[i-1] < h && h < m.heights[i+1] {
+			m.heights[i] = h
+		} else {
+			j := i + int(sign)
+			m.heights[i] += sign * (m.heights[j] - m.heights[i]) / (m.pos[j] - m.pos[i])
+		}
+		m.pos[i] += sign
+	}
+}
+
+// parabolic returns the height of marker i moved by d (1 or -1) according to
+// the piecewise-parabolic prediction formula.
+func (m *p2Markers) parabolic(i int, d float64) float64 {
+	h, n := m.heights, m.pos
+	return h[i] + d/(n[i+1]-n[i-1])*((n[i]-n[i-1]+d)*(h[i+1]-h[i])/(n[i+1]-n[i])+
+		(n[i+1]-n[i]-d)*(h[i]-h[i-1])/(n[i]-n[i-1]))
+}
+
+func (m *p2Markers) quantile() float64 {
+	switch {
+	case m.count == 0:
+		return math.NaN()
+	case m.count < 5:
+		return nearestRank(m.heights[:m.count], m.p)
+	}
+	return m.heights[2]
+}
+
+// gkEstimator is a QuantileEstimator for AlgoGK.
+type gkEstimator struct {
+	epsilon float64
+	n       int
+	tuples  []gkTuple // Sorted by value.
+}
+
+// gkTuple is a summarized observation. g is the difference between its
+// minimum rank and the minimum rank of the previous tuple, and delta is the
+// difference between its maximum and minimum rank.
+type gkTuple struct {
+	v        float64
+	g, delta int
+}
+
+// newGKEstimator returns a gkEstimator with the smallest error of the provided
+// objectives.
+func newGKEstimator(objectives map[float64]float64) QuantileEstimator {
+	epsilon := math.Inf(+1)
+	for _, e := range objectives {
+		if e > 0 && e < epsilon {
+			epsilon = e
+		}
+	}
+	if math.IsInf(epsilon, +1) {
+		epsilon = 0.001
+	}
+	return &gkEstimator{epsilon: epsilon}
+}
+
+func (e *gkEstimator) Observe(v float64) {
+	i := sort.Search(len(e.tuples), func(i int) bool { return e.tuples[i].v > v })
+	var delta int
+	if i > 0 && i < len(e.tuples) {
+		delta = int(math.Floor(2 * e.epsilon * float64(e.n)))
+	}
+	e.tuples = append(e.tuples, gkTuple{})
+	copy(e.tuples[i+1:], e.tuples[i:])
+	e.tuples[i] = gkTuple{v: v, g: 1, delta: delta}
+	e.n++
+	if period := int(1 / (2 * e.epsilon)); period < 1 || e.n%period == 0 {
+		e.compress()
+	}
+}
+
+// compress merges adjacent tuples as long as the error bound allows it.
+func (e *gkEstimator) compress() {
+	limit := int(math.Floor(2 * e.epsilon * float64(e.n)))
+	for i := len(e.tuples) - 2; i >= 1; i-- {
+		next := e.tuples[i+1]
+		if e.tuples[i].g+next.g+next.delta <= limit {
+			e.tuples[i+1].g += e.tuples[i].g
+			e.tuples = append(e.tuples[:i], e.tuples[i+1:]...)
+		}
+	}
+}
+
+func (e *gkEstimator) Quantile(q float64) float64 {
+	if e.n == 0 {
+		return math.NaN()
+	}
+	bound := q*float64(e.n) + e.epsilon*float64(e.n)
+	var rmin int
+	for i, t := range e.tuples {
+		rmin += t.g
+		if float64(rmin+t.delta) > bound {
+			if i == 0 {
+				return t.v
+			}
+			return e.tuples[i-1].v
+		}
+	}
+	return e.tuples[len(e.tuples)-1].v
+}
+
+func (e *gkEstimator) Reset() {
+	e.n = 0
+	e.tuples = e.tuples[:0]
+}
+
+// SummaryWithReset is a Summary that can discard all its observations so far,
+// either on demand or periodically. In addition to the Summary, it collects a
+// gauge with the suffix "_reset_timestamp_seconds" that contains the Unix time
+// of the last reset in seconds.
+//
+// To create SummaryWithReset instances, use NewSummaryWithReset.
+type SummaryWithReset interface {
+	Summary
+
+	// Reset discards all observations made so far.
+	Reset()
+	// ResetIfLessThan works like Reset, but only discards the observations
+	// if fewer than n observations have been made since the last
+	// reset. It returns whether the observations were discarded.
+	ResetIfLessThan(n int) bool
+	// Close stops the periodic reset. It is safe to call Close more than
+	// once.
+	Close()
+}
+
+// NewSummaryWithReset creates a new SummaryWithReset based on the provided
+// SummaryOpts. Every resetInterval, all observations are discarded by a
+// background goroutine. Unlike the sliding time window configured by MaxAge,
+// the reset is unconditional, i.e. the quantiles, the count, and the sum all
+// start from scratch. If resetInterval is 0, no background goroutine is started
+// and resets only happen on demand. Call Close if the SummaryWithReset is not
+// needed anymore to stop the background goroutine.
+func NewSummaryWithReset(opts SummaryOpts, resetInterval time.Duration) SummaryWithReset {
+	s := NewSummary(opts).(*summary)
+	result := &resettingSummary{
+		summary: s,
+		resetDesc: NewDesc(
+			s.desc.fqName+"_reset_timestamp_seconds",
+			"Unix time in seconds of the last reset of "+s.desc.fqName+".",
+			nil,
+			opts.ConstLabels,
+		),
+		lastReset: time.Now(),
+		done:      make(chan struct{}),
+	}
+	result.resetDesc.deprecatedVersion = opts.DeprecatedVersion
+	if resetInterval > 0 {
+		go result.resetPeriodically(resetInterval)
+	}
+	return result
+}
+
+type resettingSummary struct {
+	*summary
+
+	resetDesc *Desc
+	resetMtx  sync.Mutex // Protects lastReset.
+	lastReset time.Time
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func (s *resettingSummary) resetPeriodically(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.Reset()
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// Describe implements Collector.
+func (s *resettingSummary) Describe(ch chan<- *Desc) {
+	ch <- s.desc
+	ch <- s.resetDesc
+}
+
+// Collect implements Collector.
+func (s *resettingSummary) Collect(ch chan<- Metric) {
+	s.resetMtx.Lock()
+	lastReset := s.lastReset
+	s.resetMtx.Unlock()
+
+	ch <- s.summary
+	ch <- MustNewConstMetric(
+		s.resetDesc, GaugeValue,
+		float64(lastReset.UnixNano())/float64(time.Second),
+	)
+}
+
+// Reset implements SummaryWithReset.
+func (s *resettingSummary) Reset() {
+	s.ResetIfLessThan(-1)
+}
+
+// ResetIfLessThan implements SummaryWithReset.
+func (s *resettingSummary) ResetIfLessThan(n int) bool {
+	s.resetMtx.Lock()
+	defer s.resetMtx.Unlock()
+
+	if !s.summary.reset(n) {
+		return false
+	}
+	s.lastReset = time.Now()
+	return true
+}
+
+// Close implements SummaryWithReset.
+func (s *resettingSummary) Close() {
+	s.closeOnce.Do(func() { close(s.done) })
+}
+
+// RingHistogram is a Summary that reports exact quantiles as long as it has
+// seen only a small number of observations. For that, it keeps the first
+// observations in a buffer. Once more observations have been made than fit into
+// the buffer, it falls back to the estimated quantiles of a regular Summary,
+// which is fed with all observations from the start. This is a "best effort
+// exact" Summary for low-volume metrics, where the error of the estimation is
+// significant.
+//
+// To create RingHistogram instances, use NewRingHistogram.
+type RingHistogram interface {
+	Summary
+
+	// ExactQuantile returns the exact q-quantile of the observations,
+	// using the nearest-rank method. It returns false if there are no
+	// observations or too many observations for an exact result.
+	ExactQuantile(q float64) (float64, bool)
+}
+
+// RingHistogramOpts bundles the options for creating a RingHistogram. The
+// embedded SummaryOpts configure the fallback Summary. Its Objectives also
+// determine the ranks of the exact quantiles.
+type RingHistogramOpts struct {
+	SummaryOpts
+
+	// Capacity is the maximum number of observations for which exact
+	// quantiles are reported. It must be positive.
+	Capacity int
+}
+
+// NewRingHistogram creates a new RingHistogram based on the provided
+// RingHistogramOpts. It panics under the same conditions as NewSummary and if
+// the Capacity is not positive.
+func NewRingHistogram(opts RingHistogramOpts) RingHistogram {
+	if opts.Capacity < 1 {
+		panic(fmt.Errorf("ring histogram needs a positive capacity, got %d", opts.Capacity))
+	}
+	result := &ringHistogram{
+		fallback: NewSummary(opts.SummaryOpts),
+		capacity: opts.Capacity,
+		values:   make([]float64, 0, opts.Capacity),
+	}
+	result.Init(result) // Init self-collection.
+	return result
+}
+
+type ringHistogram struct {
+	SelfCollector
+
+	fallback Summary
+	capacity int
+
+	mtx      sync.Mutex // Protects the fields below.
+	values   []float64  // Nil once more than capacity observations were made.
+	overflow bool
+}
+
+func (h *ringHistogram) Desc() *Desc {
+	return h.fallback.Desc()
+}
+
+func (h *ringHistogram) Observe(v float64) {
+	h.fallback.Observe(v)
+
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	if h.overflow {
+		return
+	}
+	if len(h.values) == h.capacity {
+		h.overflow = true
+		h.values = nil
+		return
+	}
+	h.values = append(h.values, v)
+}
+
+// sortedValues returns a sorted copy of the buffered observations, or nil if
+// there are too many observations for exact quantiles.
+func (h *ringHistogram) sortedValues() []float64 {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	if h.overflow {
+		return nil
+	}
+	values := make([]float64, len(h.values))
+	copy(values, h.values)
+	sort.Float64s(values)
+	return values
+}
+
+// nearestRank returns the q-quantile of the sorted values, which must not be
+// empty, using the nearest-rank method.
+func nearestRank(sorted []float64, q float64) float64 {
+	i := int(math.Ceil(q*float64(len(sorted)))) - 1
+	switch {
+	case i < 0:
+		i = 0
+	case i >= len(sorted):
+		i = len(sorted) - 1
+	}
+	return sorted[i]
+}
+
+func (h *ringHistogram) ExactQuantile(q float64) (float64, bool) {
+	values := h.sortedValues()
+	if len(values) == 0 {
+		return math.NaN(), false
+	}
+	return nearestRank(values, q), true
+}
+
+func (h *ringHistogram) Write(out *dto.Metric) error {
+	// Take the exact values first so that they cannot include observations
+	// the fallback has not seen yet.
+	values := h.sortedValues()
+	if err := h.fallback.Write(out); err != nil {
+		return err
+	}
+	if len(values) == 0 {
+		return nil
+	}
+	for _, q := range out.Summary.Quantile {
+		q.Value = proto.Float64(nearestRank(values, q.GetQuantile()))
+	}
+	return nil
+}
+
+// RingBufferSummary is a Summary that calculates its quantiles exactly over
+// the last observations rather than estimating them over a sliding time
+// window. This is useful for quantities like "the latency of the last 1000
+// requests", e.g. for admission control. Count and sum still cover all
+// observations.
+//
+// To create RingBufferSummary instances, use NewRingBufferSummary.
+type RingBufferSummary interface {
+	Summary
+
+	// Quantile returns the exact q-quantile of the buffered observations,
+	// using the nearest-rank method, or NaN if there are no observations.
+	Quantile(q float64) float64
+}
+
+// RingBufferSummaryOpts bundles the options for creating a
+// RingBufferSummary. Of the embedded SummaryOpts, only the naming fields,
+// ConstLabels, DeprecatedVersion, and the ranks of the Objectives are used.
+type RingBufferSummaryOpts struct {
+	SummaryOpts
+
+	// Capacity is the number of most recent observations the quantiles
+	// are calculated over. It must be positive.
+	Capacity int
+}
+
+// NewRingBufferSummary creates a new RingBufferSummary based on the provided
+// RingBufferSummaryOpts. Each observation is stored in a ring buffer of the
+// configured Capacity, overwriting the oldest one once the buffer is full. The
+// buffer is sorted upon each collection (and call of Quantile), so keep the
+// Capacity moderate. NewRingBufferSummary panics if the Capacity is not
+// positive or an objective is not in [0, 1].
+func NewRingBufferSummary(opts RingBufferSummaryOpts) RingBufferSummary {
+	if opts.Capacity < 1 {
+		panic(fmt.Errorf("ring buffer summary needs a positive capacity, got %d", opts.Capacity))
+	}
+	if opts.Objectives == nil {
+		opts.Objectives = DefObjectives
+	}
+	desc := NewDesc(
+		BuildFQName(opts.Namespace, opts.Subsystem, opts.Name),
+		opts.Help,
+		nil,
+		opts.ConstLabels,
+	)
+	desc.deprecatedVersion = opts.DeprecatedVersion
+
+	result := &ringBufferSummary{
+		desc:   desc,
+		values: make([]float64, 0, opts.Capacity),
+	}
+	for q := range opts.Objectives {
+		if q < 0 || q > 1 {
+			panic(fmt.Errorf("ring buffer summary objective %f is not in [0, 1]", q))
+		}
+		result.quantiles = append(result.quantiles, q)
+	}
+	sort.Float64s(result.quantiles)
+	result.Init(result) // Init self-collection.
+	return result
+}
+
+type ringBufferSummary struct {
+	SelfCollector
+
+	desc      *Desc
+	quantiles []float64
+
+	mtx    sync.Mutex // Protects the fields below.
+	values []float64  // The ring buffer, full once len equals cap.
+	next   int        // Index of the oldest value in a full buffer.
+	count  uint64
+	sum    float64
+}
+
+func (s *ringBufferSummary) Desc() *Desc {
+	return s.desc
+}
+
+func (s *ringBufferSummary) Observe(v float64) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	if len(s.values) < cap(s.values) {
+		s.values = append(s.values, v)
+	} else {
+		s.values[s.next] = v
+		s.next = (s.next + 1) % len(s.values)
+	}
+	s.count++
+	s.sum += v
+}
+
+// snapshot returns a sorted copy of the buffered observations, the count, and
+// the sum.
+func (s *ringBufferSummary) snapshot() (sorted []float64, count uint64, sum float64) {
+	s.mtx.Lock()
+	sorted = make([]float64, len(s.values))
+	copy(sorted, s.values)
+	count, sum = s.count, s.sum
+	s.mtx.Unlock()
+
+	sort.Float64s(sorted)
+	return sorted, count, sum
+}
+
+func (s *ringBufferSummary) Quantile(q float64) float64 {
+	sorted, _, _ := s.snapshot()
+	if len(sorted) == 0 {
+		return math.NaN()
+	}
+	return nearestRank(sorted, q)
+}
+
+func (s *ringBufferSummary) Write(out *dto.Metric) error {
+	sorted, count, sum := s.snapshot()
+	summary := &dto.Summary{
+		SampleCount: proto.Uint64(count),
+		SampleSum:   proto.Float64(sum),
+		Quantile:    make([]*dto.Quantile, len(s.quantiles)),
+	}
+	for i, q := range s.quantiles {
+		v := math.NaN()
+		if len(sorted) > 0 {
+			v = nearestRank(sorted, q)
+		}
+		summary.Quantile[i] = &dto.Quantile{
+			Quantile: proto.Float64(q),
+			Value:    proto.Float64(v),
+		}
+	}
+	out.Summary = summary
+	out.Label = s.desc.constLabelPairs
+	return nil
+}
+
+// DDSketchSummaryOpts bundles the options for creating a Summary with
+// NewDDSketchSummary. Of the embedded SummaryOpts, only the naming fields,
+// ConstLabels, DeprecatedVersion, and the ranks of the Objectives are used. The
+// absolute errors of the Objectives, MaxAge, AgeBuckets, and BufCap are
+// ignored, as the error is determined by RelativeAccuracy, and the sketch
+// covers all observations since creation.
+type DDSketchSummaryOpts struct {
+	SummaryOpts
+
+	// RelativeAccuracy is the maximum relative error of the reported
+	// quantiles, i.e. a reported quantile q differs from the true one by
+	// at most RelativeAccuracy * q. It must be in the interval (0, 1).
+	// The default value is DefDDSketchRelativeAccuracy.
+	RelativeAccuracy float64
+}
+
+// DefDDSketchRelativeAccuracy is the default relative accuracy of a Summary
+// created by NewDDSketchSummary.
+const DefDDSketchRelativeAccuracy = 0.01
+
+// NewDDSketchSummary creates a new Summary based on the provided
+// DDSketchSummaryOpts that estimates quantiles with a DDSketch instead of the
+// algorithm used by NewSummary. A DDSketch counts observations in buckets
+// whose boundaries grow exponentially, so that every quantile is reported
+// with the same relative error, no matter how wide the range of the observed
+// values is. The count and the sum are exact. As the number of buckets only
+// grows logarithmically with the range of the observed values, the memory
+// usage stays small. NewDDSketchSummary panics if the RelativeAccuracy is out
+// of range or if an Objective is not in the interval [0, 1].
+func NewDDSketchSummary(opts DDSketchSummaryOpts) Summary {
+	if opts.RelativeAccuracy == 0 {
+		opts.RelativeAccuracy = DefDDSketchRelativeAccuracy
+	}
+	if !(opts.RelativeAccuracy > 0 && opts.RelativeAccuracy < 1) {
+		panic(fmt.Errorf("DDSketch summary needs a relative accuracy in (0, 1), got %f", opts.RelativeAccuracy))
+	}
+	if opts.Objectives == nil {
+		opts.Objectives = DefObjectives
+	}
+	desc := NewDesc(
+		BuildFQName(opts.Namespace, opts.Subsystem, opts.Name),
+		opts.Help,
+		nil,
+		opts.ConstLabels,
+	)
+	desc.deprecatedVersion = opts.DeprecatedVersion
+
+	result := &ddSketchSummary{
+		desc:       desc,
+		logGamma:   math.Log((1 + opts.RelativeAccuracy) / (1 - opts.RelativeAccuracy)),
+		labelPairs: desc.constLabelPairs,
+		positive:   map[int]uint64{},
+		negative:   map[int]uint64{},
+	}
+	for q := range opts.Objectives {
+		if q < 0 || q > 1 {
+			panic(fmt.Errorf("DDSketch summary objective %f is not in [0, 1]", q))
+		}
+		result.quantiles = append(result.quantiles, q)
+	}
+	sort.Float64s(result.quantiles)
+	result.Init(result) // Init self-collection.
+	return result
+}
+
+type ddSketchSummary struct {
+	SelfCollector
+
+	desc       *Desc
+	quantiles  []float64
+	logGamma   float64
+	labelPairs []*dto.LabelPair
+
+	mtx sync.Mutex // Protects the fields below.
+	// positive and negative map bucket indexes to the number of
+	// observations of the absolute value in the bucket. Bucket i
+	// contains values in (gamma^(i-1), gamma^i].
+	positive, negative map[int]uint64
+	zeros              uint64
+	count              uint64
+	sum                float64
+}
+
+func (s *ddSketchSummary) Desc() *Desc {
+	return s.desc
+}
+
+func (s *ddSketchSummary) index(v float64) int {
+	return int(math.Ceil(math.Log(v) / s.logGamma))
+}
+
+// value returns the value representing bucket i, which is off by at most the
+// relative accuracy for all values in the bucket.
+func (s *ddSketchSummary) value(i int) float64 {
+	gamma := math.Exp(s.logGamma)
+	return 2 * math.Pow(gamma, float64(i)) / (gamma + 1)
+}
+
+func (s *ddSketchSummary) Observe(v float64) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	switch {
+	case v > 0:
+		s.positive[s.index(v)]++
+	case v < 0:
+		s.negative[s.index(-v)]++
+	default:
+		s.zeros++
+	}
+	s.count++
+	s.sum += v
+}
+
+func (s *ddSketchSummary) Write(out *dto.Metric) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	sum := &dto.Summary{
+		SampleCount: proto.Uint64(s.count),
+		SampleSum:   proto.Float64(s.sum),
+		Quantile:    make([]*dto.Quantile, 0, len(s.quantiles)),
+	}
+	// Walk the buckets in the order of their values, i.e. the negative
+	// ones by decreasing index first.
+	negIdx, posIdx := sortedBucketIndexes(s.negative), sortedBucketIndexes(s.positive)
+	for i, j := 0, len(negIdx)-1; i < j; i, j = i+1, j-1 {
+		negIdx[i], negIdx[j] = negIdx[j], negIdx[i]
+	}
+	var seen uint64
+	qi := 0
+	emit := func(value float64) {
+		for ; qi < len(s.quantiles) && seen > uint64(s.quantiles[qi]*float64(s.count-1)); qi++ {
+			sum.Quantile = append(sum.Quantile, &dto.Quantile{
+				Quantile: proto.Float64(s.quantiles[qi]),
+				Value:    proto.Float64(value),
+			})
+		}
+	}
+	if s.count > 0 {
+		for _, i := range negIdx {
+			seen += s.negative[i]
+			emit(-s.value(i))
+		}
+		seen += s.zeros
+		emit(0)
+		for _, i := range posIdx {
+			seen += s.positive[i]
+			emit(s.value(i))
+		}
+	}
+	for ; qi < len(s.quantiles); qi++ {
+		sum.Quantile = append(sum.Quantile, &dto.Quantile{
+			Quantile: proto.Float64(s.quantiles[qi]),
+			Value:    proto.Float64(math.NaN()),
+		})
+	}
+	out.Summary = sum
+	out.Label = s.labelPairs
+	return nil
+}
+
+func sortedBucketIndexes(buckets map[int]uint64) []int {
+	indexes := make([]int, 0, len(buckets))
+	for i := range buckets {
+		indexes = append(indexes, i)
+	}
+	sort.Ints(indexes)
+	return indexes
+}
+
+// TDigestSummaryOpts bundles the options for creating a TDigestSummary with
+// NewTDigestSummary. Of the embedded SummaryOpts, the same fields as for
+// DDSketchSummaryOpts are used.
+type TDigestSummaryOpts struct {
+	SummaryOpts
+
+	// Compression controls the tradeoff between accuracy and memory
+	// usage. The t-digest keeps on the order of Compression centroids,
+	// and a higher value yields more accurate quantiles. It must not be
+	// negative. The default value is DefTDigestCompression.
+	Compression float64
+}
+
+// DefTDigestCompression is the default compression of a TDigestSummary.
+const DefTDigestCompression = 100
+
+// TDigestSummary is a Summary that estimates quantiles with a t-digest (see
+// https://github.com/tdunning/t-digest). Unlike other Summaries, the states of
+// two TDigestSummaries can be merged, e.g. to aggregate the observations of
+// several processes before pushing them as one Summary to the Pushgateway. To
+// create TDigestSummary instances, use NewTDigestSummary.
+type TDigestSummary interface {
+	Summary
+
+	// Merge adds all observations of other to the TDigestSummary. It
+	// returns an error if other was not created by NewTDigestSummary or
+	// is the TDigestSummary itself.
+	Merge(other TDigestSummary) error
+}
+
+// NewTDigestSummary creates a new TDigestSummary based on the provided
+// TDigestSummaryOpts. The t-digest clusters the observations in centroids
+// (weighted means), which are the smaller the closer they are to the extreme
+// quantiles. Hence, the extreme quantiles are the most accurate ones, and the
+// memory usage is bounded by the Compression. The count and the sum are exact,
+// and the t-digest covers all observations since creation. NewTDigestSummary
+// panics if the Compression is negative or if an Objective is not in the
+// interval [0, 1].
+func NewTDigestSummary(opts TDigestSummaryOpts) TDigestSummary {
+	if opts.Compression == 0 {
+		opts.Compression = DefTDigestCompression
+	}
+	if !(opts.Compression > 0) {
+		panic(fmt.Errorf("t-digest summary needs a positive compression, got %f", opts.Compression))
+	}
+	if opts.Objectives == nil {
+		opts.Objectives = DefObjectives
+	}
+	desc := NewDesc(
+		BuildFQName(opts.Namespace, opts.Subsystem, opts.Name),
+		opts.Help,
+		nil,
+		opts.ConstLabels,
+	)
+	desc.deprecatedVersion = opts.DeprecatedVersion
+
+	result := &tDigestSummary{
+		desc:        desc,
+		compression: opts.Compression,
+		labelPairs:  desc.constLabelPairs,
+		min:         math.Inf(+1),
+		max:         math.Inf(-1),
+	}
+	for q := range opts.Objectives {
+		if q < 0 || q > 1 {
+			panic(fmt.Errorf("t-digest summary objective %f is not in [0, 1]", q))
+		}
+		result.quantiles = append(result.quantiles, q)
+	}
+	sort.Float64s(result.quantiles)
+	result.Init(result) // Init self-collection.
+	return result
+}
+
+// centroid is a cluster of observations in a t-digest.
+type centroid struct {
+	mean, weight float64
+}
+
+type tDigestSummary struct {
+	SelfCollector
+
+	desc        *Desc
+	quantiles   []float64
+	compression float64
+	labelPairs  []*dto.LabelPair
+
+	mtx sync.Mutex // Protects the fields below.
+	// centroids are sorted by mean. unmerged buffers the centroids added
+	// since the last compression.
+	centroids, unmerged []centroid
+	count               uint64
+	sum, min, max       float64
+}
+
+func (s *tDigestSummary) Desc() *Desc {
+	return s.desc
+}
+
+func (s *tDigestSummary) Observe(v float64) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	s.add(centroid{mean: v, weight: 1})
+	s.count++
+	s.sum += v
+}
+
+// add buffers the provided centroid and compresses the t-digest once the
+// buffer is full. It must be called with mtx locked.
+func (s *tDigestSummary) add(c centroid) {
+	s.unmerged = append(s.unmerged, c)
+	s.min = math.Min(s.min, c.mean)
+	s.max = math.Max(s.max, c.mean)
+	if float64(len(s.unmerged)) >= 5*s.compression {
+		s.compress()
+	}
+}
+
+// compress merges the buffered centroids into the t-digest. Neighboring
+// centroids are merged as long as the merged centroid does not exceed the size
+// bound 4*n*q*(1-q)/compression, where n is the total weight and q the
+// quantile of the merged centroid. It must be called with mtx locked.
+func (s *tDigestSummary) compress() {
+	if len(s.unmerged) == 0 {
+		return
+	}
+	all := append(s.centroids, s.unmerged...)
+	sort.Sort(centroidsByMean(all))
+	var total float64
+	for _, c := range all {
+		total += c.weight
+	}
+	merged := make([]centroid, 0, len(s.centroids)+1)
+	cur := all[0]
+	var before float64 // Weight of the centroids before cur.
+	for _, c := range all[1:] {
+		w := cur.weight + c.weight
+		q := (before + w/2) / total
+		if w <= 4*total*q*(1-q)/s.compression {
+			cur.mean += (c.mean - cur.mean) * c.weight / w
+			cur.weight = w
+			continue
+		}
+		merged = append(merged, cur)
+		before += cur.weight
+		cur = c
+	}
+	s.centroids = append(merged, cur)
+	s.unmerged = s.unmerged[:0]
+}
+
+// quantile returns the estimated q-quantile by interpolating between the means
+// of the centroids, each of which is assumed to be centered at its mean. It
+// must be called with mtx locked after compress.
+func (s *tDigestSummary) quantile(q float64) float64 {
+	if len(s.centroids) == 0 {
+		return math.NaN()
+	}
+	target := q * float64(s.count)
+	prevMean, prevCenter := s.min, 0.
+	var before float64
+	for _, c := range s.centroids {
+		center := before + c.weight/2
+		if target < center {
+			if center == prevCenter {
+				return c.mean
+			}
+			return prevMean + (c.mean-prevMean)*(target-prevCenter)/(center-prevCenter)
+		}
+		prevMean, prevCenter = c.mean, center
+		before += c.weight
+	}
+	if before == prevCenter {
+		return s.max
+	}
+	return prevMean + (s.max-prevMean)*(target-prevCenter)/(before-prevCenter)
+}
+
+// Merge implements TDigestSummary.
+func (s *tDigestSummary) Merge(other TDigestSummary) error {
+	o, ok := other.(*tDigestSummary)
+	if !ok {
+		return fmt.Errorf("cannot merge %T into t-digest summary %s", other, s.desc)
+	}
+	if o == s {
+		return fmt.Errorf("cannot merge t-digest summary %s into itself", s.desc)
+	}
+	// Copy the state of other first so that both are never locked at the
+	// same time, which could deadlock concurrent merges in both
+	// directions.
+	o.mtx.Lock()
+	o.compress()
+	centroids := append([]centroid(nil), o.centroids...)
+	count, sum, min, max := o.count, o.sum, o.min, o.max
+	o.mtx.Unlock()
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	for _, c := range centroids {
+		s.add(c)
+	}
+	s.count += count
+	s.sum += sum
+	s.min = math.Min(s.min, min)
+	s.max = math.Max(s.max, max)
+	return nil
+}
+
+func (s *tDigestSummary) Write(out *dto.Metric) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	s.compress()
+	sum := &dto.Summary{
+		SampleCount: proto.Uint64(s.count),
+		SampleSum:   proto.Float64(s.sum),
+		Quantile:    make([]*dto.Quantile, 0, len(s.quantiles)),
+	}
+	for _, q := range s.quantiles {
+		sum.Quantile = append(sum.Quantile, &dto.Quantile{
+			Quantile: proto.Float64(q),
+			Value:    proto.Float64(s.quantile(q)),
+		})
+	}
+	out.Summary = sum
+	out.Label = s.labelPairs
+	return nil
+}
+
+type centroidsByMean []centroid
+
+func (c centroidsByMean) Len() int {
+	return len(c)
+}
+
+func (c centroidsByMean) Swap(i, j int) {
+	c[i], c[j] = c[j], c[i]
+}
+
+func (c centroidsByMean) Less(i, j int) bool {
+	return c[i].mean < c[j].mean
+}
+
 type quantSort []*dto.Quantile
 
 func (s quantSort) Len() int {
@@ -388,6 +1598,9 @@ func (s quantSort) Less(i, j int) bool {
 // instances with NewSummaryVec.
 type SummaryVec struct {
 	MetricVec
+	// invalid counts the observations dropped by the children because of
+	// the NaNPolicy or InfPolicy.
+	invalid *invalidObservations
 }
 
 // NewSummaryVec creates a new SummaryVec based on the provided SummaryOpts and
@@ -400,18 +1613,55 @@ func NewSummaryVec(opts SummaryOpts, labelNames []string) *SummaryVec {
 		labelNames,
 		opts.ConstLabels,
 	)
+	desc.deprecatedVersion = opts.DeprecatedVersion
+	// All children count their dropped values together.
+	invalid := newInvalidObservations("summary", desc, opts.NaNPolicy, opts.InfPolicy, opts.ErrorHandler)
+	invalid.track(desc, opts.ConstLabels)
 	return &SummaryVec{
 		MetricVec: MetricVec{
 			children: map[uint64]Metric{},
 			desc:     desc,
 			hash:     fnv.New64a(),
+			seed:     hashSeed(opts.HashSeed),
 			newMetric: func(lvs ...string) Metric {
-				return newSummary(desc, opts, lvs...)
+				childOpts := opts
+				childOpts.Objectives = opts.objectivesFor(desc, lvs)
+				s := newSummary(desc, childOpts, lvs...)
+				s.(*summary).invalid = invalid
+				if opts.TrackLastObserved {
+					return &trackedSummary{
+						observedAt: newObservedAt(),
+						Summary:    s,
+					}
+				}
+				return s
 			},
 		},
+		invalid: invalid,
 	}
 }
 
+// Describe implements Collector. It also describes the counts of dropped
+// values.
+func (m *SummaryVec) Describe(ch chan<- *Desc) {
+	m.MetricVec.Describe(ch)
+	m.invalid.Describe(ch)
+}
+
+// Collect implements Collector. It also collects the counts of dropped values.
+func (m *SummaryVec) Collect(ch chan<- Metric) {
+	m.MetricVec.Collect(ch)
+	m.invalid.Collect(ch)
+}
+
+// trackedSummary is a Summary that records the time of its last observation.
+type trackedSummary struct {
+	observedAt
+	Summary
+}
+
+func (s *trackedSummary) Observe(v float64) { s.touch(); s.Summary.Observe(v) }
+
 // GetMetricWithLabelValues replaces the method of the same name in
 // MetricVec. The difference is that this method returns a Summary and not a
 // Metric so that no type conversion is required.
@@ -449,6 +1699,87 @@ func (m *SummaryVec) With(labels Labels) Summary {
 	return m.MetricVec.With(labels).(Summary)
 }
 
+// WithPartialLabels replaces the method of the same name in MetricVec. The
+// difference is that this method returns a PartialSummaryVec and not a
+// PartialMetricVec so that no type conversion is required.
+func (m *SummaryVec) WithPartialLabels(labels Labels) *PartialSummaryVec {
+	return &PartialSummaryVec{*m.MetricVec.WithPartialLabels(labels)}
+}
+
+// CurryWith replaces the method of the same name in MetricVec. The difference
+// is that this method returns a PartialSummaryVec and not a PartialMetricVec so
+// that no type conversion is required.
+func (m *SummaryVec) CurryWith(labels Labels) (*PartialSummaryVec, error) {
+	p, err := m.MetricVec.CurryWith(labels)
+	if err != nil {
+		return nil, err
+	}
+	return &PartialSummaryVec{*p}, nil
+}
+
+// MustCurryWith works as CurryWith, but panics where CurryWith would have
+// returned an error.
+func (m *SummaryVec) MustCurryWith(labels Labels) *PartialSummaryVec {
+	return &PartialSummaryVec{*m.MetricVec.MustCurryWith(labels)}
+}
+
+// PartialSummaryVec is a SummaryVec with some of its variable labels already bound
+// to values. Create instances with the WithPartialLabels method of SummaryVec.
+type PartialSummaryVec struct {
+	PartialMetricVec
+}
+
+// GetMetricWithLabelValues replaces the method of the same name in
+// PartialMetricVec. The difference is that this method returns a Summary and
+// not a Metric so that no type conversion is required.
+func (p *PartialSummaryVec) GetMetricWithLabelValues(lvs ...string) (Summary, error) {
+	metric, err := p.PartialMetricVec.GetMetricWithLabelValues(lvs...)
+	if metric != nil {
+		return metric.(Summary), err
+	}
+	return nil, err
+}
+
+// WithLabelValues works as GetMetricWithLabelValues, but panics where
+// GetMetricWithLabelValues would have returned an error.
+func (p *PartialSummaryVec) WithLabelValues(lvs ...string) Summary {
+	return p.PartialMetricVec.WithLabelValues(lvs...).(Summary)
+}
+
+// GetMetricWith replaces the method of the same name in PartialMetricVec. The
+// difference is that this method returns a Summary and not a Metric so that no
+// type conversion is required.
+func (p *PartialSummaryVec) GetMetricWith(labels Labels) (Summary, error) {
+	metric, err := p.PartialMetricVec.GetMetricWith(labels)
+	if metric != nil {
+		return metric.(Summary), err
+	}
+	return nil, err
+}
+
+// With works as GetMetricWith, but panics where GetMetricWith would have
+// returned an error.
+func (p *PartialSummaryVec) With(labels Labels) Summary {
+	return p.PartialMetricVec.With(labels).(Summary)
+}
+
+// CurryWith replaces the method of the same name in PartialMetricVec. The
+// difference is that this method returns a PartialSummaryVec and not a
+// PartialMetricVec so that no type conversion is required.
+func (p *PartialSummaryVec) CurryWith(labels Labels) (*PartialSummaryVec, error) {
+	curried, err := p.PartialMetricVec.CurryWith(labels)
+	if err != nil {
+		return nil, err
+	}
+	return &PartialSummaryVec{*curried}, nil
+}
+
+// MustCurryWith works as CurryWith, but panics where CurryWith would have
+// returned an error.
+func (p *PartialSummaryVec) MustCurryWith(labels Labels) *PartialSummaryVec {
+	return &PartialSummaryVec{*p.PartialMetricVec.MustCurryWith(labels)}
+}
+
 type constSummary struct {
 	desc       *Desc
 	count      uint64
@@ -16,6 +16,7 @@ package prometheus
 import (
 	"math"
 	"math/rand"
+	"reflect"
 	"sort"
 	"sync"
 	"testing"
@@ -34,7 +35,7 @@ func benchmarkSummaryObserve(w int, b *testing.B) {
 	g := new(sync.WaitGroup)
 	g.Add(1)
 
-	s := NewSummary(SummaryOpts{})
+	s := NewSummary(SummaryOpts{Objectives: DefObjectives})
 
 	for i := 0; i < w; i++ {
 		go func() {
@@ -78,7 +79,7 @@ func benchmarkSummaryWrite(w int, b *testing.B) {
 	g := new(sync.WaitGroup)
 	g.Add(1)
 
-	s := NewSummary(SummaryOpts{})
+	s := NewSummary(SummaryOpts{Objectives: DefObjectives})
 
 	for i := 0; i < 1000000; i++ {
 		s.Observe(float64(i))
@@ -136,8 +137,9 @@ func TestSummaryConcurrency(t *testing.T) {
 		end.Add(concLevel)
 
 		sum := NewSummary(SummaryOpts{
-			Name: "test_summary",
-			Help: "helpless",
+			Name:       "test_summary",
+			Help:       "helpless",
+			Objectives: DefObjectives,
 		})
 
 		allVars := make([]float64, total)
@@ -223,8 +225,9 @@ func TestSummaryVecConcurrency(t *testing.T) {
 
 		sum := NewSummaryVec(
 			SummaryOpts{
-				Name: "test_summary",
-				Help: "helpless",
+				Name:       "test_summary",
+				Help:       "helpless",
+				Objectives: DefObjectives,
 			},
 			[]string{"label"},
 		)
@@ -288,6 +291,90 @@ func TestSummaryVecConcurrency(t *testing.T) {
 	}
 }
 
+func TestSummaryWithoutObjectives(t *testing.T) {
+	sum := NewSummary(SummaryOpts{
+		Name: "test_summary",
+		Help: "helpless",
+	})
+	sum.Observe(1)
+	sum.Observe(2)
+
+	m := &dto.Metric{}
+	sum.Write(m)
+	if got, want := len(m.GetSummary().GetQuantile()), 0; got != want {
+		t.Errorf("got %d quantiles, want %d", got, want)
+	}
+	if got, want := m.GetSummary().GetSampleCount(), uint64(2); got != want {
+		t.Errorf("got count %d, want %d", got, want)
+	}
+	if got, want := m.GetSummary().GetSampleSum(), 3.; got != want {
+		t.Errorf("got sum %f, want %f", got, want)
+	}
+}
+
+func TestSummaryRotationConcurrency(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Skipping test in short mode.")
+	}
+
+	sum := NewSummary(SummaryOpts{
+		Name:       "test_summary",
+		Help:       "helpless",
+		Objectives: DefObjectives,
+		MaxAge:     20 * time.Millisecond,
+		AgeBuckets: 4,
+		BufCap:     16,
+	})
+
+	const (
+		concLevel    = 8
+		observations = 2000
+	)
+	var start, end sync.WaitGroup
+	start.Add(1)
+	end.Add(concLevel)
+	for i := 0; i < concLevel; i++ {
+		go func() {
+			start.Wait()
+			for j := 0; j < observations; j++ {
+				sum.Observe(rand.Float64())
+				if j%100 == 0 {
+					// Let the age buckets rotate in between.
+					time.Sleep(time.Millisecond)
+				}
+			}
+			end.Done()
+		}()
+	}
+	done := make(chan struct{})
+	go func() {
+		end.Wait()
+		close(done)
+	}()
+	start.Done()
+
+	// Collect concurrently while the streams rotate, and once more after
+	// all observations have been made.
+	m := &dto.Metric{}
+	for collecting := true; collecting; {
+		select {
+		case <-done:
+			collecting = false
+		default:
+		}
+		m.Reset()
+		sum.Write(m)
+		for _, q := range m.GetSummary().GetQuantile() {
+			if v := q.GetValue(); !math.IsNaN(v) && (v < 0 || v >= 1) {
+				t.Fatalf("got quantile %f, want a value in [0, 1)", v)
+			}
+		}
+	}
+	if got, want := m.GetSummary().GetSampleCount(), uint64(concLevel*observations); got != want {
+		t.Errorf("got count %d, want %d", got, want)
+	}
+}
+
 func TestSummaryDecay(t *testing.T) {
 	if testing.Short() {
 		t.Skip("Skipping test in short mode.")
@@ -328,6 +415,80 @@ func TestSummaryDecay(t *testing.T) {
 	}
 }
 
+func TestSummaryStreamDuration(t *testing.T) {
+	sum := NewSummary(SummaryOpts{
+		Name:           "test_summary",
+		Help:           "helpless",
+		MaxAge:         time.Hour,
+		StreamDuration: time.Minute,
+	}).(*summary)
+	if got, want := len(sum.streams), 60; got != want {
+		t.Errorf("got %d age buckets, want %d", got, want)
+	}
+	if got, want := sum.streamDuration, time.Minute; got != want {
+		t.Errorf("got stream duration %v, want %v", got, want)
+	}
+
+	for i, opts := range []SummaryOpts{
+		{MaxAge: time.Hour, StreamDuration: 7 * time.Minute},
+		{MaxAge: time.Hour, StreamDuration: time.Minute, AgeBuckets: 5},
+		{StreamDuration: -time.Minute},
+	} {
+		opts.Name, opts.Help = "test_summary", "helpless"
+		func() {
+			defer func() {
+				if r := recover(); r == nil {
+					t.Errorf("%d. expected panic", i)
+				}
+			}()
+			NewSummary(opts)
+		}()
+	}
+}
+
+func TestSummaryVecObjectivesOverrides(t *testing.T) {
+	vec := NewSummaryVec(
+		SummaryOpts{
+			Name:       "test_summary",
+			Help:       "helpless",
+			Objectives: map[float64]float64{0.5: 0.05},
+			ObjectivesOverrides: []ObjectivesOverride{
+				{
+					Labels:     Labels{"method": "critical"},
+					Objectives: map[float64]float64{0.5: 0.05, 0.95: 0.01, 0.999: 0.0001},
+				},
+				{
+					Labels:     Labels{"unknown": "critical"},
+					Objectives: map[float64]float64{0.1: 0.01},
+				},
+			},
+		},
+		[]string{"method", "code"},
+	)
+
+	scenarios := []struct {
+		lvs  []string
+		want []float64
+	}{
+		{[]string{"GET", "200"}, []float64{0.5}},
+		{[]string{"critical", "200"}, []float64{0.5, 0.95, 0.999}},
+		{[]string{"critical", "500"}, []float64{0.5, 0.95, 0.999}},
+		{[]string{"200", "critical"}, []float64{0.5}},
+	}
+
+	for i, s := range scenarios {
+		m := &dto.Metric{}
+		vec.WithLabelValues(s.lvs...).Write(m)
+		var got []float64
+		for _, q := range m.Summary.Quantile {
+			got = append(got, q.GetQuantile())
+		}
+		if !reflect.DeepEqual(got, s.want) {
+			t.Errorf("%d. got quantiles %v, want %v", i, got, s.want)
+		}
+	}
+}
+
 func getBounds(vars []float64, q, ε float64) (min, max float64) {
 	// TODO: This currently tolerates an error of up to 2*ε. The error must
 	// be at most ε, but for some reason, it's sometimes slightly
@@ -345,3 +506,355 @@ func getBounds(vars []float64, q, ε float64) (min, max float64) {
 	}
 	return
 }
+
+func TestSummaryWithReset(t *testing.T) {
+	s := NewSummaryWithReset(SummaryOpts{
+		Name:       "test_summary",
+		Help:       "helpless",
+		Objectives: DefObjectives,
+	}, 0)
+	defer s.Close()
+
+	for i := 1; i <= 3; i++ {
+		s.Observe(float64(i))
+	}
+	if s.ResetIfLessThan(3) {
+		t.Error("expected no reset with 3 observations and n=3")
+	}
+	m := &dto.Metric{}
+	s.Write(m)
+	if got, want := m.GetSummary().GetSampleCount(), uint64(3); got != want {
+		t.Errorf("got sample count %d, want %d", got, want)
+	}
+
+	before := time.Now()
+	if !s.ResetIfLessThan(4) {
+		t.Error("expected reset with 3 observations and n=4")
+	}
+	s.Observe(42)
+	m.Reset()
+	s.Write(m)
+	if got, want := m.GetSummary().GetSampleCount(), uint64(1); got != want {
+		t.Errorf("got sample count %d, want %d", got, want)
+	}
+	if got, want := m.GetSummary().GetSampleSum(), 42.; got != want {
+		t.Errorf("got sample sum %f, want %f", got, want)
+	}
+	if got, want := m.GetSummary().GetQuantile()[0].GetValue(), 42.; got != want {
+		t.Errorf("got median %f, want %f", got, want)
+	}
+
+	ch := make(chan Metric, 2)
+	s.Collect(ch)
+	<-ch
+	m.Reset()
+	(<-ch).Write(m)
+	if got, want := m.GetGauge().GetValue(), float64(before.Unix()); got < want {
+		t.Errorf("got reset timestamp %f, want at least %f", got, want)
+	}
+
+	if _, err := newRegistry().Register(s); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestRingHistogram(t *testing.T) {
+	rh := NewRingHistogram(RingHistogramOpts{
+		SummaryOpts: SummaryOpts{
+			Name:       "test_summary",
+			Help:       "helpless",
+			Objectives: map[float64]float64{0.5: 0.05, 0.9: 0.01},
+		},
+		Capacity: 10,
+	})
+	if _, ok := rh.ExactQuantile(0.5); ok {
+		t.Error("expected no exact quantile without observations")
+	}
+
+	for i := 1; i <= 10; i++ {
+		rh.Observe(float64(i))
+	}
+	if got, ok := rh.ExactQuantile(0.9); !ok || got != 9 {
+		t.Errorf("got exact 0.9-quantile %f (%t), want 9", got, ok)
+	}
+	m := &dto.Metric{}
+	rh.Write(m)
+	for i, want := range []float64{5, 9} {
+		if got := m.GetSummary().GetQuantile()[i].GetValue(); got != want {
+			t.Errorf("%d. got quantile %f, want %f", i, got, want)
+		}
+	}
+
+	rh.Observe(11)
+	if _, ok := rh.ExactQuantile(0.5); ok {
+		t.Error("expected no exact quantile after exceeding the capacity")
+	}
+	m.Reset()
+	rh.Write(m)
+	if got, want := m.GetSummary().GetSampleCount(), uint64(11); got != want {
+		t.Errorf("got sample count %d, want %d", got, want)
+	}
+
+	if _, err := newRegistry().Register(rh); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestDDSketchSummary(t *testing.T) {
+	const accuracy = 0.02
+	sum := NewDDSketchSummary(DDSketchSummaryOpts{
+		SummaryOpts: SummaryOpts{
+			Name:       "test_summary",
+			Help:       "helpless",
+			Objectives: map[float64]float64{0: 0, 0.1: 0, 0.5: 0, 0.9: 0, 0.99: 0, 1: 0},
+		},
+		RelativeAccuracy: accuracy,
+	})
+
+	m := &dto.Metric{}
+	sum.Write(m)
+	for _, q := range m.GetSummary().GetQuantile() {
+		if !math.IsNaN(q.GetValue()) {
+			t.Errorf("got %f for quantile %f without observations, want NaN", q.GetValue(), q.GetQuantile())
+		}
+	}
+
+	// Observations spanning six decades, including some negative ones.
+	var (
+		r        = rand.New(rand.NewSource(42))
+		values   []float64
+		totalSum float64
+	)
+	for i := 0; i < 10000; i++ {
+		v := math.Pow(10, r.Float64()*6-3)
+		if i%10 == 0 {
+			v = -v
+		}
+		values = append(values, v)
+		totalSum += v
+		sum.Observe(v)
+	}
+	sort.Float64s(values)
+
+	m.Reset()
+	sum.Write(m)
+	if got, want := m.GetSummary().GetSampleCount(), uint64(len(values)); got != want {
+		t.Errorf("got count %d, want %d", got, want)
+	}
+	if got, want := m.GetSummary().GetSampleSum(), totalSum; math.Abs(got-want) > 1e-9*math.Abs(want) {
+		t.Errorf("got sum %f, want %f", got, want)
+	}
+	if got, want := len(m.GetSummary().GetQuantile()), 6; got != want {
+		t.Fatalf("got %d quantiles, want %d", got, want)
+	}
+	for _, q := range m.GetSummary().GetQuantile() {
+		want := values[int(q.GetQuantile()*float64(len(values)-1))]
+		if got := q.GetValue(); math.Abs(got-want) > accuracy*math.Abs(want) {
+			t.Errorf("got %f for quantile %f, want %f within relative error %f", got, q.GetQuantile(), want, accuracy)
+		}
+	}
+}
+
+func TestTDigestSummary(t *testing.T) {
+	newSummary := func() TDigestSummary {
+		return NewTDigestSummary(TDigestSummaryOpts{
+			SummaryOpts: SummaryOpts{
+				Name:       "test_summary",
+				Help:       "helpless",
+				Objectives: map[float64]float64{0: 0, 0.01: 0, 0.5: 0, 0.9: 0, 0.99: 0, 1: 0},
+			},
+		})
+	}
+	a, b := newSummary(), newSummary()
+
+	m := &dto.Metric{}
+	a.Write(m)
+	for _, q := range m.GetSummary().GetQuantile() {
+		if !math.IsNaN(q.GetValue()) {
+			t.Errorf("got %f for quantile %f without observations, want NaN", q.GetValue(), q.GetQuantile())
+		}
+	}
+
+	// Observe the values 1 to 10000 in random order, split between both
+	// summaries, which are merged afterwards.
+	r := rand.New(rand.NewSource(42))
+	var totalSum float64
+	for i, v := range r.Perm(10000) {
+		totalSum += float64(v + 1)
+		if i%3 == 0 {
+			b.Observe(float64(v + 1))
+			continue
+		}
+		a.Observe(float64(v + 1))
+	}
+	if err := a.Merge(b); err != nil {
+		t.Fatal(err)
+	}
+
+	m.Reset()
+	a.Write(m)
+	if got, want := m.GetSummary().GetSampleCount(), uint64(10000); got != want {
+		t.Errorf("got count %d, want %d", got, want)
+	}
+	if got, want := m.GetSummary().GetSampleSum(), totalSum; got != want {
+		t.Errorf("got sum %f, want %f", got, want)
+	}
+	for _, q := range m.GetSummary().GetQuantile() {
+		// The error is smallest for the extreme quantiles.
+		want, tolerance := math.Max(1, q.GetQuantile()*10000), 0.01*10000*math.Sqrt(q.GetQuantile()*(1-q.GetQuantile()))
+		if got := q.GetValue(); math.Abs(got-want) > tolerance+1 {
+			t.Errorf("got %f for quantile %f, want %f within %f", got, q.GetQuantile(), want, tolerance+1)
+		}
+	}
+
+	if err := a.Merge(a); err == nil {
+		t.Error("expected error when merging a summary into itself")
+	}
+}
+
+func TestRingBufferSummary(t *testing.T) {
+	s := NewRingBufferSummary(RingBufferSummaryOpts{
+		SummaryOpts: SummaryOpts{
+			Name:       "test_summary",
+			Help:       "helpless",
+			Objectives: map[float64]float64{0.5: 0.05, 0.9: 0.01},
+		},
+		Capacity: 10,
+	})
+	if got := s.Quantile(0.5); !math.IsNaN(got) {
+		t.Errorf("got quantile %f without observations, want NaN", got)
+	}
+
+	// Observe 1 to 15, so that the ring only holds 6 to 15.
+	for i := 1; i <= 15; i++ {
+		s.Observe(float64(i))
+	}
+	if got, want := s.Quantile(0.9), 14.; got != want {
+		t.Errorf("got 0.9-quantile %f, want %f", got, want)
+	}
+	if got, want := s.Quantile(0), 6.; got != want {
+		t.Errorf("got 0-quantile %f, want %f", got, want)
+	}
+
+	m := &dto.Metric{}
+	s.Write(m)
+	if got, want := m.GetSummary().GetSampleCount(), uint64(15); got != want {
+		t.Errorf("got sample count %d, want %d", got, want)
+	}
+	if got, want := m.GetSummary().GetSampleSum(), 120.; got != want {
+		t.Errorf("got sample sum %f, want %f", got, want)
+	}
+	for i, want := range []float64{10, 14} {
+		if got := m.GetSummary().GetQuantile()[i].GetValue(); got != want {
+			t.Errorf("%d. got quantile %f, want %f", i, got, want)
+		}
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 1000; i++ {
+			s.Observe(float64(i))
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			s.Write(&dto.Metric{})
+		}
+	}()
+	wg.Wait()
+
+	if _, err := newRegistry().Register(s); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestSummaryAlgorithms(t *testing.T) {
+	objectives := map[float64]float64{0.5: 0.05, 0.9: 0.01, 0.99: 0.001}
+	for _, algo := range []SummaryAlgorithm{AlgoCkms, AlgoP2, AlgoGK} {
+		s := NewSummary(SummaryOpts{
+			Name:       "test_summary",
+			Help:       "helpless",
+			Objectives: objectives,
+			Algorithm:  algo,
+		})
+		m := &dto.Metric{}
+		s.Write(m)
+		for _, q := range m.GetSummary().GetQuantile() {
+			if !math.IsNaN(q.GetValue()) {
+				t.Errorf("algorithm %d: got %f-quantile %f without observations, want NaN", algo, q.GetQuantile(), q.GetValue())
+			}
+		}
+
+		// Observe a shuffled permutation of 1 to 10000.
+		r := rand.New(rand.NewSource(42))
+		for _, v := range r.Perm(10000) {
+			s.Observe(float64(v + 1))
+		}
+		m = &dto.Metric{}
+		s.Write(m)
+		if got, want := m.GetSummary().GetSampleCount(), uint64(10000); got != want {
+			t.Errorf("algorithm %d: got sample count %d, want %d", algo, got, want)
+		}
+		for _, q := range m.GetSummary().GetQuantile() {
+			// P2 does not guarantee an error bound, so allow it 1%.
+			e := objectives[q.GetQuantile()]
+			if algo == AlgoP2 {
+				e = 0.01
+			}
+			want := q.GetQuantile() * 10000
+			if got := q.GetValue(); math.Abs(got-want) > e*10000+1 {
+				t.Errorf("algorithm %d: got %f-quantile %f, want %f±%f", algo, q.GetQuantile(), got, want, e*10000)
+			}
+		}
+	}
+
+	var estimated []float64
+	s := NewSummary(SummaryOpts{
+		Name:       "test_summary",
+		Help:       "helpless",
+		Objectives: map[float64]float64{0.5: 0.05},
+		NewEstimator: func(objectives map[float64]float64) QuantileEstimator {
+			return &maxEstimator{observed: &estimated}
+		},
+	})
+	s.Observe(3)
+	s.Observe(1)
+	m := &dto.Metric{}
+	s.Write(m)
+	if got, want := m.GetSummary().GetQuantile()[0].GetValue(), 3.; got != want {
+		t.Errorf("got quantile %f from custom estimator, want %f", got, want)
+	}
+	if len(estimated) == 0 {
+		t.Error("custom estimator was not used")
+	}
+}
+
+// maxEstimator is a QuantileEstimator that returns the maximum for every
+// quantile.
+type maxEstimator struct {
+	observed *[]float64
+	max      float64
+	n        int
+}
+
+func (e *maxEstimator) Observe(v float64) {
+	*e.observed = append(*e.observed, v)
+	if e.n == 0 || v > e.max {
+		e.max = v
+	}
+	e.n++
+}
+
+func (e *maxEstimator) Quantile(float64) float64 {
+	if e.n == 0 {
+		return math.NaN()
+	}
+	return e.max
+}
+
+func (e *maxEstimator) Reset() {
+	e.n = 0
+}
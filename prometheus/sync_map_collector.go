@@ -0,0 +1,69 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package prometheus
+
+import "fmt"
+
+// Ranger is implemented by maps that can be iterated by calling the provided
+// function for each entry until it returns false. Most notably, it is
+// implemented by sync.Map (Go 1.9 and later).
+type Ranger interface {
+	Range(f func(key, value interface{}) bool)
+}
+
+// syncMapCollector implements the Collector returned by NewSyncMapCollector.
+type syncMapCollector struct {
+	m              Ranger
+	desc           *Desc
+	valueExtractor func(v interface{}) float64
+}
+
+// NewSyncMapCollector returns a Collector that exposes each entry of the
+// provided map as a sample of a gauge described by desc. This avoids
+// maintaining a GaugeVec in parallel to a sync.Map that already holds the
+// values per key.
+//
+// The desc must have keyLabel as its only variable label, which is set to the
+// key of the entry, formatted with fmt.Sprint. The value of the sample is the
+// result of calling valueExtractor with the value of the entry. The map is
+// iterated with its Range method during each collection, so no lock is held
+// while collecting as long as Range does not hold one itself (which is the case
+// for sync.Map). NewSyncMapCollector panics if desc has other variable labels.
+func NewSyncMapCollector(m Ranger, desc *Desc, keyLabel string, valueExtractor func(v interface{}) float64) Collector {
+	if len(desc.variableLabels) != 1 || desc.variableLabels[0] != keyLabel {
+		panic(fmt.Errorf("%s must have %q as its only variable label", desc, keyLabel))
+	}
+	return &syncMapCollector{
+		m:              m,
+		desc:           desc,
+		valueExtractor: valueExtractor,
+	}
+}
+
+// Describe implements Collector.
+func (c *syncMapCollector) Describe(ch chan<- *Desc) {
+	ch <- c.desc
+}
+
+// Collect implements Collector.
+func (c *syncMapCollector) Collect(ch chan<- Metric) {
+	c.m.Range(func(key, value interface{}) bool {
+		m, err := NewConstMetric(c.desc, GaugeValue, c.valueExtractor(value), fmt.Sprint(key))
+		if err != nil {
+			m = NewInvalidMetric(c.desc, err)
+		}
+		ch <- m
+		return true
+	})
+}
@@ -0,0 +1,62 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package prometheus
+
+import (
+	"testing"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+// testRanger is a Ranger backed by a plain map.
+type testRanger map[string]int
+
+func (r testRanger) Range(f func(key, value interface{}) bool) {
+	for k, v := range r {
+		if !f(k, v) {
+			return
+		}
+	}
+}
+
+func TestSyncMapCollector(t *testing.T) {
+	desc := NewDesc("test_gauge", "helpless", []string{"key"}, nil)
+	c := NewSyncMapCollector(
+		testRanger{"a": 1, "b": 2},
+		desc, "key",
+		func(v interface{}) float64 { return float64(v.(int)) },
+	)
+
+	ch := make(chan Metric, 10)
+	c.Collect(ch)
+	close(ch)
+	got := map[string]float64{}
+	for m := range ch {
+		pb := &dto.Metric{}
+		if err := m.Write(pb); err != nil {
+			t.Fatal(err)
+		}
+		got[pb.GetLabel()[0].GetValue()] = pb.GetGauge().GetValue()
+	}
+	if len(got) != 2 || got["a"] != 1 || got["b"] != 2 {
+		t.Errorf("got samples %v, want a=1 and b=2", got)
+	}
+
+	defer func() {
+		if r := recover(); r == nil {
+			t.Error("expected panic for missing key label")
+		}
+	}()
+	NewSyncMapCollector(testRanger{}, desc, "other", nil)
+}
@@ -0,0 +1,173 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package prometheus
+
+import (
+	"errors"
+	"time"
+)
+
+// Observer is the interface that wraps the Observe method, which is used by
+// Histogram and Summary to add observations.
+type Observer interface {
+	Observe(float64)
+}
+
+// ObserverFunc is an adapter to allow the use of ordinary functions as
+// Observers. If f is a function with the appropriate signature,
+// ObserverFunc(f) is an Observer that calls f.
+//
+// This adapter is usually used in connection with the Timer type to observe
+// durations with something else than a Histogram or Summary, e.g. by setting
+// a Gauge:
+//
+//	timer := NewTimer(ObserverFunc(func(v float64) { myGauge.Set(v) }))
+type ObserverFunc func(float64)
+
+// Observe calls f(value). It implements Observer.
+func (f ObserverFunc) Observe(value float64) {
+	f(value)
+}
+
+// CounterAsObserver returns an Observer that adds each observed value to the
+// provided Counter. Together with ObserverAsCounter, it is an adaptation
+// helper for generic instrumentation code that records amounts of work with
+// either a Counter or an Observer. As with Counter.Add, observing a negative
+// value panics. Observing does not allocate.
+func CounterAsObserver(c Counter) Observer {
+	return ObserverFunc(c.Add)
+}
+
+// ObserverAsCounter returns a Counter that forwards Add to the Observe method
+// of the provided Observer, and Inc to Observe(1). Desc, Write, Describe, and
+// Collect are forwarded, too, so the provided Observer has to implement Metric
+// and Collector, as Histograms and Summaries do. ObserverAsCounter panics
+// otherwise. As there is no equivalent of setting a value for an Observer, the
+// Set method of the returned Counter panics. See CounterAsObserver for the
+// reverse adaptation.
+func ObserverAsCounter(o Observer) Counter {
+	m, ok := o.(Metric)
+	if !ok {
+		panic(errors.New("observer adapted as counter must implement Metric"))
+	}
+	c, ok := o.(Collector)
+	if !ok {
+		panic(errors.New("observer adapted as counter must implement Collector"))
+	}
+	return &observerCounter{Metric: m, Collector: c, observe: o.Observe}
+}
+
+type observerCounter struct {
+	Metric
+	Collector
+
+	observe func(float64)
+}
+
+func (c *observerCounter) Set(float64) {
+	panic(errors.New("cannot set an observer adapted as counter"))
+}
+
+func (c *observerCounter) Inc() {
+	c.observe(1)
+}
+
+func (c *observerCounter) Add(v float64) {
+	if v < 0 {
+		panic(errors.New("counter cannot decrease in value"))
+	}
+	c.observe(v)
+}
+
+// Timer is a helper type to time functions. Use NewTimer to create new
+// instances.
+type Timer struct {
+	begin    time.Time
+	clock    func() time.Time
+	observer Observer
+}
+
+// NewTimer creates a new Timer. The provided Observer is used to observe a
+// duration in seconds. Timer is usually used to time a function call in the
+// following way:
+//
+//	func TimeMe() {
+//	    timer := NewTimer(myHistogram)
+//	    defer timer.ObserveDuration()
+//	    // Do actual work.
+//	}
+func NewTimer(o Observer) *Timer {
+	return NewTimerWithClock(o, time.Now)
+}
+
+// NewTimerWithClock works like NewTimer, but takes the current time from the
+// provided clock function instead of time.Now, both when the Timer is created
+// and when ObserveDuration is called. This is useful to observe durations
+// from a fake clock in tests and benchmarks.
+func NewTimerWithClock(o Observer, clock func() time.Time) *Timer {
+	return &Timer{
+		begin:    clock(),
+		clock:    clock,
+		observer: o,
+	}
+}
+
+// ObserveDuration records the duration passed since the Timer was created with
+// NewTimer. It calls the Observe method of the Observer provided during
+// construction with the duration in seconds as an argument. The observed
+// duration is also returned. ObserveDuration is usually called with a defer
+// statement.
+func (t *Timer) ObserveDuration() time.Duration {
+	d := t.clock().Sub(t.begin)
+	if t.observer != nil {
+		t.observer.Observe(d.Seconds())
+	}
+	return d
+}
+
+// ObserveDurationUnlessDone works like ObserveDuration, but only observes the
+// duration if the provided done channel is not closed yet. The duration is
+// returned in either case. Passing the Done channel of a request context skips
+// the observation of aborted requests:
+//
+//	defer timer.ObserveDurationUnlessDone(ctx.Done())
+//
+// A nil channel is never closed, so the duration is always observed then.
+func (t *Timer) ObserveDurationUnlessDone(done <-chan struct{}) time.Duration {
+	select {
+	case <-done:
+		return t.clock().Sub(t.begin)
+	default:
+		return t.ObserveDuration()
+	}
+}
+
+// ObserveDurationFunc calls fn and observes the duration of the call in seconds
+// with the provided Observer. The observed duration is also returned. It is a
+// shortcut for timing a function with a Timer:
+//
+//	ObserveDurationFunc(myHistogram, func() {
+//	    // Do actual work.
+//	})
+//
+// If fn panics, the duration is observed before the panic continues, so that
+// panicking calls are timed, too.
+func ObserveDurationFunc(o Observer, fn func()) (seconds float64) {
+	timer := NewTimer(o)
+	defer func() {
+		seconds = timer.ObserveDuration().Seconds()
+	}()
+	fn()
+	return
+}
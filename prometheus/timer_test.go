@@ -0,0 +1,157 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package prometheus
+
+import (
+	"testing"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+func TestTimerObserve(t *testing.T) {
+	var (
+		his = NewHistogram(HistogramOpts{Name: "test_histogram", Help: "test help"})
+		sum = NewSummary(SummaryOpts{Name: "test_summary", Help: "test help"})
+		gau = NewGauge(GaugeOpts{Name: "test_gauge", Help: "test help"})
+	)
+
+	func() {
+		hisTimer := NewTimer(his)
+		sumTimer := NewTimer(sum)
+		gauTimer := NewTimer(ObserverFunc(gau.Set))
+		defer hisTimer.ObserveDuration()
+		defer sumTimer.ObserveDuration()
+		defer gauTimer.ObserveDuration()
+	}()
+
+	m := &dto.Metric{}
+	his.Write(m)
+	if want, got := uint64(1), m.GetHistogram().GetSampleCount(); want != got {
+		t.Errorf("want %d observations for histogram, got %d", want, got)
+	}
+	m.Reset()
+	sum.Write(m)
+	if want, got := uint64(1), m.GetSummary().GetSampleCount(); want != got {
+		t.Errorf("want %d observations for summary, got %d", want, got)
+	}
+	m.Reset()
+	gau.Write(m)
+	if got := m.GetGauge().GetValue(); got <= 0 {
+		t.Errorf("want value > 0 for gauge, got %f", got)
+	}
+}
+
+func TestTimerWithClock(t *testing.T) {
+	var (
+		now   = time.Unix(1000, 0)
+		clock = func() time.Time { return now }
+		got   float64
+	)
+
+	timer := NewTimerWithClock(ObserverFunc(func(v float64) { got = v }), clock)
+	now = now.Add(1500 * time.Millisecond)
+
+	if want, d := 1500*time.Millisecond, timer.ObserveDuration(); want != d {
+		t.Errorf("want duration %v, got %v", want, d)
+	}
+	if want := 1.5; want != got {
+		t.Errorf("want observed value %f, got %f", want, got)
+	}
+}
+
+func TestTimerObserveDurationUnlessDone(t *testing.T) {
+	var got []float64
+	o := ObserverFunc(func(v float64) { got = append(got, v) })
+
+	NewTimer(o).ObserveDurationUnlessDone(nil)
+	NewTimer(o).ObserveDurationUnlessDone(make(chan struct{}))
+	done := make(chan struct{})
+	close(done)
+	if d := NewTimer(o).ObserveDurationUnlessDone(done); d < 0 {
+		t.Errorf("want non-negative duration, got %v", d)
+	}
+	if want := 2; len(got) != want {
+		t.Errorf("want %d observations, got %v", want, got)
+	}
+}
+
+func TestObserveDurationFunc(t *testing.T) {
+	var got []float64
+	o := ObserverFunc(func(v float64) { got = append(got, v) })
+
+	seconds := ObserveDurationFunc(o, func() { time.Sleep(time.Millisecond) })
+	if len(got) != 1 || got[0] != seconds {
+		t.Errorf("want one observation of %f, got %v", seconds, got)
+	}
+	if seconds < 0.001 {
+		t.Errorf("want duration of at least 1ms, got %fs", seconds)
+	}
+
+	func() {
+		defer func() {
+			if r := recover(); r != "boom" {
+				t.Errorf("want panic %q, got %v", "boom", r)
+			}
+		}()
+		ObserveDurationFunc(o, func() { panic("boom") })
+	}()
+	if len(got) != 2 {
+		t.Errorf("want observation of panicking call, got %v", got)
+	}
+}
+
+func TestCounterAsObserver(t *testing.T) {
+	cnt := NewCounter(CounterOpts{Name: "test_counter", Help: "test help"})
+	obs := CounterAsObserver(cnt)
+	obs.Observe(2)
+	obs.Observe(0.5)
+
+	m := &dto.Metric{}
+	cnt.Write(m)
+	if expected, got := 2.5, m.GetCounter().GetValue(); expected != got {
+		t.Errorf("expected %f, got %f", expected, got)
+	}
+	if allocs := testing.AllocsPerRun(100, func() { obs.Observe(1) }); allocs != 0 {
+		t.Errorf("expected no allocations, got %f", allocs)
+	}
+}
+
+func TestObserverAsCounter(t *testing.T) {
+	his := NewHistogram(HistogramOpts{Name: "test_histogram", Help: "test help"})
+	cnt := ObserverAsCounter(his)
+	cnt.Inc()
+	cnt.Add(3)
+
+	m := &dto.Metric{}
+	cnt.Write(m)
+	if expected, got := uint64(2), m.GetHistogram().GetSampleCount(); expected != got {
+		t.Errorf("expected %d observations, got %d", expected, got)
+	}
+	if expected, got := 4., m.GetHistogram().GetSampleSum(); expected != got {
+		t.Errorf("expected %f, got %f", expected, got)
+	}
+	if expected, got := his.Desc(), cnt.Desc(); expected != got {
+		t.Errorf("expected %v, got %v", expected, got)
+	}
+
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Error("expected panic for plain Observer")
+			}
+		}()
+		ObserverAsCounter(ObserverFunc(func(float64) {}))
+	}()
+}
@@ -45,12 +45,14 @@ type UntypedOpts Opts
 
 // NewUntyped creates a new Untyped metric from the provided UntypedOpts.
 func NewUntyped(opts UntypedOpts) Untyped {
-	return newValue(NewDesc(
+	desc := NewDesc(
 		BuildFQName(opts.Namespace, opts.Subsystem, opts.Name),
 		opts.Help,
 		nil,
 		opts.ConstLabels,
-	), UntypedValue, 0)
+	)
+	desc.deprecatedVersion = opts.DeprecatedVersion
+	return newValue(desc, UntypedValue, 0)
 }
 
 // UntypedVec is a Collector that bundles a set of Untyped metrics that all
@@ -59,6 +61,9 @@ func NewUntyped(opts UntypedOpts) Untyped {
 // various dimensions. Create instances with NewUntypedVec.
 type UntypedVec struct {
 	MetricVec
+	// invalid is returned by WithLabelValues and With for dropped label
+	// values (see Opts.LabelAllowlist).
+	invalid Untyped
 }
 
 // NewUntypedVec creates a new UntypedVec based on the provided UntypedOpts and
@@ -71,18 +76,44 @@ func NewUntypedVec(opts UntypedOpts, labelNames []string) *UntypedVec {
 		labelNames,
 		opts.ConstLabels,
 	)
-	return &UntypedVec{
+	desc.deprecatedVersion = opts.DeprecatedVersion
+	m := &UntypedVec{
 		MetricVec: MetricVec{
 			children: map[uint64]Metric{},
 			desc:     desc,
 			hash:     fnv.New64a(),
+			seed:     hashSeed(opts.HashSeed),
 			newMetric: func(lvs ...string) Metric {
+				if opts.TrackLastObserved {
+					return &trackedUntyped{
+						observedAt: newObservedAt(),
+						Untyped:    newValue(desc, UntypedValue, 0, lvs...),
+					}
+				}
 				return newValue(desc, UntypedValue, 0, lvs...)
 			},
+			allowlist: newLabelAllowlist(desc, opts.LabelAllowlist, opts.FallbackBehavior, opts.FallbackValue),
+			lockFree:  opts.LockFreeHotPath,
 		},
 	}
+	if m.allowlist != nil && m.allowlist.drop {
+		m.invalid = newValue(desc, UntypedValue, 0, make([]string, len(labelNames))...)
+	}
+	return m
 }
 
+// trackedUntyped is an Untyped that records the time of its last update.
+type trackedUntyped struct {
+	observedAt
+	Untyped
+}
+
+func (u *trackedUntyped) Set(v float64) { u.touch(); u.Untyped.Set(v) }
+func (u *trackedUntyped) Inc()          { u.touch(); u.Untyped.Inc() }
+func (u *trackedUntyped) Dec()          { u.touch(); u.Untyped.Dec() }
+func (u *trackedUntyped) Add(v float64) { u.touch(); u.Untyped.Add(v) }
+func (u *trackedUntyped) Sub(v float64) { u.touch(); u.Untyped.Sub(v) }
+
 // GetMetricWithLabelValues replaces the method of the same name in
 // MetricVec. The difference is that this method returns an Untyped and not a
 // Metric so that no type conversion is required.
@@ -109,15 +140,113 @@ func (m *UntypedVec) GetMetricWith(labels Labels) (Untyped, error) {
 // GetMetricWithLabelValues would have returned an error. By not returning an
 // error, WithLabelValues allows shortcuts like
 //     myVec.WithLabelValues("404", "GET").Add(42)
+// Label values that are dropped because they are not in the LabelAllowlist do
+// not cause a panic but result in an Untyped that is never exposed.
 func (m *UntypedVec) WithLabelValues(lvs ...string) Untyped {
-	return m.MetricVec.WithLabelValues(lvs...).(Untyped)
+	metric, err := m.GetMetricWithLabelValues(lvs...)
+	if err == errLabelValueNotAllowed {
+		return m.invalid
+	}
+	if err != nil {
+		panic(err)
+	}
+	return metric
 }
 
 // With works as GetMetricWith, but panics where GetMetricWithLabels would have
 // returned an error. By not returning an error, With allows shortcuts like
 //     myVec.With(Labels{"code": "404", "method": "GET"}).Add(42)
+// Dropped label values are handled as in WithLabelValues.
 func (m *UntypedVec) With(labels Labels) Untyped {
-	return m.MetricVec.With(labels).(Untyped)
+	metric, err := m.GetMetricWith(labels)
+	if err == errLabelValueNotAllowed {
+		return m.invalid
+	}
+	if err != nil {
+		panic(err)
+	}
+	return metric
+}
+
+// WithPartialLabels replaces the method of the same name in MetricVec. The
+// difference is that this method returns a PartialUntypedVec and not a
+// PartialMetricVec so that no type conversion is required.
+func (m *UntypedVec) WithPartialLabels(labels Labels) *PartialUntypedVec {
+	return &PartialUntypedVec{*m.MetricVec.WithPartialLabels(labels)}
+}
+
+// CurryWith replaces the method of the same name in MetricVec. The difference
+// is that this method returns a PartialUntypedVec and not a PartialMetricVec so
+// that no type conversion is required.
+func (m *UntypedVec) CurryWith(labels Labels) (*PartialUntypedVec, error) {
+	p, err := m.MetricVec.CurryWith(labels)
+	if err != nil {
+		return nil, err
+	}
+	return &PartialUntypedVec{*p}, nil
+}
+
+// MustCurryWith works as CurryWith, but panics where CurryWith would have
+// returned an error.
+func (m *UntypedVec) MustCurryWith(labels Labels) *PartialUntypedVec {
+	return &PartialUntypedVec{*m.MetricVec.MustCurryWith(labels)}
+}
+
+// PartialUntypedVec is an UntypedVec with some of its variable labels already bound
+// to values. Create instances with the WithPartialLabels method of UntypedVec.
+type PartialUntypedVec struct {
+	PartialMetricVec
+}
+
+// GetMetricWithLabelValues replaces the method of the same name in
+// PartialMetricVec. The difference is that this method returns an Untyped and
+// not a Metric so that no type conversion is required.
+func (p *PartialUntypedVec) GetMetricWithLabelValues(lvs ...string) (Untyped, error) {
+	metric, err := p.PartialMetricVec.GetMetricWithLabelValues(lvs...)
+	if metric != nil {
+		return metric.(Untyped), err
+	}
+	return nil, err
+}
+
+// WithLabelValues works as GetMetricWithLabelValues, but panics where
+// GetMetricWithLabelValues would have returned an error.
+func (p *PartialUntypedVec) WithLabelValues(lvs ...string) Untyped {
+	return p.PartialMetricVec.WithLabelValues(lvs...).(Untyped)
+}
+
+// GetMetricWith replaces the method of the same name in PartialMetricVec. The
+// difference is that this method returns a Untyped and not a Metric so that no
+// type conversion is required.
+func (p *PartialUntypedVec) GetMetricWith(labels Labels) (Untyped, error) {
+	metric, err := p.PartialMetricVec.GetMetricWith(labels)
+	if metric != nil {
+		return metric.(Untyped), err
+	}
+	return nil, err
+}
+
+// With works as GetMetricWith, but panics where GetMetricWith would have
+// returned an error.
+func (p *PartialUntypedVec) With(labels Labels) Untyped {
+	return p.PartialMetricVec.With(labels).(Untyped)
+}
+
+// CurryWith replaces the method of the same name in PartialMetricVec. The
+// difference is that this method returns a PartialUntypedVec and not a
+// PartialMetricVec so that no type conversion is required.
+func (p *PartialUntypedVec) CurryWith(labels Labels) (*PartialUntypedVec, error) {
+	curried, err := p.PartialMetricVec.CurryWith(labels)
+	if err != nil {
+		return nil, err
+	}
+	return &PartialUntypedVec{*curried}, nil
+}
+
+// MustCurryWith works as CurryWith, but panics where CurryWith would have
+// returned an error.
+func (p *PartialUntypedVec) MustCurryWith(labels Labels) *PartialUntypedVec {
+	return &PartialUntypedVec{*p.PartialMetricVec.MustCurryWith(labels)}
 }
 
 // UntypedFunc is an Untyped whose value is determined at collect time by
@@ -136,10 +265,12 @@ type UntypedFunc interface {
 // the case where an UntypedFunc is directly registered with Prometheus, the
 // provided function must be concurrency-safe.
 func NewUntypedFunc(opts UntypedOpts, function func() float64) UntypedFunc {
-	return newValueFunc(NewDesc(
+	desc := NewDesc(
 		BuildFQName(opts.Namespace, opts.Subsystem, opts.Name),
 		opts.Help,
 		nil,
 		opts.ConstLabels,
-	), UntypedValue, function)
+	)
+	desc.deprecatedVersion = opts.DeprecatedVersion
+	return newValueFunc(desc, UntypedValue, function)
 }
@@ -0,0 +1,63 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package prometheus
+
+import (
+	"bytes"
+	"io"
+	"testing"
+
+	dto "github.com/prometheus/client_model/go"
+
+	"github.com/prometheus/client_golang/text"
+)
+
+func TestUntypedVec(t *testing.T) {
+	vec := NewUntypedVec(UntypedOpts{
+		Name: "bridged_metric",
+		Help: "Relayed from a third-party system.",
+	}, []string{"plugin"})
+	vec.WithLabelValues("cpu").Set(42)
+	vec.With(Labels{"plugin": "mem"}).Set(-3)
+
+	registry := newRegistry()
+	if _, err := registry.Register(vec); err != nil {
+		t.Fatal(err)
+	}
+
+	var (
+		types []dto.MetricType
+		buf   bytes.Buffer
+	)
+	if _, err := registry.writePB(&buf, func(w io.Writer, mf *dto.MetricFamily) (int, error) {
+		types = append(types, mf.GetType())
+		return text.MetricFamilyToText(w, mf)
+	}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if expected, got := 1, len(types); expected != got {
+		t.Fatalf("expected %d metric families, got %d", expected, got)
+	}
+	if expected, got := dto.MetricType_UNTYPED, types[0]; expected != got {
+		t.Errorf("expected type %s, got %s", expected, got)
+	}
+	expected := `# HELP bridged_metric Relayed from a third-party system.
+# TYPE bridged_metric untyped
+bridged_metric{plugin="cpu"} 42
+bridged_metric{plugin="mem"} -3
+`
+	if got := buf.String(); expected != got {
+		t.Errorf("expected\n%s\ngot\n%s", expected, got)
+	}
+}
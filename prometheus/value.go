@@ -34,9 +34,17 @@ const (
 	CounterValue
 	GaugeValue
 	UntypedValue
+	// InfoValue and StateSetValue are exposed as gauges. See NewInfoMetric
+	// and NewStateSetMetrics.
+	InfoValue
+	StateSetValue
 )
 
-var errInconsistentCardinality = errors.New("inconsistent label cardinality")
+var (
+	errInconsistentCardinality = errors.New("inconsistent label cardinality")
+	errInvalidLabelCombination = errors.New("label values are not among the valid combinations")
+	errLabelValueNotAllowed    = errors.New("label value is not in the allowlist")
+)
 
 // value is a generic metric for simple values. It implements Metric, Collector,
 // Counter, Gauge, and Untyped. Its effective type is determined by
@@ -89,17 +97,46 @@ func (v *value) Dec() {
 }
 
 func (v *value) Add(val float64) {
+	addFloat64Bits(&v.valBits, val)
+}
+
+func (v *value) Sub(val float64) {
+	v.Add(val * -1)
+}
+
+func (v *value) SetIfHigher(val float64) bool {
+	return setFloat64BitsIf(&v.valBits, val, func(val, old float64) bool { return val > old })
+}
+
+func (v *value) SetIfLower(val float64) bool {
+	return setFloat64BitsIf(&v.valBits, val, func(val, old float64) bool { return val < old })
+}
+
+// addFloat64Bits atomically adds val to the float64 represented by the bits
+// bits points to.
+func addFloat64Bits(bits *uint64, val float64) {
 	for {
-		oldBits := atomic.LoadUint64(&v.valBits)
+		oldBits := atomic.LoadUint64(bits)
 		newBits := math.Float64bits(math.Float64frombits(oldBits) + val)
-		if atomic.CompareAndSwapUint64(&v.valBits, oldBits, newBits) {
+		if atomic.CompareAndSwapUint64(bits, oldBits, newBits) {
 			return
 		}
 	}
 }
 
-func (v *value) Sub(val float64) {
-	v.Add(val * -1)
+// setFloat64BitsIf atomically sets the float64 represented by the bits bits
+// points to to val if cond(val, old) is true for its old value. It returns
+// whether it was set.
+func setFloat64BitsIf(bits *uint64, val float64, cond func(val, old float64) bool) bool {
+	for {
+		oldBits := atomic.LoadUint64(bits)
+		if !cond(val, math.Float64frombits(oldBits)) {
+			return false
+		}
+		if atomic.CompareAndSwapUint64(bits, oldBits, math.Float64bits(val)) {
+			return true
+		}
+	}
 }
 
 func (v *value) Write(out *dto.Metric) error {
@@ -174,6 +211,47 @@ func MustNewConstMetric(desc *Desc, valueType ValueType, value float64, labelVal
 	return m
 }
 
+// NewInfoMetric returns a metric with the fixed value 1 that exposes
+// information (like the version of a binary) in its label values. The metric
+// is exposed as a gauge. NewInfoMetric returns an error if the length of
+// labelValues is not consistent with the variable labels in Desc.
+func NewInfoMetric(desc *Desc, labelValues ...string) (Metric, error) {
+	return NewConstMetric(desc, InfoValue, 1, labelValues...)
+}
+
+// NewStateSetMetrics returns one metric for each of the provided states. The
+// last variable label in Desc is the label for the state name, the provided
+// labelValues are the values of the other variable labels. The metric of a
+// state has the value 1 if the state is set (i.e. true in the states map) and 0
+// otherwise. The metrics are exposed as gauges, sorted by state
+// name. NewStateSetMetrics returns an error if the length of labelValues is not
+// one less than the number of variable labels in Desc.
+func NewStateSetMetrics(desc *Desc, states map[string]bool, labelValues ...string) ([]Metric, error) {
+	if len(desc.variableLabels) != len(labelValues)+1 {
+		return nil, errInconsistentCardinality
+	}
+	names := make([]string, 0, len(states))
+	for name := range states {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	metrics := make([]Metric, 0, len(states))
+	lvs := append(make([]string, 0, len(labelValues)+1), labelValues...)
+	for _, name := range names {
+		var v float64
+		if states[name] {
+			v = 1
+		}
+		m, err := NewConstMetric(desc, StateSetValue, v, append(lvs, name)...)
+		if err != nil {
+			return nil, err
+		}
+		metrics = append(metrics, m)
+	}
+	return metrics, nil
+}
+
 type constMetric struct {
 	desc       *Desc
 	valType    ValueType
@@ -199,7 +277,7 @@ func populateMetric(
 	switch t {
 	case CounterValue:
 		m.Counter = &dto.Counter{Value: proto.Float64(v)}
-	case GaugeValue:
+	case GaugeValue, InfoValue, StateSetValue:
 		m.Gauge = &dto.Gauge{Value: proto.Float64(v)}
 	case UntypedValue:
 		m.Untyped = &dto.Untyped{Value: proto.Float64(v)}
@@ -0,0 +1,64 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package prometheus
+
+import (
+	"testing"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+func TestNewInfoMetric(t *testing.T) {
+	desc := NewDesc("build_info", "Build information.", []string{"version"}, nil)
+	m, err := NewInfoMetric(desc, "1.2.3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := &dto.Metric{}
+	m.Write(out)
+	if expected, got := `label:<name:"version" value:"1.2.3" > gauge:<value:1 > `, out.String(); expected != got {
+		t.Errorf("expected %q, got %q", expected, got)
+	}
+
+	if _, err := NewInfoMetric(desc); err == nil {
+		t.Error("expected error for missing label value")
+	}
+}
+
+func TestNewStateSetMetrics(t *testing.T) {
+	desc := NewDesc("disk_state", "State of the disk.", []string{"disk", "disk_state"}, nil)
+	metrics, err := NewStateSetMetrics(desc, map[string]bool{"ok": true, "failed": false}, "sda")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{
+		`label:<name:"disk" value:"sda" > label:<name:"disk_state" value:"failed" > gauge:<value:0 > `,
+		`label:<name:"disk" value:"sda" > label:<name:"disk_state" value:"ok" > gauge:<value:1 > `,
+	}
+	if len(metrics) != len(expected) {
+		t.Fatalf("expected %d metrics, got %d", len(expected), len(metrics))
+	}
+	for i, m := range metrics {
+		out := &dto.Metric{}
+		m.Write(out)
+		if got := out.String(); expected[i] != got {
+			t.Errorf("%d. expected %q, got %q", i, expected[i], got)
+		}
+	}
+
+	if _, err := NewStateSetMetrics(desc, nil, "sda", "ok"); err == nil {
+		t.Error("expected error for too many label values")
+	}
+}
@@ -15,9 +15,15 @@ package prometheus
 
 import (
 	"bytes"
+	"encoding/binary"
 	"fmt"
 	"hash"
+	"sort"
 	"sync"
+	"sync/atomic"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
 )
 
 // MetricVec is a Collector to bundle metrics of the same name that
@@ -35,8 +41,141 @@ type MetricVec struct {
 	// buf is used to copy string contents into it for hashing,
 	// again to avoid allocations.
 	buf bytes.Buffer
+	// seed is hashed before the label values. It is nil for the
+	// default seed of zero, see Opts.HashSeed.
+	seed []byte
 
 	newMetric func(labelValues ...string) Metric
+	// release, if not nil, is called with each deleted metric.
+	release func(Metric)
+	// valid, if not nil, contains the hashes of the only label value
+	// combinations metrics may be created for.
+	valid map[uint64]struct{}
+	// allowlist, if not nil, restricts the values of individual labels.
+	allowlist *labelAllowlist
+
+	// lockFree enables the lock-free lookup of existing children. The
+	// children map is then published as an immutable copy in snapshot
+	// after each modification, which stale marks as pending. Both stale
+	// and children are still protected by mtx.
+	lockFree bool
+	stale    bool
+	snapshot atomic.Value // map[uint64]Metric
+}
+
+// FallbackBehavior determines how a vector handles label values that are not
+// in its LabelAllowlist (see Opts).
+type FallbackBehavior int
+
+// Possible values for FallbackBehavior.
+const (
+	// FallbackRemap replaces disallowed label values with the
+	// FallbackValue, so that all of them are accounted to the same child.
+	FallbackRemap FallbackBehavior = iota
+	// FallbackDrop drops updates with disallowed label values. The
+	// WithLabelValues and With methods return a metric that is never
+	// exposed, while GetMetricWithLabelValues and GetMetricWith return an
+	// error.
+	FallbackDrop
+)
+
+// DefFallbackValue is the default value FallbackRemap replaces disallowed
+// label values with.
+const DefFallbackValue = "other"
+
+// labelAllowlist holds the allowed values of the variable labels of a
+// MetricVec, indexed like the variable labels. A nil set allows any value.
+type labelAllowlist struct {
+	allowed  []map[string]struct{}
+	drop     bool
+	fallback string
+}
+
+// newLabelAllowlist returns the labelAllowlist for the provided options, or
+// nil if allowlist is empty. It panics if a label name in allowlist is not a
+// variable label of desc or has no allowed values.
+func newLabelAllowlist(desc *Desc, allowlist map[string][]string, behavior FallbackBehavior, fallback string) *labelAllowlist {
+	if len(allowlist) == 0 {
+		return nil
+	}
+	if fallback == "" {
+		fallback = DefFallbackValue
+	}
+	a := &labelAllowlist{
+		allowed:  make([]map[string]struct{}, len(desc.variableLabels)),
+		drop:     behavior == FallbackDrop,
+		fallback: fallback,
+	}
+	for name, values := range allowlist {
+		i := -1
+		for j, l := range desc.variableLabels {
+			if l == name {
+				i = j
+			}
+		}
+		if i < 0 {
+			panic(fmt.Errorf("label %q in allowlist is not a variable label of %s", name, desc))
+		}
+		if len(values) == 0 {
+			panic(fmt.Errorf("label %q in allowlist of %s has no allowed values", name, desc))
+		}
+		a.allowed[i] = make(map[string]struct{}, len(values))
+		for _, v := range values {
+			a.allowed[i][v] = struct{}{}
+		}
+	}
+	return a
+}
+
+func (a *labelAllowlist) allows(i int, value string) bool {
+	if a.allowed[i] == nil {
+		return true
+	}
+	_, ok := a.allowed[i][value]
+	return ok
+}
+
+// applyToValues returns the provided label values with disallowed values
+// replaced by the fallback value, or errLabelValueNotAllowed if disallowed
+// values are dropped. The provided slice is not modified. Label values beyond
+// the number of variable labels are left to the cardinality check.
+func (a *labelAllowlist) applyToValues(lvs []string) ([]string, error) {
+	result, copied := lvs, false
+	for i, v := range lvs {
+		if i >= len(a.allowed) || a.allows(i, v) {
+			continue
+		}
+		if a.drop {
+			return nil, errLabelValueNotAllowed
+		}
+		if !copied {
+			result, copied = make([]string, len(lvs)), true
+			copy(result, lvs)
+		}
+		result[i] = a.fallback
+	}
+	return result, nil
+}
+
+// applyToLabels works like applyToValues for Labels.
+func (a *labelAllowlist) applyToLabels(desc *Desc, labels Labels) (Labels, error) {
+	result, copied := labels, false
+	for i, name := range desc.variableLabels {
+		if v, ok := labels[name]; !ok || a.allows(i, v) {
+			continue
+		}
+		if a.drop {
+			return nil, errLabelValueNotAllowed
+		}
+		if !copied {
+			result, copied = make(Labels, len(labels)), true
+			for n, v := range labels {
+				result[n] = v
+			}
+		}
+		result[name] = a.fallback
+	}
+	return result, nil
 }
 
 // Describe implements Collector. The length of the returned slice
@@ -80,13 +219,28 @@ func (m *MetricVec) Collect(ch chan<- Metric) {
 // with a performance overhead (for creating and processing the Labels map).
 // See also the GaugeVec example.
 func (m *MetricVec) GetMetricWithLabelValues(lvs ...string) (Metric, error) {
+	if m.allowlist != nil {
+		var err error
+		if lvs, err = m.allowlist.applyToValues(lvs); err != nil {
+			return nil, err
+		}
+	}
+	if m.lockFree && len(lvs) == len(m.desc.variableLabels) {
+		if metric, ok := m.lookup(lvs); ok {
+			return metric, nil
+		}
+	}
+
 	m.mtx.Lock()
-	defer m.mtx.Unlock()
+	defer m.unlock()
 
 	h, err := m.hashLabelValues(lvs)
 	if err != nil {
 		return nil, err
 	}
+	if err := m.checkValid(h); err != nil {
+		return nil, err
+	}
 	return m.getOrCreateMetric(h, lvs...), nil
 }
 
@@ -103,13 +257,23 @@ func (m *MetricVec) GetMetricWithLabelValues(lvs ...string) (Metric, error) {
 // GetMetricWithLabelValues(...string). See there for pros and cons of the two
 // methods.
 func (m *MetricVec) GetMetricWith(labels Labels) (Metric, error) {
+	if m.allowlist != nil {
+		var err error
+		if labels, err = m.allowlist.applyToLabels(m.desc, labels); err != nil {
+			return nil, err
+		}
+	}
+
 	m.mtx.Lock()
-	defer m.mtx.Unlock()
+	defer m.unlock()
 
 	h, err := m.hashLabels(labels)
 	if err != nil {
 		return nil, err
 	}
+	if err := m.checkValid(h); err != nil {
+		return nil, err
+	}
 	lvs := make([]string, len(labels))
 	for i, label := range m.desc.variableLabels {
 		lvs[i] = labels[label]
@@ -139,6 +303,41 @@ func (m *MetricVec) With(labels Labels) Metric {
 	return metric
 }
 
+// WithPartialLabels binds the variable labels named in the provided Labels map
+// to the given values and returns a PartialMetricVec, which only requires the
+// values of the remaining variable labels to access a Metric. This allows
+// neat syntax like:
+//     reqs := httpReqs.WithPartialLabels(Labels{"handler": "/api"})
+//     reqs.WithLabelValues("404", "POST").Inc()
+// The method panics if any of the provided label names is not a variable label
+// of the MetricVec.
+func (m *MetricVec) WithPartialLabels(labels Labels) *PartialMetricVec {
+	p, err := m.partialLabels(labels)
+	if err != nil {
+		panic(err)
+	}
+	return p
+}
+
+// CurryWith works as WithPartialLabels, but returns an error instead of
+// panicking if any of the provided label names is not a variable label of the
+// MetricVec. The returned PartialMetricVec shares its Metrics with the
+// MetricVec, i.e. anything done with a Metric obtained from it shows up when
+// the MetricVec is collected.
+func (m *MetricVec) CurryWith(labels Labels) (*PartialMetricVec, error) {
+	return m.partialLabels(labels)
+}
+
+// MustCurryWith works as CurryWith, but panics where CurryWith would have
+// returned an error.
+func (m *MetricVec) MustCurryWith(labels Labels) *PartialMetricVec {
+	p, err := m.CurryWith(labels)
+	if err != nil {
+		panic(err)
+	}
+	return p
+}
+
 // DeleteLabelValues removes the metric where the variable labels are the same
 // as those passed in as labels (same order as the VariableLabels in Desc). It
 // returns true if a metric was deleted.
@@ -156,7 +355,7 @@ func (m *MetricVec) With(labels Labels) Metric {
 // See also the CounterVec example.
 func (m *MetricVec) DeleteLabelValues(lvs ...string) bool {
 	m.mtx.Lock()
-	defer m.mtx.Unlock()
+	defer m.unlock()
 
 	h, err := m.hashLabelValues(lvs)
 	if err != nil {
@@ -165,7 +364,7 @@ func (m *MetricVec) DeleteLabelValues(lvs ...string) bool {
 	if _, has := m.children[h]; !has {
 		return false
 	}
-	delete(m.children, h)
+	m.deleteChild(h)
 	return true
 }
 
@@ -181,7 +380,7 @@ func (m *MetricVec) DeleteLabelValues(lvs ...string) bool {
 // there for pros and cons of the two methods.
 func (m *MetricVec) Delete(labels Labels) bool {
 	m.mtx.Lock()
-	defer m.mtx.Unlock()
+	defer m.unlock()
 
 	h, err := m.hashLabels(labels)
 	if err != nil {
@@ -190,18 +389,206 @@ func (m *MetricVec) Delete(labels Labels) bool {
 	if _, has := m.children[h]; !has {
 		return false
 	}
-	delete(m.children, h)
+	m.deleteChild(h)
 	return true
 }
 
 // Reset deletes all metrics in this vector.
 func (m *MetricVec) Reset() {
 	m.mtx.Lock()
-	defer m.mtx.Unlock()
+	defer m.unlock()
 
 	for h := range m.children {
-		delete(m.children, h)
+		m.deleteChild(h)
+	}
+}
+
+// unregistered is called by the registry after the MetricVec has been
+// unregistered. It resets the MetricVec so that registering it again starts
+// from a clean state.
+func (m *MetricVec) unregistered() {
+	m.Reset()
+}
+
+// deleteChild deletes the metric with the given hash. It needs mtx locked.
+func (m *MetricVec) deleteChild(h uint64) {
+	metric := m.children[h]
+	delete(m.children, h)
+	m.stale = m.lockFree
+	if m.release != nil {
+		m.release(metric)
+	}
+}
+
+// template writes a metric newly created for the provided label values
+// without adding it to the MetricVec. The result reveals the type (and, for
+// histograms, the buckets) of the metrics in the MetricVec before any of them
+// exist.
+func (m *MetricVec) template(lvs []string) (*Desc, *dto.Metric, error) {
+	metric := m.newMetric(lvs...)
+	if m.release != nil {
+		defer m.release(metric)
+	}
+	pb := &dto.Metric{}
+	if err := metric.Write(pb); err != nil {
+		return nil, nil, err
+	}
+	return m.desc, pb, nil
+}
+
+// WarmUp creates the metrics for all of the provided label sets, leaving
+// existing metrics untouched. Newly created metrics have their zero value
+// (e.g. a Counter starts at 0). Exposing metrics before anything has happened
+// to them allows functions like rate and increase in the Prometheus query
+// language to see the first change. This replaces the common pattern of
+// calling WithLabelValues(...).Add(0) at startup for each expected label
+// combination. If any of the label sets is inconsistent with the variable
+// labels in Desc, an error is returned, and no metric is created at all.
+//
+// As the method is defined on MetricVec, it is available for all vectors in
+// this package, e.g. CounterVec, HistogramVec, and SummaryVec.
+func (m *MetricVec) WarmUp(labelSets []Labels) error {
+	m.mtx.Lock()
+	defer m.unlock()
+
+	hashes := make([]uint64, len(labelSets))
+	for i, labels := range labelSets {
+		h, err := m.hashLabels(labels)
+		if err != nil {
+			return err
+		}
+		if err := m.checkValid(h); err != nil {
+			return err
+		}
+		hashes[i] = h
+	}
+	for i, labels := range labelSets {
+		lvs := make([]string, len(labels))
+		for j, label := range m.desc.variableLabels {
+			lvs[j] = labels[label]
+		}
+		m.getOrCreateMetric(hashes[i], lvs...)
+	}
+	return nil
+}
+
+func (m *MetricVec) partialLabels(labels Labels) (*PartialMetricVec, error) {
+	for name := range labels {
+		known := false
+		for _, label := range m.desc.variableLabels {
+			if label == name {
+				known = true
+				break
+			}
+		}
+		if !known {
+			return nil, fmt.Errorf("label name %q is not a variable label of %s", name, m.desc)
+		}
+	}
+	p := &PartialMetricVec{
+		vec:         m,
+		labelValues: make([]string, len(m.desc.variableLabels)),
+	}
+	for i, label := range m.desc.variableLabels {
+		if val, ok := labels[label]; ok {
+			p.labelValues[i] = val
+		} else {
+			p.unbound = append(p.unbound, i)
+		}
+	}
+	return p, nil
+}
+
+// DeleteExpired deletes all metrics that have not been updated within the
+// given maxAge and returns the number of deleted metrics. The time of the last
+// update is only tracked if the TrackLastObserved option was set upon creation
+// of the vector (see Opts). Otherwise, DeleteExpired never deletes anything. A
+// metric that has never been updated counts as updated upon its creation.
+func (m *MetricVec) DeleteExpired(maxAge time.Duration) int {
+	m.mtx.Lock()
+	defer m.unlock()
+
+	cutoff := time.Now().Add(-maxAge).UnixNano()
+	deleted := 0
+	for h, metric := range m.children {
+		t, ok := metric.(lastObserver)
+		if ok && t.lastObserved() < cutoff {
+			m.deleteChild(h)
+			deleted++
+		}
 	}
+	return deleted
+}
+
+// vecChild is a child of a MetricVec as returned by sortedChildren.
+type vecChild struct {
+	labels Labels
+	metric *dto.Metric
+}
+
+// sortedChildren writes all children of the MetricVec and returns them sorted
+// by their label values, compared in the order of the variable labels. The
+// children are written after releasing mtx, so that the caller may do
+// anything with the result, including calling methods of the MetricVec.
+// Children that cannot be written are skipped.
+func (m *MetricVec) sortedChildren() []vecChild {
+	m.mtx.RLock()
+	metrics := make([]Metric, 0, len(m.children))
+	for _, metric := range m.children {
+		metrics = append(metrics, metric)
+	}
+	m.mtx.RUnlock()
+
+	children := make([]vecChild, 0, len(metrics))
+	for _, metric := range metrics {
+		pb := &dto.Metric{}
+		if err := metric.Write(pb); err != nil {
+			continue
+		}
+		labels := make(Labels, len(m.desc.variableLabels))
+		for _, lp := range pb.Label {
+			for _, name := range m.desc.variableLabels {
+				if lp.GetName() == name {
+					labels[name] = lp.GetValue()
+				}
+			}
+		}
+		children = append(children, vecChild{labels: labels, metric: pb})
+	}
+	sort.Stable(vecChildrenByLabels{children, m.desc.variableLabels})
+	return children
+}
+
+// vecChildrenByLabels implements sort.Interface for sortedChildren.
+type vecChildrenByLabels struct {
+	children   []vecChild
+	labelNames []string
+}
+
+func (s vecChildrenByLabels) Len() int { return len(s.children) }
+func (s vecChildrenByLabels) Swap(i, j int) {
+	s.children[i], s.children[j] = s.children[j], s.children[i]
+}
+func (s vecChildrenByLabels) Less(i, j int) bool {
+	for _, name := range s.labelNames {
+		vi, vj := s.children[i].labels[name], s.children[j].labels[name]
+		if vi != vj {
+			return vi < vj
+		}
+	}
+	return false
+}
+
+// checkValid returns errInvalidLabelCombination if the label values with the
+// given hash are not among the valid ones.
+func (m *MetricVec) checkValid(h uint64) error {
+	if m.valid == nil {
+		return nil
+	}
+	if _, ok := m.valid[h]; !ok {
+		return errInvalidLabelCombination
+	}
+	return nil
 }
 
 func (m *MetricVec) hashLabelValues(vals []string) (uint64, error) {
@@ -209,6 +596,7 @@ func (m *MetricVec) hashLabelValues(vals []string) (uint64, error) {
 		return 0, errInconsistentCardinality
 	}
 	m.hash.Reset()
+	m.hash.Write(m.seed)
 	for _, val := range vals {
 		m.buf.Reset()
 		m.buf.WriteString(val)
@@ -222,6 +610,7 @@ func (m *MetricVec) hashLabels(labels Labels) (uint64, error) {
 		return 0, errInconsistentCardinality
 	}
 	m.hash.Reset()
+	m.hash.Write(m.seed)
 	for _, label := range m.desc.variableLabels {
 		val, ok := labels[label]
 		if !ok {
@@ -242,6 +631,213 @@ func (m *MetricVec) getOrCreateMetric(hash uint64, labelValues ...string) Metric
 		copiedLabelValues := append(make([]string, 0, len(labelValues)), labelValues...)
 		metric = m.newMetric(copiedLabelValues...)
 		m.children[hash] = metric
+		m.stale = m.lockFree
+	}
+	return metric
+}
+
+// unlock publishes a snapshot of the children if they have been modified and
+// the lock-free lookup is enabled, and then unlocks mtx.
+func (m *MetricVec) unlock() {
+	if m.stale {
+		snapshot := make(map[uint64]Metric, len(m.children))
+		for h, metric := range m.children {
+			snapshot[h] = metric
+		}
+		m.snapshot.Store(snapshot)
+		m.stale = false
+	}
+	m.mtx.Unlock()
+}
+
+// lookup returns the existing child for the given label values from the last
+// published snapshot without locking mtx. The number of label values must
+// match the number of variable labels.
+func (m *MetricVec) lookup(lvs []string) (Metric, bool) {
+	snapshot, _ := m.snapshot.Load().(map[uint64]Metric)
+	if snapshot == nil {
+		return nil, false
+	}
+	metric, ok := snapshot[hashSeededFNV64a(m.seed, lvs)]
+	return metric, ok
+}
+
+// FNV-1a constants, see hash/fnv.
+const (
+	offset64 = 14695981039346656037
+	prime64  = 1099511628211
+)
+
+// hashValuesFNV64a returns the same hash as hashLabelValues of a MetricVec with
+// the default seed, but without using the shared hash instance, so that it can
+// be called without locking mtx.
+func hashValuesFNV64a(vals []string) uint64 {
+	return hashSeededFNV64a(nil, vals)
+}
+
+// hashSeededFNV64a works like hashValuesFNV64a for a MetricVec with the
+// provided seed.
+func hashSeededFNV64a(seed []byte, vals []string) uint64 {
+	h := uint64(offset64)
+	for _, b := range seed {
+		h ^= uint64(b)
+		h *= prime64
+	}
+	for _, val := range vals {
+		for i := 0; i < len(val); i++ {
+			h ^= uint64(val[i])
+			h *= prime64
+		}
+	}
+	return h
+}
+
+// hashSeed returns the bytes to hash before the label values for the provided
+// seed, or nil for the default seed of zero.
+func hashSeed(seed uint64) []byte {
+	if seed == 0 {
+		return nil
+	}
+	b := make([]byte, 8)
+	binary.LittleEndian.PutUint64(b, seed)
+	return b
+}
+
+// PartialMetricVec is a MetricVec with some of its variable labels already bound
+// to values. Create instances with the WithPartialLabels method of MetricVec.
+// The values of the remaining variable labels are passed to its methods in the
+// same order as they appear in the VariableLabels of the Desc.
+type PartialMetricVec struct {
+	vec         *MetricVec
+	labelValues []string // Values of all variable labels, unbound ones empty.
+	unbound     []int    // Indices of the variable labels not bound yet.
+}
+
+// GetMetricWithLabelValues works as the method of the same name in MetricVec,
+// but only takes the values of the variable labels that have not been bound by
+// WithPartialLabels. An error is returned if the number of label values is not
+// the same as the number of those remaining variable labels.
+func (p *PartialMetricVec) GetMetricWithLabelValues(lvs ...string) (Metric, error) {
+	if len(lvs) != len(p.unbound) {
+		return nil, errInconsistentCardinality
+	}
+	all := append(make([]string, 0, len(p.labelValues)), p.labelValues...)
+	for i, idx := range p.unbound {
+		all[idx] = lvs[i]
+	}
+	return p.vec.GetMetricWithLabelValues(all...)
+}
+
+// WithLabelValues works as GetMetricWithLabelValues, but panics if an error
+// occurs.
+func (p *PartialMetricVec) WithLabelValues(lvs ...string) Metric {
+	metric, err := p.GetMetricWithLabelValues(lvs...)
+	if err != nil {
+		panic(err)
+	}
+	return metric
+}
+
+// GetMetricWith works as the method of the same name in MetricVec, but the
+// Labels map must only contain the variable labels that have not been bound
+// yet. An error is returned if a bound label is provided again or if any of the
+// remaining variable labels is missing.
+func (p *PartialMetricVec) GetMetricWith(labels Labels) (Metric, error) {
+	if len(labels) != len(p.unbound) {
+		return nil, errInconsistentCardinality
+	}
+	all := append(make([]string, 0, len(p.labelValues)), p.labelValues...)
+	for _, idx := range p.unbound {
+		val, ok := labels[p.vec.desc.variableLabels[idx]]
+		if !ok {
+			return nil, errInconsistentCardinality
+		}
+		all[idx] = val
+	}
+	return p.vec.GetMetricWithLabelValues(all...)
+}
+
+// With works as GetMetricWith, but panics if an error occurs.
+func (p *PartialMetricVec) With(labels Labels) Metric {
+	metric, err := p.GetMetricWith(labels)
+	if err != nil {
+		panic(err)
 	}
 	return metric
 }
+
+// CurryWith binds further variable labels of the PartialMetricVec and returns
+// a new PartialMetricVec sharing its Metrics with the original MetricVec. An
+// error is returned if any of the provided label names is not a variable label
+// or has already been bound.
+func (p *PartialMetricVec) CurryWith(labels Labels) (*PartialMetricVec, error) {
+	for name := range labels {
+		if p.isUnbound(name) {
+			continue
+		}
+		if _, err := p.vec.partialLabels(Labels{name: ""}); err != nil {
+			return nil, err
+		}
+		return nil, fmt.Errorf("label name %q of %s is already bound", name, p.vec.desc)
+	}
+	curried := &PartialMetricVec{
+		vec:         p.vec,
+		labelValues: append(make([]string, 0, len(p.labelValues)), p.labelValues...),
+	}
+	for _, idx := range p.unbound {
+		if val, ok := labels[p.vec.desc.variableLabels[idx]]; ok {
+			curried.labelValues[idx] = val
+		} else {
+			curried.unbound = append(curried.unbound, idx)
+		}
+	}
+	return curried, nil
+}
+
+// MustCurryWith works as CurryWith, but panics where CurryWith would have
+// returned an error.
+func (p *PartialMetricVec) MustCurryWith(labels Labels) *PartialMetricVec {
+	curried, err := p.CurryWith(labels)
+	if err != nil {
+		panic(err)
+	}
+	return curried
+}
+
+func (p *PartialMetricVec) isUnbound(name string) bool {
+	for _, idx := range p.unbound {
+		if p.vec.desc.variableLabels[idx] == name {
+			return true
+		}
+	}
+	return false
+}
+
+// lastObserver is implemented by the children of metric vectors created with
+// the TrackLastObserved option.
+type lastObserver interface {
+	// lastObserved returns the time of the last update in Unix
+	// nanoseconds.
+	lastObserved() int64
+}
+
+// observedAt implements lastObserver. It is embedded into the metric types
+// wrapped by the children of metric vectors created with the
+// TrackLastObserved option.
+type observedAt struct {
+	// nanos has to go first in the struct to guarantee alignment for atomic
+	// operations.  http://golang.org/pkg/sync/atomic/#pkg-note-BUG
+	nanos int64
+}
+
+func newObservedAt() observedAt {
+	return observedAt{nanos: time.Now().UnixNano()}
+}
+
+func (o *observedAt) touch() {
+	atomic.StoreInt64(&o.nanos, time.Now().UnixNano())
+}
+
+func (o *observedAt) lastObserved() int64 {
+	return atomic.LoadInt64(&o.nanos)
+}
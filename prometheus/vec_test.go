@@ -14,8 +14,13 @@
 package prometheus
 
 import (
+	"fmt"
 	"hash/fnv"
+	"strings"
 	"testing"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
 )
 
 func TestDelete(t *testing.T) {
@@ -89,3 +94,422 @@ func TestDeleteLabelValues(t *testing.T) {
 		t.Errorf("got %v, want %v", got, want)
 	}
 }
+
+func TestDeleteLabelValuesOfAllVecs(t *testing.T) {
+	labelNames := []string{"l1", "l2"}
+	for name, vec := range map[string]interface {
+		Collector
+		DeleteLabelValues(...string) bool
+		WarmUp([]Labels) error
+	}{
+		"CounterVec":   NewCounterVec(CounterOpts{Name: "test", Help: "helpless"}, labelNames),
+		"GaugeVec":     NewGaugeVec(GaugeOpts{Name: "test", Help: "helpless"}, labelNames),
+		"HistogramVec": NewHistogramVec(HistogramOpts{Name: "test", Help: "helpless"}, labelNames),
+		"SummaryVec":   NewSummaryVec(SummaryOpts{Name: "test", Help: "helpless"}, labelNames),
+		"UntypedVec":   NewUntypedVec(UntypedOpts{Name: "test", Help: "helpless"}, labelNames),
+	} {
+		if err := vec.WarmUp([]Labels{{"l1": "v1", "l2": "v2"}}); err != nil {
+			t.Fatalf("%s: %s", name, err)
+		}
+		if got, want := vec.DeleteLabelValues("v2", "v1"), false; got != want {
+			t.Errorf("%s: got %v, want %v", name, got, want)
+		}
+		if got, want := vec.DeleteLabelValues("v1", "v2"), true; got != want {
+			t.Errorf("%s: got %v, want %v", name, got, want)
+		}
+		if got, want := vec.DeleteLabelValues("v1", "v2"), false; got != want {
+			t.Errorf("%s: got %v, want %v", name, got, want)
+		}
+	}
+}
+
+func TestWithPartialLabels(t *testing.T) {
+	vec := NewCounterVec(
+		CounterOpts{Name: "test", Help: "helpless"},
+		[]string{"handler", "code", "method"},
+	)
+
+	partial := vec.WithPartialLabels(Labels{"code": "404"})
+	partial.WithLabelValues("/api", "GET").Inc()
+	if got, want := vec.DeleteLabelValues("/api", "404", "GET"), true; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	if _, err := partial.GetMetricWithLabelValues("/api"); err == nil {
+		t.Error("expected error for missing label value")
+	}
+	if _, err := partial.GetMetricWithLabelValues("/api", "GET", "extra"); err == nil {
+		t.Error("expected error for extra label value")
+	}
+
+	if _, err := vec.MetricVec.partialLabels(Labels{"unknown": "x"}); err == nil {
+		t.Error("expected error for unknown label name")
+	}
+
+	all := vec.WithPartialLabels(Labels{"handler": "/", "code": "200", "method": "POST"})
+	if got, want := all.WithLabelValues(), vec.WithLabelValues("/", "200", "POST"); got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestCurryWith(t *testing.T) {
+	vec := NewCounterVec(
+		CounterOpts{Name: "test", Help: "helpless"},
+		[]string{"handler", "code", "method"},
+	)
+
+	if _, err := vec.CurryWith(Labels{"unknown": "x"}); err == nil {
+		t.Error("expected error for unknown label name")
+	}
+
+	curried, err := vec.CurryWith(Labels{"handler": "/api"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	curried.With(Labels{"code": "200", "method": "GET"}).Inc()
+	curried.WithLabelValues("404", "GET").Add(2)
+
+	for lvs, want := range map[[2]string]float64{{"200", "GET"}: 1, {"404", "GET"}: 2} {
+		m := &dto.Metric{}
+		if err := vec.WithLabelValues("/api", lvs[0], lvs[1]).Write(m); err != nil {
+			t.Fatal(err)
+		}
+		if got := m.GetCounter().GetValue(); got != want {
+			t.Errorf("%v: got %v, want %v", lvs, got, want)
+		}
+	}
+	if got, want := len(vec.children), 2; got != want {
+		t.Errorf("got %d children, want %d", got, want)
+	}
+
+	if _, err := curried.GetMetricWith(Labels{"handler": "/api", "code": "200", "method": "GET"}); err == nil {
+		t.Error("expected error for already bound label")
+	}
+	if _, err := curried.GetMetricWith(Labels{"code": "200"}); err == nil {
+		t.Error("expected error for missing label")
+	}
+	if _, err := curried.CurryWith(Labels{"handler": "/other"}); err == nil {
+		t.Error("expected error for currying an already bound label")
+	}
+	if _, err := curried.CurryWith(Labels{"unknown": "x"}); err == nil {
+		t.Error("expected error for unknown label name")
+	}
+
+	twice := curried.MustCurryWith(Labels{"method": "GET"})
+	if got, want := twice.WithLabelValues("200"), vec.WithLabelValues("/api", "200", "GET"); got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestDeleteExpired(t *testing.T) {
+	vec := NewGaugeVec(
+		GaugeOpts{Name: "test", Help: "helpless", TrackLastObserved: true},
+		[]string{"l"},
+	)
+	vec.WithLabelValues("stale").Set(1)
+	vec.WithLabelValues("fresh").Set(1)
+
+	// Make the "stale" child look like it was last updated an hour ago.
+	stale := vec.WithLabelValues("stale").(*trackedGauge)
+	stale.nanos -= int64(time.Hour)
+
+	if got, want := vec.DeleteExpired(time.Minute), 1; got != want {
+		t.Errorf("got %d deleted metrics, want %d", got, want)
+	}
+	if got, want := vec.DeleteLabelValues("stale"), false; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := vec.DeleteLabelValues("fresh"), true; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	untracked := NewCounterVec(CounterOpts{Name: "test", Help: "helpless"}, []string{"l"})
+	untracked.WithLabelValues("v").Inc()
+	if got, want := untracked.DeleteExpired(0), 0; got != want {
+		t.Errorf("got %d deleted metrics, want %d", got, want)
+	}
+}
+
+func TestWarmUp(t *testing.T) {
+	vec := NewCounterVec(CounterOpts{Name: "test", Help: "helpless"}, []string{"code", "method"})
+	vec.WithLabelValues("200", "GET").Add(5)
+
+	if err := vec.WarmUp([]Labels{
+		{"code": "500", "method": "GET"},
+		{"code": "200", "method": "GET"},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(vec.children), 2; got != want {
+		t.Errorf("got %d children, want %d", got, want)
+	}
+	m := &dto.Metric{}
+	vec.WithLabelValues("200", "GET").Write(m)
+	if got, want := m.GetCounter().GetValue(), 5.; got != want {
+		t.Errorf("got %f for existing child, want %f", got, want)
+	}
+
+	if err := vec.WarmUp([]Labels{
+		{"code": "404", "method": "GET"},
+		{"code": "404"},
+	}); err == nil {
+		t.Error("expected error for inconsistent label set")
+	}
+	if got, want := len(vec.children), 2; got != want {
+		t.Errorf("got %d children after failed warm-up, want %d", got, want)
+	}
+
+	hist := NewHistogramVec(HistogramOpts{Name: "test_histogram", Help: "helpless"}, []string{"code"})
+	if err := hist.WarmUp([]Labels{{"code": "200"}}); err != nil {
+		t.Error(err)
+	}
+	if got, want := len(hist.children), 1; got != want {
+		t.Errorf("got %d histogram children, want %d", got, want)
+	}
+}
+
+func TestLabelAllowlist(t *testing.T) {
+	counters := NewCounterVec(CounterOpts{
+		Name:           "test",
+		Help:           "helpless",
+		LabelAllowlist: map[string][]string{"method": {"GET", "POST"}},
+	}, []string{"code", "method"})
+	counters.WithLabelValues("200", "GET").Inc()
+	counters.WithLabelValues("200", "BREW").Inc()
+	counters.With(Labels{"code": "200", "method": "PROPFIND"}).Inc()
+	if got, want := len(counters.children), 2; got != want {
+		t.Errorf("got %d children, want %d", got, want)
+	}
+	m := &dto.Metric{}
+	counters.WithLabelValues("200", DefFallbackValue).Write(m)
+	if got, want := m.GetCounter().GetValue(), 2.; got != want {
+		t.Errorf("got %f for fallback value, want %f", got, want)
+	}
+
+	histograms := NewHistogramVec(HistogramOpts{
+		Name:             "test",
+		Help:             "helpless",
+		LabelAllowlist:   map[string][]string{"method": {"GET"}},
+		FallbackBehavior: FallbackDrop,
+	}, []string{"method"})
+	histograms.WithLabelValues("GET").Observe(1)
+	histograms.WithLabelValues("BREW").Observe(1) // Must not panic.
+	histograms.With(Labels{"method": "BREW"}).Observe(1)
+	if got, want := len(histograms.children), 1; got != want {
+		t.Errorf("got %d children, want %d", got, want)
+	}
+	if _, err := histograms.GetMetricWithLabelValues("BREW"); err != errLabelValueNotAllowed {
+		t.Errorf("got error %v, want %v", err, errLabelValueNotAllowed)
+	}
+
+	gauges := NewGaugeVec(GaugeOpts{
+		Name:             "test",
+		Help:             "helpless",
+		LabelAllowlist:   map[string][]string{"method": {"GET"}},
+		FallbackBehavior: FallbackDrop,
+		LockFreeHotPath:  true,
+	}, []string{"method"})
+	gauges.WithLabelValues("GET").Set(1)
+	gauges.With(Labels{"method": "BREW"}).Set(1) // Must not panic.
+	if got, want := len(gauges.children), 1; got != want {
+		t.Errorf("got %d gauge children, want %d", got, want)
+	}
+	if !gauges.lockFree {
+		t.Error("LockFreeHotPath ignored by NewGaugeVec")
+	}
+	untyped := NewUntypedVec(UntypedOpts{
+		Name:           "test",
+		Help:           "helpless",
+		LabelAllowlist: map[string][]string{"method": {"GET"}},
+	}, []string{"method"})
+	untyped.WithLabelValues("BREW").Set(3)
+	untyped.WithLabelValues(DefFallbackValue).Write(m)
+	if got, want := m.GetUntyped().GetValue(), 3.; got != want {
+		t.Errorf("got %f for untyped fallback value, want %f", got, want)
+	}
+	uint64Counters := NewUint64CounterVec(CounterOpts{
+		Name:             "test",
+		Help:             "helpless",
+		LabelAllowlist:   map[string][]string{"method": {"GET"}},
+		FallbackBehavior: FallbackDrop,
+	}, []string{"method"})
+	uint64Counters.WithLabelValues("BREW").Inc() // Must not panic.
+	if got := len(uint64Counters.children); got != 0 {
+		t.Errorf("got %d uint64 counter children, want 0", got)
+	}
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Error("expected panic for hierarchical gauge vector with allowlist")
+			}
+		}()
+		NewHierarchicalGaugeVec(GaugeOpts{
+			Name:           "test",
+			Help:           "helpless",
+			LabelAllowlist: map[string][]string{"method": {"GET"}},
+		}, [][]string{{"method"}})
+	}()
+
+	remapped := NewCounterVec(CounterOpts{
+		Name:           "test",
+		Help:           "helpless",
+		LabelAllowlist: map[string][]string{"method": {"GET"}},
+		FallbackValue:  "unknown",
+	}, []string{"method"})
+	lvs := []string{"BREW"}
+	remapped.WithLabelValues(lvs...).Inc()
+	if lvs[0] != "BREW" {
+		t.Error("label values passed in were modified")
+	}
+	h, _ := remapped.hashLabelValues([]string{"unknown"})
+	if _, ok := remapped.children[h]; !ok {
+		t.Error("expected child for the fallback value")
+	}
+
+	for _, allowlist := range []map[string][]string{
+		{"verb": {"GET"}},
+		{"method": {}},
+	} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("expected panic for allowlist %v", allowlist)
+				}
+			}()
+			NewCounterVec(CounterOpts{
+				Name:           "test",
+				Help:           "helpless",
+				LabelAllowlist: allowlist,
+			}, []string{"method"})
+		}()
+	}
+}
+
+func TestLockFreeHotPath(t *testing.T) {
+	vec := NewCounterVec(CounterOpts{
+		Name:            "test",
+		Help:            "helpless",
+		LockFreeHotPath: true,
+	}, []string{"l1", "l2"})
+
+	lvs := []string{"v1", "v2"}
+	h, _ := vec.hashLabelValues(lvs)
+	if got, want := hashValuesFNV64a(lvs), h; got != want {
+		t.Errorf("got hash %d, want %d", got, want)
+	}
+
+	if _, ok := vec.lookup(lvs); ok {
+		t.Error("found child before creating it")
+	}
+	c := vec.WithLabelValues(lvs...)
+	c.Inc()
+	if got, ok := vec.lookup(lvs); !ok || got != c {
+		t.Errorf("got %v, %t from lookup, want %v, true", got, ok, c)
+	}
+	if got := vec.WithLabelValues(lvs...); got != c {
+		t.Errorf("got %v, want %v", got, c)
+	}
+
+	vec.DeleteLabelValues(lvs...)
+	if _, ok := vec.lookup(lvs); ok {
+		t.Error("found child after deleting it")
+	}
+	vec.With(Labels{"l1": "v1", "l2": "v2"})
+	vec.WithLabelValues("v3", "v4")
+	if _, ok := vec.lookup(lvs); !ok {
+		t.Error("child created with labels not found")
+	}
+	vec.Reset()
+	if _, ok := vec.lookup([]string{"v3", "v4"}); ok {
+		t.Error("found child after reset")
+	}
+	if _, err := vec.GetMetricWithLabelValues("v1"); err != errInconsistentCardinality {
+		t.Errorf("got error %v, want %v", err, errInconsistentCardinality)
+	}
+}
+
+func TestHashSeed(t *testing.T) {
+	lvs := []string{"v1", "v2"}
+	unseeded := NewCounterVec(CounterOpts{Name: "test", Help: "helpless"}, []string{"l1", "l2"})
+	seeded := NewCounterVec(CounterOpts{
+		Name:            "test",
+		Help:            "helpless",
+		HashSeed:        42,
+		LockFreeHotPath: true,
+	}, []string{"l1", "l2"})
+
+	h, _ := unseeded.hashLabelValues(lvs)
+	if got, want := hashValuesFNV64a(lvs), h; got != want {
+		t.Errorf("got hash %d without seed, want %d", got, want)
+	}
+	seededHash, _ := seeded.hashLabelValues(lvs)
+	if seededHash == h {
+		t.Errorf("got the same hash %d with and without seed", h)
+	}
+	if got, want := hashSeededFNV64a(seeded.seed, lvs), seededHash; got != want {
+		t.Errorf("got hash %d, want %d", got, want)
+	}
+	byLabels, _ := seeded.hashLabels(Labels{"l1": "v1", "l2": "v2"})
+	if byLabels != seededHash {
+		t.Errorf("got hash %d from labels, want %d", byLabels, seededHash)
+	}
+
+	c := seeded.WithLabelValues(lvs...)
+	if got, ok := seeded.lookup(lvs); !ok || got != c {
+		t.Errorf("got %v, %t from lookup, want %v, true", got, ok, c)
+	}
+	if got, want := seeded.DeleteLabelValues(lvs...), true; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestSortedForEach(t *testing.T) {
+	gauges := NewGaugeVec(GaugeOpts{
+		Name:        "test",
+		Help:        "helpless",
+		ConstLabels: Labels{"c": "const"},
+	}, []string{"l1", "l2"})
+	gauges.WithLabelValues("b", "a").Set(1)
+	gauges.WithLabelValues("a", "b").Set(2)
+	gauges.WithLabelValues("a", "a").Set(3)
+
+	var got []string
+	gauges.SortedForEach(func(labels Labels, value float64) {
+		if len(labels) != 2 {
+			t.Errorf("got labels %v, want only the variable labels", labels)
+		}
+		// Using the GaugeVec in the callback must not deadlock.
+		gauges.WithLabelValues("c", "c")
+		got = append(got, labels["l1"]+labels["l2"]+"="+fmt.Sprint(value))
+	})
+	if got, want := strings.Join(got, ","), "aa=3,ab=2,ba=1"; got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+
+	counters := NewCounterVec(CounterOpts{Name: "test", Help: "helpless"}, []string{"l1"})
+	counters.WithLabelValues("y").Add(2)
+	counters.WithLabelValues("x").Inc()
+	got = nil
+	counters.SortedForEach(func(labels Labels, value float64) {
+		got = append(got, labels["l1"]+"="+fmt.Sprint(value))
+	})
+	if got, want := strings.Join(got, ","), "x=1,y=2"; got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+
+	histograms := NewHistogramVec(HistogramOpts{
+		Name:    "test",
+		Help:    "helpless",
+		Buckets: []float64{1, 2},
+	}, []string{"l1"})
+	histograms.WithLabelValues("y").Observe(1.5)
+	histograms.WithLabelValues("x").Observe(0.5)
+	histograms.WithLabelValues("x").Observe(3)
+	got = nil
+	histograms.SortedForEach(func(labels Labels, s HistogramSnapshot) {
+		got = append(got, fmt.Sprint(labels["l1"], s.Count, s.Sum, s.UpperBounds, s.CumulativeCounts))
+	})
+	if got, want := strings.Join(got, ","), "x2 3.5 [1 2] [1 1],y1 1.5 [1 2] [0 1]"; got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+}
@@ -35,7 +35,9 @@ import (
 // writes the resulting lines to 'out'. It returns the number of bytes written
 // and any error encountered.  This function does not perform checks on the
 // content of the metric and label names, i.e. invalid metric or label names
-// will result in invalid text format output.
+// will result in invalid text format output. A histogram with a nil Bucket
+// field is written without any _bucket lines, not even the implicit one with
+// +Inf bound.
 // This method fulfills the type 'prometheus.encoder'.
 func MetricFamilyToText(out io.Writer, in *dto.MetricFamily) (int, error) {
 	var written int
@@ -138,7 +140,7 @@ func MetricFamilyToText(out io.Writer, in *dto.MetricFamily) (int, error) {
 			written += n
 			n, err = writeSample(
 				name+"_count", metric, "", "",
-				float64(metric.Summary.GetSampleCount()),
+				metric.Summary.GetSampleCount(),
 				out,
 			)
 		case dto.MetricType_HISTOGRAM:
@@ -152,7 +154,7 @@ func MetricFamilyToText(out io.Writer, in *dto.MetricFamily) (int, error) {
 				n, err = writeSample(
 					name+"_bucket", metric,
 					model.BucketLabel, fmt.Sprint(q.GetUpperBound()),
-					float64(q.GetCumulativeCount()),
+					q.GetCumulativeCount(),
 					out,
 				)
 				written += n
@@ -163,11 +165,15 @@ func MetricFamilyToText(out io.Writer, in *dto.MetricFamily) (int, error) {
 					infSeen = true
 				}
 			}
-			if !infSeen {
+			// A nil Bucket field marks a histogram that only
+			// exposes its sum and count (see
+			// HistogramOpts.NoBuckets in the prometheus package).
+			// An empty one still gets the implicit +Inf bucket.
+			if !infSeen && metric.Histogram.Bucket != nil {
 				n, err = writeSample(
 					name+"_bucket", metric,
 					model.BucketLabel, "+Inf",
-					float64(metric.Histogram.GetSampleCount()),
+					metric.Histogram.GetSampleCount(),
 					out,
 				)
 				if err != nil {
@@ -186,7 +192,7 @@ func MetricFamilyToText(out io.Writer, in *dto.MetricFamily) (int, error) {
 			written += n
 			n, err = writeSample(
 				name+"_count", metric, "", "",
-				float64(metric.Histogram.GetSampleCount()),
+				metric.Histogram.GetSampleCount(),
 				out,
 			)
 		default:
@@ -204,13 +210,15 @@ func MetricFamilyToText(out io.Writer, in *dto.MetricFamily) (int, error) {
 
 // writeSample writes a single sample in text format to out, given the metric
 // name, the metric proto message itself, optionally an additional label name
-// and value (use empty strings if not required), and the value. The function
-// returns the number of bytes written and any error encountered.
+// and value (use empty strings if not required), and the value. The value is a
+// float64 or, for counts, a uint64, which is written exactly even above 2^53,
+// where a float64 cannot represent every integer anymore. The function returns
+// the number of bytes written and any error encountered.
 func writeSample(
 	name string,
 	metric *dto.Metric,
 	additionalLabelName, additionalLabelValue string,
-	value float64,
+	value interface{},
 	out io.Writer,
 ) (int, error) {
 	var written int
@@ -311,6 +311,79 @@ request_duration_microseconds_bucket{le="172.8"} 1524
 request_duration_microseconds_bucket{le="+Inf"} 2693
 request_duration_microseconds_sum 1.7560473e+06
 request_duration_microseconds_count 2693
+`,
+		},
+		// 6: Histogram without any buckets.
+		{
+			in: &dto.MetricFamily{
+				Name: proto.String("request_duration_microseconds"),
+				Help: proto.String("The response latency."),
+				Type: dto.MetricType_HISTOGRAM.Enum(),
+				Metric: []*dto.Metric{
+					&dto.Metric{
+						Histogram: &dto.Histogram{
+							SampleCount: proto.Uint64(2693),
+							SampleSum:   proto.Float64(1756047.3),
+						},
+					},
+				},
+			},
+			out: `# HELP request_duration_microseconds The response latency.
+# TYPE request_duration_microseconds histogram
+request_duration_microseconds_sum 1.7560473e+06
+request_duration_microseconds_count 2693
+`,
+		},
+		// 7: Histogram with counts a float64 cannot represent exactly.
+		{
+			in: &dto.MetricFamily{
+				Name: proto.String("requests_bytes"),
+				Help: proto.String("Request sizes."),
+				Type: dto.MetricType_HISTOGRAM.Enum(),
+				Metric: []*dto.Metric{
+					&dto.Metric{
+						Histogram: &dto.Histogram{
+							SampleCount: proto.Uint64(1<<53 + 3),
+							SampleSum:   proto.Float64(1e18),
+							Bucket: []*dto.Bucket{
+								&dto.Bucket{
+									UpperBound:      proto.Float64(100),
+									CumulativeCount: proto.Uint64(1<<53 + 1),
+								},
+							},
+						},
+					},
+				},
+			},
+			out: `# HELP requests_bytes Request sizes.
+# TYPE requests_bytes histogram
+requests_bytes_bucket{le="100"} 9007199254740993
+requests_bytes_bucket{le="+Inf"} 9007199254740995
+requests_bytes_sum 1e+18
+requests_bytes_count 9007199254740995
+`,
+		},
+		// 8: Histogram with an empty, but not nil, Bucket field.
+		{
+			in: &dto.MetricFamily{
+				Name: proto.String("request_duration_microseconds"),
+				Help: proto.String("The response latency."),
+				Type: dto.MetricType_HISTOGRAM.Enum(),
+				Metric: []*dto.Metric{
+					&dto.Metric{
+						Histogram: &dto.Histogram{
+							SampleCount: proto.Uint64(5),
+							SampleSum:   proto.Float64(10),
+							Bucket:      []*dto.Bucket{},
+						},
+					},
+				},
+			},
+			out: `# HELP request_duration_microseconds The response latency.
+# TYPE request_duration_microseconds histogram
+request_duration_microseconds_bucket{le="+Inf"} 5
+request_duration_microseconds_sum 10
+request_duration_microseconds_count 5
 `,
 		},
 	}
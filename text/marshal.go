@@ -0,0 +1,98 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package text
+
+import (
+	"bytes"
+	"io"
+	"sort"
+
+	"github.com/matttproud/golang_protobuf_extensions/pbutil"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+// MarshalText returns the provided MetricFamilies in the text format, sorted
+// by metric name. The slice itself is not modified. It returns an error under
+// the same conditions as MetricFamilyToText.
+func MarshalText(families []*dto.MetricFamily) ([]byte, error) {
+	var buf bytes.Buffer
+	for _, mf := range sortedByName(families) {
+		if _, err := MetricFamilyToText(&buf, mf); err != nil {
+			return nil, err
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+// UnmarshalText parses the provided text format with a Parser and returns the
+// resulting MetricFamilies, sorted by metric name. See
+// Parser.TextToMetricFamilies for the details and limitations of the parsing.
+func UnmarshalText(data []byte) ([]*dto.MetricFamily, error) {
+	var p Parser
+	byName, err := p.TextToMetricFamilies(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	families := make([]*dto.MetricFamily, 0, len(byName))
+	for _, mf := range byName {
+		families = append(families, mf)
+	}
+	sort.Sort(metricFamiliesByName(families))
+	return families, nil
+}
+
+// MarshalProto returns the provided MetricFamilies in the delimited protobuf
+// format, sorted by metric name. The slice itself is not modified.
+func MarshalProto(families []*dto.MetricFamily) ([]byte, error) {
+	var buf bytes.Buffer
+	for _, mf := range sortedByName(families) {
+		if _, err := WriteProtoDelimited(&buf, mf); err != nil {
+			return nil, err
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+// UnmarshalProto returns the MetricFamilies contained in the provided
+// delimited protobuf format in the order they appear in it.
+func UnmarshalProto(data []byte) ([]*dto.MetricFamily, error) {
+	var (
+		r        = bytes.NewReader(data)
+		families []*dto.MetricFamily
+	)
+	for {
+		mf := &dto.MetricFamily{}
+		if _, err := pbutil.ReadDelimited(r, mf); err != nil {
+			if err == io.EOF {
+				return families, nil
+			}
+			return nil, err
+		}
+		families = append(families, mf)
+	}
+}
+
+func sortedByName(families []*dto.MetricFamily) []*dto.MetricFamily {
+	sorted := make([]*dto.MetricFamily, len(families))
+	copy(sorted, families)
+	sort.Sort(metricFamiliesByName(sorted))
+	return sorted
+}
+
+type metricFamiliesByName []*dto.MetricFamily
+
+func (s metricFamiliesByName) Len() int           { return len(s) }
+func (s metricFamiliesByName) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s metricFamiliesByName) Less(i, j int) bool { return s[i].GetName() < s[j].GetName() }
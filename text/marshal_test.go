@@ -0,0 +1,105 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package text
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+	dto "github.com/prometheus/client_model/go"
+)
+
+func marshalTestFamilies() []*dto.MetricFamily {
+	return []*dto.MetricFamily{
+		&dto.MetricFamily{
+			Name: proto.String("requests_total"),
+			Help: proto.String("Total requests."),
+			Type: dto.MetricType_COUNTER.Enum(),
+			Metric: []*dto.Metric{
+				&dto.Metric{
+					Label: []*dto.LabelPair{
+						&dto.LabelPair{
+							Name:  proto.String("code"),
+							Value: proto.String("200"),
+						},
+					},
+					Counter: &dto.Counter{Value: proto.Float64(42)},
+				},
+			},
+		},
+		&dto.MetricFamily{
+			Name: proto.String("queue_length"),
+			Help: proto.String("Current queue length."),
+			Type: dto.MetricType_GAUGE.Enum(),
+			Metric: []*dto.Metric{
+				&dto.Metric{
+					Gauge: &dto.Gauge{Value: proto.Float64(3)},
+				},
+			},
+		},
+	}
+}
+
+func TestMarshalText(t *testing.T) {
+	in := marshalTestFamilies()
+	data, err := MarshalText(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `# HELP queue_length Current queue length.
+# TYPE queue_length gauge
+queue_length 3
+# HELP requests_total Total requests.
+# TYPE requests_total counter
+requests_total{code="200"} 42
+`
+	if got := string(data); got != want {
+		t.Errorf("got\n%s\nwant\n%s", got, want)
+	}
+	if got, want := in[0].GetName(), "requests_total"; got != want {
+		t.Errorf("input modified, got %q first, want %q", got, want)
+	}
+
+	out, err := UnmarshalText(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []*dto.MetricFamily{in[1], in[0]}; !reflect.DeepEqual(out, want) {
+		t.Errorf("got %v, want %v", out, want)
+	}
+
+	if _, err := UnmarshalText([]byte("invalid{")); err == nil {
+		t.Error("expected error for invalid input")
+	}
+}
+
+func TestMarshalProto(t *testing.T) {
+	in := marshalTestFamilies()
+	data, err := MarshalProto(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := UnmarshalProto(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []*dto.MetricFamily{in[1], in[0]}; !reflect.DeepEqual(out, want) {
+		t.Errorf("got %v, want %v", out, want)
+	}
+
+	if _, err := UnmarshalProto(data[:len(data)-1]); err == nil {
+		t.Error("expected error for truncated input")
+	}
+}
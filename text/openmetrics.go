@@ -0,0 +1,224 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package text
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+// OpenMetricsToMetricFamilies works like TextToMetricFamilies, but it reads
+// the OpenMetrics text format. The input is translated line by line into the
+// text format described above, which is then parsed as usual. In particular:
+//
+// Counter samples with the "_total" suffix are attributed to their
+// family. Gauge histograms are read as histograms, info and stateset
+// families as gauges, and unknown families as untyped. Timestamps are
+// converted from seconds to milliseconds.
+//
+// Information the data model of this package cannot represent is dropped.
+// That is the UNIT metadata, exemplars, and the "_created" samples of
+// counters, histograms, and summaries.
+//
+// The input must end with the "# EOF" line. An error is returned otherwise,
+// as the input is most likely truncated.
+func (p *Parser) OpenMetricsToMetricFamilies(in io.Reader) (map[string]*dto.MetricFamily, error) {
+	var (
+		buf     bytes.Buffer
+		scanner = bufio.NewScanner(in)
+		tr      = openMetricsTranslator{types: map[string]string{}}
+		lineNum int
+		eof     bool
+	)
+	for scanner.Scan() {
+		lineNum++
+		line := scanner.Text()
+		if eof {
+			return nil, ParseError{Line: lineNum, Msg: "content after # EOF"}
+		}
+		if line == "# EOF" {
+			eof = true
+			continue
+		}
+		translated, err := tr.translate(line)
+		if err != nil {
+			return nil, ParseError{Line: lineNum, Msg: err.Error()}
+		}
+		if translated != "" {
+			buf.WriteString(translated)
+			buf.WriteByte('\n')
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if !eof {
+		return nil, ParseError{Line: lineNum, Msg: "missing # EOF"}
+	}
+	return p.TextToMetricFamilies(&buf)
+}
+
+// openMetricsTranslator translates OpenMetrics lines to the text format. It
+// keeps track of the types of the metric families seen so far.
+type openMetricsTranslator struct {
+	types   map[string]string // OpenMetrics type by family name.
+	current string            // Family of the last metadata line.
+}
+
+func (t *openMetricsTranslator) translate(line string) (string, error) {
+	if strings.HasPrefix(line, "#") {
+		return t.translateMetadata(line)
+	}
+	return t.translateSample(line)
+}
+
+func (t *openMetricsTranslator) translateMetadata(line string) (string, error) {
+	fields := strings.SplitN(line, " ", 4)
+	if len(fields) < 3 || fields[0] != "#" {
+		return "", fmt.Errorf("invalid metadata line %q", line)
+	}
+	keyword, name, rest := fields[1], fields[2], ""
+	if len(fields) == 4 {
+		rest = fields[3]
+	}
+	t.current = name
+	switch keyword {
+	case "TYPE":
+		t.types[name] = rest
+		switch rest {
+		case "counter", "gauge", "histogram", "summary":
+		case "gaugehistogram":
+			rest = "histogram"
+		case "stateset":
+			rest = "gauge"
+		case "info":
+			name, rest = name+"_info", "gauge"
+		case "unknown":
+			rest = "untyped"
+		default:
+			return "", fmt.Errorf("unknown metric type %q", rest)
+		}
+		return "# TYPE " + name + " " + rest, nil
+	case "HELP":
+		if t.types[name] == "info" {
+			name += "_info"
+		}
+		// The text format does not escape double quotes in help strings.
+		return "# HELP " + name + " " + strings.Replace(rest, `\"`, `"`, -1), nil
+	case "UNIT":
+		return "", nil
+	}
+	return "", fmt.Errorf("unknown metadata keyword %q", keyword)
+}
+
+func (t *openMetricsTranslator) translateSample(line string) (string, error) {
+	if line == "" {
+		return "", fmt.Errorf("empty line")
+	}
+	// The metric name ends with the label block or the first space. The
+	// label block ends with the first unquoted closing brace.
+	end := strings.IndexAny(line, "{ ")
+	if end < 0 {
+		return "", fmt.Errorf("invalid sample line %q", line)
+	}
+	name := line[:end]
+	if line[end] == '{' {
+		if end = labelBlockEnd(line, end); end < 0 {
+			return "", fmt.Errorf("unterminated label block in %q", line)
+		}
+	}
+	labels := line[len(name):end]
+
+	// Value and timestamp are followed by an optional exemplar.
+	rest := line[end:]
+	if i := strings.Index(rest, " # "); i >= 0 {
+		rest = rest[:i]
+	}
+	fields := strings.Fields(rest)
+	if len(fields) < 1 || len(fields) > 2 {
+		return "", fmt.Errorf("invalid value and timestamp in %q", line)
+	}
+
+	name, ok := t.sampleName(name)
+	if !ok {
+		return "", nil
+	}
+	translated := name + labels + " " + fields[0]
+	if len(fields) == 2 {
+		ts, err := strconv.ParseFloat(fields[1], 64)
+		if err != nil {
+			return "", fmt.Errorf("invalid timestamp %q", fields[1])
+		}
+		translated += " " + strconv.FormatInt(int64(math.Floor(ts*1000+0.5)), 10)
+	}
+	return translated, nil
+}
+
+// labelBlockEnd returns the index right after the first unquoted closing
+// brace in line after the provided start index, or -1 if there is none.
+func labelBlockEnd(line string, start int) int {
+	quoted, escaped := false, false
+	for i := start + 1; i < len(line); i++ {
+		c := line[i]
+		switch {
+		case escaped:
+			escaped = false
+		case c == '\\':
+			escaped = true
+		case c == '"':
+			quoted = !quoted
+		case c == '}' && !quoted:
+			return i + 1
+		}
+	}
+	return -1
+}
+
+// sampleName returns the name the provided sample name translates to in the
+// text format, or false if the sample is to be dropped.
+func (t *openMetricsTranslator) sampleName(name string) (string, bool) {
+	family := t.current
+	if !strings.HasPrefix(name, family) {
+		return name, true
+	}
+	suffix := name[len(family):]
+	switch t.types[family] {
+	case "counter":
+		switch suffix {
+		case "_total":
+			return family, true
+		case "_created":
+			return "", false
+		}
+	case "histogram", "summary":
+		if suffix == "_created" {
+			return "", false
+		}
+	case "gaugehistogram":
+		switch suffix {
+		case "_gcount":
+			return family + "_count", true
+		case "_gsum":
+			return family + "_sum", true
+		}
+	}
+	return name, true
+}
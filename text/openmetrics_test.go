@@ -0,0 +1,125 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package text
+
+import (
+	"bytes"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestOpenMetricsToMetricFamilies(t *testing.T) {
+	in := `# TYPE requests counter
+# UNIT requests requests
+# HELP requests Total requests with a \"quoted\" word.
+requests_total{code="200"} 42 # {trace_id="a}b"} 1 1.5
+requests_created{code="200"} 1.4e9
+# TYPE latency_seconds histogram
+# UNIT latency_seconds seconds
+latency_seconds_bucket{le="0.1"} 3 # {trace_id="c"} 0.05
+latency_seconds_bucket{le="+Inf"} 5
+latency_seconds_sum 1.5
+latency_seconds_count 5
+latency_seconds_created 1.4e9
+# TYPE queue_seconds gaugehistogram
+queue_seconds_bucket{le="+Inf"} 2
+queue_seconds_gcount 2
+queue_seconds_gsum 0.5
+# TYPE build info
+# HELP build Build information.
+build_info{version="1.0"} 1
+# TYPE state stateset
+state{state="on"} 1 1.0005
+# TYPE other unknown
+other 7
+# EOF
+`
+	want := `# HELP build_info Build information.
+# TYPE build_info gauge
+build_info{version="1.0"} 1
+# TYPE latency_seconds histogram
+latency_seconds_bucket{le="0.1"} 3
+latency_seconds_bucket{le="+Inf"} 5
+latency_seconds_sum 1.5
+latency_seconds_count 5
+# TYPE other untyped
+other 7
+# TYPE queue_seconds histogram
+queue_seconds_bucket{le="+Inf"} 2
+queue_seconds_sum 0.5
+queue_seconds_count 2
+# HELP requests Total requests with a "quoted" word.
+# TYPE requests counter
+requests{code="200"} 42
+# TYPE state gauge
+state{state="on"} 1 1001
+`
+
+	var p Parser
+	families, err := p.OpenMetricsToMetricFamilies(strings.NewReader(in))
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := make([]string, 0, len(families))
+	for name := range families {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var buf bytes.Buffer
+	for _, name := range names {
+		if _, err := MetricFamilyToText(&buf, families[name]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := buf.String(); got != want {
+		t.Errorf("got\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestOpenMetricsToMetricFamiliesErrors(t *testing.T) {
+	scenarios := []struct {
+		in  string
+		err string
+	}{
+		{
+			in:  "# TYPE a counter\na_total 1\n",
+			err: "text format parsing error in line 2: missing # EOF",
+		},
+		{
+			in:  "# EOF\na 1\n",
+			err: "text format parsing error in line 2: content after # EOF",
+		},
+		{
+			in:  "# TYPE a histogram_total\n# EOF\n",
+			err: `text format parsing error in line 1: unknown metric type "histogram_total"`,
+		},
+		{
+			in:  "a{b=\"}\n# EOF\n",
+			err: `text format parsing error in line 1: unterminated label block in "a{b=\"}"`,
+		},
+	}
+
+	for i, scenario := range scenarios {
+		var p Parser
+		_, err := p.OpenMetricsToMetricFamilies(strings.NewReader(scenario.in))
+		if err == nil {
+			t.Errorf("%d. expected error %q, got none", i, scenario.err)
+			continue
+		}
+		if err.Error() != scenario.err {
+			t.Errorf("%d. expected error %q, got %q", i, scenario.err, err)
+		}
+	}
+}
@@ -401,7 +401,7 @@ func (p *Parser) readingValue() stateFn {
 		}
 		switch {
 		case p.currentIsSummaryCount:
-			p.currentMetric.Summary.SampleCount = proto.Uint64(uint64(value))
+			p.currentMetric.Summary.SampleCount = proto.Uint64(p.countValue(value))
 		case p.currentIsSummarySum:
 			p.currentMetric.Summary.SampleSum = proto.Float64(value)
 		case !math.IsNaN(p.currentQuantile):
@@ -420,7 +420,7 @@ func (p *Parser) readingValue() stateFn {
 		}
 		switch {
 		case p.currentIsHistogramCount:
-			p.currentMetric.Histogram.SampleCount = proto.Uint64(uint64(value))
+			p.currentMetric.Histogram.SampleCount = proto.Uint64(p.countValue(value))
 		case p.currentIsHistogramSum:
 			p.currentMetric.Histogram.SampleSum = proto.Float64(value)
 		case !math.IsNaN(p.currentBucket):
@@ -428,7 +428,7 @@ func (p *Parser) readingValue() stateFn {
 				p.currentMetric.Histogram.Bucket,
 				&dto.Bucket{
 					UpperBound:      proto.Float64(p.currentBucket),
-					CumulativeCount: proto.Uint64(uint64(value)),
+					CumulativeCount: proto.Uint64(p.countValue(value)),
 				},
 			)
 		}
@@ -441,6 +441,16 @@ func (p *Parser) readingValue() stateFn {
 	return p.startTimestamp
 }
 
+// countValue returns the current token as a count. Integers are parsed exactly,
+// as the float64 value cannot represent all of them above 2^53. Other values
+// are converted from the provided float64 value.
+func (p *Parser) countValue(value float64) uint64 {
+	if count, err := strconv.ParseUint(p.currentToken.String(), 10, 64); err == nil {
+		return count
+	}
+	return uint64(value)
+}
+
 // startTimestamp represents the state where the next byte read from p.buf is
 // the start of the timestamp (or whitespace leading up to it).
 func (p *Parser) startTimestamp() stateFn {
@@ -386,6 +386,35 @@ request_duration_microseconds_count 2693
 				},
 			},
 		},
+		// 5: Counts a float64 cannot represent exactly.
+		{
+			in: `
+# TYPE requests_bytes histogram
+requests_bytes_bucket{le="+Inf"} 9007199254740993
+requests_bytes_sum 1e+18
+requests_bytes_count 9007199254740993
+`,
+			out: []*dto.MetricFamily{
+				{
+					Name: proto.String("requests_bytes"),
+					Type: dto.MetricType_HISTOGRAM.Enum(),
+					Metric: []*dto.Metric{
+						&dto.Metric{
+							Histogram: &dto.Histogram{
+								SampleCount: proto.Uint64(1<<53 + 1),
+								SampleSum:   proto.Float64(1e18),
+								Bucket: []*dto.Bucket{
+									&dto.Bucket{
+										UpperBound:      proto.Float64(math.Inf(+1)),
+										CumulativeCount: proto.Uint64(1<<53 + 1),
+									},
+								},
+							},
+						},
+					},
+				},
+			},
+		},
 	}
 
 	for i, scenario := range scenarios {